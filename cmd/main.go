@@ -5,25 +5,34 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
-	// "strings"
+	"strings"
 	"syscall"
 
-	"github.com/absmach/mproxy/examples/translator"
-	"github.com/absmach/mproxy/examples/injector"
-	"github.com/absmach/mproxy/examples/hostTranslator"
-
-
 	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/examples/hostTranslator"
+	"github.com/absmach/mproxy/examples/injector"
+	"github.com/absmach/mproxy/examples/packetLogger"
 	"github.com/absmach/mproxy/examples/simple"
+	"github.com/absmach/mproxy/examples/translator"
+	"github.com/absmach/mproxy/pkg/admin"
+	"github.com/absmach/mproxy/pkg/coap"
+	"github.com/absmach/mproxy/pkg/connlimit"
 	"github.com/absmach/mproxy/pkg/http"
+	"github.com/absmach/mproxy/pkg/metrics"
 	"github.com/absmach/mproxy/pkg/mqtt"
+	"github.com/absmach/mproxy/pkg/mqtt/quic"
 	"github.com/absmach/mproxy/pkg/mqtt/websocket"
+	"github.com/absmach/mproxy/pkg/mqttsn"
+	"github.com/absmach/mproxy/pkg/ratelimit"
 	"github.com/absmach/mproxy/pkg/session"
+	"github.com/absmach/mproxy/pkg/tracing"
+	"github.com/absmach/mproxy/pkg/websockets"
 	"github.com/caarlos0/env/v11"
 	"github.com/joho/godotenv"
 	"golang.org/x/sync/errgroup"
@@ -38,64 +47,133 @@ const (
 	mqttWSWithTLS    = "MPROXY_MQTT_WS_WITH_TLS_"
 	mqttWSWithmTLS   = "MPROXY_MQTT_WS_WITH_MTLS_"
 
+	mqttQUIC = "MPROXY_MQTT_QUIC_"
+
+	mqttSN = "MPROXY_MQTTSN_"
+
+	coapWithoutDTLS = "MPROXY_COAP_WITHOUT_DTLS_"
+	coapWithDTLS    = "MPROXY_COAP_WITH_DTLS_"
+
 	httpWithoutTLS = "MPROXY_HTTP_WITHOUT_TLS_"
 	httpWithTLS    = "MPROXY_HTTP_WITH_TLS_"
 	httpWithmTLS   = "MPROXY_HTTP_WITH_MTLS_"
+
+	wsWithoutTLS = "MPROXY_WS_WITHOUT_TLS_"
+	wsWithTLS    = "MPROXY_WS_WITH_TLS_"
+	wsWithmTLS   = "MPROXY_WS_WITH_MTLS_"
+
+	adminHTTP   = "MPROXY_ADMIN_"
+	metricsHTTP = "MPROXY_METRICS_"
+	traces      = "MPROXY_TRACING_"
+)
+
+var (
+	errUnknownHandler     = errors.New("unknown handler")
+	errUnknownInterceptor = errors.New("unknown interceptor")
 )
 
+type config struct {
+	// Handlers lists the names of the handlers chained in order.
+	Handlers []string `env:"MPROXY_HANDLERS" envDefault:"simple"`
+	// Interceptors lists the names of the interceptors chained in order.
+	Interceptors []string `env:"MPROXY_INTERCEPTORS"`
+}
+
 func main() {
-	
 	ctx, cancel := context.WithCancel(context.Background())
 	g, ctx := errgroup.WithContext(ctx)
-	
+
 	logHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	})
 	logger := slog.New(logHandler)
-	
-	topicTranslation := make(map[string]string)
-	revTopicTranslation := make(map[string]string)
-
-	topicTranslation["test/topic"] = "test/foo"
-	revTopicTranslation["test/foo"] = "test/topic"
-
-	handlerType := flag.Int("hand", 0, "selects the handler that inspects the packets")
 
-	
-	var interceptor session.Interceptor
-	
-	
 	pathPtr := flag.String("env", "", "The .env path")
 	flag.Parse()
-	
-	var handler session.Handler
-
-	switch *handlerType {
-		case 0: handler = simple.New(logger)
-		case 1: handler = translator.New(logger, topicTranslation, revTopicTranslation)
-		case 2: handler = injector.New(logger, "Hello")
-		case 3: handler = hostTranslator.New(logger)
-		default: simple.New(logger)
-	}
-	
-	
-	if (*pathPtr == "") {
+
+	if *pathPtr == "" {
 		// Loading .env file to environment
 		err := godotenv.Load()
 		if err != nil {
 			panic(err)
 		}
-		
-		} else {
-			// Loading specified file to environment
-			err := godotenv.Load(*pathPtr)
-			if err != nil {
-				panic(err)
-			}
+	} else {
+		// Loading specified file to environment
+		err := godotenv.Load(*pathPtr)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	cfg := config{}
+	if err := env.Parse(&cfg); err != nil {
+		panic(err)
+	}
+
+	handler, err := newHandler(cfg.Handlers, logger)
+	if err != nil {
+		panic(err)
+	}
+
+	interceptor, err := newInterceptor(cfg.Interceptors, logger)
+	if err != nil {
+		panic(err)
+	}
+
+	// Tracing Configuration
+	tracingConfig, err := tracing.NewConfig(env.Options{Prefix: traces})
+	if err != nil {
+		panic(err)
+	}
+
+	tp, shutdownTracing, err := tracing.NewProvider(ctx, tracingConfig)
+	if err != nil {
+		panic(err)
+	}
+	tracing.Setup(tp)
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error(fmt.Sprintf("Failed to shutdown tracing: %s", err))
+		}
+	}()
+
+	registry := session.NewRegistry()
+	mtr := metrics.New()
+
+	// Metrics server Configuration
+	metricsConfig, err := metrics.NewConfig(env.Options{Prefix: metricsHTTP})
+	if err != nil {
+		panic(err)
+	}
+
+	// Metrics server is started only if its address is set
+	if metricsConfig.Address != "" {
+		metricsServer := metrics.NewServer(metricsConfig, mtr, logger)
+		g.Go(func() error {
+			return metricsServer.Listen(ctx)
+		})
+	}
+
+	// Admin server Configuration
+	adminConfig, err := mproxy.NewConfig(env.Options{Prefix: adminHTTP})
+	if err != nil {
+		panic(err)
+	}
+	adminServerConfig, err := admin.NewConfig(env.Options{Prefix: adminHTTP})
+	if err != nil {
+		panic(err)
+	}
+
+	// Admin server is started only if its address is set
+	if adminConfig.Address != "" {
+		adminServer := admin.New(adminConfig, adminServerConfig, registry, logger)
+		g.Go(func() error {
+			return adminServer.Listen(ctx)
+		})
 	}
 
 	// mProxy server Configuration for MQTT without TLS
-	mqttConfig, err := mproxy.NewConfig(env.Options{Prefix: mqttWithoutTLS})
+	mqttConfig, err := newConfig(mqttWithoutTLS, registry, mtr, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -107,7 +185,7 @@ func main() {
 	})
 
 	// mProxy server Configuration for MQTT with TLS
-	mqttTLSConfig, err := mproxy.NewConfig(env.Options{Prefix: mqttWithTLS})
+	mqttTLSConfig, err := newConfig(mqttWithTLS, registry, mtr, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -119,7 +197,7 @@ func main() {
 	})
 
 	//  mProxy server Configuration for MQTT with mTLS
-	mqttMTLSConfig, err := mproxy.NewConfig(env.Options{Prefix: mqttWithmTLS})
+	mqttMTLSConfig, err := newConfig(mqttWithmTLS, registry, mtr, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -131,7 +209,7 @@ func main() {
 	})
 
 	// mProxy server Configuration for MQTT over Websocket without TLS
-	wsConfig, err := mproxy.NewConfig(env.Options{Prefix: mqttWSWithoutTLS})
+	wsConfig, err := newConfig(mqttWSWithoutTLS, registry, mtr, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -143,7 +221,7 @@ func main() {
 	})
 
 	// mProxy server Configuration for MQTT over Websocket with TLS
-	wsTLSConfig, err := mproxy.NewConfig(env.Options{Prefix: mqttWSWithTLS})
+	wsTLSConfig, err := newConfig(mqttWSWithTLS, registry, mtr, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -155,7 +233,7 @@ func main() {
 	})
 
 	// mProxy server Configuration for MQTT over Websocket with mTLS
-	wsMTLSConfig, err := mproxy.NewConfig(env.Options{Prefix: mqttWSWithmTLS})
+	wsMTLSConfig, err := newConfig(mqttWSWithmTLS, registry, mtr, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -166,14 +244,86 @@ func main() {
 		return wsMTLSProxy.Listen(ctx)
 	})
 
+	// mProxy server Configuration for MQTT over QUIC
+	quicConfig, err := newConfig(mqttQUIC, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for MQTT over QUIC is started only if its address is set
+	if quicConfig.Address != "" {
+		quicProxy := quic.New(quicConfig, handler, interceptor, logger)
+		g.Go(func() error {
+			return quicProxy.Listen(ctx)
+		})
+	}
+
+	// mProxy gateway Configuration for MQTT-SN
+	snConfig, err := newConfig(mqttSN, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	snGatewayConfig, err := mqttsn.NewConfig(env.Options{Prefix: mqttSN})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy gateway for MQTT-SN is started only if its address is set
+	if snConfig.Address != "" {
+		snProxy := mqttsn.New(snConfig, snGatewayConfig, handler, interceptor, logger)
+		g.Go(func() error {
+			return snProxy.Listen(ctx)
+		})
+	}
+
+	// mProxy server Configuration for CoAP without DTLS
+	coapConfig, err := newConfig(coapWithoutDTLS, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	coapProxyConfig, err := coap.NewConfig(env.Options{Prefix: coapWithoutDTLS})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for CoAP without DTLS is started only if its address is set
+	if coapConfig.Address != "" {
+		coapProxy := coap.New(coapConfig, coapProxyConfig, handler, interceptor, logger)
+		g.Go(func() error {
+			return coapProxy.Listen(ctx)
+		})
+	}
+
+	// mProxy server Configuration for CoAP with DTLS
+	coapDTLSConfig, err := newConfig(coapWithDTLS, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	coapDTLSProxyConfig, err := coap.NewConfig(env.Options{Prefix: coapWithDTLS})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for CoAP with DTLS is started only if its address is set
+	if coapDTLSConfig.Address != "" {
+		coapDTLSProxy := coap.New(coapDTLSConfig, coapDTLSProxyConfig, handler, interceptor, logger)
+		g.Go(func() error {
+			return coapDTLSProxy.Listen(ctx)
+		})
+	}
+
 	// mProxy server Configuration for HTTP without TLS
-	httpConfig, err := mproxy.NewConfig(env.Options{Prefix: httpWithoutTLS})
+	httpConfig, err := newConfig(httpWithoutTLS, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	httpProxyConfig, err := http.NewConfig(env.Options{Prefix: httpWithoutTLS})
 	if err != nil {
 		panic(err)
 	}
 
 	// mProxy server for HTTP without TLS
-	httpProxy, err := http.NewProxy(httpConfig, handler, logger)
+	httpProxy, err := http.New(httpConfig, httpProxyConfig, handler, interceptor, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -182,13 +332,17 @@ func main() {
 	})
 
 	// mProxy server Configuration for HTTP with TLS
-	httpTLSConfig, err := mproxy.NewConfig(env.Options{Prefix: httpWithTLS})
+	httpTLSConfig, err := newConfig(httpWithTLS, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	httpTLSProxyConfig, err := http.NewConfig(env.Options{Prefix: httpWithTLS})
 	if err != nil {
 		panic(err)
 	}
 
 	// mProxy server for HTTP with TLS
-	httpTLSProxy, err := http.NewProxy(httpTLSConfig, handler, logger)
+	httpTLSProxy, err := http.New(httpTLSConfig, httpTLSProxyConfig, handler, interceptor, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -197,13 +351,17 @@ func main() {
 	})
 
 	// mProxy server Configuration for HTTP with mTLS
-	httpMTLSConfig, err := mproxy.NewConfig(env.Options{Prefix: httpWithmTLS})
+	httpMTLSConfig, err := newConfig(httpWithmTLS, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	httpMTLSProxyConfig, err := http.NewConfig(env.Options{Prefix: httpWithmTLS})
 	if err != nil {
 		panic(err)
 	}
 
 	// mProxy server for HTTP with mTLS
-	httpMTLSProxy, err := http.NewProxy(httpMTLSConfig, handler, logger)
+	httpMTLSProxy, err := http.New(httpMTLSConfig, httpMTLSProxyConfig, handler, interceptor, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -211,6 +369,60 @@ func main() {
 		return httpMTLSProxy.Listen(ctx)
 	})
 
+	// mProxy server Configuration for WebSocket without TLS
+	plainWSConfig, err := newConfig(wsWithoutTLS, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	plainWSProxyConfig, err := websockets.NewConfig(env.Options{Prefix: wsWithoutTLS})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for WebSocket without TLS is started only if its address is set
+	if plainWSConfig.Address != "" {
+		plainWSProxy := websockets.New(plainWSConfig, plainWSProxyConfig, handler, interceptor, logger)
+		g.Go(func() error {
+			return plainWSProxy.Listen(ctx)
+		})
+	}
+
+	// mProxy server Configuration for WebSocket with TLS
+	plainWSTLSConfig, err := newConfig(wsWithTLS, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	plainWSTLSProxyConfig, err := websockets.NewConfig(env.Options{Prefix: wsWithTLS})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for WebSocket with TLS is started only if its address is set
+	if plainWSTLSConfig.Address != "" {
+		plainWSTLSProxy := websockets.New(plainWSTLSConfig, plainWSTLSProxyConfig, handler, interceptor, logger)
+		g.Go(func() error {
+			return plainWSTLSProxy.Listen(ctx)
+		})
+	}
+
+	// mProxy server Configuration for WebSocket with mTLS
+	plainWSMTLSConfig, err := newConfig(wsWithmTLS, registry, mtr, logger)
+	if err != nil {
+		panic(err)
+	}
+	plainWSMTLSProxyConfig, err := websockets.NewConfig(env.Options{Prefix: wsWithmTLS})
+	if err != nil {
+		panic(err)
+	}
+
+	// mProxy server for WebSocket with mTLS is started only if its address is set
+	if plainWSMTLSConfig.Address != "" {
+		plainWSMTLSProxy := websockets.New(plainWSMTLSConfig, plainWSMTLSProxyConfig, handler, interceptor, logger)
+		g.Go(func() error {
+			return plainWSMTLSProxy.Listen(ctx)
+		})
+	}
+
 	g.Go(func() error {
 		return StopSignalHandler(ctx, cancel, logger)
 	})
@@ -222,9 +434,89 @@ func main() {
 	}
 }
 
+// newConfig loads the configuration of the listener with the given
+// env prefix, including its rate and connection limits. The listener name defaults to the prefix.
+func newConfig(prefix string, registry *session.Registry, mtr *metrics.Metrics, logger *slog.Logger) (mproxy.Config, error) {
+	c, err := mproxy.NewConfig(env.Options{Prefix: prefix})
+	if err != nil {
+		return mproxy.Config{}, err
+	}
+	if c.Session.Listener == "" {
+		c.Session.Listener = strings.ToLower(strings.Trim(strings.TrimPrefix(prefix, "MPROXY_"), "_"))
+	}
+	c.Session.Registry = registry
+	c.Session.Metrics = mtr.Listener(c.Session.Listener)
+	c.Session.Logger = logger
+
+	rlConfig, err := ratelimit.NewConfig(env.Options{Prefix: prefix})
+	if err != nil {
+		return mproxy.Config{}, err
+	}
+	if c.Session.RateLimiter, err = ratelimit.New(rlConfig); err != nil {
+		return mproxy.Config{}, err
+	}
+
+	clConfig, err := connlimit.NewConfig(env.Options{Prefix: prefix})
+	if err != nil {
+		return mproxy.Config{}, err
+	}
+	c.Session.ConnLimiter = connlimit.New(clConfig)
+	return c, nil
+}
+
+// newHandler chains the handlers with the given names.
+func newHandler(names []string, logger *slog.Logger) (session.Handler, error) {
+	topicTranslation := map[string]string{
+		"test/topic": "test/foo",
+	}
+	revTopicTranslation := map[string]string{
+		"test/foo": "test/topic",
+	}
+
+	chain := session.NewHandlerChain()
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "simple":
+			chain.Append(simple.New(logger))
+		case "translator":
+			chain.Append(translator.New(logger, topicTranslation, revTopicTranslation))
+		case "injector":
+			chain.Append(injector.New(logger, "Hello"))
+		case "hostTranslator":
+			chain.Append(hostTranslator.New(logger))
+		default:
+			return nil, fmt.Errorf("%w: %s", errUnknownHandler, name)
+		}
+	}
+	if chain.Len() == 0 {
+		chain.Append(simple.New(logger))
+	}
+	return chain, nil
+}
+
+// newInterceptor chains the interceptors with the given names. It returns nil
+// without interceptors, so that uninspected packets are forwarded raw.
+func newInterceptor(names []string, logger *slog.Logger) (session.Interceptor, error) {
+	chain := session.NewInterceptorChain()
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "packetLogger":
+			chain.Append(packetLogger.New(logger))
+		default:
+			return nil, fmt.Errorf("%w: %s", errUnknownInterceptor, name)
+		}
+	}
+	if chain.Len() == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
 func StopSignalHandler(ctx context.Context, cancel context.CancelFunc, logger *slog.Logger) error {
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGABRT)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
 	select {
 	case <-c:
 		cancel()
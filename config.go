@@ -6,7 +6,11 @@ package mproxy
 import (
 	"crypto/tls"
 
+	"github.com/absmach/mproxy/pkg/proxyproto"
+	"github.com/absmach/mproxy/pkg/session"
 	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/unixsock"
+	"github.com/absmach/mproxy/pkg/upstream"
 	"github.com/caarlos0/env/v11"
 )
 
@@ -15,6 +19,24 @@ type Config struct {
 	PathPrefix string `env:"PATH_PREFIX" envDefault:"/"`
 	Target     string `env:"TARGET"      envDefault:""`
 	TLSConfig  *tls.Config
+	// TargetTLSConfig is used to dial the target, which is dialed without TLS if nil.
+	TargetTLSConfig *tls.Config
+	Session         session.Config
+	// Targets are the addresses of the target brokers the sessions are balanced
+	// between. Target is used if no Targets are set.
+	Targets       []string `env:"TARGETS" envSeparator:","`
+	Upstream      upstream.Config
+	ProxyProtocol proxyproto.Config
+	// Socket sets the socket file of the listener, if Address is a Unix socket address.
+	Socket unixsock.Config
+}
+
+// Upstreams returns the addresses of the target brokers.
+func (c Config) Upstreams() []string {
+	if len(c.Targets) > 0 {
+		return c.Targets
+	}
+	return []string{c.Target}
 }
 
 func NewConfig(opts env.Options) (Config, error) {
@@ -32,5 +54,21 @@ func NewConfig(opts env.Options) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+
+	targetCfg, err := mptls.NewClientConfig(opts)
+	if err != nil {
+		return Config{}, err
+	}
+
+	c.TargetTLSConfig, err = mptls.LoadClient(&targetCfg)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if c.Upstream.RoutesFile != "" {
+		if c.Upstream.Routes, err = upstream.LoadRoutes(c.Upstream.RoutesFile); err != nil {
+			return Config{}, err
+		}
+	}
 	return c, nil
 }
@@ -0,0 +1,69 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/quic"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	address = "localhost:14567"
+	caFile  = "ssl/certs/ca.crt"
+	topic   = "test/topic"
+)
+
+func main() {
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		log.Fatalf("Failed to read CA certificate: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+
+	opts := mqtt.NewClientOptions()
+	// The scheme of the broker is only used by Paho to pick the
+	// connection, which is opened over QUIC by the function below.
+	opts.AddBroker("tcp://" + address)
+	opts.SetClientID("quic-client")
+	opts.SetTLSConfig(&tls.Config{RootCAs: roots})
+	opts.SetCustomOpenConnectionFn(func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), options.ConnectTimeout)
+		defer cancel()
+		return quic.Dial(ctx, uri.Host, options.TLSConfig)
+	})
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("Failed to connect: %s", token.Error())
+	}
+	defer client.Disconnect(250)
+
+	received := make(chan struct{})
+	if token := client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		fmt.Printf("Received message on %s: %s\n", msg.Topic(), msg.Payload())
+		close(received)
+	}); token.Wait() && token.Error() != nil {
+		log.Fatalf("Failed to subscribe: %s", token.Error())
+	}
+	if token := client.Publish(topic, 1, false, "Hello over QUIC"); token.Wait() && token.Error() != nil {
+		log.Fatalf("Failed to publish: %s", token.Error())
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		log.Fatal("No message received")
+	}
+}
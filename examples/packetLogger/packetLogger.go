@@ -0,0 +1,42 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packetLogger
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+var _ session.Interceptor = (*Interceptor)(nil)
+
+// Interceptor logs the packets of the sessions without changing them.
+type Interceptor struct {
+	logger *slog.Logger
+}
+
+// New creates a new packet logging Interceptor.
+func New(logger *slog.Logger) *Interceptor {
+	return &Interceptor{
+		logger: logger,
+	}
+}
+
+// Intercept logs the type and direction of the packet, and passes it on unchanged.
+func (ic *Interceptor) Intercept(ctx context.Context, pkt packets.ControlPacket, dir session.Direction) (packets.ControlPacket, error) {
+	args := []interface{}{
+		slog.String("packet", packets.PacketNames[pkt.Header().MessageType]),
+		slog.String("direction", dir.String()),
+	}
+	if s, ok := session.FromContext(ctx); ok {
+		args = append(args, slog.Group("session", slog.String("id", s.ID), slog.String("username", s.Username)))
+	}
+	if p, ok := pkt.(*packets.PublishPacket); ok {
+		args = append(args, slog.String("topic", p.TopicName))
+	}
+	ic.logger.Info("Intercepted packet", args...)
+	return pkt, nil
+}
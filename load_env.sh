@@ -1,3 +1,15 @@
+export MPROXY_HANDLERS="simple"
+export MPROXY_INTERCEPTORS=""
+
+export MPROXY_ADMIN_ADDRESS="localhost:9000"
+
+export MPROXY_METRICS_ADDRESS="localhost:9100"
+export MPROXY_METRICS_ENDPOINT="/metrics"
+
+export MPROXY_TRACING_EXPORTER="none"
+export MPROXY_TRACING_OTLP_ENDPOINT="localhost:4318"
+export MPROXY_TRACING_SERVICE_NAME="mproxy"
+
 export MPROXY_MQTT_WITHOUT_TLS_ADDRESS=":1884"
 export MPROXY_MQTT_WITHOUT_TLS_TARGET="localhost:1883"
 
@@ -35,13 +47,35 @@ export MPROXY_MQTT_WS_WITH_MTLS_CLIENT_CA_FILE="ssl/certs/ca.crt"
 export MPROXY_MQTT_WS_WITH_MTLS_CERT_VERIFICATION_METHODS="ocsp"
 export MPROXY_MQTT_WS_WITH_MTLS_OCSP_RESPONDER_URL="http://localhost:8080/ocsp"
  
+export MPROXY_MQTT_QUIC_ADDRESS=":14567"
+export MPROXY_MQTT_QUIC_TARGET="localhost:1883"
+export MPROXY_MQTT_QUIC_CERT_FILE="ssl/certs/server.crt"
+export MPROXY_MQTT_QUIC_KEY_FILE="ssl/certs/server.key"
+export MPROXY_MQTT_QUIC_SERVER_CA_FILE="ssl/certs/ca.crt"
+
+export MPROXY_MQTTSN_ADDRESS=":1885"
+export MPROXY_MQTTSN_TARGET="localhost:1883"
+export MPROXY_MQTTSN_GATEWAY_ID="1"
+
+export MPROXY_COAP_WITHOUT_DTLS_ADDRESS=":5683"
+export MPROXY_COAP_WITHOUT_DTLS_TARGET="localhost:1883"
+
+export MPROXY_COAP_WITH_DTLS_ADDRESS=":5684"
+export MPROXY_COAP_WITH_DTLS_TARGET="localhost:1883"
+export MPROXY_COAP_WITH_DTLS_CERT_FILE="ssl/certs/server.crt"
+export MPROXY_COAP_WITH_DTLS_KEY_FILE="ssl/certs/server.key"
+export MPROXY_COAP_WITH_DTLS_SERVER_CA_FILE="ssl/certs/ca.crt"
+export MPROXY_COAP_WITH_DTLS_CLIENT_CA_FILE="ssl/certs/ca.crt"
+ 
 export MPROXY_HTTP_WITHOUT_TLS_ADDRESS=":8086"
 export MPROXY_HTTP_WITHOUT_TLS_PATH_PREFIX="/messages"
 export MPROXY_HTTP_WITHOUT_TLS_TARGET="http://localhost:8888/"
+export MPROXY_HTTP_WITHOUT_TLS_MODE="proxy"
  
 export MPROXY_HTTP_WITH_TLS_ADDRESS=":8087"
 export MPROXY_HTTP_WITH_TLS_PATH_PREFIX="/messages"
 export MPROXY_HTTP_WITH_TLS_TARGET="http://localhost:8888/"
+export MPROXY_HTTP_WITH_TLS_MODE="proxy"
 export MPROXY_HTTP_WITH_TLS_CERT_FILE="ssl/certs/server.crt"
 export MPROXY_HTTP_WITH_TLS_KEY_FILE="ssl/certs/server.key"
 export MPROXY_HTTP_WITH_TLS_SERVER_CA_FILE="ssl/certs/ca.crt"
@@ -49,9 +83,31 @@ export MPROXY_HTTP_WITH_TLS_SERVER_CA_FILE="ssl/certs/ca.crt"
 export MPROXY_HTTP_WITH_MTLS_ADDRESS=":8088"
 export MPROXY_HTTP_WITH_MTLS_PATH_PREFIX="/messages"
 export MPROXY_HTTP_WITH_MTLS_TARGET="http://localhost:8888/"
+export MPROXY_HTTP_WITH_MTLS_MODE="proxy"
 export MPROXY_HTTP_WITH_MTLS_CERT_FILE="ssl/certs/server.crt"
 export MPROXY_HTTP_WITH_MTLS_KEY_FILE="ssl/certs/server.key"
 export MPROXY_HTTP_WITH_MTLS_SERVER_CA_FILE="ssl/certs/ca.crt"
 export MPROXY_HTTP_WITH_MTLS_CLIENT_CA_FILE="ssl/certs/ca.crt"
 export MPROXY_HTTP_WITH_MTLS_CERT_VERIFICATION_METHODS="ocsp"
 export MPROXY_HTTP_WITH_MTLS_OCSP_RESPONDER_URL="http://localhost:8080/ocsp"
+
+export MPROXY_WS_WITHOUT_TLS_ADDRESS=":8089"
+export MPROXY_WS_WITHOUT_TLS_PATH_PREFIX="/ws"
+export MPROXY_WS_WITHOUT_TLS_TARGET="ws://localhost:8889"
+ 
+export MPROXY_WS_WITH_TLS_ADDRESS=":8090"
+export MPROXY_WS_WITH_TLS_PATH_PREFIX="/ws"
+export MPROXY_WS_WITH_TLS_TARGET="ws://localhost:8889"
+export MPROXY_WS_WITH_TLS_CERT_FILE="ssl/certs/server.crt"
+export MPROXY_WS_WITH_TLS_KEY_FILE="ssl/certs/server.key"
+export MPROXY_WS_WITH_TLS_SERVER_CA_FILE="ssl/certs/ca.crt"
+ 
+export MPROXY_WS_WITH_MTLS_ADDRESS=":8091"
+export MPROXY_WS_WITH_MTLS_PATH_PREFIX="/ws"
+export MPROXY_WS_WITH_MTLS_TARGET="ws://localhost:8889"
+export MPROXY_WS_WITH_MTLS_CERT_FILE="ssl/certs/server.crt"
+export MPROXY_WS_WITH_MTLS_KEY_FILE="ssl/certs/server.key"
+export MPROXY_WS_WITH_MTLS_SERVER_CA_FILE="ssl/certs/ca.crt"
+export MPROXY_WS_WITH_MTLS_CLIENT_CA_FILE="ssl/certs/ca.crt"
+export MPROXY_WS_WITH_MTLS_CERT_VERIFICATION_METHODS="ocsp"
+export MPROXY_WS_WITH_MTLS_OCSP_RESPONDER_URL="http://localhost:8080/ocsp"
@@ -0,0 +1,193 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package admin implements the HTTP API for inspecting and disconnecting
+// the sessions proxied by mProxy.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/session"
+	mptls "github.com/absmach/mproxy/pkg/tls"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	contentType  = "application/json"
+	sessionsPath = "sessions"
+	bearerPrefix = "Bearer "
+)
+
+var (
+	// ErrUnauthorized indicates a request without the admin token or a verified client certificate.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNoCredentials indicates an admin server listening on a non-loopback
+	// address without a token or client certificate verification.
+	ErrNoCredentials = errors.New("admin server on a non-loopback address requires a token or mTLS")
+)
+
+// Server serves the admin HTTP API.
+type Server struct {
+	config   mproxy.Config
+	admin    Config
+	registry *session.Registry
+	logger   *slog.Logger
+}
+
+// New returns a new admin Server exposing the sessions of the given registry.
+func New(config mproxy.Config, admin Config, registry *session.Registry, logger *slog.Logger) *Server {
+	return &Server{
+		config:   config,
+		admin:    admin,
+		registry: registry,
+		logger:   logger,
+	}
+}
+
+// ServeHTTP implements the following endpoints under the configured path prefix:
+//
+//	GET    sessions       lists the active sessions
+//	GET    sessions/{id}  returns the session with the given ID
+//	DELETE sessions/{id}  disconnects the session with the given ID
+//
+// Requests are served once they carry the admin token, if one is set, and a
+// verified client certificate, if the server requires one.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		encodeError(w, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	prefix := strings.TrimSuffix(s.config.PathPrefix, "/") + "/" + sessionsPath
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == prefix:
+		if r.Method != http.MethodGet {
+			encodeError(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+			return
+		}
+		encode(w, http.StatusOK, s.registry.Sessions())
+	case strings.HasPrefix(path, prefix+"/"):
+		id := strings.TrimPrefix(path, prefix+"/")
+		switch r.Method {
+		case http.MethodGet:
+			info, err := s.registry.Session(id)
+			if err != nil {
+				encodeError(w, http.StatusNotFound, err)
+				return
+			}
+			encode(w, http.StatusOK, info)
+		case http.MethodDelete:
+			err := s.registry.Disconnect(id)
+			switch {
+			case errors.Is(err, session.ErrSessionNotFound):
+				encodeError(w, http.StatusNotFound, err)
+				return
+			case err != nil:
+				s.logger.Warn("Failed to cleanly disconnect session", slog.String("id", id), slog.Any("error", err))
+			}
+			s.logger.Info("Session disconnected by admin", slog.String("id", id))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			encodeError(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized checks the token and the client certificate of the request.
+// Client certificates are verified by the TLS handshake, so only their
+// presence is checked here.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.mTLS() && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	if s.admin.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerPrefix)
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.admin.Token)) == 1
+}
+
+// mTLS reports whether the server verifies client certificates.
+func (s *Server) mTLS() bool {
+	return s.config.TLSConfig != nil && s.config.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert
+}
+
+// loopback reports whether the address only listens on the loopback interface.
+func loopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func encode(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func encodeError(w http.ResponseWriter, statusCode int, err error) {
+	encode(w, statusCode, map[string]string{"error": err.Error()})
+}
+
+// Listen of the server, this will block.
+// The server refuses to start on a non-loopback address without a token or
+// client certificate verification.
+func (s *Server) Listen(ctx context.Context) error {
+	if s.admin.Token == "" && !s.mTLS() {
+		if !loopback(s.config.Address) {
+			return ErrNoCredentials
+		}
+		s.logger.Warn("Admin server has no token or client certificate verification", slog.String("address", s.config.Address))
+	}
+	l, err := net.Listen("tcp", s.config.Address)
+	if err != nil {
+		return err
+	}
+
+	if s.config.TLSConfig != nil {
+		l = tls.NewListener(l, s.config.TLSConfig)
+	}
+	status := mptls.SecurityStatus(s.config.TLSConfig)
+
+	s.logger.Info(fmt.Sprintf("Admin server started at %s%s with %s", s.config.Address, s.config.PathPrefix, status))
+
+	server := http.Server{Handler: s}
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		return server.Serve(l)
+	})
+
+	g.Go(func() error {
+		<-ctx.Done()
+		return server.Close()
+	})
+	if err := g.Wait(); err != nil {
+		s.logger.Info(fmt.Sprintf("Admin server at %s%s with %s exiting with errors", s.config.Address, s.config.PathPrefix, status), slog.String("error", err.Error()))
+	} else {
+		s.logger.Info(fmt.Sprintf("Admin server at %s%s with %s exiting...", s.config.Address, s.config.PathPrefix, status))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestServeHTTPToken(t *testing.T) {
+	s := New(mproxy.Config{PathPrefix: "/"}, Config{Token: "secret"}, session.NewRegistry(), logger)
+	cases := []struct {
+		desc   string
+		header string
+		status int
+	}{
+		{desc: "no token", status: http.StatusUnauthorized},
+		{desc: "wrong token", header: "Bearer wrong", status: http.StatusUnauthorized},
+		{desc: "not a bearer token", header: "secret", status: http.StatusUnauthorized},
+		{desc: "token", header: "Bearer secret", status: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("status = %d, want %d", w.Code, tc.status)
+			}
+		})
+	}
+}
+
+func TestServeHTTPClientCert(t *testing.T) {
+	config := mproxy.Config{PathPrefix: "/", TLSConfig: &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}}
+	s := New(config, Config{}, session.NewRegistry(), logger)
+	cases := []struct {
+		desc   string
+		state  *tls.ConnectionState
+		status int
+	}{
+		{desc: "no TLS", status: http.StatusUnauthorized},
+		{desc: "no verified certificate", state: &tls.ConnectionState{}, status: http.StatusUnauthorized},
+		{desc: "verified certificate", state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, status: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/sessions/unknown", nil)
+			r.TLS = tc.state
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			// Authorized requests reach the registry, which does not know the session.
+			want := tc.status
+			if want == http.StatusOK {
+				want = http.StatusNotFound
+			}
+			if w.Code != want {
+				t.Errorf("status = %d, want %d", w.Code, want)
+			}
+		})
+	}
+}
+
+func TestListenWithoutCredentials(t *testing.T) {
+	cases := []struct {
+		desc    string
+		address string
+		admin   Config
+		err     error
+	}{
+		{desc: "all interfaces", address: ":0", err: ErrNoCredentials},
+		{desc: "public address", address: "0.0.0.0:0", err: ErrNoCredentials},
+		{desc: "localhost", address: "localhost:0"},
+		{desc: "loopback address", address: "127.0.0.1:0"},
+		{desc: "all interfaces with token", address: ":0", admin: Config{Token: "secret"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := New(mproxy.Config{Address: tc.address, PathPrefix: "/"}, tc.admin, session.NewRegistry(), logger)
+			ctx, cancel := context.WithCancel(context.Background())
+			// Listen returns once the context is done if it starts.
+			cancel()
+			if err := s.Listen(ctx); !errors.Is(err, tc.err) {
+				t.Errorf("Listen() = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
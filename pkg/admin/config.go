@@ -0,0 +1,22 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package admin
+
+import "github.com/caarlos0/env/v11"
+
+// Config holds the settings of the admin server.
+type Config struct {
+	// Token is the bearer token the requests have to carry in the Authorization
+	// header. Requests are not checked for a token if unset.
+	Token string `env:"TOKEN" envDefault:""`
+}
+
+// NewConfig parses the admin server settings from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
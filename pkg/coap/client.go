@@ -0,0 +1,725 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+const (
+	// inboundQueue is the number of messages of a client waiting to be
+	// translated. Messages arriving once it is full are dropped.
+	inboundQueue = 32
+	// ackTimeout and maxRetransmit are the transmission parameters of RFC 7252
+	// of the confirmable notifications.
+	ackTimeout    = 2 * time.Second
+	maxRetransmit = 4
+	// exchangeLifetime is the time the responses are kept to answer the
+	// retransmitted requests.
+	exchangeLifetime = 247 * time.Second
+	// keepAlive is the keep alive of the sessions, which the proxy pings
+	// twice per period.
+	keepAlive = 60 * time.Second
+	// maxObserve bounds the 24-bit sequence numbers of the notifications.
+	maxObserve = 1<<24 - 1
+)
+
+// errClientLost indicates the client stopped acknowledging the notifications.
+var errClientLost = errors.New("CoAP client lost")
+
+// exchange is a request of the client waiting for the answer of the broker.
+type exchange struct {
+	req      Message
+	packetID uint16
+	topic    string
+}
+
+// observation is a resource observed by the client, identified by its token.
+type observation struct {
+	token  []byte
+	filter string
+	// mid is the message ID of the last notification, which the client may reset.
+	mid uint16
+}
+
+// notification is a confirmable notification waiting for the acknowledgement
+// of the client, which acknowledges the message to the broker.
+type notification struct {
+	msg      Message
+	packetID uint16
+	retries  int
+	timeout  time.Duration
+}
+
+// response is the response to a request, nil while the request is processed
+// or if the request is not answered.
+type response struct {
+	b       []byte
+	expires time.Time
+}
+
+// client translates the CoAP requests of a client into an MQTT 3.1.1 session,
+// which is streamed over a pipe. The requests are processed one at a time, as
+// the clients are expected to do. The state of the client is only accessed by
+// the goroutine running the client, except for the fields noted.
+type client struct {
+	proxy *Proxy
+	key   clientKey
+	peer  peer
+	in    chan Message
+	quit  chan struct{}
+	once  sync.Once
+	// conn is the client end of the pipe of the session.
+	conn net.Conn
+
+	connected bool
+	// failure is the response code of the requests left once the session ends.
+	failure  Code
+	requests []Message
+	current  *exchange
+	// responses holds the responses by message ID, expiring in order.
+	responses map[uint16]*response
+	expiry    []uint16
+
+	observations map[string]*observation
+	// filters counts the observations by topic filter,
+	// which is subscribed to while it is observed.
+	filters      map[string]int
+	nextPacketID uint16
+	observe      uint32
+	// acks counts the notifications of the QoS 1 messages waiting to be
+	// acknowledged by the client, by packet ID.
+	acks        map[uint16]int
+	queue       []*notification
+	outstanding *notification
+
+	idleTimer  *time.Timer
+	retryTimer *time.Timer
+	pingTicker *time.Ticker
+
+	// auth is the result of the authorization of the last PUBLISH, set by the session.
+	authMu     sync.Mutex
+	authorized bool
+	authErr    error
+
+	// down holds the packets read from the session, signaled by ready.
+	downMu sync.Mutex
+	down   []packets.ControlPacket
+	eof    bool
+	ready  chan struct{}
+}
+
+func newClient(p *Proxy, key clientKey, pr peer) *client {
+	return &client{
+		proxy:        p,
+		key:          key,
+		peer:         pr,
+		in:           make(chan Message, inboundQueue),
+		quit:         make(chan struct{}),
+		failure:      ServiceUnavailable,
+		responses:    make(map[uint16]*response),
+		observations: make(map[string]*observation),
+		filters:      make(map[string]int),
+		acks:         make(map[uint16]int),
+		ready:        make(chan struct{}, 1),
+	}
+}
+
+// receive queues a message of the client.
+func (c *client) receive(m Message) {
+	select {
+	case c.in <- m:
+	default:
+		c.proxy.logger.Warn("Dropped CoAP message of congested client", slog.String("remote", c.peer.addr.String()), slog.String("code", m.Code.String()))
+	}
+}
+
+// close ends the client without notifying it.
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.quit)
+	})
+}
+
+// run streams the session of the client until it ends. The session outlives
+// the proxy context, so that it can be drained on shutdown instead of being cut.
+func (c *client) run(ctx context.Context) {
+	p := c.proxy
+	conn, sconn := net.Pipe()
+	c.conn = conn
+	in := sessionConn{Conn: sconn, local: p.local, remote: c.peer.addr}
+	h := authHandler{Handler: p.handler, client: c}
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		defer sconn.Close()
+		if err := session.StreamDial(context.WithoutCancel(ctx), in, p.upstreams.Dial, h, p.interceptor, c.peer.cert, p.config.Session); err != nil && !errors.Is(err, io.EOF) {
+			p.logger.Warn(err.Error())
+		}
+	}()
+	go c.read()
+
+	c.idleTimer = time.NewTimer(c.idleTimeout())
+	c.pingTicker = time.NewTicker(keepAlive / 2)
+	if err := c.loop(); err != nil && !errors.Is(err, io.EOF) {
+		p.logger.Warn("CoAP client ended", slog.String("remote", c.peer.addr.String()), slog.Any("error", err))
+	}
+	c.end()
+	c.idleTimer.Stop()
+	c.pingTicker.Stop()
+	if c.retryTimer != nil {
+		c.retryTimer.Stop()
+	}
+	conn.Close()
+	<-streamed
+}
+
+// read reads the packets of the session, so that the session never waits
+// for the client to be translated.
+func (c *client) read() {
+	for {
+		pkt, err := packets.ReadPacket(c.conn, packets.V311)
+		c.downMu.Lock()
+		if err != nil {
+			c.eof = true
+		} else {
+			c.down = append(c.down, pkt)
+		}
+		c.downMu.Unlock()
+		select {
+		case c.ready <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *client) loop() error {
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = packets.V311
+	cp.CleanSession = true
+	cp.Keepalive = uint16(keepAlive / time.Second)
+	cp.ClientIdentifier = c.key.clientID
+	cp.Username = c.key.username
+	cp.UsernameFlag = c.key.username != ""
+	cp.Password = []byte(c.key.password)
+	cp.PasswordFlag = c.key.password != ""
+	if err := c.write(cp); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case m := <-c.in:
+			c.idleTimer.Reset(c.idleTimeout())
+			if err := c.handle(m); err != nil {
+				return err
+			}
+		case <-c.ready:
+			c.downMu.Lock()
+			down, eof := c.down, c.eof
+			c.down = nil
+			c.downMu.Unlock()
+			for _, pkt := range down {
+				if err := c.downlink(pkt); err != nil {
+					return err
+				}
+			}
+			if eof {
+				return io.EOF
+			}
+		case <-timer(c.retryTimer):
+			if err := c.retransmit(); err != nil {
+				return err
+			}
+		case <-c.pingTicker.C:
+			if err := c.write(packets.NewControlPacket(packets.Pingreq)); err != nil {
+				return err
+			}
+		case <-c.idleTimer.C:
+			if c.idle() {
+				return c.write(packets.NewControlPacket(packets.Disconnect))
+			}
+			c.idleTimer.Reset(c.idleTimeout())
+		case <-c.quit:
+			return nil
+		}
+	}
+}
+
+// idleTimeout returns the timeout of the idle client, which never expires if unset.
+func (c *client) idleTimeout() time.Duration {
+	if t := c.proxy.coap.IdleTimeout; t > 0 {
+		return t
+	}
+	return time.Duration(1<<63 - 1)
+}
+
+// idle returns true if the client has nothing going on.
+func (c *client) idle() bool {
+	return len(c.observations) == 0 && len(c.requests) == 0 && c.current == nil && c.outstanding == nil
+}
+
+// handle handles a request of the client, or the acknowledgement or reset
+// of a notification. Retransmitted requests are answered with the response
+// to the original request, if any.
+func (c *client) handle(m Message) error {
+	if m.Code == Empty {
+		return c.acknowledge(m)
+	}
+	if r, ok := c.responses[m.MessageID]; ok {
+		if r.b == nil {
+			return nil
+		}
+		return c.proxy.write(c.peer, r.b)
+	}
+	now := time.Now()
+	for len(c.expiry) > 0 {
+		r := c.responses[c.expiry[0]]
+		if r != nil && now.Before(r.expires) {
+			break
+		}
+		delete(c.responses, c.expiry[0])
+		c.expiry = c.expiry[1:]
+	}
+	c.responses[m.MessageID] = &response{expires: now.Add(exchangeLifetime)}
+	c.expiry = append(c.expiry, m.MessageID)
+	c.requests = append(c.requests, m)
+	return c.next()
+}
+
+// next processes the queued requests, once the session is connected,
+// until one of them waits for the broker.
+func (c *client) next() error {
+	for c.connected && c.current == nil && len(c.requests) > 0 {
+		req := c.requests[0]
+		c.requests = c.requests[1:]
+		if err := c.process(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) process(req Message) error {
+	if _, ok := req.Critical(); ok {
+		return c.respond(req, BadOption)
+	}
+	topic, ok := c.proxy.topic(req)
+	if !ok {
+		return c.respond(req, NotFound)
+	}
+	switch req.Code {
+	case POST, PUT:
+		return c.publish(req, topic)
+	case GET:
+		obs, ok := req.Observe()
+		switch {
+		case !ok:
+			// There is no representation to return but the notifications.
+			return c.respond(req, MethodNotAllowed)
+		case obs == ObserveRegister:
+			return c.register(req, topic)
+		case obs == ObserveDeregister:
+			if o := c.observations[string(req.Token)]; o != nil {
+				if err := c.deregister(o); err != nil {
+					return err
+				}
+			}
+			return c.respond(req, Content)
+		default:
+			return c.respond(req, BadRequest)
+		}
+	default:
+		return c.respond(req, MethodNotAllowed)
+	}
+}
+
+// publish publishes the payload of the request. Confirmable requests are
+// published with QoS 1 and answered once the broker acknowledges them,
+// non-confirmable requests are published with QoS 0 and not answered.
+func (c *client) publish(req Message, topic string) error {
+	pkt := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pkt.TopicName = topic
+	pkt.Payload = req.Payload
+	if req.Type == Confirmable {
+		pkt.Qos = 1
+		pkt.MessageID = c.packetID()
+		c.current = &exchange{req: req, packetID: pkt.MessageID, topic: topic}
+		c.authMu.Lock()
+		c.authorized, c.authErr = false, nil
+		c.authMu.Unlock()
+	}
+	return c.write(pkt)
+}
+
+// register subscribes to the topic filter of the observed resource, unless
+// it is observed already. Confirmable requests subscribe with QoS 1, whose
+// messages are notified with confirmable notifications.
+func (c *client) register(req Message, topic string) error {
+	if o := c.observations[string(req.Token)]; o != nil {
+		if o.filter == topic {
+			// The client registers again to refresh the observation.
+			return c.respond(req, Content, c.nextObserve())
+		}
+		if err := c.deregister(o); err != nil {
+			return err
+		}
+	}
+	if c.filters[topic] > 0 {
+		c.observations[string(req.Token)] = &observation{token: req.Token, filter: topic}
+		c.filters[topic]++
+		return c.respond(req, Content, c.nextObserve())
+	}
+	pkt := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	pkt.MessageID = c.packetID()
+	pkt.Topics = []string{topic}
+	pkt.Options = []byte{0}
+	if req.Type == Confirmable {
+		pkt.Options[0] = 1
+	}
+	c.current = &exchange{req: req, packetID: pkt.MessageID, topic: topic}
+	return c.write(pkt)
+}
+
+// deregister ends the observation, unsubscribing from its topic filter
+// once it is not observed anymore. Its pending notifications are dropped.
+func (c *client) deregister(o *observation) error {
+	delete(c.observations, string(o.token))
+	queue := c.queue[:0]
+	for _, n := range c.queue {
+		if string(n.msg.Token) == string(o.token) {
+			if err := c.acked(n.packetID); err != nil {
+				return err
+			}
+			continue
+		}
+		queue = append(queue, n)
+	}
+	c.queue = queue
+	if c.filters[o.filter]--; c.filters[o.filter] > 0 {
+		return nil
+	}
+	delete(c.filters, o.filter)
+	pkt := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	pkt.MessageID = c.packetID()
+	pkt.Topics = []string{o.filter}
+	return c.write(pkt)
+}
+
+// downlink translates a packet of the session.
+func (c *client) downlink(pkt packets.ControlPacket) error {
+	switch pkt := pkt.(type) {
+	case *packets.ConnackPacket:
+		if pkt.ReturnCode != packets.Accepted {
+			c.failure = connackCode(pkt.ReturnCode)
+			return io.EOF
+		}
+		c.connected = true
+		return c.next()
+	case *packets.PubackPacket:
+		if x := c.current; x != nil && x.packetID == pkt.MessageID {
+			c.current = nil
+			if err := c.respond(x.req, c.publishCode()); err != nil {
+				return err
+			}
+			return c.next()
+		}
+	case *packets.SubackPacket:
+		if x := c.current; x != nil && x.packetID == pkt.MessageID {
+			c.current = nil
+			if err := c.suback(x, pkt); err != nil {
+				return err
+			}
+			return c.next()
+		}
+	case *packets.PublishPacket:
+		return c.notify(pkt)
+	}
+	return nil
+}
+
+func (c *client) suback(x *exchange, pkt *packets.SubackPacket) error {
+	if len(pkt.ReturnCodes) == 0 || pkt.ReturnCodes[0] >= packets.SubackFailure {
+		return c.respond(x.req, Forbidden)
+	}
+	if old := c.observations[string(x.req.Token)]; old != nil {
+		// The token was registered again meanwhile.
+		if err := c.deregister(old); err != nil {
+			return err
+		}
+	}
+	c.observations[string(x.req.Token)] = &observation{token: x.req.Token, filter: x.topic}
+	c.filters[x.topic]++
+	return c.respond(x.req, Content, c.nextObserve())
+}
+
+// publishCode returns the response code of the published request. The PUBLISH
+// denied by the hooks, or dropped by the rate limits, is acknowledged by the
+// session as if it were published, since MQTT 3.1.1 has no reason codes.
+func (c *client) publishCode() Code {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	switch {
+	case c.authErr != nil:
+		return Forbidden
+	case !c.authorized:
+		return TooManyRequests
+	default:
+		return Changed
+	}
+}
+
+// notify sends the message to the observations of the matching resources.
+// Messages of QoS 0 are sent with non-confirmable notifications, and the others
+// with confirmable notifications, acknowledged to the broker once all are acknowledged.
+func (c *client) notify(pkt *packets.PublishPacket) error {
+	var pending int
+	for _, o := range c.observations {
+		if !matchTopic(o.filter, pkt.TopicName) {
+			continue
+		}
+		m := Message{
+			Type:      NonConfirmable,
+			Code:      Content,
+			MessageID: c.proxy.messageID(),
+			Token:     o.token,
+			Options:   []Option{c.nextObserve()},
+			Payload:   pkt.Payload,
+		}
+		o.mid = m.MessageID
+		if pkt.Qos == 0 {
+			if err := c.send(m); err != nil {
+				return err
+			}
+			continue
+		}
+		m.Type = Confirmable
+		c.queue = append(c.queue, &notification{msg: m, packetID: pkt.MessageID})
+		pending++
+	}
+	if pkt.Qos > 0 {
+		c.acks[pkt.MessageID] += pending
+		if pending == 0 {
+			return c.acked(pkt.MessageID)
+		}
+	}
+	return c.transmit()
+}
+
+// transmit sends the next confirmable notification, once the outstanding one is acknowledged.
+func (c *client) transmit() error {
+	for c.outstanding == nil && len(c.queue) > 0 {
+		n := c.queue[0]
+		c.queue = c.queue[1:]
+		err := c.send(n.msg)
+		if errors.Is(err, ErrMessageTooLarge) {
+			if err := c.acked(n.packetID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// The initial timeout is randomized as by RFC 7252.
+		n.timeout = ackTimeout + rand.N(ackTimeout/2)
+		c.outstanding = n
+		c.retryTimer = time.NewTimer(n.timeout)
+	}
+	return nil
+}
+
+func (c *client) retransmit() error {
+	n := c.outstanding
+	if n == nil {
+		return nil
+	}
+	if n.retries++; n.retries > maxRetransmit {
+		return errClientLost
+	}
+	n.timeout *= 2
+	c.retryTimer = time.NewTimer(n.timeout)
+	return c.send(n.msg)
+}
+
+// acknowledge handles the acknowledgement or reset of a notification.
+// Resetting a notification ends its observation.
+func (c *client) acknowledge(m Message) error {
+	if n := c.outstanding; n != nil && n.msg.MessageID == m.MessageID {
+		c.retryTimer.Stop()
+		c.retryTimer, c.outstanding = nil, nil
+		if err := c.acked(n.packetID); err != nil {
+			return err
+		}
+		if m.Type == Reset {
+			if o := c.observations[string(n.msg.Token)]; o != nil {
+				if err := c.deregister(o); err != nil {
+					return err
+				}
+			}
+		}
+		return c.transmit()
+	}
+	if m.Type != Reset {
+		return nil
+	}
+	for _, o := range c.observations {
+		if o.mid == m.MessageID {
+			return c.deregister(o)
+		}
+	}
+	return nil
+}
+
+// acked acknowledges the message to the broker once all its notifications are acknowledged.
+func (c *client) acked(packetID uint16) error {
+	if c.acks[packetID]--; c.acks[packetID] > 0 {
+		return nil
+	}
+	delete(c.acks, packetID)
+	puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	puback.MessageID = packetID
+	return c.write(puback)
+}
+
+// end answers the requests left, and ends the observations of the client
+// with a notification of the failure, once the session ends.
+func (c *client) end() {
+	if x := c.current; x != nil {
+		code := c.failure
+		c.authMu.Lock()
+		if c.authErr != nil {
+			code = Forbidden
+		}
+		c.authMu.Unlock()
+		_ = c.respond(x.req, code)
+	}
+	for _, req := range c.requests {
+		_ = c.respond(req, c.failure)
+	}
+	for _, o := range c.observations {
+		_ = c.send(Message{Type: NonConfirmable, Code: c.failure, MessageID: c.proxy.messageID(), Token: o.token})
+	}
+	c.current, c.requests, c.observations = nil, nil, nil
+}
+
+// respond answers the request, keeping the response for its retransmissions.
+func (c *client) respond(req Message, code Code, opts ...Option) error {
+	b, err := reply(req, code, c.proxy.messageID(), opts...).Pack()
+	if err != nil {
+		return err
+	}
+	if r := c.responses[req.MessageID]; r != nil {
+		r.b = b
+	}
+	return c.proxy.write(c.peer, b)
+}
+
+// nextObserve returns the Observe option with the next sequence number.
+func (c *client) nextObserve() Option {
+	c.observe = (c.observe + 1) & maxObserve
+	return UintOption(OptionObserve, c.observe)
+}
+
+// packetID returns a packet ID for the packets sent to the broker, 0 being reserved.
+func (c *client) packetID() uint16 {
+	c.nextPacketID++
+	if c.nextPacketID == 0 {
+		c.nextPacketID++
+	}
+	return c.nextPacketID
+}
+
+// send sends the message to the client.
+func (c *client) send(m Message) error {
+	return c.proxy.send(c.peer, m)
+}
+
+// write writes the packet to the session.
+func (c *client) write(pkt packets.ControlPacket) error {
+	return pkt.Write(c.conn, packets.V311)
+}
+
+// authorize records the result of the authorization of the PUBLISH.
+func (c *client) authorize(err error) {
+	c.authMu.Lock()
+	c.authorized, c.authErr = true, err
+	c.authMu.Unlock()
+}
+
+// connackCode maps the return code of a refused CONNECT to a response code.
+func connackCode(rc byte) Code {
+	switch rc {
+	case packets.ErrRefusedBadUsernameOrPassword, packets.ErrRefusedNotAuthorized, packets.ErrRefusedIDRejected:
+		return Unauthorized
+	case packets.ErrRefusedServerUnavailable:
+		return ServiceUnavailable
+	default:
+		return BadGateway
+	}
+}
+
+// matchTopic returns true if the topic name matches the topic filter.
+func matchTopic(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func timer(t *time.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+// authHandler records the result of the authorization of the PUBLISH of
+// the client, which the MQTT 3.1.1 acknowledgement does not carry.
+type authHandler struct {
+	session.Handler
+	client *client
+}
+
+func (h authHandler) AuthPublish(ctx context.Context, topic *string, payload *[]byte) error {
+	err := h.Handler.AuthPublish(ctx, topic, payload)
+	h.client.authorize(err)
+	return err
+}
+
+// sessionConn is the session end of the pipe of a client, with the
+// addresses of the client and the proxy.
+type sessionConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c sessionConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c sessionConn) RemoteAddr() net.Addr {
+	return c.remote
+}
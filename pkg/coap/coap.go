@@ -0,0 +1,473 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package coap implements the CoAP proxy. CoAP clients publish with POST and
+// PUT requests, and subscribe by observing resources with GET requests as by
+// RFC 7641, the path of the request being the topic. Each client, told apart
+// by its address and credentials, is translated into an MQTT 3.1.1 session
+// streamed to the target broker over TCP as by the MQTT proxy, so that the
+// session hooks, limits, registry and tracing apply to it as to MQTT clients.
+//
+// The credentials are taken from the client_id, username and password query
+// parameters, or from the experimental options carrying them. The proxy listens
+// over DTLS if the listener has TLS certificates, which DTLS uses as TLS does.
+// Block-wise transfers are not supported.
+package coap
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/mqtt"
+	"github.com/absmach/mproxy/pkg/session"
+	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/upstream"
+	"github.com/pion/dtls/v3"
+)
+
+// handshakeTimeout bounds the DTLS handshake of the clients.
+const handshakeTimeout = 30 * time.Second
+
+// Query parameters carrying the MQTT credentials of the client.
+const (
+	queryClientID = "client_id"
+	queryUsername = "username"
+	queryPassword = "password"
+)
+
+// peer is the endpoint the messages of the clients are exchanged with,
+// either a UDP address or a DTLS connection.
+type peer struct {
+	// key identifies the peer.
+	key  string
+	addr net.Addr
+	// conn is the DTLS connection of the peer, nil for UDP peers.
+	conn net.Conn
+	cert x509.Certificate
+}
+
+// credentials are the MQTT credentials of a client.
+type credentials struct {
+	clientID string
+	username string
+	password string
+}
+
+// clientKey identifies a client by its peer and credentials.
+type clientKey struct {
+	peer string
+	credentials
+}
+
+// Proxy represents the CoAP proxy.
+type Proxy struct {
+	config      mproxy.Config
+	coap        Config
+	handler     session.Handler
+	interceptor session.Interceptor
+	logger      *slog.Logger
+	upstreams   *upstream.Router
+
+	// conn is the UDP connection of the proxy listening without DTLS.
+	conn  net.PacketConn
+	local net.Addr
+	// clients holds the wait group of the client sessions.
+	clients sync.WaitGroup
+	// mid is the message ID of the last message sent by the proxy.
+	mid   atomic.Uint32
+	peers atomic.Uint64
+
+	mu sync.Mutex
+	// byKey and byPeer index the clients by key and peer.
+	byKey   map[clientKey]*client
+	byPeer  map[string]map[*client]struct{}
+	dtls    map[net.Conn]struct{}
+	closing bool
+}
+
+// New returns a new CoAP proxy instance.
+func New(config mproxy.Config, coap Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
+	if config.Session.Tracker == nil {
+		config.Session.Tracker = session.NewTracker()
+	}
+	config.Session.Transport = session.CoAP
+	p := &Proxy{
+		config:      config,
+		coap:        coap,
+		handler:     handler,
+		interceptor: interceptor,
+		logger:      logger,
+		byKey:       make(map[clientKey]*client),
+		byPeer:      make(map[string]map[*client]struct{}),
+		dtls:        make(map[net.Conn]struct{}),
+	}
+	p.mid.Store(rand.Uint32N(0x10000))
+	p.upstreams = upstream.NewRouter(config.Upstreams(), config.Upstream, p.dial, logger)
+	return p
+}
+
+func (p *Proxy) dial(ctx context.Context, addr string) (net.Conn, error) {
+	return mqtt.DialTarget(ctx, addr, p.config)
+}
+
+// Listen of the server, this will block.
+func (p *Proxy) Listen(ctx context.Context) error {
+	addr, err := net.ResolveUDPAddr("udp", p.config.Address)
+	if err != nil {
+		return err
+	}
+	var l net.Listener
+	if p.config.TLSConfig != nil {
+		if l, err = dtls.Listen("udp", addr, dtlsConfig(p.config.TLSConfig, p.coap.ConnectionIDSize)); err != nil {
+			return err
+		}
+		p.local = l.Addr()
+	} else {
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+		p.local = conn.LocalAddr()
+	}
+	status := mptls.SecurityStatus(p.config.TLSConfig)
+	p.logger.Info(fmt.Sprintf("CoAP proxy server started at %s with %s", p.config.Address, status))
+
+	// The messages are read until the sessions are drained,
+	// so that the clients are still answered meanwhile.
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func(ctx context.Context) {
+		defer readers.Done()
+		if l != nil {
+			p.accept(ctx, l, &readers)
+			return
+		}
+		p.read(ctx)
+	}(ctx)
+
+	p.upstreams.Run(ctx)
+	<-ctx.Done()
+	p.logger.Info(fmt.Sprintf("CoAP proxy server at %s with %s exiting...", p.config.Address, status))
+	p.mu.Lock()
+	p.closing = true
+	p.mu.Unlock()
+	p.drain()
+	p.clients.Wait()
+	if l != nil {
+		err = l.Close()
+		p.mu.Lock()
+		for conn := range p.dtls {
+			conn.Close()
+		}
+		p.mu.Unlock()
+	} else {
+		err = p.conn.Close()
+	}
+	readers.Wait()
+	return err
+}
+
+func (p *Proxy) read(ctx context.Context) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.logger.Warn("Read error " + err.Error())
+			continue
+		}
+		p.receive(ctx, peer{key: "udp " + addr.String(), addr: addr}, buf[:n])
+	}
+}
+
+func (p *Proxy) accept(ctx context.Context, l net.Listener, readers *sync.WaitGroup) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.isClosing() {
+				return
+			}
+			p.logger.Warn("Accept error " + err.Error())
+			continue
+		}
+		p.mu.Lock()
+		if p.closing {
+			p.mu.Unlock()
+			conn.Close()
+			return
+		}
+		p.dtls[conn] = struct{}{}
+		readers.Add(1)
+		p.mu.Unlock()
+		go func() {
+			defer readers.Done()
+			p.serve(ctx, conn.(*dtls.Conn))
+		}()
+	}
+}
+
+// serve reads the messages of the DTLS connection, which is closed once
+// it has been idle for the idle timeout and its clients are gone.
+func (p *Proxy) serve(ctx context.Context, conn *dtls.Conn) {
+	defer func() {
+		conn.Close()
+		p.mu.Lock()
+		delete(p.dtls, conn)
+		p.mu.Unlock()
+	}()
+	remote := conn.RemoteAddr().String()
+	hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	err := conn.HandshakeContext(hctx)
+	cancel()
+	if err != nil {
+		p.logger.Warn("DTLS handshake failed", slog.String("remote", remote), slog.Any("error", err))
+		return
+	}
+	cert, err := clientCert(conn)
+	if err != nil {
+		p.logger.Warn("Failed to parse client certificate", slog.String("remote", remote), slog.Any("error", err))
+		return
+	}
+	pr := peer{
+		key:  fmt.Sprintf("dtls %d", p.peers.Add(1)),
+		addr: conn.RemoteAddr(),
+		conn: conn,
+		cert: cert,
+	}
+	defer p.closePeer(pr.key)
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		if p.coap.IdleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(p.coap.IdleTimeout))
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() && p.hasClients(pr.key) {
+				continue
+			}
+			return
+		}
+		p.receive(ctx, pr, buf[:n])
+	}
+}
+
+// receive decodes the datagram of the peer. Malformed confirmable
+// messages are rejected with a reset, others are ignored.
+func (p *Proxy) receive(ctx context.Context, pr peer, b []byte) {
+	m, err := Decode(b)
+	if err != nil {
+		if errors.Is(err, ErrMalformedMessage) && len(b) >= 4 && Type(b[0]>>4&0x03) == Confirmable {
+			_ = p.send(pr, Message{Type: Reset, MessageID: uint16(b[2])<<8 | uint16(b[3])})
+		}
+		p.logger.Debug("Dropped invalid CoAP message", slog.String("remote", pr.addr.String()), slog.Any("error", err))
+		return
+	}
+	p.dispatch(ctx, pr, m)
+}
+
+// dispatch hands the message over to the client it was sent by. Pings are
+// answered by the proxy itself, and acknowledgements and resets of the
+// notifications are handed over to the clients of the peer.
+func (p *Proxy) dispatch(ctx context.Context, pr peer, m Message) {
+	switch {
+	case m.Code == Empty:
+		switch m.Type {
+		case Confirmable:
+			_ = p.send(pr, Message{Type: Reset, MessageID: m.MessageID})
+		case Acknowledgement, Reset:
+			p.mu.Lock()
+			clients := make([]*client, 0, len(p.byPeer[pr.key]))
+			for c := range p.byPeer[pr.key] {
+				clients = append(clients, c)
+			}
+			p.mu.Unlock()
+			for _, c := range clients {
+				c.receive(m)
+			}
+		}
+	case m.Code.IsRequest():
+		if m.Type == Confirmable || m.Type == NonConfirmable {
+			p.request(ctx, pr, m)
+		}
+	case m.Type == Confirmable:
+		// Responses are not expected, as the proxy sends no requests.
+		_ = p.send(pr, Message{Type: Reset, MessageID: m.MessageID})
+	}
+}
+
+// request hands the request over to the client with its credentials,
+// starting the session of the client if needed.
+func (p *Proxy) request(ctx context.Context, pr peer, m Message) {
+	key := clientKey{peer: pr.key, credentials: credentialsOf(m)}
+	p.mu.Lock()
+	c := p.byKey[key]
+	closing := p.closing
+	p.mu.Unlock()
+	if c != nil {
+		c.receive(m)
+		return
+	}
+	if closing {
+		_ = p.send(pr, reply(m, ServiceUnavailable, p.messageID()))
+		return
+	}
+
+	release, err := p.config.Session.ConnLimiter.Accept(pr.addr)
+	if err != nil {
+		reason := connlimit.Reason(err)
+		p.config.Session.Metrics.Rejected(reason)
+		p.logger.Warn("Rejected client connection", slog.String("remote", pr.addr.String()), slog.String("reason", reason), slog.Any("error", err))
+		_ = p.send(pr, reply(m, ServiceUnavailable, p.messageID()))
+		return
+	}
+
+	c = newClient(p, key, pr)
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		release()
+		_ = p.send(pr, reply(m, ServiceUnavailable, p.messageID()))
+		return
+	}
+	p.byKey[key] = c
+	if p.byPeer[pr.key] == nil {
+		p.byPeer[pr.key] = make(map[*client]struct{})
+	}
+	p.byPeer[pr.key][c] = struct{}{}
+	p.clients.Add(1)
+	p.mu.Unlock()
+	p.logger.Info("Accepted new client")
+	p.config.Session.Metrics.Accepted()
+
+	go func() {
+		defer p.clients.Done()
+		defer p.config.Session.Metrics.Closed()
+		defer release()
+		defer p.remove(c)
+		c.run(ctx)
+	}()
+	c.receive(m)
+}
+
+// credentialsOf returns the credentials of the request,
+// the options taking precedence over the query parameters.
+func credentialsOf(m Message) credentials {
+	value := func(number uint16, query string) string {
+		if v, ok := m.Option(number); ok {
+			return string(v)
+		}
+		v, _ := m.Query(query)
+		return v
+	}
+	return credentials{
+		clientID: value(OptionClientID, queryClientID),
+		username: value(OptionUsername, queryUsername),
+		password: value(OptionPassword, queryPassword),
+	}
+}
+
+// topic returns the topic of the request path, which has to start with the path prefix.
+func (p *Proxy) topic(m Message) (string, bool) {
+	path, ok := strings.CutPrefix(m.Path(), strings.TrimSuffix(p.config.PathPrefix, "/"))
+	if !ok || !strings.HasPrefix(path, "/") {
+		return "", false
+	}
+	topic := path[1:]
+	return topic, topic != ""
+}
+
+func (p *Proxy) remove(c *client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byKey[c.key] == c {
+		delete(p.byKey, c.key)
+	}
+	if clients := p.byPeer[c.key.peer]; clients != nil {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(p.byPeer, c.key.peer)
+		}
+	}
+}
+
+// closePeer ends the clients of the peer whose DTLS connection is closed.
+func (p *Proxy) closePeer(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.byPeer[key] {
+		c.close()
+	}
+}
+
+func (p *Proxy) hasClients(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.byPeer[key]) > 0
+}
+
+func (p *Proxy) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+// messageID returns the message ID of a new message sent by the proxy.
+func (p *Proxy) messageID() uint16 {
+	return uint16(p.mid.Add(1))
+}
+
+// send writes the message to the peer.
+func (p *Proxy) send(pr peer, m Message) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	return p.write(pr, b)
+}
+
+func (p *Proxy) write(pr peer, b []byte) error {
+	if pr.conn != nil {
+		_, err := pr.conn.Write(b)
+		return err
+	}
+	_, err := p.conn.WriteTo(b, pr.addr)
+	return err
+}
+
+// reply returns the response to the request, piggybacked on the acknowledgement
+// of confirmable requests, or with the given message ID otherwise.
+func reply(req Message, code Code, mid uint16, opts ...Option) Message {
+	m := Message{Type: NonConfirmable, Code: code, MessageID: mid, Token: req.Token, Options: opts}
+	if req.Type == Confirmable {
+		m.Type, m.MessageID = Acknowledgement, req.MessageID
+	}
+	return m
+}
+
+// drain ends the sessions still active once the proxy is closed.
+func (p *Proxy) drain() {
+	cfg := p.config.Session
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	total, forced := cfg.Tracker.Drain(ctx, cfg.DrainGracePeriod)
+	if total == 0 {
+		return
+	}
+	p.logger.Info("Drained sessions", slog.String("address", p.config.Address), slog.Int("sessions", total), slog.Int("force_closed", forced))
+}
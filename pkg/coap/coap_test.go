@@ -0,0 +1,388 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+const testTimeout = 5 * time.Second
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// handler allows all the clients.
+type handler struct{}
+
+func (handler) AuthConnect(context.Context) error                   { return nil }
+func (handler) AuthPublish(context.Context, *string, *[]byte) error { return nil }
+func (handler) AuthSubscribe(context.Context, *[]string) error      { return nil }
+func (handler) DownSubscribe(context.Context, *[]string) error      { return nil }
+func (handler) Connect(context.Context) error                       { return nil }
+func (handler) Publish(context.Context, *string, *[]byte) error     { return nil }
+func (handler) Subscribe(context.Context, *[]string) error          { return nil }
+func (handler) Unsubscribe(context.Context, *[]string) error        { return nil }
+func (handler) Disconnect(context.Context) error                    { return nil }
+
+// proxy runs the CoAP proxy in front of an MQTT broker. It returns the
+// address of the proxy and the listener of the broker.
+func proxy(t *testing.T) (net.Addr, net.Listener) {
+	t.Helper()
+	broker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	// The proxy listens on a free port, which is found first.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr()
+	pc.Close()
+
+	config := mproxy.Config{Address: addr.String(), Target: broker.Addr().String(), PathPrefix: "/"}
+	config.Session.DrainTimeout = time.Second
+	p := New(config, Config{IdleTimeout: time.Minute}, handler{}, nil, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Listen(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Error("proxy did not stop")
+		}
+	})
+	return addr, broker
+}
+
+// coapClient is a CoAP client of the proxy.
+type coapClient struct {
+	t     *testing.T
+	conn  net.PacketConn
+	proxy net.Addr
+	mid   uint16
+}
+
+func newCoAPClient(t *testing.T, proxy net.Addr) *coapClient {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &coapClient{t: t, conn: conn, proxy: proxy}
+}
+
+// request returns a request of the client with a new message ID.
+func (c *coapClient) request(typ Type, code Code, token string, path ...string) Message {
+	c.mid++
+	m := Message{Type: typ, Code: code, MessageID: c.mid, Token: []byte(token)}
+	for _, seg := range path {
+		m.Options = append(m.Options, Option{Number: OptionURIPath, Value: []byte(seg)})
+	}
+	return m
+}
+
+func (c *coapClient) send(m Message) {
+	c.t.Helper()
+	b, err := m.Pack()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.WriteTo(b, c.proxy); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *coapClient) receive() Message {
+	c.t.Helper()
+	buf := make([]byte, maxMessageSize)
+	if err := c.conn.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		c.t.Fatal(err)
+	}
+	n, _, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	m, err := Decode(buf[:n])
+	if err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	return m
+}
+
+// connect sends the first request of the client, retrying until the proxy
+// listens, and returns the broker end of the session of the client.
+func (c *coapClient) connect(broker net.Listener, req Message) net.Conn {
+	c.t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := broker.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	var conn net.Conn
+	deadline := time.After(testTimeout)
+	for conn == nil {
+		// Retransmissions of the request are not processed again.
+		c.send(req)
+		select {
+		case conn = <-accepted:
+			if conn == nil {
+				c.t.Fatal("broker closed")
+			}
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			c.t.Fatal("proxy did not connect to the broker")
+		}
+	}
+	c.t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(testTimeout))
+
+	cp, ok := readPacket(c.t, conn).(*packets.ConnectPacket)
+	if !ok {
+		c.t.Fatal("broker did not receive CONNECT")
+	}
+	if cp.ClientIdentifier != "c1" || cp.Username != "user" || string(cp.Password) != "pass" {
+		c.t.Errorf("CONNECT credentials = %q %q %q", cp.ClientIdentifier, cp.Username, cp.Password)
+	}
+	writePacket(c.t, conn, packets.NewControlPacket(packets.Connack))
+	return conn
+}
+
+// withCredentials adds the credentials of the test clients to the request.
+func withCredentials(m Message) Message {
+	m.Options = append(m.Options,
+		Option{Number: OptionURIQuery, Value: []byte("client_id=c1")},
+		Option{Number: OptionURIQuery, Value: []byte("username=user")},
+		Option{Number: OptionPassword, Value: []byte("pass")},
+	)
+	return m
+}
+
+func readPacket(t *testing.T, conn net.Conn) packets.ControlPacket {
+	t.Helper()
+	pkt, err := packets.ReadPacket(conn, packets.V311)
+	if err != nil {
+		t.Fatalf("broker read: %v", err)
+	}
+	return pkt
+}
+
+func writePacket(t *testing.T, conn net.Conn, pkt packets.ControlPacket) {
+	t.Helper()
+	if err := pkt.Write(conn, packets.V311); err != nil {
+		t.Fatalf("broker write: %v", err)
+	}
+}
+
+func observe(m Message, v uint32) Message {
+	m.Options = append(m.Options, UintOption(OptionObserve, v))
+	return m
+}
+
+// checkResponse checks the response is piggybacked on the acknowledgement of the request.
+func checkResponse(t *testing.T, resp, req Message, code Code) {
+	t.Helper()
+	if resp.Type != Acknowledgement || resp.MessageID != req.MessageID || string(resp.Token) != string(req.Token) || resp.Code != code {
+		t.Fatalf("response %s %s mid %d token %x, want ACK %s mid %d token %x",
+			TypeNames[resp.Type], resp.Code, resp.MessageID, resp.Token, code, req.MessageID, req.Token)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	addr, broker := proxy(t)
+	c := newCoAPClient(t, addr)
+
+	// Observing a resource subscribes to its path, confirmable requests with QoS 1.
+	reg := withCredentials(observe(c.request(Confirmable, GET, "t1", "m", "+", "temp"), ObserveRegister))
+	conn := c.connect(broker, reg)
+	sub, ok := readPacket(t, conn).(*packets.SubscribePacket)
+	if !ok || len(sub.Topics) != 1 || sub.Topics[0] != "m/+/temp" || sub.QoS(0) != 1 {
+		t.Fatalf("broker SUBSCRIBE = %v", sub)
+	}
+	writePacket(t, conn, &packets.SubackPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Suback}, MessageID: sub.MessageID, ReturnCodes: []byte{1}})
+	resp := c.receive()
+	checkResponse(t, resp, reg, Content)
+	seq, ok := resp.Observe()
+	if !ok {
+		t.Fatal("response without Observe")
+	}
+
+	// Messages of QoS 1 are notified with confirmable notifications, and
+	// acknowledged to the broker once the client acknowledges them.
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "m/kitchen/temp"
+	pub.Qos = 1
+	pub.MessageID = 7
+	pub.Payload = []byte("21")
+	writePacket(t, conn, pub)
+	n := c.receive()
+	next, _ := n.Observe()
+	if n.Type != Confirmable || n.Code != Content || string(n.Token) != "t1" || string(n.Payload) != "21" || next <= seq {
+		t.Fatalf("notification %s %s token %q payload %q observe %d", TypeNames[n.Type], n.Code, n.Token, n.Payload, next)
+	}
+	c.send(Message{Type: Acknowledgement, MessageID: n.MessageID})
+	if ack, ok := readPacket(t, conn).(*packets.PubackPacket); !ok || ack.MessageID != 7 {
+		t.Fatalf("broker PUBACK = %v", ack)
+	}
+
+	// Messages of QoS 0 are notified with non-confirmable notifications.
+	pub.Qos, pub.MessageID, pub.Payload = 0, 0, []byte("22")
+	writePacket(t, conn, pub)
+	if n := c.receive(); n.Type != NonConfirmable || string(n.Token) != "t1" || string(n.Payload) != "22" {
+		t.Fatalf("notification %s token %q payload %q", TypeNames[n.Type], n.Token, n.Payload)
+	}
+	// Messages of other topics are not notified.
+	pub.TopicName = "m/kitchen/humidity"
+	writePacket(t, conn, pub)
+
+	// Observing the same resource with another token does not subscribe again.
+	reg2 := withCredentials(observe(c.request(Confirmable, GET, "t2", "m", "+", "temp"), ObserveRegister))
+	c.send(reg2)
+	checkResponse(t, c.receive(), reg2, Content)
+
+	// The filter is unsubscribed from once it is not observed anymore.
+	dereg := withCredentials(observe(c.request(Confirmable, GET, "t1", "m", "+", "temp"), ObserveDeregister))
+	c.send(dereg)
+	checkResponse(t, c.receive(), dereg, Content)
+	dereg2 := withCredentials(observe(c.request(Confirmable, GET, "t2", "m", "+", "temp"), ObserveDeregister))
+	c.send(dereg2)
+	checkResponse(t, c.receive(), dereg2, Content)
+	unsub, ok := readPacket(t, conn).(*packets.UnsubscribePacket)
+	if !ok || len(unsub.Topics) != 1 || unsub.Topics[0] != "m/+/temp" {
+		t.Fatalf("broker UNSUBSCRIBE = %v", unsub)
+	}
+}
+
+func TestObserveNonConfirmable(t *testing.T) {
+	addr, broker := proxy(t)
+	c := newCoAPClient(t, addr)
+
+	reg := withCredentials(observe(c.request(NonConfirmable, GET, "t1", "m", "temp"), ObserveRegister))
+	conn := c.connect(broker, reg)
+	sub, ok := readPacket(t, conn).(*packets.SubscribePacket)
+	if !ok || sub.Topics[0] != "m/temp" || sub.QoS(0) != 0 {
+		t.Fatalf("broker SUBSCRIBE = %v", sub)
+	}
+	writePacket(t, conn, &packets.SubackPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Suback}, MessageID: sub.MessageID, ReturnCodes: []byte{0}})
+	if resp := c.receive(); resp.Type != NonConfirmable || resp.Code != Content || string(resp.Token) != "t1" {
+		t.Fatalf("response %s %s token %q", TypeNames[resp.Type], resp.Code, resp.Token)
+	}
+}
+
+func TestObserveDenied(t *testing.T) {
+	addr, broker := proxy(t)
+	c := newCoAPClient(t, addr)
+
+	reg := withCredentials(observe(c.request(Confirmable, GET, "t1", "m", "temp"), ObserveRegister))
+	conn := c.connect(broker, reg)
+	sub, ok := readPacket(t, conn).(*packets.SubscribePacket)
+	if !ok {
+		t.Fatal("broker did not receive SUBSCRIBE")
+	}
+	writePacket(t, conn, &packets.SubackPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Suback}, MessageID: sub.MessageID, ReturnCodes: []byte{packets.SubackFailure}})
+	checkResponse(t, c.receive(), reg, Forbidden)
+}
+
+func TestPublish(t *testing.T) {
+	addr, broker := proxy(t)
+	c := newCoAPClient(t, addr)
+
+	// Confirmable requests are published with QoS 1, and answered once acknowledged.
+	post := withCredentials(c.request(Confirmable, POST, "p1", "m", "temp"))
+	post.Payload = []byte("21")
+	conn := c.connect(broker, post)
+	pub, ok := readPacket(t, conn).(*packets.PublishPacket)
+	if !ok || pub.TopicName != "m/temp" || pub.Qos != 1 || string(pub.Payload) != "21" {
+		t.Fatalf("broker PUBLISH = %v", pub)
+	}
+	writePacket(t, conn, &packets.PubackPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Puback}, MessageID: pub.MessageID})
+	checkResponse(t, c.receive(), post, Changed)
+
+	// Retransmissions are answered with the same response, without publishing again.
+	c.send(post)
+	checkResponse(t, c.receive(), post, Changed)
+
+	// Non-confirmable requests are published with QoS 0.
+	put := withCredentials(c.request(NonConfirmable, PUT, "", "m", "temp"))
+	put.Payload = []byte("22")
+	c.send(put)
+	if pub, ok := readPacket(t, conn).(*packets.PublishPacket); !ok || pub.TopicName != "m/temp" || pub.Qos != 0 || string(pub.Payload) != "22" {
+		t.Fatalf("broker PUBLISH = %v", pub)
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	addr, broker := proxy(t)
+	c := newCoAPClient(t, addr)
+
+	first := withCredentials(c.request(Confirmable, GET, "g", "m", "temp"))
+	c.connect(broker, first)
+	checkResponse(t, c.receive(), first, MethodNotAllowed)
+
+	cases := []struct {
+		desc string
+		req  Message
+		code Code
+	}{
+		{desc: "unknown Observe value", req: observe(c.request(Confirmable, GET, "g", "m", "temp"), 5), code: BadRequest},
+		{desc: "DELETE", req: c.request(Confirmable, DELETE, "g", "m", "temp"), code: MethodNotAllowed},
+		{desc: "no topic", req: c.request(Confirmable, POST, "g"), code: NotFound},
+		{
+			desc: "critical option",
+			req: func() Message {
+				m := c.request(Confirmable, POST, "g", "m", "temp")
+				m.Options = append(m.Options, Option{Number: OptionIfMatch})
+				return m
+			}(),
+			code: BadOption,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := withCredentials(tc.req)
+			c.send(req)
+			checkResponse(t, c.receive(), req, tc.code)
+		})
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{filter: "a/b", topic: "a/b", match: true},
+		{filter: "a/b", topic: "a/c"},
+		{filter: "a/+", topic: "a/b", match: true},
+		{filter: "a/+", topic: "a/b/c"},
+		{filter: "a/+/c", topic: "a/b/c", match: true},
+		{filter: "a/#", topic: "a/b/c", match: true},
+		{filter: "a/#", topic: "a", match: true},
+		{filter: "#", topic: "a/b", match: true},
+		{filter: "a/b/c", topic: "a/b"},
+	}
+	for _, tc := range cases {
+		if got := matchTopic(tc.filter, tc.topic); got != tc.match {
+			t.Errorf("matchTopic(%q, %q) = %t, want %t", tc.filter, tc.topic, got, tc.match)
+		}
+	}
+}
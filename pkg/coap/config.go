@@ -0,0 +1,30 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// Config holds the settings of the CoAP proxy.
+type Config struct {
+	// IdleTimeout ends the session of a client which observes no resource
+	// once it has sent no message for the timeout.
+	IdleTimeout time.Duration `env:"IDLE_TIMEOUT" envDefault:"5m"`
+	// ConnectionIDSize is the size of the DTLS connection IDs of RFC 9146, which
+	// keep the DTLS sessions of the clients whose address changes. Connection
+	// IDs are not used if it is 0.
+	ConnectionIDSize int `env:"CONNECTION_ID_SIZE" envDefault:"8"`
+}
+
+// NewConfig parses the CoAP proxy settings from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
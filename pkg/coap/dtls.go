@@ -0,0 +1,50 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/pion/dtls/v3"
+)
+
+// clientAuth maps the client authentication policies of TLS to DTLS.
+var clientAuth = map[tls.ClientAuthType]dtls.ClientAuthType{
+	tls.NoClientCert:               dtls.NoClientCert,
+	tls.RequestClientCert:          dtls.RequestClientCert,
+	tls.RequireAnyClientCert:       dtls.RequireAnyClientCert,
+	tls.VerifyClientCertIfGiven:    dtls.VerifyClientCertIfGiven,
+	tls.RequireAndVerifyClientCert: dtls.RequireAndVerifyClientCert,
+}
+
+// dtlsConfig returns the DTLS configuration with the certificates, client CAs
+// and certificate verifications of the TLS configuration of the listener.
+func dtlsConfig(c *tls.Config, cidSize int) *dtls.Config {
+	cfg := &dtls.Config{
+		Certificates:          c.Certificates,
+		ClientAuth:            clientAuth[c.ClientAuth],
+		ClientCAs:             c.ClientCAs,
+		RootCAs:               c.RootCAs,
+		VerifyPeerCertificate: c.VerifyPeerCertificate,
+		ExtendedMasterSecret:  dtls.RequireExtendedMasterSecret,
+	}
+	if cidSize > 0 {
+		cfg.ConnectionIDGenerator = dtls.RandomCIDGenerator(cidSize)
+	}
+	return cfg
+}
+
+// clientCert returns the certificate of the client of the DTLS connection.
+func clientCert(conn *dtls.Conn) (x509.Certificate, error) {
+	state, ok := conn.ConnectionState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		return x509.Certificate{}, nil
+	}
+	cert, err := x509.ParseCertificate(state.PeerCertificates[0])
+	if err != nil {
+		return x509.Certificate{}, err
+	}
+	return *cert, nil
+}
@@ -0,0 +1,358 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Type is the type of a CoAP message.
+type Type uint8
+
+// Message types of RFC 7252.
+const (
+	Confirmable Type = iota
+	NonConfirmable
+	Acknowledgement
+	Reset
+)
+
+// TypeNames maps the message type to its name.
+var TypeNames = map[Type]string{
+	Confirmable:     "CON",
+	NonConfirmable:  "NON",
+	Acknowledgement: "ACK",
+	Reset:           "RST",
+}
+
+// Code is the method or response code of a CoAP message, with the class in
+// the upper three bits and the detail in the lower five.
+type Code uint8
+
+// Method and response codes of RFC 7252, and Too Many Requests of RFC 8516.
+const (
+	Empty  Code = 0x00
+	GET    Code = 0x01
+	POST   Code = 0x02
+	PUT    Code = 0x03
+	DELETE Code = 0x04
+
+	Created = Code(2<<5 | 1)
+	Deleted = Code(2<<5 | 2)
+	Valid   = Code(2<<5 | 3)
+	Changed = Code(2<<5 | 4)
+	Content = Code(2<<5 | 5)
+
+	BadRequest            = Code(4<<5 | 0)
+	Unauthorized          = Code(4<<5 | 1)
+	BadOption             = Code(4<<5 | 2)
+	Forbidden             = Code(4<<5 | 3)
+	NotFound              = Code(4<<5 | 4)
+	MethodNotAllowed      = Code(4<<5 | 5)
+	RequestEntityTooLarge = Code(4<<5 | 13)
+	TooManyRequests       = Code(4<<5 | 29)
+	InternalServerError   = Code(5<<5 | 0)
+	BadGateway            = Code(5<<5 | 2)
+	ServiceUnavailable    = Code(5<<5 | 3)
+	GatewayTimeout        = Code(5<<5 | 4)
+)
+
+// IsRequest returns true for the method codes.
+func (c Code) IsRequest() bool {
+	return c != Empty && c>>5 == 0
+}
+
+// String returns the code in the dotted class.detail notation.
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1F)
+}
+
+// Option numbers of RFC 7252 and RFC 7641 handled by the proxy.
+const (
+	OptionIfMatch       uint16 = 1
+	OptionURIHost       uint16 = 3
+	OptionETag          uint16 = 4
+	OptionIfNoneMatch   uint16 = 5
+	OptionObserve       uint16 = 6
+	OptionURIPort       uint16 = 7
+	OptionURIPath       uint16 = 11
+	OptionContentFormat uint16 = 12
+	OptionMaxAge        uint16 = 14
+	OptionURIQuery      uint16 = 15
+	OptionAccept        uint16 = 17
+	OptionProxyURI      uint16 = 35
+	OptionProxyScheme   uint16 = 39
+	OptionSize1         uint16 = 60
+)
+
+// Options carrying the MQTT credentials of the client, taken from the range of
+// RFC 7252 reserved for experimental use. They are elective, so that servers
+// not knowing them ignore them, and take precedence over the query parameters.
+const (
+	OptionClientID uint16 = 65000
+	OptionUsername uint16 = 65004
+	OptionPassword uint16 = 65008
+)
+
+// Observe values of the GET requests registering and deregistering an observer.
+const (
+	ObserveRegister   uint32 = 0
+	ObserveDeregister uint32 = 1
+)
+
+const (
+	version = 1
+	// payloadMarker separates the options from the payload.
+	payloadMarker  = 0xFF
+	maxTokenLength = 8
+	// maxMessageSize is the size of the largest UDP datagram.
+	maxMessageSize = 0xFFFF
+)
+
+var (
+	// ErrMalformedMessage indicates a message that does not follow RFC 7252.
+	ErrMalformedMessage = errors.New("malformed CoAP message")
+	// ErrUnsupportedVersion indicates a message of another version than CoAP 1.
+	ErrUnsupportedVersion = errors.New("unsupported CoAP version")
+	// ErrMessageTooLarge indicates a message which does not fit in a datagram.
+	ErrMessageTooLarge = errors.New("CoAP message too large")
+)
+
+// Option is an option of a CoAP message.
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// Message is a CoAP message.
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	// Options are packed in the order of their numbers, which decoded options are in.
+	Options []Option
+	Payload []byte
+}
+
+// Pack encodes the message.
+func (m Message) Pack() ([]byte, error) {
+	if len(m.Token) > maxTokenLength {
+		return nil, ErrMalformedMessage
+	}
+	b := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+16)
+	b[0] = version<<6 | byte(m.Type&0x03)<<4 | byte(len(m.Token))
+	b[1] = byte(m.Code)
+	b[2], b[3] = byte(m.MessageID>>8), byte(m.MessageID)
+	b = append(b, m.Token...)
+
+	opts := slices.Clone(m.Options)
+	slices.SortStableFunc(opts, func(a, b Option) int {
+		return int(a.Number) - int(b.Number)
+	})
+	var prev uint16
+	for _, o := range opts {
+		delta, length := int(o.Number-prev), len(o.Value)
+		if length > 0xFFFF+269 {
+			return nil, ErrMessageTooLarge
+		}
+		d, dExt := extend(delta)
+		l, lExt := extend(length)
+		b = append(b, d<<4|l)
+		b = append(b, dExt...)
+		b = append(b, lExt...)
+		b = append(b, o.Value...)
+		prev = o.Number
+	}
+	if len(m.Payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, m.Payload...)
+	}
+	if len(b) > maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	return b, nil
+}
+
+// extend returns the 4-bit nibble and the extended bytes encoding an option delta or length.
+func extend(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		v -= 269
+		return 14, []byte{byte(v >> 8), byte(v)}
+	}
+}
+
+// Decode decodes a CoAP message.
+func Decode(b []byte) (Message, error) {
+	if len(b) < 4 {
+		return Message{}, ErrMalformedMessage
+	}
+	if b[0]>>6 != version {
+		return Message{}, ErrUnsupportedVersion
+	}
+	m := Message{
+		Type:      Type(b[0] >> 4 & 0x03),
+		Code:      Code(b[1]),
+		MessageID: uint16(b[2])<<8 | uint16(b[3]),
+	}
+	tkl := int(b[0] & 0x0F)
+	if tkl > maxTokenLength || len(b) < 4+tkl {
+		return Message{}, ErrMalformedMessage
+	}
+	b = b[4:]
+	if tkl > 0 {
+		m.Token = clone(b[:tkl])
+	}
+	b = b[tkl:]
+	if m.Code == Empty && (tkl > 0 || len(b) > 0) {
+		return Message{}, ErrMalformedMessage
+	}
+
+	var number int
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			if len(b) == 1 {
+				return Message{}, ErrMalformedMessage
+			}
+			m.Payload = clone(b[1:])
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0F)
+		b = b[1:]
+		var err error
+		if delta, b, err = extended(delta, b); err != nil {
+			return Message{}, err
+		}
+		if length, b, err = extended(length, b); err != nil {
+			return Message{}, err
+		}
+		number += delta
+		if number > 0xFFFF || len(b) < length {
+			return Message{}, ErrMalformedMessage
+		}
+		m.Options = append(m.Options, Option{Number: uint16(number), Value: clone(b[:length])})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+// extended decodes the extended bytes of an option delta or length.
+func extended(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, ErrMalformedMessage
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, ErrMalformedMessage
+		}
+		return int(b[0])<<8 | int(b[1]) + 269, b[2:], nil
+	case 15:
+		return 0, nil, ErrMalformedMessage
+	default:
+		return v, b, nil
+	}
+}
+
+// Option returns the value of the first option with the given number.
+func (m Message) Option(number uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Values returns the values of the options with the given number, in order.
+func (m Message) Values(number uint16) [][]byte {
+	var values [][]byte
+	for _, o := range m.Options {
+		if o.Number == number {
+			values = append(values, o.Value)
+		}
+	}
+	return values
+}
+
+// Path returns the URI path of the request, with a leading slash.
+func (m Message) Path() string {
+	var sb strings.Builder
+	for _, seg := range m.Values(OptionURIPath) {
+		sb.WriteByte('/')
+		sb.Write(seg)
+	}
+	if sb.Len() == 0 {
+		return "/"
+	}
+	return sb.String()
+}
+
+// Query returns the value of the URI query parameter with the given name.
+func (m Message) Query(name string) (string, bool) {
+	for _, q := range m.Values(OptionURIQuery) {
+		k, v, _ := strings.Cut(string(q), "=")
+		if k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Observe returns the value of the Observe option.
+func (m Message) Observe() (uint32, bool) {
+	v, ok := m.Option(OptionObserve)
+	if !ok {
+		return 0, false
+	}
+	return decodeUint(v), true
+}
+
+// Critical returns the number of the first critical option of the message
+// the proxy does not process, which the request has to be rejected for.
+func (m Message) Critical() (uint16, bool) {
+	for _, o := range m.Options {
+		if o.Number&1 == 0 {
+			continue
+		}
+		switch o.Number {
+		case OptionURIHost, OptionURIPort, OptionURIPath, OptionURIQuery:
+			continue
+		}
+		return o.Number, true
+	}
+	return 0, false
+}
+
+// UintOption returns the option with the given number and the unsigned integer
+// value encoded in as few bytes as possible.
+func UintOption(number uint16, v uint32) Option {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return Option{Number: number, Value: b}
+}
+
+func decodeUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
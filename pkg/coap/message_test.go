@@ -0,0 +1,232 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package coap
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		desc string
+		msg  Message
+		want []byte
+	}{
+		{
+			desc: "empty",
+			msg:  Message{Type: Acknowledgement, Code: Empty, MessageID: 0x1234},
+			want: []byte{0x60, 0x00, 0x12, 0x34},
+		},
+		{
+			desc: "GET with Observe",
+			msg: Message{
+				Type: Confirmable, Code: GET, MessageID: 1, Token: []byte{0xab, 0xcd},
+				Options: []Option{
+					UintOption(OptionObserve, ObserveRegister),
+					{Number: OptionURIPath, Value: []byte("m")},
+					{Number: OptionURIPath, Value: []byte("t")},
+				},
+			},
+			want: []byte{0x42, 0x01, 0x00, 0x01, 0xab, 0xcd, 0x60, 0x51, 'm', 0x01, 't'},
+		},
+		{
+			desc: "POST with payload",
+			msg: Message{
+				Type: NonConfirmable, Code: POST, MessageID: 2,
+				Options: []Option{{Number: OptionURIPath, Value: []byte("t")}},
+				Payload: []byte("hi"),
+			},
+			want: []byte{0x50, 0x02, 0x00, 0x02, 0xb1, 't', 0xff, 'h', 'i'},
+		},
+		{
+			desc: "one byte extended delta and length",
+			msg: Message{
+				Type: Confirmable, Code: PUT, MessageID: 3,
+				Options: []Option{{Number: OptionProxyURI, Value: bytes.Repeat([]byte{'u'}, 20)}},
+			},
+			want: append([]byte{0x40, 0x03, 0x00, 0x03, 0xdd, 35 - 13, 20 - 13}, bytes.Repeat([]byte{'u'}, 20)...),
+		},
+		{
+			desc: "two byte extended delta and length",
+			msg: Message{
+				Type: Confirmable, Code: PUT, MessageID: 4,
+				Options: []Option{{Number: OptionClientID, Value: bytes.Repeat([]byte{'c'}, 300)}},
+			},
+			want: append([]byte{0x40, 0x03, 0x00, 0x04, 0xee, 0xfc, 0xdb, 0x00, 300 - 269}, bytes.Repeat([]byte{'c'}, 300)...),
+		},
+		{
+			desc: "response with options out of order",
+			msg: Message{
+				Type: Acknowledgement, Code: Content, MessageID: 5, Token: []byte{1},
+				Options: []Option{
+					{Number: OptionContentFormat, Value: []byte{50}},
+					UintOption(OptionObserve, 0x010203),
+				},
+				Payload: []byte("{}"),
+			},
+			want: []byte{0x61, 0x45, 0x00, 0x05, 0x01, 0x63, 0x01, 0x02, 0x03, 0x61, 50, 0xff, '{', '}'},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b, err := tc.msg.Pack()
+			if err != nil {
+				t.Fatalf("Pack() = %v", err)
+			}
+			if !bytes.Equal(b, tc.want) {
+				t.Errorf("Pack() = % x, want % x", b, tc.want)
+			}
+			got, err := Decode(b)
+			if err != nil {
+				t.Fatalf("Decode() = %v", err)
+			}
+			// Decoded options are in the order of their numbers.
+			want := tc.msg
+			want.Options = slices.Clone(tc.msg.Options)
+			slices.SortStableFunc(want.Options, func(a, b Option) int {
+				return int(a.Number) - int(b.Number)
+			})
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Decode() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestPackErrors(t *testing.T) {
+	cases := []struct {
+		desc string
+		msg  Message
+		err  error
+	}{
+		{desc: "token too long", msg: Message{Code: GET, Token: make([]byte, 9)}, err: ErrMalformedMessage},
+		{desc: "payload too large", msg: Message{Code: POST, Payload: make([]byte, maxMessageSize)}, err: ErrMessageTooLarge},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := tc.msg.Pack(); !errors.Is(err, tc.err) {
+				t.Errorf("Pack() = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	cases := []struct {
+		desc string
+		b    []byte
+		err  error
+	}{
+		{desc: "short header", b: []byte{0x40, 0x01, 0x00}, err: ErrMalformedMessage},
+		{desc: "version 2", b: []byte{0x80, 0x01, 0x00, 0x01}, err: ErrUnsupportedVersion},
+		{desc: "token length over 8", b: append([]byte{0x49, 0x01, 0x00, 0x01}, make([]byte, 9)...), err: ErrMalformedMessage},
+		{desc: "truncated token", b: []byte{0x44, 0x01, 0x00, 0x01, 0xab}, err: ErrMalformedMessage},
+		{desc: "empty message with token", b: []byte{0x41, 0x00, 0x00, 0x01, 0xab}, err: ErrMalformedMessage},
+		{desc: "empty message with payload", b: []byte{0x40, 0x00, 0x00, 0x01, 0xff, 'x'}, err: ErrMalformedMessage},
+		{desc: "payload marker without payload", b: []byte{0x40, 0x02, 0x00, 0x01, 0xff}, err: ErrMalformedMessage},
+		{desc: "option delta 15", b: []byte{0x40, 0x01, 0x00, 0x01, 0xf1, 'x'}, err: ErrMalformedMessage},
+		{desc: "option length 15", b: []byte{0x40, 0x01, 0x00, 0x01, 0x1f, 'x'}, err: ErrMalformedMessage},
+		{desc: "truncated one byte delta", b: []byte{0x40, 0x01, 0x00, 0x01, 0xd0}, err: ErrMalformedMessage},
+		{desc: "truncated two byte delta", b: []byte{0x40, 0x01, 0x00, 0x01, 0xe0, 0x01}, err: ErrMalformedMessage},
+		{desc: "truncated two byte length", b: []byte{0x40, 0x01, 0x00, 0x01, 0x1e, 0x01}, err: ErrMalformedMessage},
+		{desc: "option value over message", b: []byte{0x40, 0x01, 0x00, 0x01, 0xb3, 'a'}, err: ErrMalformedMessage},
+		{desc: "option number over 65535", b: []byte{0x40, 0x01, 0x00, 0x01, 0xe0, 0xff, 0xff, 0xe0, 0xff, 0xff}, err: ErrMalformedMessage},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if m, err := Decode(tc.b); !errors.Is(err, tc.err) {
+				t.Errorf("Decode(% x) = %+v, %v, want %v", tc.b, m, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestMessageOptions(t *testing.T) {
+	m := Message{
+		Code: GET,
+		Options: []Option{
+			UintOption(OptionObserve, ObserveDeregister),
+			{Number: OptionURIPath, Value: []byte("channels")},
+			{Number: OptionURIPath, Value: []byte("1")},
+			{Number: OptionURIQuery, Value: []byte("client_id=c1")},
+			{Number: OptionURIQuery, Value: []byte("flag")},
+		},
+	}
+	if got := m.Path(); got != "/channels/1" {
+		t.Errorf("Path() = %q, want %q", got, "/channels/1")
+	}
+	if got := (Message{}).Path(); got != "/" {
+		t.Errorf("Path() without path = %q, want %q", got, "/")
+	}
+	if v, ok := m.Query("client_id"); !ok || v != "c1" {
+		t.Errorf("Query(client_id) = %q, %t", v, ok)
+	}
+	if v, ok := m.Query("flag"); !ok || v != "" {
+		t.Errorf("Query(flag) = %q, %t", v, ok)
+	}
+	if _, ok := m.Query("username"); ok {
+		t.Error("Query(username) found")
+	}
+	if v, ok := m.Observe(); !ok || v != ObserveDeregister {
+		t.Errorf("Observe() = %d, %t, want %d", v, ok, ObserveDeregister)
+	}
+	if _, ok := (Message{}).Observe(); ok {
+		t.Error("Observe() found without the option")
+	}
+	if n, ok := m.Critical(); ok {
+		t.Errorf("Critical() = %d, want none", n)
+	}
+	m.Options = append(m.Options, Option{Number: OptionIfMatch})
+	if n, ok := m.Critical(); !ok || n != OptionIfMatch {
+		t.Errorf("Critical() = %d, %t, want %d", n, ok, OptionIfMatch)
+	}
+}
+
+func TestUintOption(t *testing.T) {
+	cases := []struct {
+		v    uint32
+		want []byte
+	}{
+		{v: 0, want: nil},
+		{v: 1, want: []byte{1}},
+		{v: 0x0100, want: []byte{1, 0}},
+		{v: 0xffffff, want: []byte{0xff, 0xff, 0xff}},
+	}
+	for _, tc := range cases {
+		o := UintOption(OptionObserve, tc.v)
+		if o.Number != OptionObserve || !bytes.Equal(o.Value, tc.want) {
+			t.Errorf("UintOption(%d) = % x, want % x", tc.v, o.Value, tc.want)
+		}
+		if got := decodeUint(o.Value); got != tc.v {
+			t.Errorf("decodeUint(% x) = %d, want %d", o.Value, got, tc.v)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	cases := []struct {
+		code    Code
+		str     string
+		request bool
+	}{
+		{code: Empty, str: "0.00"},
+		{code: GET, str: "0.01", request: true},
+		{code: DELETE, str: "0.04", request: true},
+		{code: Content, str: "2.05"},
+		{code: TooManyRequests, str: "4.29"},
+		{code: GatewayTimeout, str: "5.04"},
+	}
+	for _, tc := range cases {
+		if got := tc.code.String(); got != tc.str {
+			t.Errorf("String() = %s, want %s", got, tc.str)
+		}
+		if got := tc.code.IsRequest(); got != tc.request {
+			t.Errorf("%s IsRequest() = %t, want %t", tc.str, got, tc.request)
+		}
+	}
+}
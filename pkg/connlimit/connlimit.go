@@ -0,0 +1,199 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package connlimit limits the number of concurrent client connections of
+// a listener, in total, per source IP and per client identity, and the
+// number of concurrent TLS handshakes.
+package connlimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// Reasons of rejected connections.
+const (
+	ReasonListener      = "listener"
+	ReasonIP            = "ip"
+	ReasonUsername      = "username"
+	ReasonClientID      = "client_id"
+	ReasonTLSHandshakes = "tls_handshakes"
+)
+
+var (
+	// ErrTooManyConnections indicates the listener connection limit is reached.
+	ErrTooManyConnections = errors.New("too many connections")
+
+	// ErrTooManyConnectionsFromIP indicates the connection limit of the source IP is reached.
+	ErrTooManyConnectionsFromIP = errors.New("too many connections from IP")
+
+	// ErrTooManyConnectionsForUsername indicates the connection limit of the username is reached.
+	ErrTooManyConnectionsForUsername = errors.New("too many connections for username")
+
+	// ErrTooManyConnectionsForClientID indicates the connection limit of the client ID is reached.
+	ErrTooManyConnectionsForClientID = errors.New("too many connections for client ID")
+
+	// ErrTooManyHandshakes indicates the limit of concurrent TLS handshakes is reached.
+	ErrTooManyHandshakes = errors.New("too many TLS handshakes")
+)
+
+// Config holds the connection limits of a listener. Limit 0 disables the limit.
+type Config struct {
+	MaxConnections            int `env:"MAX_CONNECTIONS"               envDefault:"0"`
+	MaxConnectionsPerIP       int `env:"MAX_CONNECTIONS_PER_IP"        envDefault:"0"`
+	MaxConnectionsPerUsername int `env:"MAX_CONNECTIONS_PER_USERNAME"  envDefault:"0"`
+	MaxConnectionsPerClientID int `env:"MAX_CONNECTIONS_PER_CLIENT_ID" envDefault:"0"`
+	MaxTLSHandshakes          int `env:"MAX_TLS_HANDSHAKES"            envDefault:"0"`
+}
+
+// NewConfig parses the connection limits from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Reason returns the reason of the rejection for metrics and logs.
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, ErrTooManyConnectionsFromIP):
+		return ReasonIP
+	case errors.Is(err, ErrTooManyConnectionsForUsername):
+		return ReasonUsername
+	case errors.Is(err, ErrTooManyConnectionsForClientID):
+		return ReasonClientID
+	case errors.Is(err, ErrTooManyHandshakes):
+		return ReasonTLSHandshakes
+	default:
+		return ReasonListener
+	}
+}
+
+// Limiter counts the connections of a listener. Its methods are safe to call
+// on a nil Limiter, which does not limit connections.
+type Limiter struct {
+	config Config
+
+	mu          sync.Mutex
+	connections int
+	ips         map[string]int
+	usernames   map[string]int
+	clientIDs   map[string]int
+}
+
+// New returns a new Limiter, or nil if no limit is configured.
+func New(config Config) *Limiter {
+	if config == (Config{}) {
+		return nil
+	}
+	return &Limiter{
+		config:    config,
+		ips:       make(map[string]int),
+		usernames: make(map[string]int),
+		clientIDs: make(map[string]int),
+	}
+}
+
+// Accept counts a new connection from the given address. The returned
+// function must be called once the connection is closed.
+func (l *Limiter) Accept(addr net.Addr) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	ip := host(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.config.MaxConnections > 0 && l.connections >= l.config.MaxConnections {
+		return nil, ErrTooManyConnections
+	}
+	if err := acquire(l.ips, ip, l.config.MaxConnectionsPerIP, ErrTooManyConnectionsFromIP); err != nil {
+		return nil, err
+	}
+	l.connections++
+	return l.once(func() {
+		l.connections--
+		release(l.ips, ip, l.config.MaxConnectionsPerIP)
+	}), nil
+}
+
+// Identity counts a new session of the given username and client ID. An empty
+// username or client ID, as anonymous clients and the sessions of the HTTP
+// bridge have, is not limited, since it is shared by unrelated clients. The
+// returned function must be called once the session ends.
+func (l *Limiter) Identity(username, clientID string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := acquire(l.usernames, username, l.config.MaxConnectionsPerUsername, ErrTooManyConnectionsForUsername); err != nil {
+		return nil, err
+	}
+	if err := acquire(l.clientIDs, clientID, l.config.MaxConnectionsPerClientID, ErrTooManyConnectionsForClientID); err != nil {
+		release(l.usernames, username, l.config.MaxConnectionsPerUsername)
+		return nil, err
+	}
+	return l.once(func() {
+		release(l.usernames, username, l.config.MaxConnectionsPerUsername)
+		release(l.clientIDs, clientID, l.config.MaxConnectionsPerClientID)
+	}), nil
+}
+
+// MaxTLSHandshakes returns the limit of concurrent TLS handshakes.
+func (l *Limiter) MaxTLSHandshakes() int {
+	if l == nil {
+		return 0
+	}
+	return l.config.MaxTLSHandshakes
+}
+
+// once returns the function calling f under the lock at most once.
+func (l *Limiter) once(f func()) func() {
+	var o sync.Once
+	return func() {
+		o.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			f()
+		})
+	}
+}
+
+// acquire counts the key against the limit. Empty keys are not counted.
+func acquire(counts map[string]int, key string, limit int, err error) error {
+	if limit <= 0 || key == "" {
+		return nil
+	}
+	if counts[key] >= limit {
+		return err
+	}
+	counts[key]++
+	return nil
+}
+
+func release(counts map[string]int, key string, limit int) {
+	if limit <= 0 || key == "" {
+		return
+	}
+	if counts[key]--; counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+func host(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return h
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package connlimit
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIdentity(t *testing.T) {
+	l := New(Config{MaxConnectionsPerUsername: 1, MaxConnectionsPerClientID: 1})
+
+	release, err := l.Identity("alice", "device-1")
+	if err != nil {
+		t.Fatalf("Identity() = %v", err)
+	}
+	if _, err := l.Identity("alice", "device-2"); !errors.Is(err, ErrTooManyConnectionsForUsername) {
+		t.Errorf("second session of the username = %v, want %v", err, ErrTooManyConnectionsForUsername)
+	}
+	if _, err := l.Identity("bob", "device-1"); !errors.Is(err, ErrTooManyConnectionsForClientID) {
+		t.Errorf("second session of the client ID = %v, want %v", err, ErrTooManyConnectionsForClientID)
+	}
+	// The username counted by the rejected client ID is released.
+	release()
+	release()
+	second, err := l.Identity("alice", "device-1")
+	if err != nil {
+		t.Fatalf("Identity() after release = %v", err)
+	}
+	second()
+}
+
+func TestIdentityEmpty(t *testing.T) {
+	l := New(Config{MaxConnectionsPerUsername: 1, MaxConnectionsPerClientID: 1})
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		release, err := l.Identity("", "")
+		if err != nil {
+			t.Fatalf("anonymous session %d = %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		release()
+	}
+	if len(l.usernames) != 0 || len(l.clientIDs) != 0 {
+		t.Errorf("counts = %v %v, want none", l.usernames, l.clientIDs)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	release, err := l.Identity("alice", "device-1")
+	if err != nil {
+		t.Fatalf("Identity() = %v", err)
+	}
+	release()
+	if n := l.MaxTLSHandshakes(); n != 0 {
+		t.Errorf("MaxTLSHandshakes() = %d, want 0", n)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package connlimit
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/metrics"
+	mptls "github.com/absmach/mproxy/pkg/tls"
+)
+
+// handshakeTimeout limits the TLS handshakes run by the TLS listener.
+const handshakeTimeout = 10 * time.Second
+
+// NewListener returns the listener which closes the accepted connections over the
+// limits of limiter right away. Rejected connections are counted and logged.
+// If limiter is nil, l is returned unchanged.
+func NewListener(l net.Listener, limiter *Limiter, m *metrics.Listener, logger *slog.Logger) net.Listener {
+	if limiter == nil {
+		return l
+	}
+	return &listener{
+		Listener: l,
+		limiter:  limiter,
+		metrics:  m,
+		logger:   logger,
+	}
+}
+
+type listener struct {
+	net.Listener
+	limiter *Limiter
+	metrics *metrics.Listener
+	logger  *slog.Logger
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, err := l.limiter.Accept(c.RemoteAddr())
+		if err != nil {
+			reject(c, err, l.metrics, l.logger)
+			continue
+		}
+		return &conn{Conn: c, release: release}, nil
+	}
+}
+
+// conn releases its slot of the limiter on close.
+type conn struct {
+	net.Conn
+	release func()
+}
+
+func (c *conn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection.
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// NewTLSListener returns the listener accepting TLS connections of l. Without the
+// limit of concurrent TLS handshakes, it is the same as tls.NewListener. Otherwise,
+// handshakes are run by the listener at most the limit at a time, and connections
+// accepted while the limit is reached are rejected. Handshake failures are counted
+// and logged, and Accept only returns the connections with completed handshake.
+func NewTLSListener(l net.Listener, config *tls.Config, limiter *Limiter, m *metrics.Listener, logger *slog.Logger) net.Listener {
+	limit := limiter.MaxTLSHandshakes()
+	if limit <= 0 {
+		return tls.NewListener(l, config)
+	}
+	tl := &tlsListener{
+		Listener: l,
+		config:   config,
+		metrics:  m,
+		logger:   logger,
+		slots:    make(chan struct{}, limit),
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go tl.serve()
+	return tl
+}
+
+type tlsListener struct {
+	net.Listener
+	config  *tls.Config
+	metrics *metrics.Listener
+	logger  *slog.Logger
+
+	slots     chan struct{}
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *tlsListener) serve() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		select {
+		case l.slots <- struct{}{}:
+			go l.handshake(c)
+		default:
+			reject(c, ErrTooManyHandshakes, l.metrics, l.logger)
+		}
+	}
+}
+
+func (l *tlsListener) handshake(c net.Conn) {
+	tc := tls.Server(c, l.config)
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	err := tc.HandshakeContext(ctx)
+	cancel()
+	<-l.slots
+	if err != nil {
+		l.metrics.TLSHandshakeFailed(mptls.HandshakeFailure(err))
+		l.logger.Warn("TLS handshake failed", slog.String("remote", c.RemoteAddr().String()), slog.Any("error", err))
+		tc.Close()
+		return
+	}
+	select {
+	case l.conns <- tc:
+	case <-l.closed:
+		tc.Close()
+	}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+func reject(c net.Conn, err error, m *metrics.Listener, logger *slog.Logger) {
+	reason := Reason(err)
+	m.Rejected(reason)
+	logger.Warn("Rejected client connection", slog.String("remote", c.RemoteAddr().String()), slog.String("reason", reason), slog.Any("error", err))
+	c.Close()
+}
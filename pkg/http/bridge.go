@@ -0,0 +1,653 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/mqtt"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/absmach/mproxy/pkg/upstream"
+)
+
+const (
+	// keepAlive is the keep alive of the sessions, which the bridge pings
+	// twice per period.
+	keepAlive = 60 * time.Second
+	// unsubscribeTimeout bounds the wait for the UNSUBACK of a subscription being closed.
+	unsubscribeTimeout = 5 * time.Second
+)
+
+// errNoPacketID indicates a session with all the packet IDs in use.
+var errNoPacketID = errors.New("no packet ID available")
+
+// bridge publishes the requests to the broker over MQTT 5.0 sessions pooled
+// by client identity. The sessions are streamed over pipes as by the MQTT
+// proxy, so that the session hooks, limits, registry and tracing apply to them
+// as to MQTT clients. MQTT 5.0 is used for the reason codes of the
+// acknowledgements, which the responses reflect, so the broker has to support it.
+type bridge struct {
+	config      mproxy.Config
+	bridgeCfg   Config
+	handler     session.Handler
+	interceptor session.Interceptor
+	logger      *slog.Logger
+	upstreams   *upstream.Router
+
+	// clients holds the wait group of the pooled sessions.
+	clients sync.WaitGroup
+
+	mu   sync.Mutex
+	pool map[identity]*client
+	// polls holds the sessions of the long-poll subscriptions by ID.
+	polls   map[string]*client
+	closing bool
+}
+
+// identity identifies the pooled session of a client by its credentials
+// and the fingerprint of its certificate.
+type identity struct {
+	username string
+	password string
+	cert     [sha256.Size]byte
+}
+
+func newBridge(config mproxy.Config, bridgeCfg Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *bridge {
+	// A denied message is answered with the reason code of its acknowledgement,
+	// rather than ending the session the other requests of the identity share.
+	config.Session.PublishDenyPolicy = session.DropOnDeny
+	b := &bridge{
+		config:      config,
+		bridgeCfg:   bridgeCfg,
+		handler:     handler,
+		interceptor: interceptor,
+		logger:      logger,
+		pool:        make(map[identity]*client),
+		polls:       make(map[string]*client),
+	}
+	b.upstreams = upstream.NewRouter(config.Upstreams(), config.Upstream, b.dial, logger)
+	return b
+}
+
+func (b *bridge) dial(ctx context.Context, addr string) (net.Conn, error) {
+	return mqtt.DialTarget(ctx, addr, b.config)
+}
+
+// publish publishes the message in the pooled session of the client of the
+// request, and returns the response status reflecting the acknowledgement.
+func (b *bridge) publish(ctx context.Context, s *session.Session, pkt *packets.PublishPacket) int {
+	c, ok := b.acquire(s)
+	if !ok {
+		return http.StatusServiceUnavailable
+	}
+	defer b.release(c)
+	if t := b.bridgeCfg.PublishTimeout; t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	return c.publish(ctx, pkt)
+}
+
+// acquire returns the pooled session of the client identity, starting it if
+// there is none. It returns false once the bridge is closing.
+func (b *bridge) acquire(s *session.Session) (*client, bool) {
+	key := key(s)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing {
+		return nil, false
+	}
+	c := b.pool[key]
+	if c == nil || c.ended() {
+		c = newClient(b, key)
+		b.pool[key] = c
+		b.start(c, s)
+	}
+	c.refs++
+	return c, true
+}
+
+// start runs the session of the client of the request, with the lock held.
+func (b *bridge) start(c *client, s *session.Session) {
+	b.clients.Add(1)
+	go func(remote, local net.Addr, cert x509.Certificate) {
+		defer b.clients.Done()
+		c.run(remote, local, cert)
+	}(s.RemoteAddr, s.LocalAddr, s.Cert)
+}
+
+// key returns the identity of the client of the request.
+func key(s *session.Session) identity {
+	return identity{
+		username: s.Username,
+		password: string(s.Password),
+		cert:     sha256.Sum256(s.Cert.Raw),
+	}
+}
+
+func (b *bridge) release(c *client) {
+	b.mu.Lock()
+	c.refs--
+	c.used = time.Now()
+	b.mu.Unlock()
+}
+
+// expire removes the session from the pool, or the long-poll subscription,
+// once it has been idle for the idle timeout.
+func (b *bridge) expire(c *client) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.refs > 0 || time.Since(c.used) < b.bridgeCfg.IdleTimeout {
+		return false
+	}
+	b.drop(c)
+	return true
+}
+
+func (b *bridge) remove(c *client) {
+	b.mu.Lock()
+	b.drop(c)
+	b.mu.Unlock()
+}
+
+// drop removes the session from the pool, or the long-poll subscription, with the lock held.
+func (b *bridge) drop(c *client) {
+	if b.pool[c.key] == c {
+		delete(b.pool, c.key)
+	}
+	if c.poll != "" && b.polls[c.poll] == c {
+		delete(b.polls, c.poll)
+	}
+}
+
+// close stops pooling sessions, and drains the pooled sessions.
+func (b *bridge) close() {
+	b.mu.Lock()
+	b.closing = true
+	b.mu.Unlock()
+	cfg := b.config.Session
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	total, forced := cfg.Tracker.Drain(ctx, cfg.DrainGracePeriod)
+	b.clients.Wait()
+	if total == 0 {
+		return
+	}
+	b.logger.Info("Drained sessions", slog.String("address", b.config.Address), slog.Int("sessions", total), slog.Int("force_closed", forced))
+}
+
+// client is the MQTT 5.0 session of a client identity, either pooled to publish
+// or subscribed for an SSE stream or long-poll subscription. The packets of
+// the concurrent requests are written to the session at once, each with a
+// packet ID of its own.
+type client struct {
+	bridge *bridge
+	key    identity
+	// topics are the topic filters of the subscription, and messages the
+	// messages of the subscription waiting to be delivered, nil for the
+	// pooled sessions. poll is the ID of the long-poll subscription.
+	topics   []string
+	messages chan *packets.PublishPacket
+	poll     string
+	// dropped counts the messages of the subscription dropped since the
+	// client was last told, once the queue of the messages is full.
+	dropped atomic.Uint64
+	// closing is closed once the session is being disconnected.
+	closing   chan struct{}
+	closeOnce sync.Once
+	// conn is the client end of the pipe of the session, and sconn the session end.
+	conn, sconn net.Conn
+	// connected is closed once the broker accepts the session, and done once the session ends.
+	connected chan struct{}
+	done      chan struct{}
+
+	// refs and used count the requests using the session and the time it was
+	// last used, guarded by the lock of the bridge.
+	refs int
+	used time.Time
+
+	// wmu serializes the writes to the session. It is never held by the
+	// reader of the session, which the session may be waiting for.
+	wmu sync.Mutex
+
+	mu sync.Mutex
+	// pending holds the channels of the acknowledgements by packet ID.
+	pending map[uint16]chan int
+	nextID  uint16
+	// failure is the response status of the requests left once the session ends.
+	failure int
+	// subscribed is set once the broker grants the subscription.
+	subscribed bool
+}
+
+func newClient(b *bridge, key identity) *client {
+	conn, sconn := net.Pipe()
+	return &client{
+		bridge:    b,
+		key:       key,
+		conn:      conn,
+		sconn:     sconn,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+		closing:   make(chan struct{}),
+		used:      time.Now(),
+		pending:   make(map[uint16]chan int),
+	}
+}
+
+// run streams the session until it ends, or until it is idle for the idle
+// timeout. The session outlives the requests which started it.
+func (c *client) run(remote, local net.Addr, cert x509.Certificate) {
+	b := c.bridge
+	in := sessionConn{Conn: c.sconn, local: local, remote: remote}
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		defer c.sconn.Close()
+		if err := session.StreamDial(context.Background(), in, b.upstreams.Dial, b.handler, b.interceptor, cert, b.config.Session); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+			b.logger.Warn(err.Error())
+		}
+	}()
+	go c.read()
+
+	ping := time.NewTicker(keepAlive / 2)
+	var idle <-chan time.Time
+	if t := b.bridgeCfg.IdleTimeout; t > 0 {
+		ticker := time.NewTicker(t / 2)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	if err := c.write(c.connect()); err != nil {
+		c.end(http.StatusBadGateway)
+	}
+loop:
+	for {
+		select {
+		case <-c.done:
+			break loop
+		case <-ping.C:
+			if err := c.write(packets.NewControlPacket(packets.Pingreq)); err != nil {
+				c.end(http.StatusBadGateway)
+			}
+		case <-idle:
+			if b.expire(c) {
+				c.disconnect()
+			}
+		}
+	}
+	ping.Stop()
+	b.remove(c)
+	c.conn.Close()
+	<-streamed
+}
+
+func (c *client) connect() *packets.ConnectPacket {
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = packets.V5
+	cp.CleanSession = true
+	cp.Keepalive = uint16(keepAlive / time.Second)
+	cp.Username = c.key.username
+	cp.UsernameFlag = c.key.username != ""
+	cp.Password = []byte(c.key.password)
+	cp.PasswordFlag = c.key.password != ""
+	return cp
+}
+
+// read reads the packets of the session, passing the acknowledgements on
+// to the requests waiting for them, and the messages on to the subscription.
+func (c *client) read() {
+	for {
+		pkt, err := packets.ReadPacket(c.conn, packets.V5)
+		if err != nil {
+			c.end(http.StatusBadGateway)
+			return
+		}
+		switch pkt := pkt.(type) {
+		case *packets.ConnackPacket:
+			if pkt.ReturnCode >= packets.UnspecifiedError {
+				c.end(connackStatus(pkt.ReturnCode))
+				return
+			}
+			close(c.connected)
+		case *packets.PubackPacket:
+			c.ack(pkt.MessageID, reasonStatus(pkt.ReasonCode))
+		case *packets.PubrecPacket:
+			if pkt.ReasonCode >= packets.UnspecifiedError {
+				c.ack(pkt.MessageID, reasonStatus(pkt.ReasonCode))
+				continue
+			}
+			pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubrel.MessageID = pkt.MessageID
+			c.reply(pubrel)
+		case *packets.PubcompPacket:
+			c.ack(pkt.MessageID, reasonStatus(pkt.ReasonCode))
+		case *packets.SubackPacket:
+			c.ack(pkt.MessageID, subackStatus(pkt.ReturnCodes))
+		case *packets.UnsubackPacket:
+			c.ack(pkt.MessageID, http.StatusOK)
+		case *packets.PublishPacket:
+			if c.messages == nil {
+				continue
+			}
+			// Messages arriving once the subscription is being closed are not delivered.
+			select {
+			case c.messages <- pkt:
+			case <-c.closing:
+			case <-c.done:
+			default:
+				c.overflow(pkt)
+			}
+		case *packets.PubrelPacket:
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = pkt.MessageID
+			c.reply(pubcomp)
+		case *packets.DisconnectPacket:
+			status := http.StatusBadGateway
+			if pkt.ReasonCode >= packets.UnspecifiedError {
+				status = reasonStatus(pkt.ReasonCode)
+			}
+			c.end(status)
+			return
+		}
+	}
+}
+
+// publish publishes the message once the session is connected, and waits
+// for its acknowledgement. QoS 0 messages are accepted once written.
+func (c *client) publish(ctx context.Context, pkt *packets.PublishPacket) int {
+	if status := c.ready(ctx); status != http.StatusOK {
+		return status
+	}
+	if pkt.Qos == 0 {
+		if err := c.write(pkt); err != nil {
+			c.bridge.logger.Warn("Failed to publish", slog.String("topic", pkt.TopicName), slog.Any("error", err))
+			return http.StatusBadGateway
+		}
+		return http.StatusAccepted
+	}
+	id, ack, err := c.expect()
+	if err != nil {
+		c.bridge.logger.Warn("Failed to publish", slog.String("topic", pkt.TopicName), slog.Any("error", err))
+		return http.StatusServiceUnavailable
+	}
+	defer c.forget(id)
+	pkt.MessageID = id
+	return c.await(ctx, pkt, ack)
+}
+
+// subscribe subscribes to the topics once the session is connected, and
+// waits for the broker to grant all of them.
+func (c *client) subscribe(ctx context.Context, qos byte) int {
+	if status := c.ready(ctx); status != http.StatusOK {
+		return status
+	}
+	pkt := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	pkt.Topics = c.topics
+	for range c.topics {
+		pkt.Options = append(pkt.Options, qos)
+	}
+	id, ack, err := c.expect()
+	if err != nil {
+		c.bridge.logger.Warn("Failed to subscribe", slog.Any("topics", c.topics), slog.Any("error", err))
+		return http.StatusServiceUnavailable
+	}
+	defer c.forget(id)
+	pkt.MessageID = id
+	status := c.await(ctx, pkt, ack)
+	if status == http.StatusOK {
+		c.mu.Lock()
+		c.subscribed = true
+		c.mu.Unlock()
+	}
+	return status
+}
+
+// disconnect ends the session cleanly, so that the session hooks are called.
+// The topics of the subscription, if granted, are unsubscribed from first.
+func (c *client) disconnect() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.mu.Lock()
+		subscribed := c.subscribed
+		c.mu.Unlock()
+		if subscribed && !c.ended() {
+			c.unsubscribe()
+		}
+		if !c.ended() {
+			_ = c.write(packets.NewControlPacket(packets.Disconnect))
+		}
+		c.end(http.StatusServiceUnavailable)
+	})
+}
+
+// unsubscribe unsubscribes from the topics of the subscription, and waits
+// for the UNSUBACK for up to the unsubscribe timeout.
+func (c *client) unsubscribe() {
+	id, ack, err := c.expect()
+	if err != nil {
+		return
+	}
+	defer c.forget(id)
+	ctx, cancel := context.WithTimeout(context.Background(), unsubscribeTimeout)
+	defer cancel()
+	pkt := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	pkt.Topics = c.topics
+	pkt.MessageID = id
+	c.await(ctx, pkt, ack)
+}
+
+// overflow drops the message of a subscription whose client does not keep up
+// with the broker, rather than waiting for the client, which would stall the
+// reader and the session with it. The message is acknowledged all the same,
+// so that the broker goes on sending the next ones.
+func (c *client) overflow(pkt *packets.PublishPacket) {
+	if c.dropped.Add(1) == 1 {
+		c.bridge.logger.Warn("Dropped messages of subscription with full queue", slog.Any("topics", c.topics), slog.String("username", c.key.username))
+	}
+	go c.delivered(pkt)
+}
+
+// delivered acknowledges the message of the subscription once it is delivered to the client.
+func (c *client) delivered(pkt *packets.PublishPacket) {
+	switch pkt.Qos {
+	case 1:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = pkt.MessageID
+		_ = c.write(puback)
+	case 2:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = pkt.MessageID
+		_ = c.write(pubrec)
+	}
+}
+
+// ready waits for the session to be connected, and returns the response
+// status of the requests which cannot use it otherwise.
+func (c *client) ready(ctx context.Context) int {
+	select {
+	case <-c.connected:
+		return http.StatusOK
+	case <-c.done:
+		return c.failure
+	case <-ctx.Done():
+		return http.StatusGatewayTimeout
+	}
+}
+
+// expect returns a packet ID not in use, and the channel of the acknowledgement
+// of the packet, which is forgotten once the caller is done with it.
+func (c *client) expect() (uint16, chan int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.packetID()
+	if err != nil {
+		return 0, nil, err
+	}
+	ack := make(chan int, 1)
+	c.pending[id] = ack
+	return id, ack, nil
+}
+
+// await writes the packet and waits for its acknowledgement.
+func (c *client) await(ctx context.Context, pkt packets.ControlPacket, ack chan int) int {
+	if err := c.write(pkt); err != nil {
+		c.bridge.logger.Warn("Failed to write to session", slog.String("packet", packets.PacketNames[pkt.Header().MessageType]), slog.Any("error", err))
+		return http.StatusBadGateway
+	}
+	select {
+	case status := <-ack:
+		return status
+	case <-c.done:
+		select {
+		case status := <-ack:
+			return status
+		default:
+			return c.failure
+		}
+	case <-ctx.Done():
+		return http.StatusGatewayTimeout
+	}
+}
+
+// ack passes the response status on to the request waiting for the acknowledgement.
+func (c *client) ack(id uint16, status int) {
+	c.mu.Lock()
+	ch := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if ch != nil {
+		ch <- status
+	}
+}
+
+func (c *client) forget(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// packetID returns a packet ID not in use, 0 being reserved, with the lock held.
+func (c *client) packetID() (uint16, error) {
+	if len(c.pending) >= math.MaxUint16 {
+		return 0, errNoPacketID
+	}
+	for {
+		c.nextID++
+		if _, ok := c.pending[c.nextID]; c.nextID != 0 && !ok {
+			return c.nextID, nil
+		}
+	}
+}
+
+// end ends the session, failing the requests left with the status.
+func (c *client) end(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+	default:
+		c.failure = status
+		close(c.done)
+	}
+}
+
+func (c *client) ended() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// reply writes the reply to a packet of the session without blocking the
+// reader, which the session may be waiting for to write to the pipe.
+func (c *client) reply(pkt packets.ControlPacket) {
+	go func() {
+		_ = c.write(pkt)
+	}()
+}
+
+// write writes the packet to the session.
+func (c *client) write(pkt packets.ControlPacket) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return pkt.Write(c.conn, packets.V5)
+}
+
+// reasonStatus maps the reason code of the acknowledgement of a packet,
+// or of the DISCONNECT ending the session, to the response status.
+func reasonStatus(code byte) int {
+	switch code {
+	case packets.Success, packets.NoMatchingSubscribers:
+		return http.StatusOK
+	case packets.NotAuthorized:
+		return http.StatusForbidden
+	case packets.TopicNameInvalid, packets.TopicFilterInvalid, packets.PayloadFormatInvalid:
+		return http.StatusBadRequest
+	case packets.PacketTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case packets.MessageRateTooHigh, packets.QuotaExceeded:
+		return http.StatusTooManyRequests
+	case packets.ServerUnavailable, packets.ServerBusy, packets.ServerShuttingDown:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// subackStatus returns the response status of the first topic the SUBACK
+// does not grant, if any.
+func subackStatus(codes []byte) int {
+	for _, code := range codes {
+		if code >= packets.UnspecifiedError {
+			return reasonStatus(code)
+		}
+	}
+	return http.StatusOK
+}
+
+// connackStatus maps the reason code of a refused CONNECT to the response status.
+func connackStatus(code byte) int {
+	switch code {
+	case packets.BadUserNameOrPassword, packets.NotAuthorized, packets.Banned, packets.BadAuthenticationMethod, packets.ClientIdentifierNotValid:
+		return http.StatusUnauthorized
+	case packets.ConnectionRateExceeded, packets.QuotaExceeded:
+		return http.StatusTooManyRequests
+	case packets.ServerUnavailable, packets.ServerBusy, packets.ServerShuttingDown, packets.UseAnotherServer, packets.ServerMoved:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// sessionConn is the session end of the pipe of a pooled session, with the
+// addresses of the client which started it and of the proxy.
+type sessionConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c sessionConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c sessionConn) RemoteAddr() net.Addr {
+	return c.remote
+}
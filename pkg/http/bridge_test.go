@@ -0,0 +1,262 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+// post publishes the body to the path with the credentials and returns the response status.
+func post(t *testing.T, url, username, body string, header http.Header) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.SetBasicAuth(username, "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPublish(t *testing.T) {
+	cases := []struct {
+		desc   string
+		path   string
+		code   byte
+		status int
+		qos    byte
+		retain bool
+	}{
+		{desc: "QoS 0", path: "/messages/a/b?qos=0", status: http.StatusAccepted},
+		{desc: "QoS 1", path: "/messages/a/b?qos=1", status: http.StatusOK, qos: 1},
+		{desc: "QoS 2", path: "/messages/a/b?qos=2", status: http.StatusOK, qos: 2},
+		{desc: "default QoS and retain", path: "/messages/a/b", status: http.StatusOK, qos: 1},
+		{desc: "retain", path: "/messages/a/b?retain=true", status: http.StatusOK, qos: 1, retain: true},
+		{desc: "no matching subscribers", path: "/messages/a/b?qos=1", code: packets.NoMatchingSubscribers, status: http.StatusOK, qos: 1},
+		{desc: "not authorized", path: "/messages/a/b?qos=1", code: packets.NotAuthorized, status: http.StatusForbidden, qos: 1},
+		{desc: "topic name invalid", path: "/messages/a/b?qos=1", code: packets.TopicNameInvalid, status: http.StatusBadRequest, qos: 1},
+		{desc: "quota exceeded", path: "/messages/a/b?qos=2", code: packets.QuotaExceeded, status: http.StatusTooManyRequests, qos: 2},
+		{desc: "server busy", path: "/messages/a/b?qos=1", code: packets.ServerBusy, status: http.StatusServiceUnavailable, qos: 1},
+		{desc: "unspecified error", path: "/messages/a/b?qos=1", code: packets.UnspecifiedError, status: http.StatusBadGateway, qos: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := newBroker(t)
+			b.codes["a/b"] = tc.code
+			srv := newServer(t, b, &handler{}, Config{QoS: 1, PublishTimeout: testTimeout})
+			if status := post(t, srv.URL+tc.path, "user", "m", http.Header{"Content-Type": {"text/plain"}}); status != tc.status {
+				t.Errorf("status = %d, want %d", status, tc.status)
+			}
+			pub := b.expect(packets.Publish).(*packets.PublishPacket)
+			if pub.TopicName != "a/b" || string(pub.Payload) != "m" || pub.Qos != tc.qos || pub.Retain != tc.retain {
+				t.Errorf("PUBLISH = %s, want QoS %d and retain %t", pub, tc.qos, tc.retain)
+			}
+			if pub.Properties == nil || pub.Properties.ContentType != "text/plain" {
+				t.Errorf("PUBLISH properties = %+v, want content type text/plain", pub.Properties)
+			}
+		})
+	}
+}
+
+func TestPublishInvalid(t *testing.T) {
+	cases := []struct {
+		desc   string
+		path   string
+		status int
+	}{
+		{desc: "no topic", path: "/messages/", status: http.StatusBadRequest},
+		{desc: "single level wildcard", path: "/messages/a/+", status: http.StatusBadRequest},
+		{desc: "multi level wildcard", path: "/messages/a/%23", status: http.StatusBadRequest},
+		{desc: "invalid QoS", path: "/messages/a?qos=3", status: http.StatusBadRequest},
+		{desc: "invalid retain", path: "/messages/a?retain=maybe", status: http.StatusBadRequest},
+	}
+	b := newBroker(t)
+	h := &handler{}
+	srv := newServer(t, b, h, Config{PublishTimeout: testTimeout})
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if status := post(t, srv.URL+tc.path, "user", "m", nil); status != tc.status {
+				t.Errorf("status = %d, want %d", status, tc.status)
+			}
+		})
+	}
+	// Invalid requests never reach the broker nor the hooks.
+	if calls := h.called(); len(calls) != 0 {
+		t.Errorf("hooks called for invalid requests: %v", calls)
+	}
+}
+
+func TestPublishHooks(t *testing.T) {
+	b := newBroker(t)
+	h := &handler{}
+	srv := newServer(t, b, h, Config{QoS: 1, PublishTimeout: testTimeout})
+	if status := post(t, srv.URL+"/messages/t", "user", "m", nil); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	h.wait(t, "Publish")
+	calls := slices.DeleteFunc(h.called(), func(name string) bool {
+		return name != "AuthConnect" && name != "AuthPublish" && name != "Publish"
+	})
+	if want := []string{"AuthConnect", "AuthPublish", "Publish"}; !slices.Equal(calls, want) {
+		t.Errorf("hooks = %v, want %v", calls, want)
+	}
+}
+
+func TestPublishDenied(t *testing.T) {
+	cases := []struct {
+		desc   string
+		err    error
+		status int
+	}{
+		{desc: "denied", err: errors.New("denied"), status: http.StatusForbidden},
+		{desc: "denied with reason code", err: session.NewError(packets.QuotaExceeded, errors.New("quota")), status: http.StatusTooManyRequests},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := newBroker(t)
+			h := &handler{authPublish: func(topic string) error {
+				if topic == "denied" {
+					return tc.err
+				}
+				return nil
+			}}
+			// The pooled sessions drop denied messages whatever the publish deny policy.
+			srv := newServer(t, b, h, Config{QoS: 1, PublishTimeout: testTimeout})
+			if status := post(t, srv.URL+"/messages/denied", "user", "m", nil); status != tc.status {
+				t.Errorf("denied status = %d, want %d", status, tc.status)
+			}
+			if status := post(t, srv.URL+"/messages/allowed", "user", "m", nil); status != http.StatusOK {
+				t.Errorf("allowed status = %d, want %d", status, http.StatusOK)
+			}
+			// The denied message did not end the session the requests share.
+			connects := 0
+			for len(b.received) > 0 {
+				switch p := (<-b.received).(type) {
+				case *packets.ConnectPacket:
+					connects++
+				case *packets.PublishPacket:
+					if p.TopicName != "allowed" {
+						t.Errorf("broker received %q, want only the allowed message", p.TopicName)
+					}
+				}
+			}
+			if connects != 1 {
+				t.Errorf("broker received %d CONNECT, want 1", connects)
+			}
+		})
+	}
+}
+
+func TestPublishPool(t *testing.T) {
+	b := newBroker(t)
+	srv := newServer(t, b, &handler{}, Config{QoS: 1, PublishTimeout: testTimeout})
+
+	// The concurrent requests of an identity share its session.
+	var wg sync.WaitGroup
+	for _, username := range []string{"a", "a", "a", "b", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status := post(t, srv.URL+"/messages/t", username, "m", nil); status != http.StatusOK {
+				t.Errorf("%s status = %d, want %d", username, status, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	if status := post(t, srv.URL+"/messages/t", "a", "m", nil); status != http.StatusOK {
+		t.Errorf("status = %d, want %d", status, http.StatusOK)
+	}
+
+	var users []string
+	publishes := 0
+	for len(b.received) > 0 {
+		switch p := (<-b.received).(type) {
+		case *packets.ConnectPacket:
+			if p.ProtocolVersion != packets.V5 || string(p.Password) != "pass" {
+				t.Errorf("CONNECT = %s, want MQTT 5.0 with the password", p)
+			}
+			users = append(users, p.Username)
+		case *packets.PublishPacket:
+			publishes++
+		}
+	}
+	slices.Sort(users)
+	if want := []string{"a", "b"}; !slices.Equal(users, want) {
+		t.Errorf("sessions of %v, want one for each of %v", users, want)
+	}
+	if publishes != 6 {
+		t.Errorf("broker received %d PUBLISH, want 6", publishes)
+	}
+}
+
+func TestPublishIdle(t *testing.T) {
+	b := newBroker(t)
+	h := &handler{}
+	srv := newServer(t, b, h, Config{QoS: 1, PublishTimeout: testTimeout, IdleTimeout: 50 * time.Millisecond})
+	if status := post(t, srv.URL+"/messages/t", "user", "m", nil); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	// The pooled session ends once idle, and the next request starts another one.
+	b.expect(packets.Disconnect)
+	h.wait(t, "Disconnect")
+	if status := post(t, srv.URL+"/messages/t", "user", "m", nil); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	b.expect(packets.Connect)
+}
+
+func TestPublishUnavailable(t *testing.T) {
+	b := newBroker(t)
+	b.connack = packets.ServerUnavailable
+	srv := newServer(t, b, &handler{}, Config{QoS: 1, PublishTimeout: testTimeout})
+	if status := post(t, srv.URL+"/messages/t", "user", "m", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestPacketIDExhausted(t *testing.T) {
+	b := &bridge{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	c := newClient(b, identity{})
+	defer c.conn.Close()
+	defer c.sconn.Close()
+	close(c.connected)
+	for id := 1; id <= math.MaxUint16; id++ {
+		c.pending[uint16(id)] = make(chan int, 1)
+	}
+	if _, _, err := c.expect(); !errors.Is(err, errNoPacketID) {
+		t.Fatalf("expect() = %v, want %v", err, errNoPacketID)
+	}
+	pkt := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pkt.TopicName = "t"
+	pkt.Qos = 1
+	if status := c.publish(context.Background(), pkt); status != http.StatusServiceUnavailable {
+		t.Errorf("publish() = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// A packet ID is available again once forgotten.
+	c.forget(42)
+	if id, _, err := c.expect(); err != nil || id != 42 {
+		t.Errorf("expect() = %d, %v, want 42", id, err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	// ErrInvalidMode indicates an unknown HTTP proxy mode value.
+	ErrInvalidMode = errors.New("invalid HTTP proxy mode")
+	// ErrInvalidQoS indicates a QoS other than 0, 1 or 2.
+	ErrInvalidQoS = errors.New("invalid QoS")
+)
+
+// Mode selects how the HTTP proxy forwards the requests.
+type Mode int
+
+const (
+	// ProxyMode reverse proxies the requests to the target HTTP server.
+	ProxyMode Mode = iota
+	// BridgeMode publishes the POST requests to the target MQTT broker.
+	BridgeMode
+)
+
+// UnmarshalText parses the mode from its name.
+func (m *Mode) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "proxy":
+		*m = ProxyMode
+	case "bridge":
+		*m = BridgeMode
+	default:
+		return ErrInvalidMode
+	}
+	return nil
+}
+
+func (m Mode) String() string {
+	switch m {
+	case BridgeMode:
+		return "bridge"
+	default:
+		return "proxy"
+	}
+}
+
+// Config holds the settings of the HTTP proxy.
+type Config struct {
+	Mode Mode `env:"MODE" envDefault:"proxy"`
+	// QoS and Retain are the flags of the messages published by the bridge,
+	// unless the request sets them with the qos and retain query parameters.
+	// QoS is also the QoS of the subscriptions.
+	QoS    byte `env:"BRIDGE_QOS" envDefault:"1"`
+	Retain bool `env:"BRIDGE_RETAIN" envDefault:"false"`
+	// IdleTimeout ends the pooled MQTT session of a client identity once it
+	// has published nothing for the timeout, and the long-poll subscriptions
+	// not polled for the timeout. 0 keeps them open.
+	IdleTimeout time.Duration `env:"BRIDGE_IDLE_TIMEOUT" envDefault:"1m"`
+	// PublishTimeout limits the time the bridge waits for the broker to
+	// connect and acknowledge a message or subscription, 0 disables it.
+	PublishTimeout time.Duration `env:"BRIDGE_PUBLISH_TIMEOUT" envDefault:"10s"`
+	// PollTimeout is the time a long-poll waits for messages, 0 waits until
+	// the client goes away.
+	PollTimeout time.Duration `env:"BRIDGE_POLL_TIMEOUT" envDefault:"30s"`
+}
+
+// NewConfig parses the HTTP proxy settings from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	if c.QoS > 2 {
+		return Config{}, ErrInvalidQoS
+	}
+	return c, nil
+}
@@ -6,7 +6,6 @@ package http
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,32 +14,69 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/proxyproto"
 	"github.com/absmach/mproxy/pkg/session"
 	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/tracing"
+	"github.com/absmach/mproxy/pkg/unixsock"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
 const contentType = "application/json"
 
-// ErrMissingAuthentication returned when no basic or Authorization header is set.
-var ErrMissingAuthentication = errors.New("missing authorization")
+var (
+	// ErrMissingAuthentication returned when no basic or Authorization header is set.
+	ErrMissingAuthentication = errors.New("missing authorization")
+	// ErrMethodNotAllowed indicates a request other than POST in bridge mode,
+	// or other than GET and DELETE to the subscriptions.
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	// ErrInvalidTopic indicates a request path which is not a valid topic name in bridge mode.
+	ErrInvalidTopic = errors.New("invalid topic")
+	// ErrPublishFailed indicates a message the broker or the session hooks did not accept in bridge mode.
+	ErrPublishFailed = errors.New("failed to publish")
+)
 
-func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Metrics and health endpoints are served directly.
-	if r.URL.Path == "/metrics" || r.URL.Path == "/health" {
-		p.target.ServeHTTP(w, r)
-		return
-	}
+// connKey is the context key of the client connection of a request.
+type connKey struct{}
 
+// connInfo describes the client connection of the requests.
+type connInfo struct {
+	id   string
+	cred *unixsock.Credentials
+}
+
+func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !strings.HasPrefix(r.URL.Path, p.config.PathPrefix) {
 		http.NotFound(w, r)
 		return
 	}
 
+	// Continue the trace of the client, if any, and pass it on to the target.
+	ctx, span := tracing.Tracer().Start(tracing.Extract(r.Context(), r.Header), "HTTP "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("mproxy.listener", p.config.Session.Listener),
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.RequestURI),
+			attribute.String("net.peer.addr", r.RemoteAddr),
+		))
+	defer span.End()
+	r = r.WithContext(ctx)
+	tracing.Inject(ctx, r.Header)
+	w = &statusRecorder{ResponseWriter: w, span: span}
+
 	username, password, ok := r.BasicAuth()
 	switch {
 	case ok:
@@ -53,12 +89,41 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s := &session.Session{
-		Password: []byte(password),
-		Username: username,
+		Password:   []byte(password),
+		Username:   username,
+		Listener:   p.config.Session.Listener,
+		Transport:  session.HTTP,
+		RemoteAddr: remoteAddr(r),
 	}
-	ctx := session.NewContext(r.Context(), s)
-	payload, err := io.ReadAll(r.Body)
+	if ci, ok := r.Context().Value(connKey{}).(connInfo); ok {
+		s.ConnID, s.PeerCredentials = ci.id, ci.cred
+	} else {
+		// Requests served without Listen get an ID of their own.
+		s.ConnID = uuid.NewString()
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		s.LocalAddr = addr
+	}
+	if r.TLS != nil {
+		s.TLS = session.NewTLSInfo(*r.TLS)
+		if len(r.TLS.PeerCertificates) > 0 {
+			s.Cert = *r.TLS.PeerCertificates[0]
+		}
+	}
+	span.SetAttributes(attribute.String("mproxy.conn_id", s.ConnID))
+	ctx = session.NewContext(ctx, s)
+	body := r.Body
+	if limit := p.config.Session.MaxPacketSize; limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+	payload, err := io.ReadAll(body)
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			encodeError(w, http.StatusRequestEntityTooLarge, err)
+			p.logger.Warn("Request body too large", slog.Int64("limit", maxBytesErr.Limit))
+			return
+		}
 		encodeError(w, http.StatusBadRequest, err)
 		p.logger.Error("Failed to read body", slog.Any("error", err))
 		return
@@ -69,6 +134,16 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.bridge != nil {
+		// POST requests publish to any topic, subscribe included.
+		if p.topic(r) == subscribePath && r.Method != http.MethodPost {
+			p.subscribe(ctx, w, r, s)
+			return
+		}
+		p.publish(ctx, w, r, s, payload)
+		return
+	}
+
 	// r.Body is reset to ensure it can be safely copied by httputil.ReverseProxy.
 	// no close method is required since NopClose Close() always returns nill.
 	r.Body = io.NopCloser(bytes.NewBuffer(payload))
@@ -85,6 +160,88 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p.target.ServeHTTP(w, r)
 }
 
+// publish publishes the payload of the POST request in bridge mode, to the
+// topic of the path after the path prefix, with the QoS and retain flags of the
+// qos and retain query parameters, if any.
+func (p Proxy) publish(ctx context.Context, w http.ResponseWriter, r *http.Request, s *session.Session, payload []byte) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		encodeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	topic := p.topic(r)
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		encodeError(w, http.StatusBadRequest, ErrInvalidTopic)
+		return
+	}
+	pkt := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pkt.TopicName = topic
+	pkt.Payload = payload
+	pkt.Qos = p.bridge.bridgeCfg.QoS
+	pkt.Retain = p.bridge.bridgeCfg.Retain
+	query := r.URL.Query()
+	if v := query.Get("qos"); v != "" {
+		qos, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || qos > 2 {
+			encodeError(w, http.StatusBadRequest, ErrInvalidQoS)
+			return
+		}
+		pkt.Qos = byte(qos)
+	}
+	if v := query.Get("retain"); v != "" {
+		retain, err := strconv.ParseBool(v)
+		if err != nil {
+			encodeError(w, http.StatusBadRequest, err)
+			return
+		}
+		pkt.Retain = retain
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		pkt.Properties = &packets.Properties{ContentType: ct}
+	}
+
+	status := p.bridge.publish(ctx, s, pkt)
+	if status >= http.StatusBadRequest {
+		p.logger.Warn("Failed to publish", slog.String("topic", topic), slog.Int("status", status))
+		encodeError(w, status, ErrPublishFailed)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// topic returns the path of the request after the path prefix.
+func (p Proxy) topic(r *http.Request) string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, p.config.PathPrefix), "/")
+}
+
+// remoteAddr returns the address of the client of the request.
+func remoteAddr(r *http.Request) net.Addr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// statusRecorder sets the status of the request span from the response status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	span trace.Span
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	sr.span.SetAttributes(attribute.Int("http.status_code", statusCode))
+	if statusCode >= http.StatusBadRequest {
+		sr.span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
 func encodeError(w http.ResponseWriter, statusCode int, err error) {
 	w.WriteHeader(statusCode)
 	w.Header().Set("Content-Type", contentType)
@@ -99,40 +256,110 @@ type Proxy struct {
 	target  *httputil.ReverseProxy
 	session session.Handler
 	logger  *slog.Logger
+	// bridge publishes the requests to the broker in bridge mode, nil in proxy mode.
+	bridge *bridge
+}
+
+// New returns a new HTTP Proxy in the mode of the HTTP proxy settings.
+func New(config mproxy.Config, bridgeCfg Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) (Proxy, error) {
+	if bridgeCfg.Mode == BridgeMode {
+		return NewBridge(config, bridgeCfg, handler, interceptor, logger), nil
+	}
+	return NewProxy(config, handler, logger)
+}
+
+// NewBridge returns a new HTTP Proxy publishing the POST requests to the target
+// MQTT broker, the topic being the path of the request after the path prefix.
+// The messages are published in MQTT 5.0 sessions pooled by client identity,
+// which are authorized once when they connect, and the response status reflects
+// the acknowledgement of the message.
+func NewBridge(config mproxy.Config, bridgeCfg Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) Proxy {
+	if config.Session.Tracker == nil {
+		config.Session.Tracker = session.NewTracker()
+	}
+	config.Session.Transport = session.HTTP
+	return Proxy{
+		config: config,
+		logger: logger,
+		bridge: newBridge(config, bridgeCfg, handler, interceptor, logger),
+	}
 }
 
+// NewProxy returns a new HTTP Proxy. Targets on Unix sockets are written as
+// unix:///run/app.sock:/prefix, with the path the requests are sent to after
+// the socket path.
 func NewProxy(config mproxy.Config, handler session.Handler, logger *slog.Logger) (Proxy, error) {
-	target, err := url.Parse(config.Target)
+	targetURL := config.Target
+	socket, uri, unix := unixsock.SplitURI(config.Target)
+	if unix {
+		targetURL = "http://localhost" + uri
+		if config.TargetTLSConfig != nil {
+			targetURL = "https://localhost" + uri
+		}
+	}
+	target, err := url.Parse(targetURL)
 	if err != nil {
 		return Proxy{}, err
 	}
 
+	rp := httputil.NewSingleHostReverseProxy(target)
+	if config.TargetTLSConfig != nil || unix {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config.TargetTLSConfig
+		if unix {
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return unixsock.Dial(ctx, unixsock.Scheme+socket)
+			}
+		}
+		rp.Transport = transport
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		config.Session.Metrics.DialFailed()
+		logger.Error("Failed to proxy request to target", slog.Any("error", err))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
 	return Proxy{
 		config:  config,
-		target:  httputil.NewSingleHostReverseProxy(target),
-		session: handler,
+		target:  rp,
+		session: session.Instrument(handler, config.Session.Metrics),
 		logger:  logger,
 	}, nil
 }
 
 func (p Proxy) Listen(ctx context.Context) error {
-	l, err := net.Listen("tcp", p.config.Address)
+	l, err := unixsock.Listen(p.config.Address, p.config.Socket)
 	if err != nil {
 		return err
 	}
 
+	l = proxyproto.NewListener(l, p.config.ProxyProtocol, p.config.Session.Metrics, p.logger)
+	l = connlimit.NewListener(l, p.config.Session.ConnLimiter, p.config.Session.Metrics, p.logger)
 	if p.config.TLSConfig != nil {
-		l = tls.NewListener(l, p.config.TLSConfig)
+		l = connlimit.NewTLSListener(l, p.config.TLSConfig, p.config.Session.ConnLimiter, p.config.Session.Metrics, p.logger)
 	}
 	status := mptls.SecurityStatus(p.config.TLSConfig)
 
 	p.logger.Info(fmt.Sprintf("HTTP proxy server started at %s%s with %s", p.config.Address, p.config.PathPrefix, status))
 
-	var server http.Server
+	server := http.Server{
+		ErrorLog:    p.config.Session.Metrics.ServerErrorLog(p.logger),
+		ConnState:   p.connState,
+		ConnContext: p.connContext,
+	}
 	g, ctx := errgroup.WithContext(ctx)
 
 	mux := http.NewServeMux()
-	mux.Handle(p.config.PathPrefix, p)
+	if p.bridge != nil {
+		// The topics are the paths below the path prefix.
+		mux.Handle(strings.TrimSuffix(p.config.PathPrefix, "/")+"/", p)
+		g.Go(func() error {
+			p.bridge.upstreams.Run(ctx)
+			return nil
+		})
+	} else {
+		mux.Handle(p.config.PathPrefix, p)
+	}
 	server.Handler = mux
 
 	g.Go(func() error {
@@ -143,10 +370,34 @@ func (p Proxy) Listen(ctx context.Context) error {
 		<-ctx.Done()
 		return server.Close()
 	})
-	if err := g.Wait(); err != nil {
+	err = g.Wait()
+	if p.bridge != nil {
+		p.bridge.close()
+	}
+	if err != nil {
 		p.logger.Info(fmt.Sprintf("HTTP proxy server at %s%s with %s exiting with errors", p.config.Address, p.config.PathPrefix, status), slog.String("error", err.Error()))
 	} else {
 		p.logger.Info(fmt.Sprintf("HTTP proxy server at %s%s with %s exiting...", p.config.Address, p.config.PathPrefix, status))
 	}
 	return nil
 }
+
+// connContext identifies the client connection, so that the requests of the
+// same keep-alive connection share the connection ID.
+func (p Proxy) connContext(ctx context.Context, c net.Conn) context.Context {
+	cred, err := unixsock.PeerCredentials(c)
+	if err != nil {
+		p.logger.Warn("Failed to get peer credentials", slog.Any("error", err))
+	}
+	return context.WithValue(ctx, connKey{}, connInfo{id: uuid.NewString(), cred: cred})
+}
+
+// connState records accepted and closed client connections.
+func (p Proxy) connState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		p.config.Session.Metrics.Accepted()
+	case http.StateClosed, http.StateHijacked:
+		p.config.Session.Metrics.Closed()
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/google/uuid"
+)
+
+const (
+	// subscribePath is the path below the path prefix of the subscriptions.
+	subscribePath = "subscribe"
+	// eventStream is the media type of the SSE streams.
+	eventStream = "text/event-stream"
+	// subscriptionQueue is the number of messages of a subscription waiting
+	// to be delivered. Messages arriving once it is full are dropped, and
+	// their number is reported to the client.
+	subscriptionQueue = 100
+	// maxPollMessages is the number of messages of a long-poll response.
+	maxPollMessages = 100
+	// streamKeepAlive is the interval of the comments keeping idle SSE streams open.
+	streamKeepAlive = 15 * time.Second
+)
+
+var (
+	// ErrMissingTopic indicates a subscription without topics.
+	ErrMissingTopic = errors.New("missing topic")
+	// ErrSubscriptionNotFound indicates an unknown or expired long-poll subscription.
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	// ErrSubscribeFailed indicates a subscription the broker or the session hooks did not accept.
+	ErrSubscribeFailed = errors.New("failed to subscribe")
+)
+
+// message is a message delivered to the subscribers, with its payload encoded in base64.
+type message struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+// pollResponse is the response to a long-poll request. Dropped is the number
+// of messages dropped since the previous poll.
+type pollResponse struct {
+	ID       string    `json:"id"`
+	Messages []message `json:"messages"`
+	Dropped  uint64    `json:"dropped,omitempty"`
+}
+
+// subscribe serves the subscription requests of bridge mode. GET requests
+// accepting text/event-stream are answered with an SSE stream, and other GET
+// requests are long-polls. A long-poll without the id query parameter starts
+// a subscription, which is polled by its ID and ended by a DELETE request.
+func (p Proxy) subscribe(ctx context.Context, w http.ResponseWriter, r *http.Request, s *session.Session) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodDelete:
+		c, ok := p.bridge.lookup(query.Get("id"), s)
+		if !ok {
+			encodeError(w, http.StatusNotFound, ErrSubscriptionNotFound)
+			return
+		}
+		p.bridge.release(c)
+		p.bridge.remove(c)
+		c.disconnect()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method != http.MethodGet:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		encodeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+	case query.Has("id"):
+		c, ok := p.bridge.lookup(query.Get("id"), s)
+		if !ok {
+			encodeError(w, http.StatusNotFound, ErrSubscriptionNotFound)
+			return
+		}
+		defer p.bridge.release(c)
+		p.poll(ctx, w, c)
+	default:
+		topics, qos, err := p.subscription(query)
+		if err != nil {
+			encodeError(w, http.StatusBadRequest, err)
+			return
+		}
+		stream := strings.Contains(r.Header.Get("Accept"), eventStream)
+		c, status := p.bridge.subscribe(ctx, s, topics, qos, !stream)
+		if status != http.StatusOK {
+			p.logger.Warn("Failed to subscribe", slog.Any("topics", topics), slog.Int("status", status))
+			encodeError(w, status, ErrSubscribeFailed)
+			return
+		}
+		defer p.bridge.release(c)
+		if stream {
+			// The subscription of the stream ends with the request.
+			defer c.disconnect()
+			p.stream(ctx, w, c)
+			return
+		}
+		p.poll(ctx, w, c)
+	}
+}
+
+// subscription returns the topic filters and the QoS of the subscription of the query.
+func (p Proxy) subscription(query url.Values) ([]string, byte, error) {
+	topics := query["topic"]
+	if len(topics) == 0 || slices.Contains(topics, "") {
+		return nil, 0, ErrMissingTopic
+	}
+	qos := p.bridge.bridgeCfg.QoS
+	if v := query.Get("qos"); v != "" {
+		q, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || q > 2 {
+			return nil, 0, ErrInvalidQoS
+		}
+		qos = byte(q)
+	}
+	return topics, qos, nil
+}
+
+// stream sends the messages of the subscription as SSE events until the
+// client goes away or the session ends. The number of messages dropped
+// since the previous event is sent as a dropped event.
+func (p Proxy) stream(ctx context.Context, w http.ResponseWriter, c *client) {
+	w.Header().Set("Content-Type", eventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := dropped(w, c); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case pkt := <-c.messages:
+			if err := dropped(w, c); err != nil {
+				return
+			}
+			data, err := json.Marshal(message{Topic: pkt.TopicName, Payload: pkt.Payload})
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			c.delivered(pkt)
+		}
+	}
+}
+
+// dropped writes the dropped event of the stream, if messages were dropped.
+func dropped(w http.ResponseWriter, c *client) error {
+	n := c.dropped.Swap(0)
+	if n == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", n)
+	return err
+}
+
+// poll answers the long-poll with the messages of the subscription, waiting
+// up to the poll timeout for the first one.
+func (p Proxy) poll(ctx context.Context, w http.ResponseWriter, c *client) {
+	if t := p.bridge.bridgeCfg.PollTimeout; t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	pkts := c.collect(ctx)
+	if len(pkts) == 0 && c.ended() {
+		p.bridge.remove(c)
+		encodeError(w, c.failure, ErrSubscriptionNotFound)
+		return
+	}
+	resp := pollResponse{ID: c.poll, Messages: make([]message, 0, len(pkts)), Dropped: c.dropped.Swap(0)}
+	for _, pkt := range pkts {
+		resp.Messages = append(resp.Messages, message{Topic: pkt.TopicName, Payload: pkt.Payload})
+	}
+	w.Header().Set("Content-Type", contentType)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		p.logger.Warn("Failed to write long-poll response", slog.Any("error", err))
+		return
+	}
+	for _, pkt := range pkts {
+		c.delivered(pkt)
+	}
+}
+
+// subscribe starts a session subscribed to the topics for the client of the
+// request, which is released by the caller. Long-poll subscriptions are kept
+// by ID until they are not polled for the idle timeout.
+func (b *bridge) subscribe(ctx context.Context, s *session.Session, topics []string, qos byte, poll bool) (*client, int) {
+	c := newClient(b, key(s))
+	c.topics = topics
+	c.messages = make(chan *packets.PublishPacket, subscriptionQueue)
+	b.mu.Lock()
+	if b.closing {
+		b.mu.Unlock()
+		return nil, http.StatusServiceUnavailable
+	}
+	if poll {
+		c.poll = uuid.NewString()
+		b.polls[c.poll] = c
+	}
+	c.refs++
+	b.start(c, s)
+	b.mu.Unlock()
+
+	if t := b.bridgeCfg.PublishTimeout; t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	if status := c.subscribe(ctx, qos); status != http.StatusOK {
+		b.release(c)
+		b.remove(c)
+		c.disconnect()
+		return nil, status
+	}
+	return c, http.StatusOK
+}
+
+// lookup returns the long-poll subscription of the ID, if the client of
+// the request made it.
+func (b *bridge) lookup(id string, s *session.Session) (*client, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.polls[id]
+	if c == nil || c.key != key(s) {
+		return nil, false
+	}
+	c.refs++
+	return c, true
+}
+
+// collect waits for the first message of the subscription until the context
+// is done, and returns the messages waiting.
+func (c *client) collect(ctx context.Context) []*packets.PublishPacket {
+	var pkts []*packets.PublishPacket
+	select {
+	case pkt := <-c.messages:
+		pkts = append(pkts, pkt)
+	case <-c.done:
+	case <-ctx.Done():
+	}
+	for len(pkts) < maxPollMessages {
+		select {
+		case pkt := <-c.messages:
+			pkts = append(pkts, pkt)
+		default:
+			return pkts
+		}
+	}
+	return pkts
+}
@@ -0,0 +1,570 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+// testTimeout limits each step of the tests, so that a stuck session fails the test.
+const testTimeout = 5 * time.Second
+
+// handler authorizes everything but the hooks set to fail, and records the hooks called.
+type handler struct {
+	authConnect   error
+	authPublish   func(topic string) error
+	authSubscribe error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (h *handler) call(name string, err error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = append(h.calls, name)
+	return err
+}
+
+func (h *handler) AuthConnect(context.Context) error {
+	return h.call("AuthConnect", h.authConnect)
+}
+
+func (h *handler) AuthPublish(_ context.Context, topic *string, _ *[]byte) error {
+	var err error
+	if h.authPublish != nil {
+		err = h.authPublish(*topic)
+	}
+	return h.call("AuthPublish", err)
+}
+
+func (h *handler) AuthSubscribe(context.Context, *[]string) error {
+	return h.call("AuthSubscribe", h.authSubscribe)
+}
+
+func (h *handler) DownSubscribe(context.Context, *[]string) error {
+	return h.call("DownSubscribe", nil)
+}
+
+func (h *handler) Connect(context.Context) error { return h.call("Connect", nil) }
+
+func (h *handler) Publish(context.Context, *string, *[]byte) error {
+	return h.call("Publish", nil)
+}
+
+func (h *handler) Subscribe(context.Context, *[]string) error {
+	return h.call("Subscribe", nil)
+}
+
+func (h *handler) Unsubscribe(context.Context, *[]string) error {
+	return h.call("Unsubscribe", nil)
+}
+
+func (h *handler) Disconnect(context.Context) error { return h.call("Disconnect", nil) }
+
+// called returns the hooks called so far, in order.
+func (h *handler) called() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.calls)
+}
+
+// wait waits for the hooks to be called.
+func (h *handler) wait(t *testing.T, names ...string) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		calls := h.called()
+		missing := slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+			return slices.Contains(calls, name)
+		})
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hooks %v were not called, called %v", missing, calls)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// broker is an MQTT 5.0 broker which accepts the sessions, acknowledges the
+// packets and sends the messages of the tests to the subscribed sessions.
+type broker struct {
+	t *testing.T
+	l net.Listener
+	// connack is the reason code of the CONNACK, and codes the reason codes
+	// of the acknowledgements of the messages by topic.
+	connack byte
+	codes   map[string]byte
+	// received holds the packets the broker received.
+	received chan packets.ControlPacket
+
+	mu    sync.Mutex
+	conns []*brokerConn
+}
+
+type brokerConn struct {
+	mu         sync.Mutex
+	conn       net.Conn
+	subscribed bool
+}
+
+func (c *brokerConn) write(pkt packets.ControlPacket) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return pkt.Write(c.conn, packets.V5)
+}
+
+// newBroker starts a broker which stops with the test.
+func newBroker(t *testing.T) *broker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{t: t, l: l, codes: map[string]byte{}, received: make(chan packets.ControlPacket, 1000)}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		b.mu.Lock()
+		for _, c := range b.conns {
+			c.conn.Close()
+		}
+		b.mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := &brokerConn{conn: conn}
+			b.mu.Lock()
+			b.conns = append(b.conns, c)
+			b.mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.serve(c)
+			}()
+		}
+	}()
+	return b
+}
+
+func (b *broker) serve(c *brokerConn) {
+	defer c.conn.Close()
+	for {
+		pkt, err := packets.ReadPacket(c.conn, packets.V5)
+		if err != nil {
+			return
+		}
+		b.received <- pkt
+		var reply packets.ControlPacket
+		switch p := pkt.(type) {
+		case *packets.ConnectPacket:
+			connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			connack.ReturnCode = b.connack
+			reply = connack
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID, puback.ReasonCode = p.MessageID, b.codes[p.TopicName]
+				reply = puback
+			case 2:
+				pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pubrec.MessageID, pubrec.ReasonCode = p.MessageID, b.codes[p.TopicName]
+				reply = pubrec
+			}
+		case *packets.PubrelPacket:
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = p.MessageID
+			reply = pubcomp
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			for _, opts := range p.Options {
+				suback.ReturnCodes = append(suback.ReturnCodes, opts&0x03)
+			}
+			c.mu.Lock()
+			c.subscribed = true
+			c.mu.Unlock()
+			reply = suback
+		case *packets.UnsubscribePacket:
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			unsuback.ReasonCodes = make([]byte, len(p.Topics))
+			c.mu.Lock()
+			c.subscribed = false
+			c.mu.Unlock()
+			reply = unsuback
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			if err := c.write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// publish sends the message to the subscribed sessions.
+func (b *broker) publish(topic, payload string, qos byte, id uint16) {
+	b.t.Helper()
+	pkt := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pkt.TopicName = topic
+	pkt.Payload = []byte(payload)
+	pkt.Qos = qos
+	pkt.MessageID = id
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.mu.Lock()
+		subscribed := c.subscribed
+		c.mu.Unlock()
+		if !subscribed {
+			continue
+		}
+		if err := c.write(pkt); err != nil {
+			b.t.Errorf("broker publish: %v", err)
+		}
+	}
+}
+
+// expect returns the next packet of the type the broker receives.
+func (b *broker) expect(packetType byte) packets.ControlPacket {
+	b.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case pkt := <-b.received:
+			if pkt.Header().MessageType == packetType {
+				return pkt
+			}
+		case <-timeout:
+			b.t.Fatalf("broker did not receive %s", packets.PacketNames[packetType])
+			return nil
+		}
+	}
+}
+
+// newServer serves the bridge to the broker with the handler, until the test ends.
+func newServer(t *testing.T, b *broker, h session.Handler, cfg Config) *httptest.Server {
+	t.Helper()
+	config := mproxy.Config{
+		Target:     b.l.Addr().String(),
+		PathPrefix: "/messages",
+		Session:    session.Config{DrainTimeout: testTimeout},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	p := NewBridge(config, cfg, h, nil, logger)
+	srv := httptest.NewServer(p)
+	t.Cleanup(func() {
+		srv.Close()
+		p.bridge.close()
+	})
+	return srv
+}
+
+// request sends the request with the credentials of the tests.
+func request(t *testing.T, ctx context.Context, method, url string, body io.Reader, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// readEvent reads the next event of the SSE stream, skipping the comments.
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && len(lines) > 0:
+			return lines
+		case line == "", strings.HasPrefix(line, ":"):
+		default:
+			lines = append(lines, line)
+		}
+	}
+}
+
+func TestSubscribeStream(t *testing.T) {
+	b := newBroker(t)
+	h := &handler{}
+	srv := newServer(t, b, h, Config{QoS: 1, PublishTimeout: testTimeout})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := request(t, ctx, http.MethodGet, srv.URL+"/messages/subscribe?topic=a/%23&topic=b&qos=1", nil, http.Header{"Accept": {eventStream}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != eventStream {
+		t.Errorf("Content-Type = %q, want %q", ct, eventStream)
+	}
+	sub := b.expect(packets.Subscribe).(*packets.SubscribePacket)
+	if !slices.Equal(sub.Topics, []string{"a/#", "b"}) {
+		t.Errorf("SUBSCRIBE topics = %v, want %v", sub.Topics, []string{"a/#", "b"})
+	}
+	h.wait(t, "AuthConnect", "AuthSubscribe", "Subscribe")
+
+	r := bufio.NewReader(resp.Body)
+	b.publish("a/1", "hello", 1, 7)
+	if got, want := readEvent(t, r), []string{`data: {"topic":"a/1","payload":"aGVsbG8="}`}; !slices.Equal(got, want) {
+		t.Errorf("event = %q, want %q", got, want)
+	}
+	// The broker gets the acknowledgement once the message is written to the stream.
+	if ack := b.expect(packets.Puback).(*packets.PubackPacket); ack.MessageID != 7 {
+		t.Errorf("PUBACK message ID = %d, want 7", ack.MessageID)
+	}
+	b.publish("b", "", 0, 0)
+	if got, want := readEvent(t, r), []string{`data: {"topic":"b","payload":""}`}; !slices.Equal(got, want) {
+		t.Errorf("event = %q, want %q", got, want)
+	}
+	h.wait(t, "DownSubscribe")
+
+	// The session unsubscribes and disconnects once the client goes away.
+	cancel()
+	unsub := b.expect(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	if !slices.Equal(unsub.Topics, sub.Topics) {
+		t.Errorf("UNSUBSCRIBE topics = %v, want %v", unsub.Topics, sub.Topics)
+	}
+	b.expect(packets.Disconnect)
+	h.wait(t, "Unsubscribe", "Disconnect")
+}
+
+func TestSubscribeDenied(t *testing.T) {
+	cases := []struct {
+		desc    string
+		handler *handler
+		connack byte
+		status  int
+	}{
+		{
+			desc:    "AuthSubscribe denied",
+			handler: &handler{authSubscribe: errors.New("denied")},
+			status:  http.StatusForbidden,
+		},
+		{
+			desc:    "AuthSubscribe denied with reason code",
+			handler: &handler{authSubscribe: session.NewError(packets.TopicFilterInvalid, errors.New("invalid"))},
+			status:  http.StatusBadRequest,
+		},
+		{
+			desc:    "AuthConnect denied",
+			handler: &handler{authConnect: errors.New("denied")},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			desc:    "broker refused",
+			handler: &handler{},
+			connack: packets.ServerUnavailable,
+			status:  http.StatusServiceUnavailable,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := newBroker(t)
+			b.connack = tc.connack
+			srv := newServer(t, b, tc.handler, Config{PublishTimeout: testTimeout})
+			for _, accept := range []string{eventStream, contentType} {
+				resp := request(t, context.Background(), http.MethodGet, srv.URL+"/messages/subscribe?topic=t", nil, http.Header{"Accept": {accept}})
+				resp.Body.Close()
+				if resp.StatusCode != tc.status {
+					t.Errorf("%s status = %d, want %d", accept, resp.StatusCode, tc.status)
+				}
+			}
+			if calls := tc.handler.called(); slices.Contains(calls, "Subscribe") {
+				t.Errorf("Subscribe called for denied subscription: %v", calls)
+			}
+		})
+	}
+}
+
+// poll sends the long-poll request and decodes its response.
+func poll(t *testing.T, url string) (int, pollResponse) {
+	t.Helper()
+	resp := request(t, context.Background(), http.MethodGet, url, nil, nil)
+	defer resp.Body.Close()
+	var pr pollResponse
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+	}
+	return resp.StatusCode, pr
+}
+
+func TestLongPoll(t *testing.T) {
+	b := newBroker(t)
+	h := &handler{}
+	srv := newServer(t, b, h, Config{PublishTimeout: testTimeout, PollTimeout: 50 * time.Millisecond, IdleTimeout: time.Minute})
+	url := srv.URL + "/messages/subscribe"
+
+	// The first poll times out without messages.
+	start := time.Now()
+	status, pr := poll(t, url+"?topic=t")
+	if status != http.StatusOK || pr.ID == "" || len(pr.Messages) != 0 {
+		t.Fatalf("poll = %d %+v, want an empty subscription", status, pr)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("poll returned after %s, before the poll timeout", d)
+	}
+	b.expect(packets.Subscribe)
+
+	b.publish("t", "one", 1, 1)
+	b.publish("t", "two", 1, 2)
+	// The messages may arrive across polls.
+	var got []message
+	deadline := time.Now().Add(testTimeout)
+	for len(got) < 2 && time.Now().Before(deadline) {
+		status, next := poll(t, url+"?id="+pr.ID)
+		if status != http.StatusOK || next.ID != pr.ID {
+			t.Fatalf("poll = %d %+v, want the subscription", status, next)
+		}
+		got = append(got, next.Messages...)
+	}
+	want := []message{{Topic: "t", Payload: []byte("one")}, {Topic: "t", Payload: []byte("two")}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %+v, want %+v", got, want)
+	}
+	for _, id := range []uint16{1, 2} {
+		if ack := b.expect(packets.Puback).(*packets.PubackPacket); ack.MessageID != id {
+			t.Errorf("PUBACK message ID = %d, want %d", ack.MessageID, id)
+		}
+	}
+
+	// Only the client identity which started the subscription can poll it.
+	req, err := http.NewRequest(http.MethodGet, url+"?id="+pr.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("other", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("poll of another identity = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// DELETE ends the subscription, unsubscribing and disconnecting.
+	resp = request(t, context.Background(), http.MethodDelete, url+"?id="+pr.ID, nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	b.expect(packets.Unsubscribe)
+	b.expect(packets.Disconnect)
+	h.wait(t, "Unsubscribe", "Disconnect")
+	if status, _ := poll(t, url+"?id="+pr.ID); status != http.StatusNotFound {
+		t.Errorf("poll after DELETE = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestLongPollExpiry(t *testing.T) {
+	b := newBroker(t)
+	h := &handler{}
+	srv := newServer(t, b, h, Config{PublishTimeout: testTimeout, PollTimeout: 10 * time.Millisecond, IdleTimeout: 100 * time.Millisecond})
+	url := srv.URL + "/messages/subscribe"
+
+	status, pr := poll(t, url+"?topic=t")
+	if status != http.StatusOK || pr.ID == "" {
+		t.Fatalf("poll = %d %+v, want a subscription", status, pr)
+	}
+	// The subscription ends once it is not polled for the idle timeout.
+	b.expect(packets.Unsubscribe)
+	b.expect(packets.Disconnect)
+	h.wait(t, "Unsubscribe", "Disconnect")
+	if status, _ := poll(t, url+"?id="+pr.ID); status != http.StatusNotFound {
+		t.Errorf("poll of expired subscription = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestSubscribeRequests(t *testing.T) {
+	cases := []struct {
+		desc   string
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{desc: "without topic", method: http.MethodGet, path: "/messages/subscribe", status: http.StatusBadRequest},
+		{desc: "empty topic", method: http.MethodGet, path: "/messages/subscribe?topic=", status: http.StatusBadRequest},
+		{desc: "invalid QoS", method: http.MethodGet, path: "/messages/subscribe?topic=t&qos=3", status: http.StatusBadRequest},
+		{desc: "unknown subscription", method: http.MethodGet, path: "/messages/subscribe?id=unknown", status: http.StatusNotFound},
+		{desc: "delete unknown subscription", method: http.MethodDelete, path: "/messages/subscribe?id=unknown", status: http.StatusNotFound},
+		{desc: "PUT subscription", method: http.MethodPut, path: "/messages/subscribe?topic=t", status: http.StatusMethodNotAllowed, allow: "GET, DELETE"},
+		{desc: "GET topic", method: http.MethodGet, path: "/messages/t?topic=t", status: http.StatusMethodNotAllowed, allow: "POST"},
+		{desc: "DELETE topic", method: http.MethodDelete, path: "/messages/t", status: http.StatusMethodNotAllowed, allow: "POST"},
+	}
+	b := newBroker(t)
+	srv := newServer(t, b, &handler{}, Config{PublishTimeout: testTimeout})
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp := request(t, context.Background(), tc.method, srv.URL+tc.path, nil, nil)
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+			if allow := resp.Header.Get("Allow"); allow != tc.allow {
+				t.Errorf("Allow = %q, want %q", allow, tc.allow)
+			}
+		})
+	}
+
+	// POST to the subscriptions publishes to the subscribe topic.
+	resp := request(t, context.Background(), http.MethodPost, srv.URL+"/messages/subscribe?qos=1", strings.NewReader("m"), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if pub := b.expect(packets.Publish).(*packets.PublishPacket); pub.TopicName != subscribePath {
+		t.Errorf("topic = %q, want %q", pub.TopicName, subscribePath)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics implements Prometheus metrics of the mProxy listeners.
+package metrics
+
+import (
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mproxy"
+
+// Metrics holds the metrics of all the listeners.
+type Metrics struct {
+	registry       *prometheus.Registry
+	accepted       *prometheus.CounterVec
+	active         *prometheus.GaugeVec
+	rejected       *prometheus.CounterVec
+	tlsFailures    *prometheus.CounterVec
+	authDenials    *prometheus.CounterVec
+	packets        *prometheus.CounterVec
+	bytes          *prometheus.CounterVec
+	handlerLatency *prometheus.HistogramVec
+	dialErrors     *prometheus.CounterVec
+	duplicateIDs   *prometheus.CounterVec
+}
+
+// New returns new Metrics registered in their own Prometheus registry,
+// together with the Go runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		accepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_accepted_total",
+			Help:      "Number of accepted client connections.",
+		}, []string{"listener"}),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections_active",
+			Help:      "Number of active client connections.",
+		}, []string{"listener"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_rejected_total",
+			Help:      "Number of client connections rejected by connection limits by reason.",
+		}, []string{"listener", "reason"}),
+		tlsFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_handshake_failures_total",
+			Help:      "Number of failed TLS handshakes with clients by reason.",
+		}, []string{"listener", "reason"}),
+		authDenials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_denials_total",
+			Help:      "Number of packets denied by authorization hooks.",
+		}, []string{"listener", "hook"}),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "packets_total",
+			Help:      "Number of MQTT packets read by packet type and direction.",
+		}, []string{"listener", "type", "direction"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_total",
+			Help:      "Number of MQTT packet bytes read by packet type and direction.",
+		}, []string{"listener", "type", "direction"}),
+		handlerLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Duration of Handler hook calls.",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"listener", "hook"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "broker_dial_errors_total",
+			Help:      "Number of failed connection attempts to the upstream broker or server.",
+		}, []string{"listener"}),
+		duplicateIDs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "duplicate_client_ids_total",
+			Help:      "Number of client connections with the client ID of another active session by the applied policy.",
+		}, []string{"listener", "policy"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.accepted,
+		m.active,
+		m.rejected,
+		m.tlsFailures,
+		m.authDenials,
+		m.packets,
+		m.bytes,
+		m.handlerLatency,
+		m.dialErrors,
+		m.duplicateIDs,
+	)
+	return m
+}
+
+// Handler returns the HTTP handler exposing the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Listener returns the metrics of the listener with the given name.
+// It returns nil on nil Metrics, so metrics can be disabled.
+func (m *Metrics) Listener(name string) *Listener {
+	if m == nil {
+		return nil
+	}
+	labels := prometheus.Labels{"listener": name}
+	return &Listener{
+		accepted:       m.accepted.With(labels),
+		active:         m.active.With(labels),
+		rejected:       m.rejected.MustCurryWith(labels),
+		tlsFailures:    m.tlsFailures.MustCurryWith(labels),
+		authDenials:    m.authDenials.MustCurryWith(labels),
+		packets:        m.packets.MustCurryWith(labels),
+		bytes:          m.bytes.MustCurryWith(labels),
+		handlerLatency: m.handlerLatency.MustCurryWith(labels),
+		dialErrors:     m.dialErrors.With(labels),
+		duplicateIDs:   m.duplicateIDs.MustCurryWith(labels),
+	}
+}
+
+// Listener records the metrics of a single listener. All the methods are
+// safe to call on a nil Listener, in which case they do nothing.
+type Listener struct {
+	accepted       prometheus.Counter
+	active         prometheus.Gauge
+	rejected       *prometheus.CounterVec
+	tlsFailures    *prometheus.CounterVec
+	authDenials    *prometheus.CounterVec
+	packets        *prometheus.CounterVec
+	bytes          *prometheus.CounterVec
+	handlerLatency prometheus.ObserverVec
+	dialErrors     prometheus.Counter
+	duplicateIDs   *prometheus.CounterVec
+}
+
+// Accepted records a new client connection.
+func (l *Listener) Accepted() {
+	if l == nil {
+		return
+	}
+	l.accepted.Inc()
+	l.active.Inc()
+}
+
+// Closed records the end of a client connection.
+func (l *Listener) Closed() {
+	if l == nil {
+		return
+	}
+	l.active.Dec()
+}
+
+// Rejected records a client connection rejected for the given reason.
+func (l *Listener) Rejected(reason string) {
+	if l == nil {
+		return
+	}
+	l.rejected.WithLabelValues(reason).Inc()
+}
+
+// TLSHandshakeFailed records a failed TLS handshake with the given reason.
+func (l *Listener) TLSHandshakeFailed(reason string) {
+	if l == nil {
+		return
+	}
+	l.tlsFailures.WithLabelValues(reason).Inc()
+}
+
+// AuthDenied records a packet denied by the given authorization hook.
+func (l *Listener) AuthDenied(hook string) {
+	if l == nil {
+		return
+	}
+	l.authDenials.WithLabelValues(hook).Inc()
+}
+
+// Packet records a packet of the given type and size read in the given direction.
+func (l *Listener) Packet(packetType, direction string, size int) {
+	if l == nil {
+		return
+	}
+	l.packets.WithLabelValues(packetType, direction).Inc()
+	l.bytes.WithLabelValues(packetType, direction).Add(float64(size))
+}
+
+// HandlerDuration records the duration of the given Handler hook call.
+func (l *Listener) HandlerDuration(hook string, d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.handlerLatency.WithLabelValues(hook).Observe(d.Seconds())
+}
+
+// DialFailed records a failed connection attempt to the upstream.
+func (l *Listener) DialFailed() {
+	if l == nil {
+		return
+	}
+	l.dialErrors.Inc()
+}
+
+// DuplicateClientID records a client connecting with the client ID of
+// another active session, handled with the given policy.
+func (l *Listener) DuplicateClientID(policy string) {
+	if l == nil {
+		return
+	}
+	l.duplicateIDs.WithLabelValues(policy).Inc()
+}
+
+// ServerErrorLog returns a logger to be used as http.Server ErrorLog. It records
+// failed TLS handshakes, which http.Server only reports through its error log,
+// and forwards all the messages to the given logger.
+func (l *Listener) ServerErrorLog(logger *slog.Logger) *log.Logger {
+	return log.New(serverErrorWriter{listener: l, logger: logger}, "", 0)
+}
+
+type serverErrorWriter struct {
+	listener *Listener
+	logger   *slog.Logger
+}
+
+func (w serverErrorWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if reason, ok := mptls.IsHandshakeError(msg); ok {
+		w.listener.TLSHandshakeFailed(mptls.HandshakeFailure(errors.New(reason)))
+	}
+	w.logger.Warn(msg)
+	return len(p), nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/caarlos0/env/v11"
+	"golang.org/x/sync/errgroup"
+)
+
+// Config holds the metrics server configuration.
+type Config struct {
+	Address string `env:"ADDRESS" envDefault:""`
+	Path    string `env:"ENDPOINT" envDefault:"/metrics"`
+}
+
+// NewConfig parses the metrics server configuration from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Server exposes the metrics on a dedicated HTTP listener.
+type Server struct {
+	config  Config
+	metrics *Metrics
+	logger  *slog.Logger
+}
+
+// NewServer returns a new metrics Server.
+func NewServer(config Config, metrics *Metrics, logger *slog.Logger) *Server {
+	return &Server{
+		config:  config,
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Listen of the server, this will block.
+func (s *Server) Listen(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.config.Address)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info(fmt.Sprintf("Metrics server started at %s%s", s.config.Address, s.config.Path))
+
+	mux := http.NewServeMux()
+	mux.Handle(s.config.Path, s.metrics.Handler())
+	server := http.Server{Handler: mux}
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		return server.Serve(l)
+	})
+
+	g.Go(func() error {
+		<-ctx.Done()
+		return server.Close()
+	})
+	if err := g.Wait(); err != nil {
+		s.logger.Info(fmt.Sprintf("Metrics server at %s%s exiting with errors", s.config.Address, s.config.Path), slog.String("error", err.Error()))
+	} else {
+		s.logger.Info(fmt.Sprintf("Metrics server at %s%s exiting...", s.config.Address, s.config.Path))
+	}
+	return nil
+}
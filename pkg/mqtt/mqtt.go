@@ -6,14 +6,19 @@ package mqtt
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 
 	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/proxyproto"
 	"github.com/absmach/mproxy/pkg/session"
 	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/unixsock"
+	"github.com/absmach/mproxy/pkg/upstream"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -23,17 +28,23 @@ type Proxy struct {
 	handler     session.Handler
 	interceptor session.Interceptor
 	logger      *slog.Logger
-	dialer      net.Dialer
+	upstreams   *upstream.Router
 }
 
 // New returns a new MQTT Proxy instance.
 func New(config mproxy.Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
-	return &Proxy{
+	if config.Session.Tracker == nil {
+		config.Session.Tracker = session.NewTracker()
+	}
+	config.Session.Transport = session.TCP
+	p := &Proxy{
 		config:      config,
 		handler:     handler,
 		logger:      logger,
 		interceptor: interceptor,
 	}
+	p.upstreams = upstream.NewRouter(config.Upstreams(), config.Upstream, p.dial, logger)
+	return p
 }
 
 func (p Proxy) accept(ctx context.Context, l net.Listener) {
@@ -48,40 +59,83 @@ func (p Proxy) accept(ctx context.Context, l net.Listener) {
 				continue
 			}
 			p.logger.Info("Accepted new client")
+			p.config.Session.Metrics.Accepted()
 			go p.handle(ctx, conn)
 		}
 	}
 }
 
+// handle streams the client connection. The session outlives the listener
+// context, so that it can be drained on shutdown instead of being cut.
 func (p Proxy) handle(ctx context.Context, inbound net.Conn) {
+	defer p.config.Session.Metrics.Closed()
 	defer p.close(inbound)
-	outbound, err := p.dialer.Dial("tcp", p.config.Target)
-	if err != nil {
-		p.logger.Error("Cannot connect to remote broker " + p.config.Target + " due to: " + err.Error())
-		return
-	}
-	defer p.close(outbound)
 
 	clientCert, err := mptls.ClientCert(inbound)
 	if err != nil {
+		p.config.Session.Metrics.TLSHandshakeFailed(mptls.HandshakeFailure(err))
 		p.logger.Error("Failed to get client certificate: " + err.Error())
 		return
 	}
 
-	if err = session.Stream(ctx, inbound, outbound, p.handler, p.interceptor, clientCert); err != io.EOF {
+	// The broker is dialed once the client CONNECT is authorized,
+	// so that it can be selected by the client identity.
+	if err = session.StreamDial(context.WithoutCancel(ctx), inbound, p.upstreams.Dial, p.handler, p.interceptor, clientCert, p.config.Session); err != nil && !errors.Is(err, io.EOF) {
 		p.logger.Warn(err.Error())
 	}
 }
 
+func (p Proxy) dial(ctx context.Context, addr string) (net.Conn, error) {
+	return DialTarget(ctx, addr, p.config)
+}
+
+// DialTarget connects to the MQTT target with the given address, with TLS if the
+// target TLS of the configuration is set. The PROXY protocol header, if configured,
+// carries the addresses of the client of the session. Targets on Unix sockets need
+// the server name of the target TLS to be set. It lets other transports, such as
+// QUIC, proxy their sessions to TCP targets as the MQTT proxy does.
+func DialTarget(ctx context.Context, addr string, cfg mproxy.Config) (net.Conn, error) {
+	conn, err := unixsock.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var h proxyproto.Header
+	if s, ok := session.FromContext(ctx); ok {
+		h = proxyproto.Header{Source: s.RemoteAddr, Destination: s.LocalAddr}
+	}
+	if err := proxyproto.WriteHeader(conn, cfg.ProxyProtocol.Target, h); err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+	if cfg.TargetTLSConfig == nil {
+		return conn, nil
+	}
+	config := cfg.TargetTLSConfig
+	if _, ok := unixsock.Path(addr); !ok && config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errors.Join(err, conn.Close())
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+	return tc, nil
+}
+
 // Listen of the server, this will block.
 func (p Proxy) Listen(ctx context.Context) error {
-	l, err := net.Listen("tcp", p.config.Address)
+	l, err := unixsock.Listen(p.config.Address, p.config.Socket)
 	if err != nil {
 		return err
 	}
 
+	l = proxyproto.NewListener(l, p.config.ProxyProtocol, p.config.Session.Metrics, p.logger)
+	l = connlimit.NewListener(l, p.config.Session.ConnLimiter, p.config.Session.Metrics, p.logger)
 	if p.config.TLSConfig != nil {
-		l = tls.NewListener(l, p.config.TLSConfig)
+		l = connlimit.NewTLSListener(l, p.config.TLSConfig, p.config.Session.ConnLimiter, p.config.Session.Metrics, p.logger)
 	}
 	status := mptls.SecurityStatus(p.config.TLSConfig)
 	p.logger.Info(fmt.Sprintf("MQTT proxy server started at %s  with %s", p.config.Address, status))
@@ -93,6 +147,11 @@ func (p Proxy) Listen(ctx context.Context) error {
 		return nil
 	})
 
+	g.Go(func() error {
+		p.upstreams.Run(ctx)
+		return nil
+	})
+
 	g.Go(func() error {
 		<-ctx.Done()
 		return l.Close()
@@ -102,9 +161,22 @@ func (p Proxy) Listen(ctx context.Context) error {
 	} else {
 		p.logger.Info(fmt.Sprintf("MQTT proxy server at %s with %s exiting...", p.config.Address, status))
 	}
+	p.drain()
 	return nil
 }
 
+// drain ends the sessions still active once the listener is closed.
+func (p Proxy) drain() {
+	cfg := p.config.Session
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	total, forced := cfg.Tracker.Drain(ctx, cfg.DrainGracePeriod)
+	if total == 0 {
+		return
+	}
+	p.logger.Info("Drained sessions", slog.String("address", p.config.Address), slog.Int("sessions", total), slog.Int("force_closed", forced))
+}
+
 func (p Proxy) close(conn net.Conn) {
 	if err := conn.Close(); err != nil {
 		p.logger.Warn(fmt.Sprintf("Error closing connection %s", err.Error()))
@@ -0,0 +1,152 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/absmach/mproxy/pkg/unixsock"
+)
+
+// testTimeout limits each step of the tests, so that a stuck session fails the test.
+const testTimeout = 5 * time.Second
+
+// handler authorizes everything.
+type handler struct{}
+
+func (handler) AuthConnect(context.Context) error                   { return nil }
+func (handler) AuthPublish(context.Context, *string, *[]byte) error { return nil }
+func (handler) AuthSubscribe(context.Context, *[]string) error      { return nil }
+func (handler) DownSubscribe(context.Context, *[]string) error      { return nil }
+func (handler) Connect(context.Context) error                       { return nil }
+func (handler) Publish(context.Context, *string, *[]byte) error     { return nil }
+func (handler) Subscribe(context.Context, *[]string) error          { return nil }
+func (handler) Unsubscribe(context.Context, *[]string) error        { return nil }
+func (handler) Disconnect(context.Context) error                    { return nil }
+
+// read reads the next packet from the connection.
+func read(t *testing.T, c net.Conn) packets.ControlPacket {
+	t.Helper()
+	if err := c.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := packets.ReadPacket(c, packets.V5)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return pkt
+}
+
+// broker accepts a single session, and sends the packets it receives after CONNECT.
+func broker(t *testing.T) (string, <-chan packets.ControlPacket) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan packets.ControlPacket, 10)
+	go func() {
+		defer close(received)
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, err := packets.ReadPacket(c, packets.V5); err != nil {
+			return
+		}
+		if err := packets.NewControlPacket(packets.Connack).Write(c, packets.V5); err != nil {
+			return
+		}
+		for {
+			pkt, err := packets.ReadPacket(c, packets.V5)
+			if err != nil {
+				return
+			}
+			received <- pkt
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestListenDrain(t *testing.T) {
+	target, received := broker(t)
+	sock := filepath.Join(t.TempDir(), "mqtt.sock")
+	cfg := mproxy.Config{
+		Address: unixsock.Scheme + sock,
+		Target:  target,
+		Socket:  unixsock.Config{Mode: 0o600},
+		Session: session.Config{DrainGracePeriod: 50 * time.Millisecond, DrainTimeout: testTimeout},
+	}
+	p := New(cfg, handler{}, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Listen(ctx)
+	}()
+
+	var client net.Conn
+	deadline := time.Now().Add(testTimeout)
+	for {
+		c, err := net.Dial("unix", sock)
+		if err == nil {
+			client = c
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer client.Close()
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = packets.V5
+	connect.CleanSession = true
+	connect.ClientIdentifier = "c1"
+	if err := connect.Write(client, packets.V5); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := read(t, client).(*packets.ConnackPacket); !ok {
+		t.Fatal("client did not receive CONNACK")
+	}
+
+	// Shutting the listener down drains the session after the grace period.
+	start := time.Now()
+	cancel()
+	d, ok := read(t, client).(*packets.DisconnectPacket)
+	if !ok || d.ReasonCode != packets.ServerShuttingDown {
+		t.Fatalf("client received %v, want DISCONNECT with Server shutting down", d)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.Session.DrainGracePeriod {
+		t.Errorf("session disconnected %s after shutdown, within the grace period", elapsed)
+	}
+	select {
+	case pkt := <-received:
+		if _, ok := pkt.(*packets.DisconnectPacket); !ok {
+			t.Errorf("broker received %s, want DISCONNECT", pkt)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("broker did not receive DISCONNECT")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Listen() = %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Listen() did not return")
+	}
+}
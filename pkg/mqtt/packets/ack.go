@@ -0,0 +1,161 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PubackPacket is an internal representation of the fields of the PUBACK packet.
+type PubackPacket struct {
+	FixedHeader
+	MessageID  uint16
+	ReasonCode byte
+	Properties *Properties
+}
+
+// PubrecPacket is an internal representation of the fields of the PUBREC packet.
+type PubrecPacket struct {
+	FixedHeader
+	MessageID  uint16
+	ReasonCode byte
+	Properties *Properties
+}
+
+// PubrelPacket is an internal representation of the fields of the PUBREL packet.
+type PubrelPacket struct {
+	FixedHeader
+	MessageID  uint16
+	ReasonCode byte
+	Properties *Properties
+}
+
+// PubcompPacket is an internal representation of the fields of the PUBCOMP packet.
+type PubcompPacket struct {
+	FixedHeader
+	MessageID  uint16
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (pa *PubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pa.FixedHeader, pa.MessageID, pa.ReasonCode)
+}
+
+// Write writes the PUBACK packet.
+func (pa *PubackPacket) Write(w io.Writer, version byte) error {
+	return write(w, pa, version)
+}
+
+// Pack encodes the PUBACK packet.
+func (pa *PubackPacket) Pack(version byte) ([]byte, error) {
+	return packAck(pa.MessageID, pa.ReasonCode, pa.Properties, version), nil
+}
+
+// Unpack decodes the PUBACK packet.
+func (pa *PubackPacket) Unpack(b []byte, version byte) error {
+	var err error
+	pa.MessageID, pa.ReasonCode, pa.Properties, err = unpackAck(b, version)
+	return err
+}
+
+func (pr *PubrecPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pr.FixedHeader, pr.MessageID, pr.ReasonCode)
+}
+
+// Write writes the PUBREC packet.
+func (pr *PubrecPacket) Write(w io.Writer, version byte) error {
+	return write(w, pr, version)
+}
+
+// Pack encodes the PUBREC packet.
+func (pr *PubrecPacket) Pack(version byte) ([]byte, error) {
+	return packAck(pr.MessageID, pr.ReasonCode, pr.Properties, version), nil
+}
+
+// Unpack decodes the PUBREC packet.
+func (pr *PubrecPacket) Unpack(b []byte, version byte) error {
+	var err error
+	pr.MessageID, pr.ReasonCode, pr.Properties, err = unpackAck(b, version)
+	return err
+}
+
+func (pr *PubrelPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pr.FixedHeader, pr.MessageID, pr.ReasonCode)
+}
+
+// Write writes the PUBREL packet.
+func (pr *PubrelPacket) Write(w io.Writer, version byte) error {
+	return write(w, pr, version)
+}
+
+// Pack encodes the PUBREL packet.
+func (pr *PubrelPacket) Pack(version byte) ([]byte, error) {
+	return packAck(pr.MessageID, pr.ReasonCode, pr.Properties, version), nil
+}
+
+// Unpack decodes the PUBREL packet.
+func (pr *PubrelPacket) Unpack(b []byte, version byte) error {
+	var err error
+	pr.MessageID, pr.ReasonCode, pr.Properties, err = unpackAck(b, version)
+	return err
+}
+
+func (pc *PubcompPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pc.FixedHeader, pc.MessageID, pc.ReasonCode)
+}
+
+// Write writes the PUBCOMP packet.
+func (pc *PubcompPacket) Write(w io.Writer, version byte) error {
+	return write(w, pc, version)
+}
+
+// Pack encodes the PUBCOMP packet.
+func (pc *PubcompPacket) Pack(version byte) ([]byte, error) {
+	return packAck(pc.MessageID, pc.ReasonCode, pc.Properties, version), nil
+}
+
+// Unpack decodes the PUBCOMP packet.
+func (pc *PubcompPacket) Unpack(b []byte, version byte) error {
+	var err error
+	pc.MessageID, pc.ReasonCode, pc.Properties, err = unpackAck(b, version)
+	return err
+}
+
+// packAck encodes the variable header shared by PUBACK, PUBREC, PUBREL and PUBCOMP.
+// MQTT 5.0 allows omitting the reason code when it is Success and there are no properties.
+func packAck(id uint16, rc byte, props *Properties, version byte) []byte {
+	b := appendUint16(make([]byte, 0, 4), id)
+	if version != V5 {
+		return b
+	}
+	pb := props.Pack()
+	if rc == Success && len(pb) == 1 {
+		return b
+	}
+	b = append(b, rc)
+	if len(pb) > 1 {
+		b = append(b, pb...)
+	}
+	return b
+}
+
+func unpackAck(b []byte, version byte) (uint16, byte, *Properties, error) {
+	d := decoder{b: b}
+	id := d.uint16()
+	var (
+		rc    byte
+		props *Properties
+	)
+	if version == V5 {
+		if d.len() > 0 {
+			rc = d.byte()
+		}
+		if d.len() > 0 {
+			props = unpackProperties(&d)
+		}
+	}
+	return id, rc, props, d.err()
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// benchPacket is a packet measured by the benchmarks.
+type benchPacket struct {
+	name string
+	new  func(id uint16) ControlPacket
+}
+
+var benchPackets = []benchPacket{
+	{"PINGREQ", func(uint16) ControlPacket {
+		return NewControlPacket(Pingreq)
+	}},
+	{"PUBACK", func(id uint16) ControlPacket {
+		p := NewControlPacket(Puback).(*PubackPacket)
+		p.MessageID = id
+		return p
+	}},
+	{"PUBLISH_QoS0_64B", func(uint16) ControlPacket {
+		return benchPublish(0, 0, 64)
+	}},
+	{"PUBLISH_QoS1_1KB", func(id uint16) ControlPacket {
+		return benchPublish(1, id, 1024)
+	}},
+}
+
+func benchPublish(qos byte, id uint16, size int) *PublishPacket {
+	p := NewControlPacket(Publish).(*PublishPacket)
+	p.TopicName = "bench/topic"
+	p.Qos = qos
+	p.MessageID = id
+	p.Payload = bytes.Repeat([]byte{'x'}, size)
+	return p
+}
+
+// BenchmarkCodec measures reading and writing each packet, either decoded
+// and encoded again, or forwarded raw from a pooled buffer.
+func BenchmarkCodec(b *testing.B) {
+	for _, version := range []byte{V311, V5} {
+		for _, p := range benchPackets {
+			for _, raw := range []bool{false, true} {
+				path := "decode"
+				if raw {
+					path = "raw"
+				}
+				b.Run(fmt.Sprintf("v%d/%s/%s", version, p.name, path), func(b *testing.B) {
+					benchmarkCodec(b, p, version, raw)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkCodec(b *testing.B, p benchPacket, version byte, raw bool) {
+	var buf bytes.Buffer
+	if err := p.new(1).Write(&buf, version); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	r := bytes.NewReader(data)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		fh, err := ReadFixedHeader(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if raw {
+			rp, err := ReadRaw(r, fh)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = rp.Write(io.Discard, version)
+			rp.Release()
+			if err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		cp, err := ReadBody(r, fh, version)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := cp.Write(io.Discard, version); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+func appendUint16(b []byte, v uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, v)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func appendBinary(b, v []byte) []byte {
+	b = appendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendVarint(b []byte, v int) []byte {
+	for {
+		d := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+func varintLen(v int) int {
+	n := 1
+	for v >= 128 {
+		v /= 128
+		n++
+	}
+	return n
+}
+
+func readVarint(r io.Reader) (int, error) {
+	var (
+		v    int
+		mult = 1
+	)
+	for i := 0; i < 4; i++ {
+		b, err := readByte(r)
+		if err != nil {
+			return 0, err
+		}
+		v += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			return v, nil
+		}
+		mult *= 128
+	}
+	return 0, ErrRemainingLength
+}
+
+// readByte reads a single byte, without allocating if r is an io.ByteReader.
+func readByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// decoder reads MQTT data types from a packet body. The first decoding
+// failure is sticky and returned by err().
+type decoder struct {
+	b   []byte
+	bad bool
+}
+
+func (d *decoder) err() error {
+	if d.bad {
+		return ErrMalformedPacket
+	}
+	return nil
+}
+
+func (d *decoder) len() int {
+	return len(d.b)
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.bad || n < 0 || len(d.b) < n {
+		d.bad = true
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if v := d.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if v := d.next(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if v := d.next(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (d *decoder) varint() int {
+	var (
+		v    int
+		mult = 1
+	)
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		if d.bad {
+			return 0
+		}
+		v += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			return v
+		}
+		mult *= 128
+	}
+	d.bad = true
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	n := int(d.uint16())
+	v := d.next(n)
+	if v == nil {
+		return nil
+	}
+	// Copy so the packet does not retain the read buffer.
+	return append([]byte{}, v...)
+}
+
+func (d *decoder) string() string {
+	n := int(d.uint16())
+	return string(d.next(n))
+}
+
+func (d *decoder) rest() []byte {
+	v := d.b
+	d.b = nil
+	return v
+}
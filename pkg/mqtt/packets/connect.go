@@ -0,0 +1,209 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// ConnectPacket is an internal representation of the fields of the CONNECT packet.
+type ConnectPacket struct {
+	FixedHeader
+	ProtocolName     string
+	ProtocolVersion  byte
+	CleanSession     bool
+	WillFlag         bool
+	WillQos          byte
+	WillRetain       bool
+	UsernameFlag     bool
+	PasswordFlag     bool
+	ReservedBit      byte
+	Keepalive        uint16
+	Properties       *Properties
+	ClientIdentifier string
+	WillProperties   *Properties
+	WillTopic        string
+	WillMessage      []byte
+	Username         string
+	Password         []byte
+}
+
+func (c *ConnectPacket) String() string {
+	return fmt.Sprintf("%s protocolversion: %d protocolname: %s cleansession: %t willflag: %t willqos: %d willretain: %t usernameflag: %t passwordflag: %t keepalive: %d clientId: %s willtopic: %s username: %s",
+		c.FixedHeader, c.ProtocolVersion, c.ProtocolName, c.CleanSession, c.WillFlag, c.WillQos, c.WillRetain, c.UsernameFlag, c.PasswordFlag, c.Keepalive, c.ClientIdentifier, c.WillTopic, c.Username)
+}
+
+// Write writes the CONNECT packet. The version argument is ignored in favour
+// of the packet's own ProtocolVersion.
+func (c *ConnectPacket) Write(w io.Writer, _ byte) error {
+	return write(w, c, c.ProtocolVersion)
+}
+
+// Pack encodes the variable header and the payload of the CONNECT packet.
+func (c *ConnectPacket) Pack(_ byte) ([]byte, error) {
+	if c.ProtocolName == "" {
+		c.ProtocolName = "MQTT"
+		if c.ProtocolVersion == V31 {
+			c.ProtocolName = "MQIsdp"
+		}
+	}
+	c.UsernameFlag = c.UsernameFlag || c.Username != ""
+	c.PasswordFlag = c.PasswordFlag || len(c.Password) > 0
+
+	var b []byte
+	b = appendString(b, c.ProtocolName)
+	b = append(b, c.ProtocolVersion)
+	var flags byte
+	if c.CleanSession {
+		flags |= 0x02
+	}
+	if c.WillFlag {
+		flags |= 0x04 | c.WillQos<<3
+		if c.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if c.PasswordFlag {
+		flags |= 0x40
+	}
+	if c.UsernameFlag {
+		flags |= 0x80
+	}
+	b = append(b, flags)
+	b = appendUint16(b, c.Keepalive)
+	if c.ProtocolVersion == V5 {
+		b = append(b, c.Properties.Pack()...)
+	}
+	b = appendString(b, c.ClientIdentifier)
+	if c.WillFlag {
+		if c.ProtocolVersion == V5 {
+			b = append(b, c.WillProperties.Pack()...)
+		}
+		b = appendString(b, c.WillTopic)
+		b = appendBinary(b, c.WillMessage)
+	}
+	if c.UsernameFlag {
+		b = appendString(b, c.Username)
+	}
+	if c.PasswordFlag {
+		b = appendBinary(b, c.Password)
+	}
+	return b, nil
+}
+
+// Unpack decodes the CONNECT packet. The version argument is ignored
+// since CONNECT carries the protocol version itself.
+func (c *ConnectPacket) Unpack(b []byte, _ byte) error {
+	d := decoder{b: b}
+	c.ProtocolName = d.string()
+	c.ProtocolVersion = d.byte()
+	if d.bad {
+		return ErrMalformedPacket
+	}
+	switch c.ProtocolVersion {
+	case V31, V311, V5:
+	default:
+		return ErrUnsupportedVersion
+	}
+	flags := d.byte()
+	c.ReservedBit = flags & 0x01
+	c.CleanSession = flags&0x02 > 0
+	c.WillFlag = flags&0x04 > 0
+	c.WillQos = (flags >> 3) & 0x03
+	c.WillRetain = flags&0x20 > 0
+	c.PasswordFlag = flags&0x40 > 0
+	c.UsernameFlag = flags&0x80 > 0
+	c.Keepalive = d.uint16()
+	if c.ProtocolVersion == V5 {
+		c.Properties = unpackProperties(&d)
+	}
+	c.ClientIdentifier = d.string()
+	if c.WillFlag {
+		if c.ProtocolVersion == V5 {
+			c.WillProperties = unpackProperties(&d)
+		}
+		c.WillTopic = d.string()
+		c.WillMessage = d.binary()
+	}
+	if c.UsernameFlag {
+		c.Username = d.string()
+	}
+	if c.PasswordFlag {
+		c.Password = d.binary()
+	}
+	return d.err()
+}
+
+// Validate performs validation of the fields of a CONNECT packet and returns
+// the CONNACK code to reply with.
+func (c *ConnectPacket) Validate() byte {
+	if c.ProtocolVersion == V5 {
+		switch {
+		case c.ProtocolName != "MQTT", c.ReservedBit != 0, c.WillQos > 2, !c.WillFlag && (c.WillQos != 0 || c.WillRetain):
+			return MalformedPacket
+		case len(c.ClientIdentifier) > 65535:
+			return ClientIdentifierNotValid
+		}
+		return Success
+	}
+	switch {
+	case c.PasswordFlag && !c.UsernameFlag:
+		return ErrRefusedBadUsernameOrPassword
+	case c.ReservedBit != 0:
+		return ErrRefusedBadProtocolVersion
+	case (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != V31) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != V311):
+		return ErrRefusedBadProtocolVersion
+	case c.ProtocolName != "MQIsdp" && c.ProtocolName != "MQTT":
+		return ErrRefusedBadProtocolVersion
+	case len(c.ClientIdentifier) > 65535 || (len(c.ClientIdentifier) == 0 && !c.CleanSession):
+		return ErrRefusedIDRejected
+	}
+	return Accepted
+}
+
+// ConnackPacket is an internal representation of the fields of the CONNACK packet.
+type ConnackPacket struct {
+	FixedHeader
+	SessionPresent bool
+	// ReturnCode is the CONNACK return code for MQTT 3.1.x
+	// and the reason code for MQTT 5.0.
+	ReturnCode byte
+	Properties *Properties
+}
+
+func (ca *ConnackPacket) String() string {
+	return fmt.Sprintf("%s sessionpresent: %t returncode: %d", ca.FixedHeader, ca.SessionPresent, ca.ReturnCode)
+}
+
+// Write writes the CONNACK packet.
+func (ca *ConnackPacket) Write(w io.Writer, version byte) error {
+	return write(w, ca, version)
+}
+
+// Pack encodes the CONNACK packet.
+func (ca *ConnackPacket) Pack(version byte) ([]byte, error) {
+	var b []byte
+	if ca.SessionPresent {
+		b = append(b, 0x01)
+	} else {
+		b = append(b, 0x00)
+	}
+	b = append(b, ca.ReturnCode)
+	if version == V5 {
+		b = append(b, ca.Properties.Pack()...)
+	}
+	return b, nil
+}
+
+// Unpack decodes the CONNACK packet.
+func (ca *ConnackPacket) Unpack(b []byte, version byte) error {
+	d := decoder{b: b}
+	ca.SessionPresent = d.byte()&0x01 > 0
+	ca.ReturnCode = d.byte()
+	if version == V5 && d.len() > 0 {
+		ca.Properties = unpackProperties(&d)
+	}
+	return d.err()
+}
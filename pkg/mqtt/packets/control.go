@@ -0,0 +1,144 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PingreqPacket is an internal representation of the fields of the PINGREQ packet.
+type PingreqPacket struct {
+	FixedHeader
+}
+
+func (pr *PingreqPacket) String() string {
+	return pr.FixedHeader.String()
+}
+
+// Write writes the PINGREQ packet.
+func (pr *PingreqPacket) Write(w io.Writer, version byte) error {
+	return write(w, pr, version)
+}
+
+// Pack encodes the PINGREQ packet.
+func (pr *PingreqPacket) Pack(_ byte) ([]byte, error) {
+	return nil, nil
+}
+
+// Unpack decodes the PINGREQ packet.
+func (pr *PingreqPacket) Unpack(_ []byte, _ byte) error {
+	return nil
+}
+
+// PingrespPacket is an internal representation of the fields of the PINGRESP packet.
+type PingrespPacket struct {
+	FixedHeader
+}
+
+func (pr *PingrespPacket) String() string {
+	return pr.FixedHeader.String()
+}
+
+// Write writes the PINGRESP packet.
+func (pr *PingrespPacket) Write(w io.Writer, version byte) error {
+	return write(w, pr, version)
+}
+
+// Pack encodes the PINGRESP packet.
+func (pr *PingrespPacket) Pack(_ byte) ([]byte, error) {
+	return nil, nil
+}
+
+// Unpack decodes the PINGRESP packet.
+func (pr *PingrespPacket) Unpack(_ []byte, _ byte) error {
+	return nil
+}
+
+// DisconnectPacket is an internal representation of the fields of the DISCONNECT packet.
+type DisconnectPacket struct {
+	FixedHeader
+	// ReasonCode and Properties are only present in MQTT 5.0.
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (d *DisconnectPacket) String() string {
+	return fmt.Sprintf("%s reasoncode: %d", d.FixedHeader, d.ReasonCode)
+}
+
+// Write writes the DISCONNECT packet.
+func (d *DisconnectPacket) Write(w io.Writer, version byte) error {
+	return write(w, d, version)
+}
+
+// Pack encodes the DISCONNECT packet.
+func (d *DisconnectPacket) Pack(version byte) ([]byte, error) {
+	if version != V5 {
+		return nil, nil
+	}
+	pb := d.Properties.Pack()
+	if d.ReasonCode == NormalDisconnection && len(pb) == 1 {
+		return nil, nil
+	}
+	return append([]byte{d.ReasonCode}, pb...), nil
+}
+
+// Unpack decodes the DISCONNECT packet.
+func (d *DisconnectPacket) Unpack(b []byte, version byte) error {
+	if version != V5 {
+		return nil
+	}
+	dec := decoder{b: b}
+	if dec.len() > 0 {
+		d.ReasonCode = dec.byte()
+	}
+	if dec.len() > 0 {
+		d.Properties = unpackProperties(&dec)
+	}
+	return dec.err()
+}
+
+// AuthPacket is an internal representation of the fields of the MQTT 5.0 AUTH packet.
+type AuthPacket struct {
+	FixedHeader
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (a *AuthPacket) String() string {
+	return fmt.Sprintf("%s reasoncode: %d", a.FixedHeader, a.ReasonCode)
+}
+
+// Write writes the AUTH packet.
+func (a *AuthPacket) Write(w io.Writer, version byte) error {
+	return write(w, a, version)
+}
+
+// Pack encodes the AUTH packet.
+func (a *AuthPacket) Pack(version byte) ([]byte, error) {
+	if version != V5 {
+		return nil, ErrUnsupportedVersion
+	}
+	pb := a.Properties.Pack()
+	if a.ReasonCode == Success && len(pb) == 1 {
+		return nil, nil
+	}
+	return append([]byte{a.ReasonCode}, pb...), nil
+}
+
+// Unpack decodes the AUTH packet.
+func (a *AuthPacket) Unpack(b []byte, version byte) error {
+	if version != V5 {
+		return ErrUnsupportedVersion
+	}
+	d := decoder{b: b}
+	if d.len() > 0 {
+		a.ReasonCode = d.byte()
+	}
+	if d.len() > 0 {
+		a.Properties = unpackProperties(&d)
+	}
+	return d.err()
+}
@@ -0,0 +1,282 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package packets implements encoding and decoding of MQTT 3.1, 3.1.1 and 5.0
+// control packets.
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol versions as carried in the CONNECT packet.
+const (
+	V31  byte = 3
+	V311 byte = 4
+	V5   byte = 5
+)
+
+// Control packet types.
+const (
+	Connect     byte = 1
+	Connack     byte = 2
+	Publish     byte = 3
+	Puback      byte = 4
+	Pubrec      byte = 5
+	Pubrel      byte = 6
+	Pubcomp     byte = 7
+	Subscribe   byte = 8
+	Suback      byte = 9
+	Unsubscribe byte = 10
+	Unsuback    byte = 11
+	Pingreq     byte = 12
+	Pingresp    byte = 13
+	Disconnect  byte = 14
+	Auth        byte = 15
+)
+
+// PacketNames maps the packet type to its name.
+var PacketNames = map[byte]string{
+	Connect:     "CONNECT",
+	Connack:     "CONNACK",
+	Publish:     "PUBLISH",
+	Puback:      "PUBACK",
+	Pubrec:      "PUBREC",
+	Pubrel:      "PUBREL",
+	Pubcomp:     "PUBCOMP",
+	Subscribe:   "SUBSCRIBE",
+	Suback:      "SUBACK",
+	Unsubscribe: "UNSUBSCRIBE",
+	Unsuback:    "UNSUBACK",
+	Pingreq:     "PINGREQ",
+	Pingresp:    "PINGRESP",
+	Disconnect:  "DISCONNECT",
+	Auth:        "AUTH",
+}
+
+// MaxRemainingLength is the largest value the remaining length field can encode.
+const MaxRemainingLength = 268435455
+
+var (
+	// ErrMalformedPacket indicates the packet could not be decoded.
+	ErrMalformedPacket = errors.New("malformed packet")
+
+	// ErrUnknownPacketType indicates an unsupported control packet type.
+	ErrUnknownPacketType = errors.New("unknown packet type")
+
+	// ErrUnsupportedVersion indicates an unsupported protocol version.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrRemainingLength indicates an invalid remaining length field.
+	ErrRemainingLength = errors.New("invalid remaining length")
+
+	// ErrPacketTooLarge indicates the packet exceeds the maximum packet size.
+	ErrPacketTooLarge = errors.New("packet too large")
+)
+
+// ControlPacket is the interface implemented by all MQTT control packets.
+type ControlPacket interface {
+	// Header returns the fixed header of the packet.
+	Header() *FixedHeader
+
+	// Unpack decodes the variable header and payload of the packet.
+	Unpack(b []byte, version byte) error
+
+	// Pack encodes the variable header and payload of the packet.
+	Pack(version byte) ([]byte, error)
+
+	// Write encodes the whole packet and writes it to w.
+	Write(w io.Writer, version byte) error
+
+	String() string
+}
+
+// FixedHeader represents the MQTT fixed header.
+type FixedHeader struct {
+	MessageType     byte
+	Dup             bool
+	Qos             byte
+	Retain          bool
+	RemainingLength int
+}
+
+// Header returns the fixed header itself so that it satisfies ControlPacket
+// when embedded.
+func (fh *FixedHeader) Header() *FixedHeader {
+	return fh
+}
+
+func (fh FixedHeader) String() string {
+	return fmt.Sprintf("%s: dup: %t qos: %d retain: %t rLength: %d", PacketNames[fh.MessageType], fh.Dup, fh.Qos, fh.Retain, fh.RemainingLength)
+}
+
+// Size returns the size of the whole packet on the wire.
+func (fh FixedHeader) Size() int {
+	return 1 + varintLen(fh.RemainingLength) + fh.RemainingLength
+}
+
+func (fh FixedHeader) flags() byte {
+	switch fh.MessageType {
+	case Publish:
+		b := fh.Qos << 1
+		if fh.Dup {
+			b |= 0x08
+		}
+		if fh.Retain {
+			b |= 0x01
+		}
+		return b
+	case Pubrel, Subscribe, Unsubscribe:
+		return 0x02
+	default:
+		return 0
+	}
+}
+
+// Encode returns the encoded fixed header for a body of the given length.
+func (fh FixedHeader) Encode(length int) ([]byte, error) {
+	return fh.appendTo(make([]byte, 0, 5), length)
+}
+
+// appendTo appends the encoded fixed header for a body of the given length to b.
+func (fh FixedHeader) appendTo(b []byte, length int) ([]byte, error) {
+	if length > MaxRemainingLength {
+		return nil, ErrRemainingLength
+	}
+	b = append(b, fh.MessageType<<4|fh.flags())
+	return appendVarint(b, length), nil
+}
+
+// ReadFixedHeader reads and validates the fixed header from r.
+func ReadFixedHeader(r io.Reader) (FixedHeader, error) {
+	b, err := readByte(r)
+	if err != nil {
+		return FixedHeader{}, err
+	}
+	fh := FixedHeader{
+		MessageType: b >> 4,
+		Dup:         b&0x08 > 0,
+		Qos:         (b >> 1) & 0x03,
+		Retain:      b&0x01 > 0,
+	}
+	if fh.MessageType < Connect || fh.MessageType > Auth {
+		return FixedHeader{}, ErrUnknownPacketType
+	}
+	if fh.MessageType == Publish && fh.Qos > 2 {
+		return FixedHeader{}, ErrMalformedPacket
+	}
+	rl, err := readVarint(r)
+	if err != nil {
+		return FixedHeader{}, err
+	}
+	fh.RemainingLength = rl
+	return fh, nil
+}
+
+// NewControlPacket returns an empty packet of the given type.
+func NewControlPacket(packetType byte) ControlPacket {
+	return NewControlPacketWithHeader(FixedHeader{MessageType: packetType})
+}
+
+// NewControlPacketWithHeader returns an empty packet with the given fixed header.
+func NewControlPacketWithHeader(fh FixedHeader) ControlPacket {
+	switch fh.MessageType {
+	case Connect:
+		return &ConnectPacket{FixedHeader: fh}
+	case Connack:
+		return &ConnackPacket{FixedHeader: fh}
+	case Publish:
+		return &PublishPacket{FixedHeader: fh}
+	case Puback:
+		return &PubackPacket{FixedHeader: fh}
+	case Pubrec:
+		return &PubrecPacket{FixedHeader: fh}
+	case Pubrel:
+		fh.Qos = 1
+		return &PubrelPacket{FixedHeader: fh}
+	case Pubcomp:
+		return &PubcompPacket{FixedHeader: fh}
+	case Subscribe:
+		fh.Qos = 1
+		return &SubscribePacket{FixedHeader: fh}
+	case Suback:
+		return &SubackPacket{FixedHeader: fh}
+	case Unsubscribe:
+		fh.Qos = 1
+		return &UnsubscribePacket{FixedHeader: fh}
+	case Unsuback:
+		return &UnsubackPacket{FixedHeader: fh}
+	case Pingreq:
+		return &PingreqPacket{FixedHeader: fh}
+	case Pingresp:
+		return &PingrespPacket{FixedHeader: fh}
+	case Disconnect:
+		return &DisconnectPacket{FixedHeader: fh}
+	case Auth:
+		return &AuthPacket{FixedHeader: fh}
+	default:
+		return nil
+	}
+}
+
+// ReadPacket reads a whole control packet from r. The version is used to
+// decode all packets but CONNECT, which carries its own protocol version.
+func ReadPacket(r io.Reader, version byte) (ControlPacket, error) {
+	fh, err := ReadFixedHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ReadBody(r, fh, version)
+}
+
+// ReadBody reads and decodes the body of the packet described by the fixed header.
+// Reading the fixed header first allows checking the packet size before the body
+// is allocated.
+func ReadBody(r io.Reader, fh FixedHeader, version byte) (ControlPacket, error) {
+	body := make([]byte, fh.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return Decode(fh, body, version)
+}
+
+// Decode decodes the packet body described by the fixed header.
+func Decode(fh FixedHeader, body []byte, version byte) (ControlPacket, error) {
+	pkt := NewControlPacketWithHeader(fh)
+	if pkt == nil {
+		return nil, ErrUnknownPacketType
+	}
+	if err := pkt.Unpack(body, version); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// Version returns the protocol version of the CONNECT packet,
+// or 0 for other packet types.
+func Version(pkt ControlPacket) byte {
+	if c, ok := pkt.(*ConnectPacket); ok {
+		return c.ProtocolVersion
+	}
+	return 0
+}
+
+func write(w io.Writer, pkt ControlPacket, version byte) error {
+	body, err := pkt.Pack(version)
+	if err != nil {
+		return err
+	}
+	fh := pkt.Header()
+	fh.RemainingLength = len(body)
+	buf := getBuffer(5 + len(body))
+	defer putBuffer(buf)
+	b, err := fh.appendTo(*buf, len(body))
+	if err != nil {
+		return err
+	}
+	*buf = append(b, body...)
+	_, err = w.Write(*buf)
+	return err
+}
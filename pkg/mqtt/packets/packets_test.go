@@ -0,0 +1,344 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRoundTrip(t *testing.T) {
+	props := &Properties{
+		PayloadFormat:          ptr[byte](1),
+		MessageExpiry:          ptr[uint32](60),
+		ContentType:            "text/plain",
+		ResponseTopic:          "response",
+		CorrelationData:        []byte{1, 2},
+		SubscriptionIdentifier: []int{1, 268435455},
+		TopicAlias:             ptr[uint16](3),
+		User:                   []UserProperty{{Key: "k", Value: "v"}, {Key: "k", Value: "w"}},
+	}
+	cases := []struct {
+		desc    string
+		version byte
+		pkt     ControlPacket
+	}{
+		{
+			desc:    "3.1 CONNECT",
+			version: V31,
+			pkt: &ConnectPacket{
+				FixedHeader: FixedHeader{MessageType: Connect}, ProtocolName: "MQIsdp", ProtocolVersion: V31,
+				CleanSession: true, Keepalive: 30, ClientIdentifier: "client",
+				UsernameFlag: true, Username: "user", PasswordFlag: true, Password: []byte("pass"),
+			},
+		},
+		{
+			desc:    "3.1.1 CONNECT with will",
+			version: V311,
+			pkt: &ConnectPacket{
+				FixedHeader: FixedHeader{MessageType: Connect}, ProtocolName: "MQTT", ProtocolVersion: V311,
+				Keepalive: 60, ClientIdentifier: "client",
+				WillFlag: true, WillQos: 1, WillRetain: true, WillTopic: "will", WillMessage: []byte("gone"),
+			},
+		},
+		{
+			desc:    "5.0 CONNECT with will",
+			version: V5,
+			pkt: &ConnectPacket{
+				FixedHeader: FixedHeader{MessageType: Connect}, ProtocolName: "MQTT", ProtocolVersion: V5,
+				CleanSession: true, Keepalive: 60, ClientIdentifier: "client",
+				Properties: &Properties{SessionExpiryInterval: ptr[uint32](3600), ReceiveMaximum: ptr[uint16](10), AuthMethod: "token", AuthData: []byte("data")},
+				WillFlag:   true, WillTopic: "will", WillMessage: []byte("gone"),
+				WillProperties: &Properties{WillDelayInterval: ptr[uint32](5)},
+				UsernameFlag:   true, Username: "user",
+			},
+		},
+		{
+			desc:    "3.1.1 CONNACK",
+			version: V311,
+			pkt:     &ConnackPacket{FixedHeader: FixedHeader{MessageType: Connack}, SessionPresent: true, ReturnCode: ErrRefusedNotAuthorized},
+		},
+		{
+			desc:    "5.0 CONNACK",
+			version: V5,
+			pkt: &ConnackPacket{
+				FixedHeader: FixedHeader{MessageType: Connack}, ReturnCode: Success,
+				Properties: &Properties{ServerKeepAlive: ptr[uint16](30), AssignedClientID: "assigned", MaximumQoS: ptr[byte](1), MaximumPacketSize: ptr[uint32](1024)},
+			},
+		},
+		{
+			desc:    "3.1.1 PUBLISH QoS 0",
+			version: V311,
+			pkt:     &PublishPacket{FixedHeader: FixedHeader{MessageType: Publish, Retain: true}, TopicName: "a/b", Payload: []byte("payload")},
+		},
+		{
+			desc:    "3.1.1 PUBLISH QoS 2",
+			version: V311,
+			pkt:     &PublishPacket{FixedHeader: FixedHeader{MessageType: Publish, Qos: 2, Dup: true}, TopicName: "a/b", MessageID: 7, Payload: []byte("payload")},
+		},
+		{
+			desc:    "5.0 PUBLISH",
+			version: V5,
+			pkt:     &PublishPacket{FixedHeader: FixedHeader{MessageType: Publish, Qos: 1}, TopicName: "a/b", MessageID: 7, Properties: props, Payload: []byte("payload")},
+		},
+		{
+			desc:    "3.1.1 PUBACK",
+			version: V311,
+			pkt:     &PubackPacket{FixedHeader: FixedHeader{MessageType: Puback}, MessageID: 7},
+		},
+		{
+			desc:    "5.0 PUBACK with reason code",
+			version: V5,
+			pkt:     &PubackPacket{FixedHeader: FixedHeader{MessageType: Puback}, MessageID: 7, ReasonCode: NotAuthorized, Properties: &Properties{ReasonString: "denied"}},
+		},
+		{
+			desc:    "5.0 PUBREL",
+			version: V5,
+			pkt:     &PubrelPacket{FixedHeader: FixedHeader{MessageType: Pubrel, Qos: 1}, MessageID: 7, ReasonCode: PacketIdentifierNotFound},
+		},
+		{
+			desc:    "3.1.1 SUBSCRIBE",
+			version: V311,
+			pkt:     &SubscribePacket{FixedHeader: FixedHeader{MessageType: Subscribe, Qos: 1}, MessageID: 7, Topics: []string{"a", "b/#"}, Options: []byte{0, 2}},
+		},
+		{
+			desc:    "5.0 SUBSCRIBE",
+			version: V5,
+			pkt: &SubscribePacket{
+				FixedHeader: FixedHeader{MessageType: Subscribe, Qos: 1}, MessageID: 7,
+				Properties: &Properties{SubscriptionIdentifier: []int{5}}, Topics: []string{"a", "b/#"}, Options: []byte{0x2e, 1},
+			},
+		},
+		{
+			desc:    "5.0 SUBACK",
+			version: V5,
+			pkt:     &SubackPacket{FixedHeader: FixedHeader{MessageType: Suback}, MessageID: 7, Properties: &Properties{}, ReturnCodes: []byte{1, NotAuthorized}},
+		},
+		{
+			desc:    "3.1.1 UNSUBSCRIBE",
+			version: V311,
+			pkt:     &UnsubscribePacket{FixedHeader: FixedHeader{MessageType: Unsubscribe, Qos: 1}, MessageID: 7, Topics: []string{"a", "b/#"}},
+		},
+		{
+			desc:    "3.1.1 PINGREQ",
+			version: V311,
+			pkt:     &PingreqPacket{FixedHeader: FixedHeader{MessageType: Pingreq}},
+		},
+		{
+			desc:    "3.1.1 DISCONNECT",
+			version: V311,
+			pkt:     &DisconnectPacket{FixedHeader: FixedHeader{MessageType: Disconnect}},
+		},
+		{
+			desc:    "5.0 DISCONNECT",
+			version: V5,
+			pkt:     &DisconnectPacket{FixedHeader: FixedHeader{MessageType: Disconnect}, ReasonCode: SessionTakenOver, Properties: &Properties{ServerReference: "other"}},
+		},
+		{
+			desc:    "5.0 AUTH",
+			version: V5,
+			pkt:     &AuthPacket{FixedHeader: FixedHeader{MessageType: Auth}, ReasonCode: ContinueAuthentication, Properties: &Properties{AuthMethod: "token", AuthData: []byte("data")}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tc.pkt.Write(&buf, tc.version); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			encoded := bytes.Clone(buf.Bytes())
+			got, err := ReadPacket(&buf, tc.version)
+			if err != nil {
+				t.Fatalf("ReadPacket() = %v", err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d bytes left unread", buf.Len())
+			}
+			tc.pkt.Header().RemainingLength = got.Header().RemainingLength
+			if !reflect.DeepEqual(got, tc.pkt) {
+				t.Errorf("ReadPacket() = %+v, want %+v", got, tc.pkt)
+			}
+			buf.Reset()
+			if err := got.Write(&buf, tc.version); err != nil {
+				t.Fatalf("Write() decoded = %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), encoded) {
+				t.Errorf("encoded again as % x, want % x", buf.Bytes(), encoded)
+			}
+		})
+	}
+}
+
+// TestEncoding checks the wire format of packets which differ between versions.
+func TestEncoding(t *testing.T) {
+	cases := []struct {
+		desc    string
+		version byte
+		pkt     ControlPacket
+		want    []byte
+	}{
+		{
+			desc:    "3.1 CONNECT",
+			version: V31,
+			pkt:     &ConnectPacket{FixedHeader: FixedHeader{MessageType: Connect}, ProtocolVersion: V31, CleanSession: true, Keepalive: 10, ClientIdentifier: "c"},
+			want:    []byte{0x10, 15, 0, 6, 'M', 'Q', 'I', 's', 'd', 'p', 3, 0x02, 0, 10, 0, 1, 'c'},
+		},
+		{
+			desc:    "3.1.1 CONNECT",
+			version: V311,
+			pkt:     &ConnectPacket{FixedHeader: FixedHeader{MessageType: Connect}, ProtocolVersion: V311, CleanSession: true, Keepalive: 10, ClientIdentifier: "c"},
+			want:    []byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 10, 0, 1, 'c'},
+		},
+		{
+			desc:    "5.0 CONNECT",
+			version: V5,
+			pkt:     &ConnectPacket{FixedHeader: FixedHeader{MessageType: Connect}, ProtocolVersion: V5, CleanSession: true, Keepalive: 10, ClientIdentifier: "c"},
+			want:    []byte{0x10, 14, 0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 10, 0, 0, 1, 'c'},
+		},
+		{
+			desc:    "3.1.1 PUBLISH",
+			version: V311,
+			pkt:     &PublishPacket{FixedHeader: FixedHeader{MessageType: Publish, Qos: 1}, TopicName: "t", MessageID: 1, Payload: []byte("p")},
+			want:    []byte{0x32, 6, 0, 1, 't', 0, 1, 'p'},
+		},
+		{
+			desc:    "5.0 PUBLISH",
+			version: V5,
+			pkt:     &PublishPacket{FixedHeader: FixedHeader{MessageType: Publish, Qos: 1}, TopicName: "t", MessageID: 1, Payload: []byte("p")},
+			want:    []byte{0x32, 7, 0, 1, 't', 0, 1, 0, 'p'},
+		},
+		{
+			desc:    "3.1.1 PUBACK drops the reason code",
+			version: V311,
+			pkt:     &PubackPacket{FixedHeader: FixedHeader{MessageType: Puback}, MessageID: 1, ReasonCode: NotAuthorized},
+			want:    []byte{0x40, 2, 0, 1},
+		},
+		{
+			desc:    "5.0 PUBACK omits success",
+			version: V5,
+			pkt:     &PubackPacket{FixedHeader: FixedHeader{MessageType: Puback}, MessageID: 1},
+			want:    []byte{0x40, 2, 0, 1},
+		},
+		{
+			desc:    "5.0 PUBACK with reason code",
+			version: V5,
+			pkt:     &PubackPacket{FixedHeader: FixedHeader{MessageType: Puback}, MessageID: 1, ReasonCode: NotAuthorized},
+			want:    []byte{0x40, 3, 0, 1, NotAuthorized},
+		},
+		{
+			desc:    "3.1.1 SUBSCRIBE keeps the QoS only",
+			version: V311,
+			pkt:     &SubscribePacket{FixedHeader: FixedHeader{MessageType: Subscribe, Qos: 1}, MessageID: 1, Topics: []string{"t"}, Options: []byte{0x2d}},
+			want:    []byte{0x82, 6, 0, 1, 0, 1, 't', 1},
+		},
+		{
+			desc:    "5.0 SUBSCRIBE",
+			version: V5,
+			pkt:     &SubscribePacket{FixedHeader: FixedHeader{MessageType: Subscribe, Qos: 1}, MessageID: 1, Topics: []string{"t"}, Options: []byte{0x2d}},
+			want:    []byte{0x82, 7, 0, 1, 0, 0, 1, 't', 0x2d},
+		},
+		{
+			desc:    "3.1.1 DISCONNECT",
+			version: V311,
+			pkt:     &DisconnectPacket{FixedHeader: FixedHeader{MessageType: Disconnect}, ReasonCode: SessionTakenOver},
+			want:    []byte{0xe0, 0},
+		},
+		{
+			desc:    "5.0 DISCONNECT",
+			version: V5,
+			pkt:     &DisconnectPacket{FixedHeader: FixedHeader{MessageType: Disconnect}, ReasonCode: SessionTakenOver},
+			want:    []byte{0xe0, 2, SessionTakenOver, 0},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tc.pkt.Write(&buf, tc.version); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), tc.want) {
+				t.Errorf("Write() = % x, want % x", buf.Bytes(), tc.want)
+			}
+		})
+	}
+}
+
+func TestRemainingLength(t *testing.T) {
+	cases := []struct {
+		length int
+		want   []byte
+	}{
+		{length: 0, want: []byte{0x00}},
+		{length: 127, want: []byte{0x7f}},
+		{length: 128, want: []byte{0x80, 0x01}},
+		{length: 16383, want: []byte{0xff, 0x7f}},
+		{length: 16384, want: []byte{0x80, 0x80, 0x01}},
+		{length: 2097152, want: []byte{0x80, 0x80, 0x80, 0x01}},
+		{length: MaxRemainingLength, want: []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, tc := range cases {
+		fh := FixedHeader{MessageType: Pingreq}
+		b, err := fh.Encode(tc.length)
+		if err != nil {
+			t.Fatalf("Encode(%d) = %v", tc.length, err)
+		}
+		if !bytes.Equal(b[1:], tc.want) {
+			t.Errorf("Encode(%d) = % x, want % x", tc.length, b[1:], tc.want)
+		}
+		got, err := ReadFixedHeader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("ReadFixedHeader(% x) = %v", b, err)
+		}
+		if got.RemainingLength != tc.length {
+			t.Errorf("ReadFixedHeader(% x) length = %d, want %d", b, got.RemainingLength, tc.length)
+		}
+	}
+	if _, err := (FixedHeader{MessageType: Pingreq}).Encode(MaxRemainingLength + 1); !errors.Is(err, ErrRemainingLength) {
+		t.Errorf("Encode(MaxRemainingLength+1) = %v, want %v", err, ErrRemainingLength)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	cases := []struct {
+		desc    string
+		version byte
+		b       []byte
+		err     error
+	}{
+		{desc: "empty", version: V311, b: nil, err: io.EOF},
+		{desc: "reserved packet type", version: V311, b: []byte{0x00, 0}, err: ErrUnknownPacketType},
+		{desc: "PUBLISH QoS 3", version: V311, b: []byte{0x36, 0}, err: ErrMalformedPacket},
+		{desc: "truncated remaining length", version: V311, b: []byte{0x30, 0x80, 0x80}, err: io.EOF},
+		{desc: "remaining length over four bytes", version: V311, b: []byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}, err: ErrRemainingLength},
+		{desc: "truncated body", version: V311, b: []byte{0x30, 5, 0, 1, 't'}, err: io.ErrUnexpectedEOF},
+		{desc: "topic length over body", version: V311, b: []byte{0x30, 3, 0, 9, 't'}, err: ErrMalformedPacket},
+		{desc: "PUBACK without packet identifier", version: V311, b: []byte{0x40, 1, 0}, err: ErrMalformedPacket},
+		{desc: "property length over body", version: V5, b: []byte{0x40, 4, 0, 1, 0, 9}, err: ErrMalformedPacket},
+		{desc: "truncated property length", version: V5, b: []byte{0x40, 4, 0, 1, 0, 0x80}, err: ErrMalformedPacket},
+		{desc: "property value over property length", version: V5, b: []byte{0x40, 6, 0, 1, 0, 2, PropMessageExpiry, 0}, err: ErrMalformedPacket},
+		{desc: "unknown property", version: V5, b: []byte{0x40, 6, 0, 1, 0, 2, 0x7f, 0}, err: ErrMalformedPacket},
+		{desc: "subscription identifier over four bytes", version: V5, b: []byte{0x30, 10, 0, 1, 't', 6, PropSubscriptionIdentifier, 0x80, 0x80, 0x80, 0x80, 0x01}, err: ErrMalformedPacket},
+		{desc: "SUBSCRIBE without topics", version: V311, b: []byte{0x82, 2, 0, 1}, err: ErrMalformedPacket},
+		{desc: "SUBSCRIBE without options", version: V311, b: []byte{0x82, 5, 0, 1, 0, 1, 't'}, err: ErrMalformedPacket},
+		{desc: "CONNECT without protocol version", version: V311, b: []byte{0x10, 6, 0, 4, 'M', 'Q', 'T', 'T'}, err: ErrMalformedPacket},
+		{desc: "CONNECT with unknown protocol version", version: V311, b: []byte{0x10, 7, 0, 4, 'M', 'Q', 'T', 'T', 6}, err: ErrUnsupportedVersion},
+		{desc: "CONNECT without client identifier", version: V311, b: []byte{0x10, 10, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 10}, err: ErrMalformedPacket},
+		{desc: "3.1.1 AUTH", version: V311, b: []byte{0xf0, 0}, err: ErrUnsupportedVersion},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			pkt, err := ReadPacket(bytes.NewReader(tc.b), tc.version)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("ReadPacket(% x) = %v, %v, want %v", tc.b, pkt, err, tc.err)
+			}
+		})
+	}
+}
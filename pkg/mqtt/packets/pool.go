@@ -0,0 +1,34 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import "sync"
+
+// maxPooledSize is the capacity of the largest buffer kept in the pool,
+// so that a few large packets do not pin memory.
+const maxPooledSize = 64 * 1024
+
+var bufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// getBuffer returns an empty pooled buffer with at least the given capacity.
+func getBuffer(size int) *[]byte {
+	b := bufPool.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, 0, size)
+	}
+	*b = (*b)[:0]
+	return b
+}
+
+func putBuffer(b *[]byte) {
+	if b == nil || cap(*b) > maxPooledSize {
+		return
+	}
+	bufPool.Put(b)
+}
@@ -0,0 +1,292 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+// MQTT 5.0 property identifiers.
+const (
+	PropPayloadFormat          byte = 0x01
+	PropMessageExpiry          byte = 0x02
+	PropContentType            byte = 0x03
+	PropResponseTopic          byte = 0x08
+	PropCorrelationData        byte = 0x09
+	PropSubscriptionIdentifier byte = 0x0B
+	PropSessionExpiryInterval  byte = 0x11
+	PropAssignedClientID       byte = 0x12
+	PropServerKeepAlive        byte = 0x13
+	PropAuthMethod             byte = 0x15
+	PropAuthData               byte = 0x16
+	PropRequestProblemInfo     byte = 0x17
+	PropWillDelayInterval      byte = 0x18
+	PropRequestResponseInfo    byte = 0x19
+	PropResponseInfo           byte = 0x1A
+	PropServerReference        byte = 0x1C
+	PropReasonString           byte = 0x1F
+	PropReceiveMaximum         byte = 0x21
+	PropTopicAliasMaximum      byte = 0x22
+	PropTopicAlias             byte = 0x23
+	PropMaximumQoS             byte = 0x24
+	PropRetainAvailable        byte = 0x25
+	PropUserProperty           byte = 0x26
+	PropMaximumPacketSize      byte = 0x27
+	PropWildcardSubAvailable   byte = 0x28
+	PropSubIDAvailable         byte = 0x29
+	PropSharedSubAvailable     byte = 0x2A
+)
+
+// UserProperty is a MQTT 5.0 user property name-value pair.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds MQTT 5.0 properties. Optional numeric properties are
+// pointers so that absence can be distinguished from the zero value.
+type Properties struct {
+	PayloadFormat          *byte
+	MessageExpiry          *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+	SessionExpiryInterval  *uint32
+	AssignedClientID       string
+	ServerKeepAlive        *uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      *uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         *uint16
+	TopicAliasMaximum      *uint16
+	TopicAlias             *uint16
+	MaximumQoS             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      *uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+}
+
+// GetUserProperty returns the value of the first user property with the given key.
+func (p *Properties) GetUserProperty(key string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	for _, u := range p.User {
+		if u.Key == key {
+			return u.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetUserProperty replaces all user properties with the given key with a single value.
+func (p *Properties) SetUserProperty(key, value string) {
+	p.DelUserProperty(key)
+	p.User = append(p.User, UserProperty{Key: key, Value: value})
+}
+
+// DelUserProperty removes all user properties with the given key.
+func (p *Properties) DelUserProperty(key string) {
+	user := p.User[:0]
+	for _, u := range p.User {
+		if u.Key != key {
+			user = append(user, u)
+		}
+	}
+	p.User = user
+}
+
+// Pack encodes the properties including the leading property length.
+func (p *Properties) Pack() []byte {
+	var b []byte
+	if p != nil {
+		b = p.pack()
+	}
+	ret := appendVarint(make([]byte, 0, len(b)+varintLen(len(b))), len(b))
+	return append(ret, b...)
+}
+
+func (p *Properties) pack() []byte {
+	var b []byte
+	if p.PayloadFormat != nil {
+		b = append(b, PropPayloadFormat, *p.PayloadFormat)
+	}
+	if p.MessageExpiry != nil {
+		b = appendUint32(append(b, PropMessageExpiry), *p.MessageExpiry)
+	}
+	if p.ContentType != "" {
+		b = appendString(append(b, PropContentType), p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		b = appendString(append(b, PropResponseTopic), p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		b = appendBinary(append(b, PropCorrelationData), p.CorrelationData)
+	}
+	for _, id := range p.SubscriptionIdentifier {
+		b = appendVarint(append(b, PropSubscriptionIdentifier), id)
+	}
+	if p.SessionExpiryInterval != nil {
+		b = appendUint32(append(b, PropSessionExpiryInterval), *p.SessionExpiryInterval)
+	}
+	if p.AssignedClientID != "" {
+		b = appendString(append(b, PropAssignedClientID), p.AssignedClientID)
+	}
+	if p.ServerKeepAlive != nil {
+		b = appendUint16(append(b, PropServerKeepAlive), *p.ServerKeepAlive)
+	}
+	if p.AuthMethod != "" {
+		b = appendString(append(b, PropAuthMethod), p.AuthMethod)
+	}
+	if p.AuthData != nil {
+		b = appendBinary(append(b, PropAuthData), p.AuthData)
+	}
+	if p.RequestProblemInfo != nil {
+		b = append(b, PropRequestProblemInfo, *p.RequestProblemInfo)
+	}
+	if p.WillDelayInterval != nil {
+		b = appendUint32(append(b, PropWillDelayInterval), *p.WillDelayInterval)
+	}
+	if p.RequestResponseInfo != nil {
+		b = append(b, PropRequestResponseInfo, *p.RequestResponseInfo)
+	}
+	if p.ResponseInfo != "" {
+		b = appendString(append(b, PropResponseInfo), p.ResponseInfo)
+	}
+	if p.ServerReference != "" {
+		b = appendString(append(b, PropServerReference), p.ServerReference)
+	}
+	if p.ReasonString != "" {
+		b = appendString(append(b, PropReasonString), p.ReasonString)
+	}
+	if p.ReceiveMaximum != nil {
+		b = appendUint16(append(b, PropReceiveMaximum), *p.ReceiveMaximum)
+	}
+	if p.TopicAliasMaximum != nil {
+		b = appendUint16(append(b, PropTopicAliasMaximum), *p.TopicAliasMaximum)
+	}
+	if p.TopicAlias != nil {
+		b = appendUint16(append(b, PropTopicAlias), *p.TopicAlias)
+	}
+	if p.MaximumQoS != nil {
+		b = append(b, PropMaximumQoS, *p.MaximumQoS)
+	}
+	if p.RetainAvailable != nil {
+		b = append(b, PropRetainAvailable, *p.RetainAvailable)
+	}
+	for _, u := range p.User {
+		b = appendString(appendString(append(b, PropUserProperty), u.Key), u.Value)
+	}
+	if p.MaximumPacketSize != nil {
+		b = appendUint32(append(b, PropMaximumPacketSize), *p.MaximumPacketSize)
+	}
+	if p.WildcardSubAvailable != nil {
+		b = append(b, PropWildcardSubAvailable, *p.WildcardSubAvailable)
+	}
+	if p.SubIDAvailable != nil {
+		b = append(b, PropSubIDAvailable, *p.SubIDAvailable)
+	}
+	if p.SharedSubAvailable != nil {
+		b = append(b, PropSharedSubAvailable, *p.SharedSubAvailable)
+	}
+	return b
+}
+
+// unpackProperties decodes the property length and properties from d.
+func unpackProperties(d *decoder) *Properties {
+	n := d.varint()
+	pd := decoder{b: d.next(n)}
+	if d.bad {
+		return nil
+	}
+	p := &Properties{}
+	for pd.len() > 0 && !pd.bad {
+		switch id := pd.byte(); id {
+		case PropPayloadFormat:
+			v := pd.byte()
+			p.PayloadFormat = &v
+		case PropMessageExpiry:
+			v := pd.uint32()
+			p.MessageExpiry = &v
+		case PropContentType:
+			p.ContentType = pd.string()
+		case PropResponseTopic:
+			p.ResponseTopic = pd.string()
+		case PropCorrelationData:
+			p.CorrelationData = pd.binary()
+		case PropSubscriptionIdentifier:
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, pd.varint())
+		case PropSessionExpiryInterval:
+			v := pd.uint32()
+			p.SessionExpiryInterval = &v
+		case PropAssignedClientID:
+			p.AssignedClientID = pd.string()
+		case PropServerKeepAlive:
+			v := pd.uint16()
+			p.ServerKeepAlive = &v
+		case PropAuthMethod:
+			p.AuthMethod = pd.string()
+		case PropAuthData:
+			p.AuthData = pd.binary()
+		case PropRequestProblemInfo:
+			v := pd.byte()
+			p.RequestProblemInfo = &v
+		case PropWillDelayInterval:
+			v := pd.uint32()
+			p.WillDelayInterval = &v
+		case PropRequestResponseInfo:
+			v := pd.byte()
+			p.RequestResponseInfo = &v
+		case PropResponseInfo:
+			p.ResponseInfo = pd.string()
+		case PropServerReference:
+			p.ServerReference = pd.string()
+		case PropReasonString:
+			p.ReasonString = pd.string()
+		case PropReceiveMaximum:
+			v := pd.uint16()
+			p.ReceiveMaximum = &v
+		case PropTopicAliasMaximum:
+			v := pd.uint16()
+			p.TopicAliasMaximum = &v
+		case PropTopicAlias:
+			v := pd.uint16()
+			p.TopicAlias = &v
+		case PropMaximumQoS:
+			v := pd.byte()
+			p.MaximumQoS = &v
+		case PropRetainAvailable:
+			v := pd.byte()
+			p.RetainAvailable = &v
+		case PropUserProperty:
+			k := pd.string()
+			v := pd.string()
+			p.User = append(p.User, UserProperty{Key: k, Value: v})
+		case PropMaximumPacketSize:
+			v := pd.uint32()
+			p.MaximumPacketSize = &v
+		case PropWildcardSubAvailable:
+			v := pd.byte()
+			p.WildcardSubAvailable = &v
+		case PropSubIDAvailable:
+			v := pd.byte()
+			p.SubIDAvailable = &v
+		case PropSharedSubAvailable:
+			v := pd.byte()
+			p.SharedSubAvailable = &v
+		default:
+			pd.bad = true
+		}
+	}
+	if pd.bad {
+		d.bad = true
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PublishPacket is an internal representation of the fields of the PUBLISH packet.
+type PublishPacket struct {
+	FixedHeader
+	TopicName  string
+	MessageID  uint16
+	Properties *Properties
+	Payload    []byte
+}
+
+func (p *PublishPacket) String() string {
+	return fmt.Sprintf("%s topicName: %s MessageID: %d payload: %s", p.FixedHeader, p.TopicName, p.MessageID, string(p.Payload))
+}
+
+// Write writes the PUBLISH packet. The packet is encoded straight into a pooled
+// buffer, so that the payload is copied only once.
+func (p *PublishPacket) Write(w io.Writer, version byte) error {
+	var props []byte
+	if version == V5 {
+		props = p.Properties.Pack()
+	}
+	length := 2 + len(p.TopicName) + len(props) + len(p.Payload)
+	if p.Qos > 0 {
+		length += 2
+	}
+	buf := getBuffer(5 + length)
+	defer putBuffer(buf)
+	b, err := p.FixedHeader.appendTo(*buf, length)
+	if err != nil {
+		return err
+	}
+	p.RemainingLength = length
+	b = appendString(b, p.TopicName)
+	if p.Qos > 0 {
+		b = appendUint16(b, p.MessageID)
+	}
+	b = append(append(b, props...), p.Payload...)
+	*buf = b
+	_, err = w.Write(b)
+	return err
+}
+
+// Pack encodes the PUBLISH packet.
+func (p *PublishPacket) Pack(version byte) ([]byte, error) {
+	b := make([]byte, 0, len(p.TopicName)+len(p.Payload)+8)
+	b = appendString(b, p.TopicName)
+	if p.Qos > 0 {
+		b = appendUint16(b, p.MessageID)
+	}
+	if version == V5 {
+		b = append(b, p.Properties.Pack()...)
+	}
+	return append(b, p.Payload...), nil
+}
+
+// Unpack decodes the PUBLISH packet.
+func (p *PublishPacket) Unpack(b []byte, version byte) error {
+	d := decoder{b: b}
+	p.TopicName = d.string()
+	if p.Qos > 0 {
+		p.MessageID = d.uint16()
+	}
+	if version == V5 {
+		p.Properties = unpackProperties(&d)
+	}
+	p.Payload = d.rest()
+	return d.err()
+}
+
+// Copy creates a new PublishPacket with the same topic and payload
+// but an empty fixed header, useful for when you want to deliver
+// a message with different properties such as Qos but the same
+// content.
+func (p *PublishPacket) Copy() *PublishPacket {
+	cp := NewControlPacket(Publish).(*PublishPacket)
+	cp.TopicName = p.TopicName
+	cp.Payload = p.Payload
+	cp.Properties = p.Properties
+	return cp
+}
+
+// TopicAlias returns the topic alias of the packet or 0 if none is set.
+func (p *PublishPacket) TopicAlias() uint16 {
+	if p.Properties == nil || p.Properties.TopicAlias == nil {
+		return 0
+	}
+	return *p.Properties.TopicAlias
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// RawPacket is a packet kept in its wire format, so that it can be forwarded
+// without being decoded and encoded again. Raw packets are pooled, Release
+// returns the packet to the pool once it is no longer used.
+type RawPacket struct {
+	FixedHeader
+	// buf holds the whole packet, including the fixed header.
+	buf []byte
+	// body is the variable header and payload part of buf.
+	body []byte
+}
+
+var rawPool = sync.Pool{
+	New: func() any {
+		return &RawPacket{buf: make([]byte, 0, 512)}
+	},
+}
+
+// ReadRaw reads the body of the packet described by the fixed header
+// without decoding it.
+func ReadRaw(r io.Reader, fh FixedHeader) (*RawPacket, error) {
+	p := rawPool.Get().(*RawPacket)
+	p.FixedHeader = fh
+	if err := p.read(r, fh.RemainingLength); err != nil {
+		p.Release()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *RawPacket) read(r io.Reader, length int) error {
+	b, err := p.FixedHeader.appendTo(p.buf[:0], length)
+	if err != nil {
+		return err
+	}
+	header := len(b)
+	if cap(b) < header+length {
+		b = append(make([]byte, 0, header+length), b...)
+	}
+	p.RemainingLength = length
+	p.buf = b[:header+length]
+	p.body = p.buf[header:]
+	_, err = io.ReadFull(r, p.body)
+	return err
+}
+
+func (p *RawPacket) String() string {
+	return fmt.Sprintf("%s raw", p.FixedHeader)
+}
+
+// Write writes the packet as it was read.
+func (p *RawPacket) Write(w io.Writer, _ byte) error {
+	if p.body == nil {
+		return ErrMalformedPacket
+	}
+	_, err := w.Write(p.buf)
+	return err
+}
+
+// Pack returns a copy of the packet body.
+func (p *RawPacket) Pack(_ byte) ([]byte, error) {
+	return append([]byte{}, p.body...), nil
+}
+
+// Unpack replaces the packet body with a copy of b.
+func (p *RawPacket) Unpack(b []byte, _ byte) error {
+	return p.read(bytes.NewReader(b), len(b))
+}
+
+// MessageID returns the packet identifier of PUBACK, PUBREC, PUBREL and
+// PUBCOMP packets, which is the first field of their variable header.
+func (p *RawPacket) MessageID() uint16 {
+	if len(p.body) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(p.body)
+}
+
+// ReasonCode returns the reason code of MQTT 5.0 PUBACK, PUBREC, PUBREL and
+// PUBCOMP packets. The reason code is Success if it is omitted or for the
+// earlier protocol versions.
+func (p *RawPacket) ReasonCode(version byte) byte {
+	if version != V5 || len(p.body) < 3 {
+		return Success
+	}
+	return p.body[2]
+}
+
+// Release returns the buffer of the packet to the pool.
+// The packet must not be used after it is released.
+func (p *RawPacket) Release() {
+	p.body = nil
+	if cap(p.buf) > maxPooledSize {
+		return
+	}
+	rawPool.Put(p)
+}
@@ -0,0 +1,198 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Subscription options bits as defined by MQTT 5.0. MQTT 3.1.x only uses the QoS bits.
+const (
+	SubOptionQoSMask           byte = 0x03
+	SubOptionNoLocal           byte = 0x04
+	SubOptionRetainAsPublished byte = 0x08
+	SubOptionRetainHandling    byte = 0x30
+)
+
+// SubscribePacket is an internal representation of the fields of the SUBSCRIBE packet.
+type SubscribePacket struct {
+	FixedHeader
+	MessageID  uint16
+	Properties *Properties
+	Topics     []string
+	// Options holds the subscription options byte for each of the topics.
+	// For MQTT 3.1.x it only carries the requested QoS.
+	Options []byte
+}
+
+func (s *SubscribePacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d topics: %s", s.FixedHeader, s.MessageID, s.Topics)
+}
+
+// Write writes the SUBSCRIBE packet.
+func (s *SubscribePacket) Write(w io.Writer, version byte) error {
+	return write(w, s, version)
+}
+
+// Pack encodes the SUBSCRIBE packet.
+func (s *SubscribePacket) Pack(version byte) ([]byte, error) {
+	if len(s.Topics) != len(s.Options) {
+		return nil, ErrMalformedPacket
+	}
+	b := appendUint16(nil, s.MessageID)
+	if version == V5 {
+		b = append(b, s.Properties.Pack()...)
+	}
+	for i, t := range s.Topics {
+		b = appendString(b, t)
+		opt := s.Options[i]
+		if version != V5 {
+			opt &= SubOptionQoSMask
+		}
+		b = append(b, opt)
+	}
+	return b, nil
+}
+
+// Unpack decodes the SUBSCRIBE packet.
+func (s *SubscribePacket) Unpack(b []byte, version byte) error {
+	d := decoder{b: b}
+	s.MessageID = d.uint16()
+	if version == V5 {
+		s.Properties = unpackProperties(&d)
+	}
+	for d.len() > 0 && !d.bad {
+		s.Topics = append(s.Topics, d.string())
+		s.Options = append(s.Options, d.byte())
+	}
+	if len(s.Topics) == 0 {
+		return ErrMalformedPacket
+	}
+	return d.err()
+}
+
+// QoS returns the requested QoS of the i-th subscription.
+func (s *SubscribePacket) QoS(i int) byte {
+	return s.Options[i] & SubOptionQoSMask
+}
+
+// SubackPacket is an internal representation of the fields of the SUBACK packet.
+type SubackPacket struct {
+	FixedHeader
+	MessageID  uint16
+	Properties *Properties
+	// ReturnCodes holds the granted QoS or the failure code for each subscription.
+	ReturnCodes []byte
+}
+
+func (sa *SubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d returncodes: %v", sa.FixedHeader, sa.MessageID, sa.ReturnCodes)
+}
+
+// Write writes the SUBACK packet.
+func (sa *SubackPacket) Write(w io.Writer, version byte) error {
+	return write(w, sa, version)
+}
+
+// Pack encodes the SUBACK packet.
+func (sa *SubackPacket) Pack(version byte) ([]byte, error) {
+	b := appendUint16(nil, sa.MessageID)
+	if version == V5 {
+		b = append(b, sa.Properties.Pack()...)
+	}
+	return append(b, sa.ReturnCodes...), nil
+}
+
+// Unpack decodes the SUBACK packet.
+func (sa *SubackPacket) Unpack(b []byte, version byte) error {
+	d := decoder{b: b}
+	sa.MessageID = d.uint16()
+	if version == V5 {
+		sa.Properties = unpackProperties(&d)
+	}
+	sa.ReturnCodes = append([]byte{}, d.rest()...)
+	return d.err()
+}
+
+// UnsubscribePacket is an internal representation of the fields of the UNSUBSCRIBE packet.
+type UnsubscribePacket struct {
+	FixedHeader
+	MessageID  uint16
+	Properties *Properties
+	Topics     []string
+}
+
+func (u *UnsubscribePacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d topics: %s", u.FixedHeader, u.MessageID, u.Topics)
+}
+
+// Write writes the UNSUBSCRIBE packet.
+func (u *UnsubscribePacket) Write(w io.Writer, version byte) error {
+	return write(w, u, version)
+}
+
+// Pack encodes the UNSUBSCRIBE packet.
+func (u *UnsubscribePacket) Pack(version byte) ([]byte, error) {
+	b := appendUint16(nil, u.MessageID)
+	if version == V5 {
+		b = append(b, u.Properties.Pack()...)
+	}
+	for _, t := range u.Topics {
+		b = appendString(b, t)
+	}
+	return b, nil
+}
+
+// Unpack decodes the UNSUBSCRIBE packet.
+func (u *UnsubscribePacket) Unpack(b []byte, version byte) error {
+	d := decoder{b: b}
+	u.MessageID = d.uint16()
+	if version == V5 {
+		u.Properties = unpackProperties(&d)
+	}
+	for d.len() > 0 && !d.bad {
+		u.Topics = append(u.Topics, d.string())
+	}
+	return d.err()
+}
+
+// UnsubackPacket is an internal representation of the fields of the UNSUBACK packet.
+type UnsubackPacket struct {
+	FixedHeader
+	MessageID  uint16
+	Properties *Properties
+	// ReasonCodes are only present in MQTT 5.0.
+	ReasonCodes []byte
+}
+
+func (ua *UnsubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d", ua.FixedHeader, ua.MessageID)
+}
+
+// Write writes the UNSUBACK packet.
+func (ua *UnsubackPacket) Write(w io.Writer, version byte) error {
+	return write(w, ua, version)
+}
+
+// Pack encodes the UNSUBACK packet.
+func (ua *UnsubackPacket) Pack(version byte) ([]byte, error) {
+	b := appendUint16(nil, ua.MessageID)
+	if version == V5 {
+		b = append(b, ua.Properties.Pack()...)
+		b = append(b, ua.ReasonCodes...)
+	}
+	return b, nil
+}
+
+// Unpack decodes the UNSUBACK packet.
+func (ua *UnsubackPacket) Unpack(b []byte, version byte) error {
+	d := decoder{b: b}
+	ua.MessageID = d.uint16()
+	if version == V5 {
+		ua.Properties = unpackProperties(&d)
+		ua.ReasonCodes = append([]byte{}, d.rest()...)
+	}
+	return d.err()
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package quic
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// streamConn is a QUIC stream wrapper so it satisfies the net.Conn interface.
+// The addresses are the current addresses of the QUIC connection, which change
+// when the client migrates to another network.
+type streamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func newConn(s quic.Stream, c quic.Connection) net.Conn {
+	return &streamConn{Stream: s, conn: c}
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ConnectionState returns the state of the TLS handshake of the QUIC connection.
+func (c *streamConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// Close closes both directions of the stream. Closing a QUIC stream only
+// closes its send direction, so the receive direction is canceled.
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// clientConn is the stream of a client session, which owns its QUIC connection.
+type clientConn struct {
+	streamConn
+}
+
+// Close closes the stream, and the connection once the server ended the
+// session or after the linger timeout, since closing the connection
+// discards the data not yet sent, such as the client DISCONNECT.
+func (c *clientConn) Close() error {
+	err := c.Stream.Close()
+	if err := c.Stream.SetReadDeadline(time.Now().Add(lingerTimeout)); err == nil {
+		_, _ = io.Copy(io.Discard, c.Stream)
+	}
+	return errors.Join(err, c.conn.CloseWithError(codeNoError, ""))
+}
@@ -0,0 +1,250 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package quic implements the MQTT over QUIC proxy. Each bidirectional stream
+// opened by a client carries an MQTT session, which is proxied to the target
+// over TCP as by the MQTT proxy. Since QUIC streams are independent, a lost
+// packet only holds back its own session, and sessions survive the client
+// moving to another network, as the QUIC connection migrates with it.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/mqtt"
+	"github.com/absmach/mproxy/pkg/session"
+	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/upstream"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// ALPN is the application protocol negotiated by the clients,
+// unless the TLS configuration of the listener sets its own.
+const ALPN = "mqtt"
+
+const (
+	// maxIdleTimeout closes the connections of the clients which stopped responding.
+	maxIdleTimeout = 30 * time.Second
+	// keepAlivePeriod keeps the connections of idle clients, and their NAT bindings, open.
+	keepAlivePeriod = 15 * time.Second
+	// lingerTimeout limits the wait for the peer to close the connection first.
+	lingerTimeout = time.Second
+
+	codeNoError quic.ApplicationErrorCode = 0
+	codeRefused quic.ApplicationErrorCode = 1
+)
+
+// ErrMissingTLS indicates the listener has no TLS configuration, which QUIC requires.
+var ErrMissingTLS = errors.New("QUIC listener requires TLS configuration")
+
+// Proxy represents the MQTT over QUIC proxy.
+type Proxy struct {
+	config      mproxy.Config
+	handler     session.Handler
+	interceptor session.Interceptor
+	logger      *slog.Logger
+	upstreams   *upstream.Router
+}
+
+// New returns a new MQTT over QUIC Proxy instance.
+func New(config mproxy.Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
+	if config.Session.Tracker == nil {
+		config.Session.Tracker = session.NewTracker()
+	}
+	config.Session.Transport = session.QUIC
+	p := &Proxy{
+		config:      config,
+		handler:     handler,
+		interceptor: interceptor,
+		logger:      logger,
+	}
+	p.upstreams = upstream.NewRouter(config.Upstreams(), config.Upstream, p.dial, logger)
+	return p
+}
+
+func (p Proxy) dial(ctx context.Context, addr string) (net.Conn, error) {
+	return mqtt.DialTarget(ctx, addr, p.config)
+}
+
+// Listen of the server, this will block.
+func (p Proxy) Listen(ctx context.Context) error {
+	if p.config.TLSConfig == nil {
+		return ErrMissingTLS
+	}
+	udp, err := net.ListenPacket("udp", p.config.Address)
+	if err != nil {
+		return err
+	}
+	// The transport outlives the listener, so that the connections
+	// of the sessions being drained are not closed with it.
+	tr := &quic.Transport{Conn: udp}
+	defer udp.Close()
+	defer tr.Close()
+
+	l, err := tr.Listen(tlsConfig(p.config.TLSConfig), &quic.Config{
+		MaxIdleTimeout:  maxIdleTimeout,
+		KeepAlivePeriod: keepAlivePeriod,
+		// Sessions are only carried by bidirectional streams.
+		MaxIncomingUniStreams: -1,
+	})
+	if err != nil {
+		return err
+	}
+	status := mptls.SecurityStatus(p.config.TLSConfig)
+	p.logger.Info(fmt.Sprintf("MQTT over QUIC proxy server started at %s with %s", p.config.Address, status))
+	g, ctx := errgroup.WithContext(ctx)
+
+	var conns sync.WaitGroup
+	g.Go(func() error {
+		p.accept(ctx, l, &conns)
+		return nil
+	})
+
+	g.Go(func() error {
+		p.upstreams.Run(ctx)
+		return nil
+	})
+
+	g.Go(func() error {
+		<-ctx.Done()
+		return l.Close()
+	})
+	if err := g.Wait(); err != nil {
+		p.logger.Info(fmt.Sprintf("MQTT over QUIC proxy server at %s with %s exiting with errors", p.config.Address, status), slog.String("error", err.Error()))
+	} else {
+		p.logger.Info(fmt.Sprintf("MQTT over QUIC proxy server at %s with %s exiting...", p.config.Address, status))
+	}
+	p.drain()
+	// The connections are closed before the transport, so that the clients
+	// are notified instead of waiting for the idle timeout.
+	conns.Wait()
+	return nil
+}
+
+// tlsConfig returns the TLS configuration of the listener with the MQTT ALPN.
+func tlsConfig(c *tls.Config) *tls.Config {
+	c = c.Clone()
+	if len(c.NextProtos) == 0 {
+		c.NextProtos = []string{ALPN}
+	}
+	return c
+}
+
+func (p Proxy) accept(ctx context.Context, l *quic.Listener, conns *sync.WaitGroup) {
+	for {
+		conn, err := l.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+				return
+			}
+			p.logger.Warn("Accept error " + err.Error())
+			continue
+		}
+		release, err := p.config.Session.ConnLimiter.Accept(conn.RemoteAddr())
+		if err != nil {
+			reason := connlimit.Reason(err)
+			p.config.Session.Metrics.Rejected(reason)
+			p.logger.Warn("Rejected client connection", slog.String("remote", conn.RemoteAddr().String()), slog.String("reason", reason), slog.Any("error", err))
+			_ = conn.CloseWithError(codeRefused, reason)
+			continue
+		}
+		p.logger.Info("Accepted new client")
+		p.config.Session.Metrics.Accepted()
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			p.handle(ctx, conn, release)
+		}()
+	}
+}
+
+// handle streams the sessions of the client connection, one per bidirectional
+// stream, until the client closes the connection or the listener is closed.
+// The connection is closed once its sessions end, so that the sessions being
+// drained are not cut.
+func (p Proxy) handle(ctx context.Context, conn quic.Connection, release func()) {
+	defer p.config.Session.Metrics.Closed()
+	defer release()
+
+	var cert x509.Certificate
+	if certs := conn.ConnectionState().TLS.PeerCertificates; len(certs) > 0 {
+		cert = *certs[0]
+	}
+
+	var wg sync.WaitGroup
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.stream(ctx, newConn(stream, conn), cert)
+		}()
+	}
+	wg.Wait()
+	// On shutdown, the client is given time to receive the last packets of its
+	// sessions and to close the connection itself.
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(lingerTimeout):
+	}
+	_ = conn.CloseWithError(codeNoError, "")
+}
+
+// stream proxies the session of the stream. The session outlives the listener
+// context, so that it can be drained on shutdown instead of being cut.
+func (p Proxy) stream(ctx context.Context, in net.Conn, cert x509.Certificate) {
+	defer in.Close()
+	if err := session.StreamDial(context.WithoutCancel(ctx), in, p.upstreams.Dial, p.handler, p.interceptor, cert, p.config.Session); err != nil && !errors.Is(err, io.EOF) {
+		p.logger.Warn(err.Error())
+	}
+}
+
+// drain ends the sessions still active once the listener is closed.
+func (p Proxy) drain() {
+	cfg := p.config.Session
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	total, forced := cfg.Tracker.Drain(ctx, cfg.DrainGracePeriod)
+	if total == 0 {
+		return
+	}
+	p.logger.Info("Drained sessions", slog.String("address", p.config.Address), slog.Int("sessions", total), slog.Int("force_closed", forced))
+}
+
+// Dial connects to the MQTT over QUIC server at the given address and opens
+// the stream of a session. Closing the returned connection closes the QUIC
+// connection. It lets MQTT clients which accept a custom connection, such as
+// the Paho client, connect over QUIC.
+func Dial(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = tlsConfig(config)
+	conn, err := quic.DialAddr(ctx, addr, config, &quic.Config{
+		MaxIdleTimeout:  maxIdleTimeout,
+		KeepAlivePeriod: keepAlivePeriod,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, errors.Join(err, conn.CloseWithError(codeNoError, ""))
+	}
+	return &clientConn{streamConn: streamConn{Stream: stream, conn: conn}}, nil
+}
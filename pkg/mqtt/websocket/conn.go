@@ -4,6 +4,7 @@
 package websocket
 
 import (
+	"crypto/tls"
 	"io"
 	"net"
 	"sync"
@@ -26,6 +27,20 @@ func newConn(ws *websocket.Conn) net.Conn {
 	}
 }
 
+// NetConn returns the connection the websocket runs over.
+func (c *wsWrapper) NetConn() net.Conn {
+	return c.UnderlyingConn()
+}
+
+// ConnectionState returns the state of the TLS connection the websocket
+// runs over, which is the zero state if the connection is not TLS.
+func (c *wsWrapper) ConnectionState() tls.ConnectionState {
+	if tc, ok := c.UnderlyingConn().(*tls.Conn); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
 // SetDeadline sets both the read and write deadlines.
 func (c *wsWrapper) SetDeadline(t time.Time) error {
 	if err := c.SetReadDeadline(t); err != nil {
@@ -5,7 +5,7 @@ package websocket
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -14,8 +14,13 @@ import (
 	"time"
 
 	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/proxyproto"
 	"github.com/absmach/mproxy/pkg/session"
 	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/tracing"
+	"github.com/absmach/mproxy/pkg/unixsock"
+	"github.com/absmach/mproxy/pkg/upstream"
 	"github.com/gorilla/websocket"
 	"golang.org/x/sync/errgroup"
 )
@@ -26,16 +31,23 @@ type Proxy struct {
 	handler     session.Handler
 	interceptor session.Interceptor
 	logger      *slog.Logger
+	upstreams   *upstream.Router
 }
 
 // New - creates new WS proxy.
 func New(config mproxy.Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
-	return &Proxy{
+	if config.Session.Tracker == nil {
+		config.Session.Tracker = session.NewTracker()
+	}
+	config.Session.Transport = session.WebSocket
+	p := &Proxy{
 		config:      config,
 		handler:     handler,
 		interceptor: interceptor,
 		logger:      logger,
 	}
+	p.upstreams = upstream.NewRouter(config.Upstreams(), config.Upstream, p.dial, logger)
+	return p
 }
 
 var upgrader = websocket.Upgrader{
@@ -61,30 +73,25 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go p.pass(cconn)
+	// Using a new context so as to avoiding infinitely long traces.
+	// And also avoiding proxy cancellation due to parent context cancellation,
+	// the session is drained by Listen on shutdown instead.
+	// The trace context of the upgrade request is kept, so the session
+	// is traced as part of the client trace.
+	ctx := tracing.Extract(context.Background(), r.Header)
+
+	go p.pass(ctx, cconn)
 }
 
-func (p Proxy) pass(in *websocket.Conn) {
+func (p Proxy) pass(ctx context.Context, in *websocket.Conn) {
+	p.config.Session.Metrics.Accepted()
+	defer p.config.Session.Metrics.Closed()
 	defer in.Close()
-	// Using a new context so as to avoiding infinitely long traces.
-	// And also avoiding proxy cancellation due to parent context cancellation.
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	dialer := &websocket.Dialer{
-		Subprotocols: []string{"mqtt"},
-	}
-	srv, _, err := dialer.Dial(p.config.Target, nil)
-	if err != nil {
-		p.logger.Error("Unable to connect to broker", slog.Any("error", err))
-		return
-	}
 
-	errc := make(chan error, 1)
 	inboundConn := newConn(in)
-	outboundConn := newConn(srv)
-
 	defer inboundConn.Close()
-	defer outboundConn.Close()
 
 	clientCert, err := mptls.ClientCert(in.UnderlyingConn())
 	if err != nil {
@@ -92,22 +99,70 @@ func (p Proxy) pass(in *websocket.Conn) {
 		return
 	}
 
-	err = session.Stream(ctx, inboundConn, outboundConn, p.handler, p.interceptor, clientCert)
-	errc <- err
+	err = session.StreamDial(ctx, inboundConn, p.upstreams.Dial, p.handler, p.interceptor, clientCert, p.config.Session)
 	p.logger.Warn("Broken connection for client", slog.Any("error", err))
 }
 
+// dial connects to the target with the given URL. The trace context is
+// propagated in the upgrade request. The PROXY protocol header, if configured,
+// carries the addresses of the client of the session. Targets on Unix sockets
+// are written as unix:///run/broker.sock:/mqtt, with the path of the upgrade
+// request after the socket path.
+func (p Proxy) dial(ctx context.Context, url string) (net.Conn, error) {
+	var h proxyproto.Header
+	if s, ok := session.FromContext(ctx); ok {
+		h = proxyproto.Header{Source: s.RemoteAddr, Destination: s.LocalAddr}
+	}
+	// socket is the Unix socket dialed instead of the host of the URL.
+	var socket string
+	if path, uri, ok := unixsock.SplitURI(url); ok {
+		url = "ws://localhost" + uri
+		if p.config.TargetTLSConfig != nil {
+			url = "wss://localhost" + uri
+		}
+		socket = unixsock.Scheme + path
+	}
+	dialer := &websocket.Dialer{
+		Subprotocols:    []string{"mqtt"},
+		TLSClientConfig: p.config.TargetTLSConfig,
+		NetDialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			if socket != "" {
+				addr = socket
+			}
+			conn, err := unixsock.Dial(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := proxyproto.WriteHeader(conn, p.config.ProxyProtocol.Target, h); err != nil {
+				return nil, errors.Join(err, conn.Close())
+			}
+			return conn, nil
+		},
+	}
+	header := http.Header{}
+	tracing.Inject(ctx, header)
+	srv, _, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(srv), nil
+}
+
 func (p Proxy) Listen(ctx context.Context) error {
-	l, err := net.Listen("tcp", p.config.Address)
+	l, err := unixsock.Listen(p.config.Address, p.config.Socket)
 	if err != nil {
 		return err
 	}
 
+	l = proxyproto.NewListener(l, p.config.ProxyProtocol, p.config.Session.Metrics, p.logger)
+	l = connlimit.NewListener(l, p.config.Session.ConnLimiter, p.config.Session.Metrics, p.logger)
 	if p.config.TLSConfig != nil {
-		l = tls.NewListener(l, p.config.TLSConfig)
+		l = connlimit.NewTLSListener(l, p.config.TLSConfig, p.config.Session.ConnLimiter, p.config.Session.Metrics, p.logger)
 	}
 
-	var server http.Server
+	server := http.Server{
+		ErrorLog: p.config.Session.Metrics.ServerErrorLog(p.logger),
+	}
 	g, ctx := errgroup.WithContext(ctx)
 
 	mux := http.NewServeMux()
@@ -121,6 +176,11 @@ func (p Proxy) Listen(ctx context.Context) error {
 
 	p.logger.Info(fmt.Sprintf("MQTT websocket proxy server started at %s%s with %s", p.config.Address, p.config.PathPrefix, status))
 
+	g.Go(func() error {
+		p.upstreams.Run(ctx)
+		return nil
+	})
+
 	g.Go(func() error {
 		<-ctx.Done()
 		return server.Close()
@@ -130,5 +190,18 @@ func (p Proxy) Listen(ctx context.Context) error {
 	} else {
 		p.logger.Info(fmt.Sprintf("MQTT websocket proxy server at %s%s with %s exiting...", p.config.Address, p.config.PathPrefix, status))
 	}
+	p.drain()
 	return nil
 }
+
+// drain ends the sessions still active once the listener is closed.
+func (p Proxy) drain() {
+	cfg := p.config.Session
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	total, forced := cfg.Tracker.Drain(ctx, cfg.DrainGracePeriod)
+	if total == 0 {
+		return
+	}
+	p.logger.Info("Drained sessions", slog.String("address", p.config.Address), slog.Int("sessions", total), slog.Int("force_closed", forced))
+}
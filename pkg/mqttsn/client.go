@@ -0,0 +1,702 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqttsn
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+const (
+	// inboundQueue is the number of messages of a client waiting to be
+	// translated. Messages arriving once it is full are dropped.
+	inboundQueue = 32
+	// retryTimeout and maxRetries bound the wait for the REGACK of the
+	// topics registered by the gateway.
+	retryTimeout = 10 * time.Second
+	maxRetries   = 3
+)
+
+// errClientLost indicates the client stopped answering the gateway.
+var errClientLost = errors.New("MQTT-SN client lost")
+
+// state is the state of an MQTT-SN client.
+type state int32
+
+const (
+	// connecting clients wait for the CONNACK of the broker.
+	connecting state = iota
+	active
+	// asleep clients have their messages buffered.
+	asleep
+	// awake clients receive the messages buffered while they were asleep.
+	awake
+)
+
+type inbound struct {
+	pkt  Packet
+	addr net.Addr
+}
+
+// registration is a topic registered by the gateway, waiting for the REGACK of the client.
+type registration struct {
+	msgID   uint16
+	topicID uint16
+	name    string
+	retries int
+}
+
+// subscription is a SUBSCRIBE waiting for the SUBACK of the broker.
+type subscription struct {
+	name      string
+	topicType byte
+}
+
+// client translates the MQTT-SN messages of a client into an MQTT 3.1.1
+// session, which is streamed over a pipe. The state of the client is only
+// accessed by the goroutine running the client, except for the fields noted.
+type client struct {
+	proxy *Proxy
+	id    string
+	// key is the address the client is indexed by, guarded by the proxy lock.
+	key string
+	// state is also read by the proxy to resume sleeping clients.
+	state atomic.Int32
+	in    chan inbound
+	quit  chan struct{}
+	once  sync.Once
+
+	addr net.Addr
+	// conn is the client end of the pipe of the session.
+	conn net.Conn
+	// connect is the CONNECT waiting for the will of the client.
+	connect *packets.ConnectPacket
+	// sent is set once the CONNECT is sent to the session.
+	sent bool
+	// disconnected is set once the client is sent a DISCONNECT.
+	disconnected bool
+	keepAlive    time.Duration
+
+	topics      map[string]uint16
+	names       map[uint16]string
+	nextTopicID uint16
+	nextMsgID   uint16
+	// publishes holds the topic IDs of the QoS 1 and 2 PUBLISH of the client,
+	// by message ID, so that they can be acknowledged.
+	publishes     map[uint16]uint16
+	subscriptions map[uint16]subscription
+	// queue holds the messages waiting to be delivered to the client,
+	// while it sleeps or while their topic is being registered.
+	queue    []packets.ControlPacket
+	register *registration
+	// pings counts the PINGREQ sent by the gateway to keep the session of the
+	// sleeping client alive, whose PINGRESP is not forwarded.
+	pings int
+
+	// sleepTimeout is the time the sleeping client is given to wake up.
+	sleepTimeout time.Duration
+	sleepTimer   *time.Timer
+	pingTicker   *time.Ticker
+	retryTimer   *time.Timer
+
+	// down holds the packets read from the session, signaled by ready.
+	downMu sync.Mutex
+	down   []packets.ControlPacket
+	eof    bool
+	ready  chan struct{}
+}
+
+func newClient(p *Proxy, id string, addr net.Addr) *client {
+	return &client{
+		proxy:         p,
+		id:            id,
+		key:           addr.String(),
+		in:            make(chan inbound, inboundQueue),
+		quit:          make(chan struct{}),
+		addr:          addr,
+		topics:        make(map[string]uint16),
+		names:         make(map[uint16]string),
+		publishes:     make(map[uint16]uint16),
+		subscriptions: make(map[uint16]subscription),
+		ready:         make(chan struct{}, 1),
+	}
+}
+
+// receive queues a message of the client.
+func (c *client) receive(pkt Packet, addr net.Addr) {
+	select {
+	case c.in <- inbound{pkt: pkt, addr: addr}:
+	default:
+		c.proxy.logger.Warn("Dropped MQTT-SN message of congested client", slog.String("client_id", c.id), slog.String("type", PacketNames[pkt.Type()]))
+	}
+}
+
+// close ends the client without notifying it, as it is replaced by another client.
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.quit)
+	})
+}
+
+func (c *client) asleep() bool {
+	s := state(c.state.Load())
+	return s == asleep || s == awake
+}
+
+// run streams the session of the client until it ends. The session outlives
+// the gateway context, so that it can be drained on shutdown instead of being cut.
+func (c *client) run(ctx context.Context) {
+	p := c.proxy
+	conn, sconn := net.Pipe()
+	c.conn = conn
+	in := sessionConn{Conn: sconn, local: p.conn.LocalAddr(), remote: c.addr}
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		defer sconn.Close()
+		if err := session.StreamDial(context.WithoutCancel(ctx), in, p.upstreams.Dial, p.handler, p.interceptor, x509.Certificate{}, p.config.Session); err != nil && !errors.Is(err, io.EOF) {
+			p.logger.Warn(err.Error())
+		}
+	}()
+	go c.read()
+
+	if err := c.loop(); err != nil && !errors.Is(err, io.EOF) {
+		p.logger.Warn("MQTT-SN client ended", slog.String("client_id", c.id), slog.Any("error", err))
+	}
+	c.stopSleep()
+	if c.retryTimer != nil {
+		c.retryTimer.Stop()
+	}
+	conn.Close()
+	<-streamed
+}
+
+// read reads the packets of the session, so that the session never waits
+// for the client to be translated.
+func (c *client) read() {
+	for {
+		pkt, err := packets.ReadPacket(c.conn, packets.V311)
+		c.downMu.Lock()
+		if err != nil {
+			c.eof = true
+		} else {
+			c.down = append(c.down, pkt)
+		}
+		c.downMu.Unlock()
+		select {
+		case c.ready <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *client) loop() error {
+	for {
+		select {
+		case m := <-c.in:
+			c.addr = m.addr
+			if err := c.handle(m.pkt); err != nil {
+				return err
+			}
+		case <-c.ready:
+			c.downMu.Lock()
+			down, eof := c.down, c.eof
+			c.down = nil
+			c.downMu.Unlock()
+			for _, pkt := range down {
+				if err := c.downlink(pkt); err != nil {
+					return err
+				}
+			}
+			if eof {
+				// The session ended, so the client has to connect again.
+				if !c.disconnected {
+					return c.send(DisconnectPacket{})
+				}
+				return nil
+			}
+		case <-timer(c.sleepTimer):
+			// The will message is published, as the session is not disconnected.
+			return errClientLost
+		case <-ticker(c.pingTicker):
+			c.pings++
+			if err := c.write(packets.NewControlPacket(packets.Pingreq)); err != nil {
+				return err
+			}
+		case <-timer(c.retryTimer):
+			if err := c.retry(); err != nil {
+				return err
+			}
+		case <-c.quit:
+			return nil
+		}
+	}
+}
+
+// handle translates a message of the client.
+func (c *client) handle(pkt Packet) error {
+	switch pkt := pkt.(type) {
+	case ConnectPacket:
+		return c.handleConnect(pkt)
+	case WillTopicPacket:
+		return c.willTopic(pkt)
+	case WillMsgPacket:
+		return c.willMsg(pkt)
+	}
+	if state(c.state.Load()) == connecting {
+		return nil
+	}
+	switch pkt := pkt.(type) {
+	case RegisterPacket:
+		id, ok := c.topicID(pkt.TopicName)
+		rc := Accepted
+		if !ok {
+			rc = RejectedCongestion
+		}
+		return c.send(RegackPacket{TopicID: id, MsgID: pkt.MsgID, ReturnCode: rc})
+	case RegackPacket:
+		return c.regack(pkt)
+	case PublishPacket:
+		return c.publish(pkt)
+	case PubackPacket:
+		if pkt.ReturnCode == RejectedTopicID {
+			// The client does not know the topic ID, which is registered again for the next messages.
+			if name, ok := c.names[pkt.TopicID]; ok {
+				delete(c.names, pkt.TopicID)
+				delete(c.topics, name)
+			}
+		}
+		return c.write(&packets.PubackPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Puback}, MessageID: pkt.MsgID})
+	case PubrecPacket:
+		return c.write(&packets.PubrecPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Pubrec}, MessageID: pkt.MsgID})
+	case PubrelPacket:
+		return c.write(&packets.PubrelPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Pubrel, Qos: 1}, MessageID: pkt.MsgID})
+	case PubcompPacket:
+		return c.write(&packets.PubcompPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Pubcomp}, MessageID: pkt.MsgID})
+	case SubscribePacket:
+		return c.subscribe(pkt)
+	case UnsubscribePacket:
+		return c.unsubscribe(pkt)
+	case PingreqPacket:
+		if c.asleep() {
+			return c.wake()
+		}
+		return c.write(packets.NewControlPacket(packets.Pingreq))
+	case DisconnectPacket:
+		if pkt.Sleep && pkt.Duration > 0 {
+			return c.sleep(time.Duration(pkt.Duration) * time.Second)
+		}
+		c.disconnected = true
+		if err := c.send(DisconnectPacket{}); err != nil {
+			return err
+		}
+		// The session ends once the broker closes the connection.
+		return c.write(packets.NewControlPacket(packets.Disconnect))
+	case WillTopicUpdPacket:
+		// The will of an MQTT 3.1.1 session can not be changed.
+		return c.send(WillTopicRespPacket{ReturnCode: RejectedNotSupport})
+	case WillMsgUpdPacket:
+		return c.send(WillMsgRespPacket{ReturnCode: RejectedNotSupport})
+	}
+	return nil
+}
+
+// handleConnect starts the session, once the will is received if the client has one,
+// or resumes the session of a sleeping client.
+func (c *client) handleConnect(pkt ConnectPacket) error {
+	if c.asleep() {
+		c.stopSleep()
+		c.state.Store(int32(active))
+		if err := c.send(ConnackPacket{ReturnCode: Accepted}); err != nil {
+			return err
+		}
+		return c.deliver()
+	}
+	if c.sent {
+		return nil
+	}
+	if pkt.ProtocolID != ProtocolID {
+		c.disconnected = true
+		if err := c.send(ConnackPacket{ReturnCode: RejectedNotSupport}); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = packets.V311
+	cp.CleanSession = pkt.Flags.CleanSession
+	cp.Keepalive = pkt.Duration
+	cp.ClientIdentifier = pkt.ClientID
+	c.keepAlive = time.Duration(pkt.Duration) * time.Second
+	c.connect = cp
+	if pkt.Flags.Will {
+		return c.send(WillTopicReqPacket{})
+	}
+	return c.sendConnect()
+}
+
+func (c *client) willTopic(pkt WillTopicPacket) error {
+	if c.connect == nil || c.sent {
+		return nil
+	}
+	if pkt.Topic == "" {
+		return c.sendConnect()
+	}
+	c.connect.WillFlag = true
+	c.connect.WillTopic = pkt.Topic
+	c.connect.WillQos = byte(max(pkt.Flags.QoS, 0))
+	c.connect.WillRetain = pkt.Flags.Retain
+	return c.send(WillMsgReqPacket{})
+}
+
+func (c *client) willMsg(pkt WillMsgPacket) error {
+	if c.connect == nil || c.sent || !c.connect.WillFlag {
+		return nil
+	}
+	c.connect.WillMessage = pkt.Message
+	return c.sendConnect()
+}
+
+func (c *client) sendConnect() error {
+	c.sent = true
+	return c.write(c.connect)
+}
+
+// publish forwards the PUBLISH of the client with its topic name.
+func (c *client) publish(pkt PublishPacket) error {
+	name, ok := c.topicName(pkt.Flags.TopicIDType, pkt.TopicID)
+	if !ok {
+		return c.send(PubackPacket{TopicID: pkt.TopicID, MsgID: pkt.MsgID, ReturnCode: RejectedTopicID})
+	}
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = name
+	p.Qos = byte(max(pkt.Flags.QoS, 0))
+	p.Retain = pkt.Flags.Retain
+	p.Dup = pkt.Flags.DUP
+	p.Payload = pkt.Data
+	if p.Qos > 0 {
+		p.MessageID = pkt.MsgID
+		c.publishes[pkt.MsgID] = pkt.TopicID
+	}
+	return c.write(p)
+}
+
+func (c *client) subscribe(pkt SubscribePacket) error {
+	if pkt.Flags.TopicIDType == TopicPredefined {
+		return c.send(SubackPacket{MsgID: pkt.MsgID, ReturnCode: RejectedTopicID})
+	}
+	c.subscriptions[pkt.MsgID] = subscription{name: pkt.TopicName, topicType: pkt.Flags.TopicIDType}
+	p := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	p.MessageID = pkt.MsgID
+	p.Topics = []string{pkt.TopicName}
+	p.Options = []byte{byte(max(pkt.Flags.QoS, 0))}
+	return c.write(p)
+}
+
+func (c *client) unsubscribe(pkt UnsubscribePacket) error {
+	if pkt.Flags.TopicIDType == TopicPredefined {
+		return c.send(UnsubackPacket{MsgID: pkt.MsgID})
+	}
+	p := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	p.MessageID = pkt.MsgID
+	p.Topics = []string{pkt.TopicName}
+	return c.write(p)
+}
+
+// sleep keeps the session of the client, which is lost if it does not wake up
+// within the sleep duration. The gateway keeps the session alive meanwhile.
+func (c *client) sleep(d time.Duration) error {
+	c.stopSleep()
+	c.state.Store(int32(asleep))
+	// As for the keep alive, the client is given half the duration more to wake up.
+	c.sleepTimeout = d + d/2
+	c.sleepTimer = time.NewTimer(c.sleepTimeout)
+	if c.keepAlive > 0 {
+		c.pingTicker = time.NewTicker(c.keepAlive)
+	}
+	return c.send(DisconnectPacket{})
+}
+
+// wake delivers the messages buffered for the sleeping client,
+// which is sent to sleep again with PINGRESP once they are delivered.
+func (c *client) wake() error {
+	if state(c.state.Load()) == asleep {
+		if c.sleepTimer != nil {
+			c.sleepTimer.Stop()
+		}
+		c.state.Store(int32(awake))
+	}
+	return c.deliver()
+}
+
+// downlink translates a packet of the session.
+func (c *client) downlink(pkt packets.ControlPacket) error {
+	switch pkt := pkt.(type) {
+	case *packets.ConnackPacket:
+		if pkt.ReturnCode != packets.Accepted {
+			// The session ends with the rejection.
+			c.disconnected = true
+			rc := RejectedNotSupport
+			if pkt.ReturnCode == packets.ErrRefusedServerUnavailable {
+				rc = RejectedCongestion
+			}
+			return c.send(ConnackPacket{ReturnCode: rc})
+		}
+		c.state.Store(int32(active))
+		return c.send(ConnackPacket{ReturnCode: Accepted})
+	case *packets.PingrespPacket:
+		if c.pings > 0 {
+			c.pings--
+			return nil
+		}
+		return c.send(PingrespPacket{})
+	case *packets.SubackPacket:
+		return c.suback(pkt)
+	case *packets.UnsubackPacket:
+		return c.send(UnsubackPacket{MsgID: pkt.MessageID})
+	case *packets.PubackPacket:
+		topicID := c.publishes[pkt.MessageID]
+		delete(c.publishes, pkt.MessageID)
+		return c.send(PubackPacket{TopicID: topicID, MsgID: pkt.MessageID, ReturnCode: Accepted})
+	case *packets.PubrecPacket:
+		return c.send(PubrecPacket{MsgID: pkt.MessageID})
+	case *packets.PubcompPacket:
+		delete(c.publishes, pkt.MessageID)
+		return c.send(PubcompPacket{MsgID: pkt.MessageID})
+	case *packets.PublishPacket, *packets.PubrelPacket:
+		if c.asleep() && len(c.queue) >= c.proxy.gateway.SleepBuffer {
+			c.proxy.logger.Warn("Dropped message of sleeping client with full buffer", slog.String("client_id", c.id))
+			return nil
+		}
+		c.queue = append(c.queue, pkt)
+		return c.deliver()
+	}
+	return nil
+}
+
+func (c *client) suback(pkt *packets.SubackPacket) error {
+	sub := c.subscriptions[pkt.MessageID]
+	delete(c.subscriptions, pkt.MessageID)
+	ack := SubackPacket{MsgID: pkt.MessageID, ReturnCode: Accepted}
+	if len(pkt.ReturnCodes) == 0 || pkt.ReturnCodes[0] >= packets.SubackFailure {
+		ack.ReturnCode = RejectedNotSupport
+		return c.send(ack)
+	}
+	ack.Flags.QoS = int8(pkt.ReturnCodes[0])
+	// Topic names without wildcards are registered, so that the client gets their ID.
+	if sub.topicType == TopicNormal && !strings.ContainsAny(sub.name, "+#") {
+		id, ok := c.topicID(sub.name)
+		if !ok {
+			ack.ReturnCode = RejectedCongestion
+		}
+		ack.TopicID = id
+	}
+	return c.send(ack)
+}
+
+// deliver sends the queued messages to the client, registering their topics
+// first if needed. Awake clients are sent back to sleep once all are delivered.
+func (c *client) deliver() error {
+	for len(c.queue) > 0 && c.register == nil {
+		if s := state(c.state.Load()); s != active && s != awake {
+			return nil
+		}
+		switch pkt := c.queue[0].(type) {
+		case *packets.PublishPacket:
+			topicType, id, ok := c.publishTopic(pkt.TopicName)
+			if !ok {
+				return c.registerTopic(pkt.TopicName)
+			}
+			p := PublishPacket{
+				Flags:   Flags{DUP: pkt.Dup, QoS: int8(pkt.Qos), Retain: pkt.Retain, TopicIDType: topicType},
+				TopicID: id,
+				MsgID:   pkt.MessageID,
+				Data:    pkt.Payload,
+			}
+			if err := c.send(p); err != nil {
+				if !errors.Is(err, ErrPacketTooLarge) {
+					return err
+				}
+				c.proxy.logger.Warn("Dropped message too large for MQTT-SN", slog.String("client_id", c.id), slog.String("topic", pkt.TopicName))
+			}
+		case *packets.PubrelPacket:
+			if err := c.send(PubrelPacket{MsgID: pkt.MessageID}); err != nil {
+				return err
+			}
+		}
+		c.queue = c.queue[1:]
+	}
+	if state(c.state.Load()) == awake && len(c.queue) == 0 && c.register == nil {
+		c.state.Store(int32(asleep))
+		c.sleepTimer.Reset(c.sleepTimeout)
+		return c.send(PingrespPacket{})
+	}
+	return nil
+}
+
+// publishTopic returns the topic ID type and ID of the topic name, if the client knows it.
+func (c *client) publishTopic(name string) (byte, uint16, bool) {
+	if id, ok := c.topics[name]; ok {
+		return TopicNormal, id, true
+	}
+	if len(name) == 2 {
+		return TopicShort, uint16(name[0])<<8 | uint16(name[1]), true
+	}
+	return 0, 0, false
+}
+
+// registerTopic registers the topic name with the client, holding back the
+// queued messages until the client acknowledges it.
+func (c *client) registerTopic(name string) error {
+	id, ok := c.allocTopicID()
+	if !ok {
+		c.proxy.logger.Warn("Dropped message with no topic ID left", slog.String("client_id", c.id), slog.String("topic", name))
+		c.queue = c.queue[1:]
+		return c.deliver()
+	}
+	c.nextMsgID++
+	if c.nextMsgID == 0 {
+		c.nextMsgID++
+	}
+	c.register = &registration{msgID: c.nextMsgID, topicID: id, name: name}
+	c.retryTimer = time.NewTimer(retryTimeout)
+	return c.send(RegisterPacket{TopicID: id, MsgID: c.register.msgID, TopicName: name})
+}
+
+func (c *client) retry() error {
+	r := c.register
+	if r == nil {
+		return nil
+	}
+	if r.retries++; r.retries > maxRetries {
+		return errClientLost
+	}
+	c.retryTimer = time.NewTimer(retryTimeout)
+	return c.send(RegisterPacket{TopicID: r.topicID, MsgID: r.msgID, TopicName: r.name})
+}
+
+func (c *client) regack(pkt RegackPacket) error {
+	r := c.register
+	if r == nil || pkt.MsgID != r.msgID {
+		return nil
+	}
+	c.register = nil
+	c.retryTimer.Stop()
+	c.retryTimer = nil
+	if pkt.ReturnCode != Accepted {
+		c.proxy.logger.Warn("Dropped message with topic rejected by client", slog.String("client_id", c.id), slog.String("topic", r.name))
+		c.queue = c.queue[1:]
+		return c.deliver()
+	}
+	c.topics[r.name] = r.topicID
+	c.names[r.topicID] = r.name
+	return c.deliver()
+}
+
+// topicID returns the topic ID of the topic name, registering it if needed.
+func (c *client) topicID(name string) (uint16, bool) {
+	if id, ok := c.topics[name]; ok {
+		return id, true
+	}
+	id, ok := c.allocTopicID()
+	if !ok {
+		return 0, false
+	}
+	c.topics[name] = id
+	c.names[id] = name
+	return id, true
+}
+
+// allocTopicID returns a topic ID not in use, 0x0000 and 0xFFFF being reserved.
+func (c *client) allocTopicID() (uint16, bool) {
+	for range 0xFFFE {
+		c.nextTopicID++
+		if c.nextTopicID == 0 || c.nextTopicID == 0xFFFF {
+			c.nextTopicID = 1
+		}
+		if _, ok := c.names[c.nextTopicID]; !ok {
+			return c.nextTopicID, true
+		}
+	}
+	return 0, false
+}
+
+// topicName returns the topic name of the topic ID of a PUBLISH.
+func (c *client) topicName(topicType byte, id uint16) (string, bool) {
+	switch topicType {
+	case TopicNormal:
+		name, ok := c.names[id]
+		return name, ok
+	case TopicShort:
+		return string([]byte{byte(id >> 8), byte(id)}), true
+	default:
+		return "", false
+	}
+}
+
+// send sends the message to the client.
+func (c *client) send(pkt Packet) error {
+	return c.proxy.send(pkt, c.addr)
+}
+
+// write writes the packet to the session.
+func (c *client) write(pkt packets.ControlPacket) error {
+	return pkt.Write(c.conn, packets.V311)
+}
+
+// stopSleep stops the timers of the sleeping client.
+func (c *client) stopSleep() {
+	if c.sleepTimer != nil {
+		c.sleepTimer.Stop()
+	}
+	if c.pingTicker != nil {
+		c.pingTicker.Stop()
+	}
+	c.sleepTimer, c.pingTicker = nil, nil
+}
+
+// timer and ticker return the channel of the timer or ticker, nil if not set.
+func timer(t *time.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+func ticker(t *time.Ticker) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+// sessionConn is the session end of the pipe of a client, with the UDP
+// addresses of the client and the gateway.
+type sessionConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c sessionConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c sessionConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,284 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqttsn
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+const testTimeout = 5 * time.Second
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// handler allows all the clients.
+type handler struct{}
+
+func (handler) AuthConnect(context.Context) error                   { return nil }
+func (handler) AuthPublish(context.Context, *string, *[]byte) error { return nil }
+func (handler) AuthSubscribe(context.Context, *[]string) error      { return nil }
+func (handler) DownSubscribe(context.Context, *[]string) error      { return nil }
+func (handler) Connect(context.Context) error                       { return nil }
+func (handler) Publish(context.Context, *string, *[]byte) error     { return nil }
+func (handler) Subscribe(context.Context, *[]string) error          { return nil }
+func (handler) Unsubscribe(context.Context, *[]string) error        { return nil }
+func (handler) Disconnect(context.Context) error                    { return nil }
+
+var _ session.Handler = handler{}
+
+// gateway runs the MQTT-SN gateway in front of an MQTT broker. It returns the
+// address of the gateway and the listener of the broker.
+func gateway(t *testing.T) (net.Addr, net.Listener) {
+	t.Helper()
+	broker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	// The gateway listens on a free port, which is found first.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr()
+	pc.Close()
+
+	config := mproxy.Config{Address: addr.String(), Target: broker.Addr().String()}
+	config.Session.DrainTimeout = time.Second
+	p := New(config, Config{GatewayID: 1, SleepBuffer: 10}, handler{}, nil, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Listen(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Error("gateway did not stop")
+		}
+	})
+	return addr, broker
+}
+
+// snClient is an MQTT-SN client of the gateway.
+type snClient struct {
+	t       *testing.T
+	conn    net.PacketConn
+	gateway net.Addr
+}
+
+func newSNClient(t *testing.T, gateway net.Addr) *snClient {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &snClient{t: t, conn: conn, gateway: gateway}
+}
+
+func (c *snClient) send(pkt Packet) {
+	c.t.Helper()
+	b, err := pkt.Pack()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.WriteTo(b, c.gateway); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *snClient) receive() Packet {
+	c.t.Helper()
+	buf := make([]byte, maxLength)
+	if err := c.conn.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		c.t.Fatal(err)
+	}
+	n, _, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	pkt, err := Decode(buf[:n])
+	if err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	return pkt
+}
+
+// connect connects the client, retrying until the gateway listens, and
+// returns the broker end of its session.
+func (c *snClient) connect(broker net.Listener, clientID string) net.Conn {
+	c.t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := broker.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	var conn net.Conn
+	deadline := time.After(testTimeout)
+	for conn == nil {
+		c.send(ConnectPacket{Flags: Flags{CleanSession: true}, ProtocolID: ProtocolID, Duration: 60, ClientID: clientID})
+		select {
+		case conn = <-accepted:
+			if conn == nil {
+				c.t.Fatal("broker closed")
+			}
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			c.t.Fatal("gateway did not connect to the broker")
+		}
+	}
+	c.t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(testTimeout))
+
+	cp, ok := readPacket(c.t, conn).(*packets.ConnectPacket)
+	if !ok || cp.ClientIdentifier != clientID || cp.Keepalive != 60 || !cp.CleanSession {
+		c.t.Fatalf("broker CONNECT = %v", cp)
+	}
+	writePacket(c.t, conn, packets.NewControlPacket(packets.Connack))
+	if ack, ok := c.receive().(ConnackPacket); !ok || ack.ReturnCode != Accepted {
+		c.t.Fatalf("CONNACK = %+v", ack)
+	}
+	return conn
+}
+
+func readPacket(t *testing.T, conn net.Conn) packets.ControlPacket {
+	t.Helper()
+	pkt, err := packets.ReadPacket(conn, packets.V311)
+	if err != nil {
+		t.Fatalf("broker read: %v", err)
+	}
+	return pkt
+}
+
+func writePacket(t *testing.T, conn net.Conn, pkt packets.ControlPacket) {
+	t.Helper()
+	if err := pkt.Write(conn, packets.V311); err != nil {
+		t.Fatalf("broker write: %v", err)
+	}
+}
+
+func TestConnectPublish(t *testing.T) {
+	addr, broker := gateway(t)
+	c := newSNClient(t, addr)
+	conn := c.connect(broker, "sensor")
+
+	// The client registers its topic, and publishes with the topic ID.
+	c.send(RegisterPacket{MsgID: 1, TopicName: "sensors/temperature"})
+	ack, ok := c.receive().(RegackPacket)
+	if !ok || ack.MsgID != 1 || ack.ReturnCode != Accepted || ack.TopicID == 0 {
+		t.Fatalf("REGACK = %+v", ack)
+	}
+	c.send(PublishPacket{Flags: Flags{QoS: 1}, TopicID: ack.TopicID, MsgID: 2, Data: []byte("21.5")})
+	pub, ok := readPacket(t, conn).(*packets.PublishPacket)
+	if !ok || pub.TopicName != "sensors/temperature" || pub.Qos != 1 || pub.MessageID != 2 || string(pub.Payload) != "21.5" {
+		t.Fatalf("broker PUBLISH = %v", pub)
+	}
+	writePacket(t, conn, &packets.PubackPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Puback}, MessageID: 2})
+	if puback, ok := c.receive().(PubackPacket); !ok || puback.MsgID != 2 || puback.TopicID != ack.TopicID || puback.ReturnCode != Accepted {
+		t.Fatalf("PUBACK = %+v", puback)
+	}
+
+	// Short topic names are sent in place of the topic ID.
+	c.send(PublishPacket{Flags: Flags{TopicIDType: TopicShort}, TopicID: 'a'<<8 | 'b', Data: []byte("short")})
+	if pub, ok := readPacket(t, conn).(*packets.PublishPacket); !ok || pub.TopicName != "ab" || pub.Qos != 0 {
+		t.Fatalf("broker PUBLISH = %v", pub)
+	}
+
+	// Unknown topic IDs are rejected by the gateway.
+	c.send(PublishPacket{Flags: Flags{QoS: 1}, TopicID: 0x1234, MsgID: 3, Data: []byte("lost")})
+	if puback, ok := c.receive().(PubackPacket); !ok || puback.MsgID != 3 || puback.ReturnCode != RejectedTopicID {
+		t.Fatalf("PUBACK = %+v", puback)
+	}
+}
+
+func TestSubscribeReceive(t *testing.T) {
+	addr, broker := gateway(t)
+	c := newSNClient(t, addr)
+	conn := c.connect(broker, "actuator")
+
+	c.send(SubscribePacket{Flags: Flags{QoS: 1}, MsgID: 1, TopicName: "commands/#"})
+	sub, ok := readPacket(t, conn).(*packets.SubscribePacket)
+	if !ok || len(sub.Topics) != 1 || sub.Topics[0] != "commands/#" || sub.QoS(0) != 1 {
+		t.Fatalf("broker SUBSCRIBE = %v", sub)
+	}
+	writePacket(t, conn, &packets.SubackPacket{FixedHeader: packets.FixedHeader{MessageType: packets.Suback}, MessageID: sub.MessageID, ReturnCodes: []byte{1}})
+	if ack, ok := c.receive().(SubackPacket); !ok || ack.MsgID != 1 || ack.ReturnCode != Accepted || ack.Flags.QoS != 1 {
+		t.Fatalf("SUBACK = %+v", ack)
+	}
+
+	// The gateway registers the topic of the message before delivering it.
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "commands/on"
+	pub.Payload = []byte("1")
+	writePacket(t, conn, pub)
+	reg, ok := c.receive().(RegisterPacket)
+	if !ok || reg.TopicName != "commands/on" || reg.TopicID == 0 {
+		t.Fatalf("REGISTER = %+v", reg)
+	}
+	c.send(RegackPacket{TopicID: reg.TopicID, MsgID: reg.MsgID, ReturnCode: Accepted})
+	got, ok := c.receive().(PublishPacket)
+	if !ok || got.TopicID != reg.TopicID || got.Flags.TopicIDType != TopicNormal || string(got.Data) != "1" {
+		t.Fatalf("PUBLISH = %+v", got)
+	}
+
+	// The next message of the topic uses the registered topic ID.
+	pub.Payload = []byte("0")
+	writePacket(t, conn, pub)
+	if got, ok := c.receive().(PublishPacket); !ok || got.TopicID != reg.TopicID || string(got.Data) != "0" {
+		t.Fatalf("PUBLISH = %+v", got)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	addr, broker := gateway(t)
+	c := newSNClient(t, addr)
+	conn := c.connect(broker, "client")
+
+	c.send(DisconnectPacket{})
+	if d, ok := c.receive().(DisconnectPacket); !ok || d.Sleep {
+		t.Fatalf("DISCONNECT = %+v", d)
+	}
+	if _, ok := readPacket(t, conn).(*packets.DisconnectPacket); !ok {
+		t.Fatal("broker did not receive DISCONNECT")
+	}
+}
+
+func TestUnknownClient(t *testing.T) {
+	addr, broker := gateway(t)
+	// The gateway is known to listen once a client is connected.
+	newSNClient(t, addr).connect(broker, "client")
+
+	c := newSNClient(t, addr)
+	c.send(PingreqPacket{})
+	if _, ok := c.receive().(DisconnectPacket); !ok {
+		t.Fatal("unknown client was not told to connect again")
+	}
+}
+
+func TestSearchGateway(t *testing.T) {
+	addr, broker := gateway(t)
+	newSNClient(t, addr).connect(broker, "client")
+
+	c := newSNClient(t, addr)
+	c.send(SearchGWPacket{Radius: 1})
+	if info, ok := c.receive().(GWInfoPacket); !ok || info.GatewayID != 1 || len(info.GatewayAddress) != 0 {
+		t.Fatalf("GWINFO = %+v", info)
+	}
+}
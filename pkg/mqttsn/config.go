@@ -0,0 +1,34 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqttsn
+
+import (
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// Config holds the settings of the MQTT-SN gateway.
+type Config struct {
+	// GatewayID identifies the gateway in ADVERTISE and GWINFO.
+	GatewayID uint8 `env:"GATEWAY_ID" envDefault:"1"`
+	// AdvertiseAddress is the UDP address, usually a broadcast or multicast
+	// address, the gateway is advertised to. The gateway is not advertised if unset.
+	AdvertiseAddress string `env:"ADVERTISE_ADDRESS" envDefault:""`
+	// AdvertiseInterval is the interval between the advertisements, announced in
+	// them so that clients notice the gateway is gone. It is capped to 18 hours.
+	AdvertiseInterval time.Duration `env:"ADVERTISE_INTERVAL" envDefault:"15m"`
+	// SleepBuffer is the number of messages buffered for a sleeping client.
+	// Messages arriving once the buffer is full are dropped.
+	SleepBuffer int `env:"SLEEP_BUFFER" envDefault:"100"`
+}
+
+// NewConfig parses the gateway settings from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
@@ -0,0 +1,327 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mqttsn implements the MQTT-SN gateway. MQTT-SN 1.2 clients connect
+// over UDP, and each of them is translated into an MQTT 3.1.1 session streamed
+// to the target broker over TCP as by the MQTT proxy, so that the session
+// hooks, limits, registry and tracing apply to them as to MQTT clients.
+//
+// The gateway registers topic IDs for the topic names of the clients, in both
+// directions, and buffers the messages of sleeping clients until they wake up.
+// QoS -1 publishing without a connection and predefined topic IDs are not supported.
+package mqttsn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/mqtt"
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/absmach/mproxy/pkg/upstream"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxAdvertiseInterval is the longest interval the duration of ADVERTISE can announce.
+const maxAdvertiseInterval = 0xFFFF * time.Second
+
+// Proxy represents the MQTT-SN gateway.
+type Proxy struct {
+	config      mproxy.Config
+	gateway     Config
+	handler     session.Handler
+	interceptor session.Interceptor
+	logger      *slog.Logger
+	upstreams   *upstream.Router
+
+	conn net.PacketConn
+	// clients holds the wait group of the client sessions.
+	clients sync.WaitGroup
+
+	mu sync.Mutex
+	// byAddr and byID index the clients by address and client ID.
+	byAddr  map[string]*client
+	byID    map[string]*client
+	closing bool
+}
+
+// New returns a new MQTT-SN gateway instance.
+func New(config mproxy.Config, gateway Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
+	if config.Session.Tracker == nil {
+		config.Session.Tracker = session.NewTracker()
+	}
+	config.Session.Transport = session.MQTTSN
+	p := &Proxy{
+		config:      config,
+		gateway:     gateway,
+		handler:     handler,
+		interceptor: interceptor,
+		logger:      logger,
+		byAddr:      make(map[string]*client),
+		byID:        make(map[string]*client),
+	}
+	p.upstreams = upstream.NewRouter(config.Upstreams(), config.Upstream, p.dial, logger)
+	return p
+}
+
+func (p *Proxy) dial(ctx context.Context, addr string) (net.Conn, error) {
+	return mqtt.DialTarget(ctx, addr, p.config)
+}
+
+// Listen of the gateway, this will block.
+func (p *Proxy) Listen(ctx context.Context) error {
+	var adv net.Addr
+	if p.gateway.AdvertiseAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", p.gateway.AdvertiseAddress)
+		if err != nil {
+			return err
+		}
+		adv = addr
+	}
+	conn, err := net.ListenPacket("udp", p.config.Address)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	p.logger.Info(fmt.Sprintf("MQTT-SN gateway started at %s", p.config.Address))
+
+	// The datagrams are read until the sessions are drained,
+	// so that the clients can disconnect on their own.
+	read := make(chan struct{})
+	go func(ctx context.Context) {
+		defer close(read)
+		p.read(ctx)
+	}(ctx)
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		p.upstreams.Run(ctx)
+		return nil
+	})
+
+	g.Go(func() error {
+		p.advertise(ctx, adv)
+		return nil
+	})
+
+	g.Go(func() error {
+		<-ctx.Done()
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		p.logger.Info(fmt.Sprintf("MQTT-SN gateway at %s exiting with errors", p.config.Address), slog.String("error", err.Error()))
+	} else {
+		p.logger.Info(fmt.Sprintf("MQTT-SN gateway at %s exiting...", p.config.Address))
+	}
+	p.mu.Lock()
+	p.closing = true
+	p.mu.Unlock()
+	p.drain()
+	p.clients.Wait()
+	err = conn.Close()
+	<-read
+	return err
+}
+
+func (p *Proxy) read(ctx context.Context) {
+	buf := make([]byte, maxLength)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.logger.Warn("Read error " + err.Error())
+			continue
+		}
+		pkt, err := Decode(buf[:n])
+		if err != nil {
+			p.logger.Debug("Dropped invalid MQTT-SN message", slog.String("remote", addr.String()), slog.Any("error", err))
+			continue
+		}
+		p.dispatch(ctx, pkt, addr)
+	}
+}
+
+// dispatch hands the message over to the client it was sent by. Gateway
+// discovery is answered by the gateway itself, and the clients it does not
+// know are told to connect again with a DISCONNECT.
+func (p *Proxy) dispatch(ctx context.Context, pkt Packet, addr net.Addr) {
+	switch pkt := pkt.(type) {
+	case SearchGWPacket:
+		_ = p.send(GWInfoPacket{GatewayID: p.gateway.GatewayID}, addr)
+		return
+	case AdvertisePacket, GWInfoPacket:
+		return
+	case ConnectPacket:
+		p.connect(ctx, pkt, addr)
+		return
+	case PingreqPacket:
+		// Sleeping clients may wake up with another address.
+		if c := p.sleeping(pkt.ClientID, addr); c != nil {
+			c.receive(pkt, addr)
+			return
+		}
+	}
+	p.mu.Lock()
+	c := p.byAddr[addr.String()]
+	p.mu.Unlock()
+	if c != nil {
+		c.receive(pkt, addr)
+		return
+	}
+	if pub, ok := pkt.(PublishPacket); ok && pub.Flags.QoS == -1 {
+		p.logger.Debug("Dropped QoS -1 PUBLISH, which is not supported", slog.String("remote", addr.String()))
+		return
+	}
+	if _, ok := pkt.(DisconnectPacket); !ok {
+		_ = p.send(DisconnectPacket{}, addr)
+	}
+}
+
+// connect starts the session of the client, or resumes the session of a
+// sleeping client which does not ask for a clean session.
+func (p *Proxy) connect(ctx context.Context, pkt ConnectPacket, addr net.Addr) {
+	key := addr.String()
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		_ = p.send(ConnackPacket{ReturnCode: RejectedCongestion}, addr)
+		return
+	}
+	old := p.byAddr[key]
+	if old != nil && old.id == pkt.ClientID && old.state.Load() == int32(connecting) {
+		// The client sent CONNECT again before receiving CONNACK.
+		p.mu.Unlock()
+		old.receive(pkt, addr)
+		return
+	}
+	if c := p.byID[pkt.ClientID]; c != nil && c.asleep() && !pkt.Flags.CleanSession {
+		p.rekey(c, key)
+		p.mu.Unlock()
+		c.receive(pkt, addr)
+		return
+	}
+	p.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+
+	release, err := p.config.Session.ConnLimiter.Accept(addr)
+	if err != nil {
+		reason := connlimit.Reason(err)
+		p.config.Session.Metrics.Rejected(reason)
+		p.logger.Warn("Rejected client connection", slog.String("remote", key), slog.String("reason", reason), slog.Any("error", err))
+		_ = p.send(ConnackPacket{ReturnCode: RejectedCongestion}, addr)
+		return
+	}
+	p.logger.Info("Accepted new client")
+	p.config.Session.Metrics.Accepted()
+
+	c := newClient(p, pkt.ClientID, addr)
+	p.mu.Lock()
+	p.byAddr[key] = c
+	p.byID[c.id] = c
+	p.mu.Unlock()
+	p.clients.Add(1)
+	go func() {
+		defer p.clients.Done()
+		defer p.config.Session.Metrics.Closed()
+		defer release()
+		defer p.remove(c)
+		c.run(ctx)
+	}()
+	c.receive(pkt, addr)
+}
+
+// sleeping returns the sleeping client with the given client ID, which is
+// then indexed by its new address.
+func (p *Proxy) sleeping(id string, addr net.Addr) *client {
+	if id == "" {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.byID[id]
+	if c == nil || !c.asleep() {
+		return nil
+	}
+	p.rekey(c, addr.String())
+	return c
+}
+
+// rekey indexes the client by its new address. It must be called with the lock held.
+func (p *Proxy) rekey(c *client, key string) {
+	if c.key == key {
+		return
+	}
+	if p.byAddr[c.key] == c {
+		delete(p.byAddr, c.key)
+	}
+	if old := p.byAddr[key]; old != nil {
+		old.close()
+	}
+	c.key = key
+	p.byAddr[key] = c
+}
+
+func (p *Proxy) remove(c *client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byAddr[c.key] == c {
+		delete(p.byAddr, c.key)
+	}
+	if p.byID[c.id] == c {
+		delete(p.byID, c.id)
+	}
+}
+
+// send writes the message to the client with the given address.
+func (p *Proxy) send(pkt Packet, addr net.Addr) error {
+	b, err := pkt.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.WriteTo(b, addr)
+	return err
+}
+
+// advertise broadcasts ADVERTISE to the advertise address until the context is done.
+func (p *Proxy) advertise(ctx context.Context, addr net.Addr) {
+	if addr == nil || p.gateway.AdvertiseInterval <= 0 {
+		return
+	}
+	interval := min(p.gateway.AdvertiseInterval, maxAdvertiseInterval)
+	pkt := AdvertisePacket{GatewayID: p.gateway.GatewayID, Duration: uint16(interval / time.Second)}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.send(pkt, addr); err != nil {
+			p.logger.Warn("Failed to advertise gateway", slog.String("address", addr.String()), slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain ends the sessions still active once the gateway is closed.
+func (p *Proxy) drain() {
+	cfg := p.config.Session
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	total, forced := cfg.Tracker.Drain(ctx, cfg.DrainGracePeriod)
+	if total == 0 {
+		return
+	}
+	p.logger.Info("Drained sessions", slog.String("address", p.config.Address), slog.Int("sessions", total), slog.Int("force_closed", forced))
+}
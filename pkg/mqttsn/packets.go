@@ -0,0 +1,675 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Message types of MQTT-SN 1.2.
+const (
+	Advertise     byte = 0x00
+	SearchGW      byte = 0x01
+	GWInfo        byte = 0x02
+	Connect       byte = 0x04
+	Connack       byte = 0x05
+	WillTopicReq  byte = 0x06
+	WillTopic     byte = 0x07
+	WillMsgReq    byte = 0x08
+	WillMsg       byte = 0x09
+	Register      byte = 0x0A
+	Regack        byte = 0x0B
+	Publish       byte = 0x0C
+	Puback        byte = 0x0D
+	Pubcomp       byte = 0x0E
+	Pubrec        byte = 0x0F
+	Pubrel        byte = 0x10
+	Subscribe     byte = 0x12
+	Suback        byte = 0x13
+	Unsubscribe   byte = 0x14
+	Unsuback      byte = 0x15
+	Pingreq       byte = 0x16
+	Pingresp      byte = 0x17
+	Disconnect    byte = 0x18
+	WillTopicUpd  byte = 0x1A
+	WillTopicResp byte = 0x1B
+	WillMsgUpd    byte = 0x1C
+	WillMsgResp   byte = 0x1D
+)
+
+// PacketNames maps the message type to its name.
+var PacketNames = map[byte]string{
+	Advertise:     "ADVERTISE",
+	SearchGW:      "SEARCHGW",
+	GWInfo:        "GWINFO",
+	Connect:       "CONNECT",
+	Connack:       "CONNACK",
+	WillTopicReq:  "WILLTOPICREQ",
+	WillTopic:     "WILLTOPIC",
+	WillMsgReq:    "WILLMSGREQ",
+	WillMsg:       "WILLMSG",
+	Register:      "REGISTER",
+	Regack:        "REGACK",
+	Publish:       "PUBLISH",
+	Puback:        "PUBACK",
+	Pubcomp:       "PUBCOMP",
+	Pubrec:        "PUBREC",
+	Pubrel:        "PUBREL",
+	Subscribe:     "SUBSCRIBE",
+	Suback:        "SUBACK",
+	Unsubscribe:   "UNSUBSCRIBE",
+	Unsuback:      "UNSUBACK",
+	Pingreq:       "PINGREQ",
+	Pingresp:      "PINGRESP",
+	Disconnect:    "DISCONNECT",
+	WillTopicUpd:  "WILLTOPICUPD",
+	WillTopicResp: "WILLTOPICRESP",
+	WillMsgUpd:    "WILLMSGUPD",
+	WillMsgResp:   "WILLMSGRESP",
+}
+
+// Return codes of CONNACK, REGACK, PUBACK, SUBACK and the will update responses.
+const (
+	Accepted           byte = 0x00
+	RejectedCongestion byte = 0x01
+	RejectedTopicID    byte = 0x02
+	RejectedNotSupport byte = 0x03
+)
+
+// Topic ID types of the flags.
+const (
+	// TopicNormal is a topic ID registered with REGISTER, or a topic name in SUBSCRIBE and UNSUBSCRIBE.
+	TopicNormal byte = 0x00
+	// TopicPredefined is a topic ID agreed upon in advance by the client and the gateway.
+	TopicPredefined byte = 0x01
+	// TopicShort is a topic name of two characters carried in place of the topic ID.
+	TopicShort byte = 0x02
+)
+
+// ProtocolID is the protocol ID of MQTT-SN 1.2 in CONNECT.
+const ProtocolID byte = 0x01
+
+// maxLength is the largest length of a message, including its header.
+const maxLength = 0xFFFF
+
+var (
+	// ErrMalformedPacket indicates the message could not be decoded.
+	ErrMalformedPacket = errors.New("malformed MQTT-SN message")
+
+	// ErrUnknownPacketType indicates an unsupported message type.
+	ErrUnknownPacketType = errors.New("unknown MQTT-SN message type")
+
+	// ErrPacketTooLarge indicates the message exceeds the maximum message length.
+	ErrPacketTooLarge = errors.New("MQTT-SN message too large")
+)
+
+// Packet is the interface implemented by all MQTT-SN messages.
+type Packet interface {
+	// Type returns the message type.
+	Type() byte
+	// Pack encodes the message, including its header.
+	Pack() ([]byte, error)
+}
+
+// Flags are the flags of CONNECT, WILLTOPIC, PUBLISH, SUBSCRIBE, SUBACK and UNSUBSCRIBE.
+type Flags struct {
+	DUP bool
+	// QoS is the QoS level, -1 for publishing without connection.
+	QoS          int8
+	Retain       bool
+	Will         bool
+	CleanSession bool
+	TopicIDType  byte
+}
+
+func decodeFlags(b byte) Flags {
+	f := Flags{
+		DUP:          b&0x80 != 0,
+		QoS:          int8(b>>5) & 0x03,
+		Retain:       b&0x10 != 0,
+		Will:         b&0x08 != 0,
+		CleanSession: b&0x04 != 0,
+		TopicIDType:  b & 0x03,
+	}
+	if f.QoS == 3 {
+		f.QoS = -1
+	}
+	return f
+}
+
+func (f Flags) encode() byte {
+	b := byte(f.QoS&0x03)<<5 | f.TopicIDType&0x03
+	if f.DUP {
+		b |= 0x80
+	}
+	if f.Retain {
+		b |= 0x10
+	}
+	if f.Will {
+		b |= 0x08
+	}
+	if f.CleanSession {
+		b |= 0x04
+	}
+	return b
+}
+
+// AdvertisePacket is broadcast by the gateway to announce its presence.
+type AdvertisePacket struct {
+	GatewayID byte
+	// Duration is the time in seconds until the next advertisement.
+	Duration uint16
+}
+
+// SearchGWPacket is broadcast by clients looking for a gateway.
+type SearchGWPacket struct {
+	Radius byte
+}
+
+// GWInfoPacket answers SEARCHGW. The address is only set by clients answering on behalf of a gateway.
+type GWInfoPacket struct {
+	GatewayID      byte
+	GatewayAddress []byte
+}
+
+// ConnectPacket opens the session of a client.
+type ConnectPacket struct {
+	Flags      Flags
+	ProtocolID byte
+	// Duration is the keep alive period in seconds.
+	Duration uint16
+	ClientID string
+}
+
+// ConnackPacket answers CONNECT.
+type ConnackPacket struct {
+	ReturnCode byte
+}
+
+// WillTopicReqPacket requests the will topic of a connecting client.
+type WillTopicReqPacket struct{}
+
+// WillTopicPacket carries the will topic, with the QoS and retain flags of the will message.
+// An empty will topic deletes the will.
+type WillTopicPacket struct {
+	Flags Flags
+	Topic string
+}
+
+// WillMsgReqPacket requests the will message of a connecting client.
+type WillMsgReqPacket struct{}
+
+// WillMsgPacket carries the will message.
+type WillMsgPacket struct {
+	Message []byte
+}
+
+// RegisterPacket registers a topic name, assigning it a topic ID.
+type RegisterPacket struct {
+	TopicID   uint16
+	MsgID     uint16
+	TopicName string
+}
+
+// RegackPacket answers REGISTER.
+type RegackPacket struct {
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode byte
+}
+
+// PublishPacket carries an application message.
+type PublishPacket struct {
+	Flags Flags
+	// TopicID is the topic ID, or the two characters of a short topic name.
+	TopicID uint16
+	MsgID   uint16
+	Data    []byte
+}
+
+// PubackPacket acknowledges a PUBLISH of QoS 1, or rejects a PUBLISH of any QoS.
+type PubackPacket struct {
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode byte
+}
+
+// PubrecPacket, PubrelPacket and PubcompPacket carry the QoS 2 flows.
+type (
+	PubrecPacket  struct{ MsgID uint16 }
+	PubrelPacket  struct{ MsgID uint16 }
+	PubcompPacket struct{ MsgID uint16 }
+)
+
+// SubscribePacket subscribes to a topic name or filter, or to a predefined topic ID.
+type SubscribePacket struct {
+	Flags Flags
+	MsgID uint16
+	// TopicName is the topic name or filter of the normal and short topic types.
+	TopicName string
+	// TopicID is the topic ID of the predefined topic type.
+	TopicID uint16
+}
+
+// SubackPacket answers SUBSCRIBE with the granted QoS in its flags.
+type SubackPacket struct {
+	Flags      Flags
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode byte
+}
+
+// UnsubscribePacket unsubscribes from a topic name or filter, or from a predefined topic ID.
+type UnsubscribePacket struct {
+	Flags     Flags
+	MsgID     uint16
+	TopicName string
+	TopicID   uint16
+}
+
+// UnsubackPacket answers UNSUBSCRIBE.
+type UnsubackPacket struct {
+	MsgID uint16
+}
+
+// PingreqPacket keeps the session alive. Sleeping clients set their client ID
+// to wake up and receive the messages buffered for them.
+type PingreqPacket struct {
+	ClientID string
+}
+
+// PingrespPacket answers PINGREQ.
+type PingrespPacket struct{}
+
+// DisconnectPacket ends the session, or sends the client to sleep for Duration seconds.
+type DisconnectPacket struct {
+	// Duration is the sleep duration in seconds, only present if Sleep is set.
+	Duration uint16
+	Sleep    bool
+}
+
+// WillTopicUpdPacket updates the will topic of an active session.
+type WillTopicUpdPacket struct {
+	Flags Flags
+	Topic string
+}
+
+// WillTopicRespPacket answers WILLTOPICUPD.
+type WillTopicRespPacket struct {
+	ReturnCode byte
+}
+
+// WillMsgUpdPacket updates the will message of an active session.
+type WillMsgUpdPacket struct {
+	Message []byte
+}
+
+// WillMsgRespPacket answers WILLMSGUPD.
+type WillMsgRespPacket struct {
+	ReturnCode byte
+}
+
+func (AdvertisePacket) Type() byte     { return Advertise }
+func (SearchGWPacket) Type() byte      { return SearchGW }
+func (GWInfoPacket) Type() byte        { return GWInfo }
+func (ConnectPacket) Type() byte       { return Connect }
+func (ConnackPacket) Type() byte       { return Connack }
+func (WillTopicReqPacket) Type() byte  { return WillTopicReq }
+func (WillTopicPacket) Type() byte     { return WillTopic }
+func (WillMsgReqPacket) Type() byte    { return WillMsgReq }
+func (WillMsgPacket) Type() byte       { return WillMsg }
+func (RegisterPacket) Type() byte      { return Register }
+func (RegackPacket) Type() byte        { return Regack }
+func (PublishPacket) Type() byte       { return Publish }
+func (PubackPacket) Type() byte        { return Puback }
+func (PubrecPacket) Type() byte        { return Pubrec }
+func (PubrelPacket) Type() byte        { return Pubrel }
+func (PubcompPacket) Type() byte       { return Pubcomp }
+func (SubscribePacket) Type() byte     { return Subscribe }
+func (SubackPacket) Type() byte        { return Suback }
+func (UnsubscribePacket) Type() byte   { return Unsubscribe }
+func (UnsubackPacket) Type() byte      { return Unsuback }
+func (PingreqPacket) Type() byte       { return Pingreq }
+func (PingrespPacket) Type() byte      { return Pingresp }
+func (DisconnectPacket) Type() byte    { return Disconnect }
+func (WillTopicUpdPacket) Type() byte  { return WillTopicUpd }
+func (WillTopicRespPacket) Type() byte { return WillTopicResp }
+func (WillMsgUpdPacket) Type() byte    { return WillMsgUpd }
+func (WillMsgRespPacket) Type() byte   { return WillMsgResp }
+
+func (p AdvertisePacket) Pack() ([]byte, error) {
+	return pack(Advertise, binary.BigEndian.AppendUint16([]byte{p.GatewayID}, p.Duration))
+}
+
+func (p SearchGWPacket) Pack() ([]byte, error) {
+	return pack(SearchGW, []byte{p.Radius})
+}
+
+func (p GWInfoPacket) Pack() ([]byte, error) {
+	return pack(GWInfo, append([]byte{p.GatewayID}, p.GatewayAddress...))
+}
+
+func (p ConnectPacket) Pack() ([]byte, error) {
+	b := binary.BigEndian.AppendUint16([]byte{p.Flags.encode(), p.ProtocolID}, p.Duration)
+	return pack(Connect, append(b, p.ClientID...))
+}
+
+func (p ConnackPacket) Pack() ([]byte, error) {
+	return pack(Connack, []byte{p.ReturnCode})
+}
+
+func (WillTopicReqPacket) Pack() ([]byte, error) {
+	return pack(WillTopicReq, nil)
+}
+
+func (p WillTopicPacket) Pack() ([]byte, error) {
+	if p.Topic == "" {
+		return pack(WillTopic, nil)
+	}
+	return pack(WillTopic, append([]byte{p.Flags.encode()}, p.Topic...))
+}
+
+func (WillMsgReqPacket) Pack() ([]byte, error) {
+	return pack(WillMsgReq, nil)
+}
+
+func (p WillMsgPacket) Pack() ([]byte, error) {
+	return pack(WillMsg, p.Message)
+}
+
+func (p RegisterPacket) Pack() ([]byte, error) {
+	return pack(Register, append(appendIDs(nil, p.TopicID, p.MsgID), p.TopicName...))
+}
+
+func (p RegackPacket) Pack() ([]byte, error) {
+	return pack(Regack, append(appendIDs(nil, p.TopicID, p.MsgID), p.ReturnCode))
+}
+
+func (p PublishPacket) Pack() ([]byte, error) {
+	return pack(Publish, append(appendIDs([]byte{p.Flags.encode()}, p.TopicID, p.MsgID), p.Data...))
+}
+
+func (p PubackPacket) Pack() ([]byte, error) {
+	return pack(Puback, append(appendIDs(nil, p.TopicID, p.MsgID), p.ReturnCode))
+}
+
+func (p PubrecPacket) Pack() ([]byte, error) {
+	return pack(Pubrec, binary.BigEndian.AppendUint16(nil, p.MsgID))
+}
+
+func (p PubrelPacket) Pack() ([]byte, error) {
+	return pack(Pubrel, binary.BigEndian.AppendUint16(nil, p.MsgID))
+}
+
+func (p PubcompPacket) Pack() ([]byte, error) {
+	return pack(Pubcomp, binary.BigEndian.AppendUint16(nil, p.MsgID))
+}
+
+func (p SubscribePacket) Pack() ([]byte, error) {
+	return pack(Subscribe, appendTopic([]byte{p.Flags.encode()}, p.Flags, p.MsgID, p.TopicName, p.TopicID))
+}
+
+func (p SubackPacket) Pack() ([]byte, error) {
+	return pack(Suback, append(appendIDs([]byte{p.Flags.encode()}, p.TopicID, p.MsgID), p.ReturnCode))
+}
+
+func (p UnsubscribePacket) Pack() ([]byte, error) {
+	return pack(Unsubscribe, appendTopic([]byte{p.Flags.encode()}, p.Flags, p.MsgID, p.TopicName, p.TopicID))
+}
+
+func (p UnsubackPacket) Pack() ([]byte, error) {
+	return pack(Unsuback, binary.BigEndian.AppendUint16(nil, p.MsgID))
+}
+
+func (p PingreqPacket) Pack() ([]byte, error) {
+	return pack(Pingreq, []byte(p.ClientID))
+}
+
+func (PingrespPacket) Pack() ([]byte, error) {
+	return pack(Pingresp, nil)
+}
+
+func (p DisconnectPacket) Pack() ([]byte, error) {
+	if !p.Sleep {
+		return pack(Disconnect, nil)
+	}
+	return pack(Disconnect, binary.BigEndian.AppendUint16(nil, p.Duration))
+}
+
+func (p WillTopicUpdPacket) Pack() ([]byte, error) {
+	if p.Topic == "" {
+		return pack(WillTopicUpd, nil)
+	}
+	return pack(WillTopicUpd, append([]byte{p.Flags.encode()}, p.Topic...))
+}
+
+func (p WillTopicRespPacket) Pack() ([]byte, error) {
+	return pack(WillTopicResp, []byte{p.ReturnCode})
+}
+
+func (p WillMsgUpdPacket) Pack() ([]byte, error) {
+	return pack(WillMsgUpd, p.Message)
+}
+
+func (p WillMsgRespPacket) Pack() ([]byte, error) {
+	return pack(WillMsgResp, []byte{p.ReturnCode})
+}
+
+// pack prefixes the body with the header of the message. The length takes one
+// byte, or three bytes starting with 0x01 for messages longer than 255 bytes.
+func pack(t byte, body []byte) ([]byte, error) {
+	n := len(body) + 2
+	if n <= 0xFF {
+		return append([]byte{byte(n), t}, body...), nil
+	}
+	n += 2
+	if n > maxLength {
+		return nil, ErrPacketTooLarge
+	}
+	b := binary.BigEndian.AppendUint16([]byte{0x01}, uint16(n))
+	return append(append(b, t), body...), nil
+}
+
+func appendIDs(b []byte, topicID, msgID uint16) []byte {
+	b = binary.BigEndian.AppendUint16(b, topicID)
+	return binary.BigEndian.AppendUint16(b, msgID)
+}
+
+// appendTopic appends the message ID and the topic of SUBSCRIBE and UNSUBSCRIBE,
+// which is a topic ID for predefined topics and a topic name otherwise.
+func appendTopic(b []byte, f Flags, msgID uint16, name string, id uint16) []byte {
+	b = binary.BigEndian.AppendUint16(b, msgID)
+	if f.TopicIDType == TopicPredefined {
+		return binary.BigEndian.AppendUint16(b, id)
+	}
+	return append(b, name...)
+}
+
+// Decode decodes the MQTT-SN message of a datagram.
+func Decode(b []byte) (Packet, error) {
+	if len(b) < 2 {
+		return nil, ErrMalformedPacket
+	}
+	n, h := int(b[0]), 1
+	if n == 0x01 {
+		if len(b) < 4 {
+			return nil, ErrMalformedPacket
+		}
+		n, h = int(binary.BigEndian.Uint16(b[1:3])), 3
+	}
+	if n != len(b) || n < h+1 {
+		return nil, ErrMalformedPacket
+	}
+	t, body := b[h], b[h+1:]
+	switch t {
+	case Advertise:
+		if len(body) != 3 {
+			return nil, ErrMalformedPacket
+		}
+		return AdvertisePacket{GatewayID: body[0], Duration: binary.BigEndian.Uint16(body[1:])}, nil
+	case SearchGW:
+		if len(body) != 1 {
+			return nil, ErrMalformedPacket
+		}
+		return SearchGWPacket{Radius: body[0]}, nil
+	case GWInfo:
+		if len(body) < 1 {
+			return nil, ErrMalformedPacket
+		}
+		return GWInfoPacket{GatewayID: body[0], GatewayAddress: clone(body[1:])}, nil
+	case Connect:
+		if len(body) < 4 {
+			return nil, ErrMalformedPacket
+		}
+		return ConnectPacket{
+			Flags:      decodeFlags(body[0]),
+			ProtocolID: body[1],
+			Duration:   binary.BigEndian.Uint16(body[2:4]),
+			ClientID:   string(body[4:]),
+		}, nil
+	case Connack:
+		if len(body) != 1 {
+			return nil, ErrMalformedPacket
+		}
+		return ConnackPacket{ReturnCode: body[0]}, nil
+	case WillTopicReq:
+		return WillTopicReqPacket{}, nil
+	case WillTopic:
+		if len(body) == 0 {
+			return WillTopicPacket{}, nil
+		}
+		return WillTopicPacket{Flags: decodeFlags(body[0]), Topic: string(body[1:])}, nil
+	case WillMsgReq:
+		return WillMsgReqPacket{}, nil
+	case WillMsg:
+		return WillMsgPacket{Message: clone(body)}, nil
+	case Register:
+		if len(body) < 4 {
+			return nil, ErrMalformedPacket
+		}
+		return RegisterPacket{
+			TopicID:   binary.BigEndian.Uint16(body[0:2]),
+			MsgID:     binary.BigEndian.Uint16(body[2:4]),
+			TopicName: string(body[4:]),
+		}, nil
+	case Regack:
+		if len(body) != 5 {
+			return nil, ErrMalformedPacket
+		}
+		return RegackPacket{
+			TopicID:    binary.BigEndian.Uint16(body[0:2]),
+			MsgID:      binary.BigEndian.Uint16(body[2:4]),
+			ReturnCode: body[4],
+		}, nil
+	case Publish:
+		if len(body) < 5 {
+			return nil, ErrMalformedPacket
+		}
+		return PublishPacket{
+			Flags:   decodeFlags(body[0]),
+			TopicID: binary.BigEndian.Uint16(body[1:3]),
+			MsgID:   binary.BigEndian.Uint16(body[3:5]),
+			Data:    clone(body[5:]),
+		}, nil
+	case Puback:
+		if len(body) != 5 {
+			return nil, ErrMalformedPacket
+		}
+		return PubackPacket{
+			TopicID:    binary.BigEndian.Uint16(body[0:2]),
+			MsgID:      binary.BigEndian.Uint16(body[2:4]),
+			ReturnCode: body[4],
+		}, nil
+	case Pubrec, Pubrel, Pubcomp, Unsuback:
+		if len(body) != 2 {
+			return nil, ErrMalformedPacket
+		}
+		id := binary.BigEndian.Uint16(body)
+		switch t {
+		case Pubrec:
+			return PubrecPacket{MsgID: id}, nil
+		case Pubrel:
+			return PubrelPacket{MsgID: id}, nil
+		case Pubcomp:
+			return PubcompPacket{MsgID: id}, nil
+		default:
+			return UnsubackPacket{MsgID: id}, nil
+		}
+	case Subscribe, Unsubscribe:
+		if len(body) < 3 {
+			return nil, ErrMalformedPacket
+		}
+		f := decodeFlags(body[0])
+		id := binary.BigEndian.Uint16(body[1:3])
+		var (
+			name    string
+			topicID uint16
+		)
+		switch f.TopicIDType {
+		case TopicPredefined:
+			if len(body) != 5 {
+				return nil, ErrMalformedPacket
+			}
+			topicID = binary.BigEndian.Uint16(body[3:])
+		case TopicShort:
+			if len(body) != 5 {
+				return nil, ErrMalformedPacket
+			}
+			name = string(body[3:])
+		default:
+			name = string(body[3:])
+		}
+		if t == Subscribe {
+			return SubscribePacket{Flags: f, MsgID: id, TopicName: name, TopicID: topicID}, nil
+		}
+		return UnsubscribePacket{Flags: f, MsgID: id, TopicName: name, TopicID: topicID}, nil
+	case Suback:
+		if len(body) != 6 {
+			return nil, ErrMalformedPacket
+		}
+		return SubackPacket{
+			Flags:      decodeFlags(body[0]),
+			TopicID:    binary.BigEndian.Uint16(body[1:3]),
+			MsgID:      binary.BigEndian.Uint16(body[3:5]),
+			ReturnCode: body[5],
+		}, nil
+	case Pingreq:
+		return PingreqPacket{ClientID: string(body)}, nil
+	case Pingresp:
+		return PingrespPacket{}, nil
+	case Disconnect:
+		switch len(body) {
+		case 0:
+			return DisconnectPacket{}, nil
+		case 2:
+			return DisconnectPacket{Duration: binary.BigEndian.Uint16(body), Sleep: true}, nil
+		default:
+			return nil, ErrMalformedPacket
+		}
+	case WillTopicUpd:
+		if len(body) == 0 {
+			return WillTopicUpdPacket{}, nil
+		}
+		return WillTopicUpdPacket{Flags: decodeFlags(body[0]), Topic: string(body[1:])}, nil
+	case WillTopicResp, WillMsgResp:
+		if len(body) != 1 {
+			return nil, ErrMalformedPacket
+		}
+		if t == WillTopicResp {
+			return WillTopicRespPacket{ReturnCode: body[0]}, nil
+		}
+		return WillMsgRespPacket{ReturnCode: body[0]}, nil
+	case WillMsgUpd:
+		return WillMsgUpdPacket{Message: clone(body)}, nil
+	default:
+		return nil, fmt.Errorf("%w: %#02x", ErrUnknownPacketType, t)
+	}
+}
+
+// clone copies b, since the datagram buffer is reused for the next read.
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mqttsn
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cases := []Packet{
+		AdvertisePacket{GatewayID: 1, Duration: 900},
+		SearchGWPacket{Radius: 2},
+		GWInfoPacket{GatewayID: 1, GatewayAddress: []byte{127, 0, 0, 1}},
+		ConnectPacket{Flags: Flags{Will: true, CleanSession: true}, ProtocolID: ProtocolID, Duration: 60, ClientID: "client"},
+		ConnackPacket{ReturnCode: RejectedCongestion},
+		WillTopicReqPacket{},
+		WillTopicPacket{Flags: Flags{QoS: 1, Retain: true}, Topic: "will"},
+		WillMsgReqPacket{},
+		WillMsgPacket{Message: []byte("gone")},
+		RegisterPacket{TopicID: 1, MsgID: 2, TopicName: "a/b"},
+		RegackPacket{TopicID: 1, MsgID: 2, ReturnCode: RejectedTopicID},
+		PublishPacket{Flags: Flags{DUP: true, QoS: 2, Retain: true, TopicIDType: TopicShort}, TopicID: 0x6162, MsgID: 3, Data: []byte("payload")},
+		PublishPacket{Flags: Flags{QoS: -1, TopicIDType: TopicPredefined}, TopicID: 4},
+		PubackPacket{TopicID: 1, MsgID: 3, ReturnCode: Accepted},
+		PubrecPacket{MsgID: 3},
+		PubrelPacket{MsgID: 3},
+		PubcompPacket{MsgID: 3},
+		SubscribePacket{Flags: Flags{QoS: 1}, MsgID: 4, TopicName: "a/+"},
+		SubscribePacket{Flags: Flags{TopicIDType: TopicShort}, MsgID: 4, TopicName: "ab"},
+		SubscribePacket{Flags: Flags{TopicIDType: TopicPredefined}, MsgID: 4, TopicID: 7},
+		SubackPacket{Flags: Flags{QoS: 1}, TopicID: 1, MsgID: 4, ReturnCode: Accepted},
+		UnsubscribePacket{MsgID: 5, TopicName: "a/+"},
+		UnsubscribePacket{Flags: Flags{TopicIDType: TopicPredefined}, MsgID: 5, TopicID: 7},
+		UnsubackPacket{MsgID: 5},
+		PingreqPacket{},
+		PingreqPacket{ClientID: "sleeper"},
+		PingrespPacket{},
+		DisconnectPacket{},
+		DisconnectPacket{Sleep: true, Duration: 30},
+		WillTopicUpdPacket{Flags: Flags{QoS: 1}, Topic: "will"},
+		WillTopicUpdPacket{},
+		WillTopicRespPacket{ReturnCode: RejectedNotSupport},
+		WillMsgUpdPacket{Message: []byte("gone")},
+		WillMsgRespPacket{ReturnCode: RejectedNotSupport},
+		// Messages longer than 255 bytes have a three byte length.
+		PublishPacket{TopicID: 1, MsgID: 1, Data: bytes.Repeat([]byte{'x'}, 300)},
+	}
+	for _, pkt := range cases {
+		t.Run(PacketNames[pkt.Type()], func(t *testing.T) {
+			b, err := pkt.Pack()
+			if err != nil {
+				t.Fatalf("Pack() = %v", err)
+			}
+			if b[0] == 0x01 {
+				if n := int(b[1])<<8 | int(b[2]); n != len(b) || b[3] != pkt.Type() {
+					t.Errorf("long header % x for %d bytes", b[:4], len(b))
+				}
+			} else if int(b[0]) != len(b) || b[1] != pkt.Type() {
+				t.Errorf("header % x for %d bytes", b[:2], len(b))
+			}
+			got, err := Decode(b)
+			if err != nil {
+				t.Fatalf("Decode(% x) = %v", b, err)
+			}
+			if !reflect.DeepEqual(got, pkt) {
+				t.Errorf("Decode() = %+v, want %+v", got, pkt)
+			}
+		})
+	}
+}
+
+func TestFlags(t *testing.T) {
+	cases := []struct {
+		b     byte
+		flags Flags
+	}{
+		{b: 0x00, flags: Flags{}},
+		{b: 0x80, flags: Flags{DUP: true}},
+		{b: 0x20, flags: Flags{QoS: 1}},
+		{b: 0x40, flags: Flags{QoS: 2}},
+		{b: 0x60, flags: Flags{QoS: -1}},
+		{b: 0x10, flags: Flags{Retain: true}},
+		{b: 0x08, flags: Flags{Will: true}},
+		{b: 0x04, flags: Flags{CleanSession: true}},
+		{b: 0x01, flags: Flags{TopicIDType: TopicPredefined}},
+		{b: 0x02, flags: Flags{TopicIDType: TopicShort}},
+	}
+	for _, tc := range cases {
+		if got := decodeFlags(tc.b); got != tc.flags {
+			t.Errorf("decodeFlags(%#02x) = %+v, want %+v", tc.b, got, tc.flags)
+		}
+		if got := tc.flags.encode(); got != tc.b {
+			t.Errorf("%+v.encode() = %#02x, want %#02x", tc.flags, got, tc.b)
+		}
+	}
+}
+
+func TestPackTooLarge(t *testing.T) {
+	pkt := PublishPacket{TopicID: 1, MsgID: 1, Data: make([]byte, maxLength)}
+	if _, err := pkt.Pack(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("Pack() = %v, want %v", err, ErrPacketTooLarge)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	cases := []struct {
+		desc string
+		b    []byte
+		err  error
+	}{
+		{desc: "empty", b: nil, err: ErrMalformedPacket},
+		{desc: "length only", b: []byte{0x01}, err: ErrMalformedPacket},
+		{desc: "length over datagram", b: []byte{0x05, Connack, 0x00}, err: ErrMalformedPacket},
+		{desc: "length under datagram", b: []byte{0x02, Connack, 0x00}, err: ErrMalformedPacket},
+		{desc: "truncated long length", b: []byte{0x01, 0x00, 0x05}, err: ErrMalformedPacket},
+		{desc: "long length over datagram", b: []byte{0x01, 0x01, 0x00, Pingresp}, err: ErrMalformedPacket},
+		{desc: "long length without type", b: []byte{0x01, 0x00, 0x03, Pingresp}, err: ErrMalformedPacket},
+		{desc: "unknown type", b: []byte{0x02, 0x03}, err: ErrUnknownPacketType},
+		{desc: "short CONNECT", b: []byte{0x05, Connect, 0x04, ProtocolID, 0x00}, err: ErrMalformedPacket},
+		{desc: "short PUBLISH", b: []byte{0x06, Publish, 0x00, 0x00, 0x01, 0x00}, err: ErrMalformedPacket},
+		{desc: "short REGISTER", b: []byte{0x05, Register, 0x00, 0x01, 0x00}, err: ErrMalformedPacket},
+		{desc: "long REGACK", b: []byte{0x08, Regack, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00}, err: ErrMalformedPacket},
+		{desc: "short PUBACK", b: []byte{0x06, Puback, 0x00, 0x01, 0x00, 0x01}, err: ErrMalformedPacket},
+		{desc: "short PUBREL", b: []byte{0x03, Pubrel, 0x00}, err: ErrMalformedPacket},
+		{desc: "short SUBSCRIBE", b: []byte{0x04, Subscribe, 0x00, 0x00}, err: ErrMalformedPacket},
+		{desc: "short topic name over two characters", b: []byte{0x08, Subscribe, 0x02, 0x00, 0x01, 'a', 'b', 'c'}, err: ErrMalformedPacket},
+		{desc: "predefined topic ID over two bytes", b: []byte{0x06, Subscribe, 0x01, 0x00, 0x01, 0x07}, err: ErrMalformedPacket},
+		{desc: "short SUBACK", b: []byte{0x07, Suback, 0x00, 0x00, 0x01, 0x00, 0x01}, err: ErrMalformedPacket},
+		{desc: "DISCONNECT with one byte duration", b: []byte{0x03, Disconnect, 0x01}, err: ErrMalformedPacket},
+		{desc: "ADVERTISE without duration", b: []byte{0x03, Advertise, 0x01}, err: ErrMalformedPacket},
+		{desc: "empty GWINFO", b: []byte{0x02, GWInfo}, err: ErrMalformedPacket},
+		{desc: "empty WILLTOPICRESP", b: []byte{0x02, WillTopicResp}, err: ErrMalformedPacket},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if pkt, err := Decode(tc.b); !errors.Is(err, tc.err) {
+				t.Errorf("Decode(% x) = %+v, %v, want %v", tc.b, pkt, err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyproto
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/metrics"
+)
+
+// ReasonProxyProtocol is the reason of the connections rejected
+// because of a missing or malformed PROXY protocol header.
+const ReasonProxyProtocol = "proxy_protocol"
+
+// NewListener returns the listener reading the PROXY protocol header of the
+// accepted connections, whose RemoteAddr and LocalAddr return the addresses of
+// the header. Headers are read concurrently with the header timeout, so that
+// slow clients do not hold back Accept. Connections with an invalid header, or
+// without one while it is required, are closed, counted and logged. If the mode
+// is Off, l is returned unchanged.
+func NewListener(l net.Listener, config Config, m *metrics.Listener, logger *slog.Logger) net.Listener {
+	if config.Mode == Off {
+		return l
+	}
+	pl := &listener{
+		Listener: l,
+		config:   config,
+		metrics:  m,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go pl.serve()
+	return pl
+}
+
+type listener struct {
+	net.Listener
+	config  Config
+	metrics *metrics.Listener
+	logger  *slog.Logger
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) serve() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handle(c)
+	}
+}
+
+func (l *listener) handle(c net.Conn) {
+	pc, err := l.readHeader(c)
+	if err != nil {
+		l.metrics.Rejected(ReasonProxyProtocol)
+		l.logger.Warn("Rejected client connection", slog.String("remote", c.RemoteAddr().String()), slog.String("reason", ReasonProxyProtocol), slog.Any("error", err))
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.closed:
+		pc.Close()
+	}
+}
+
+// readHeader reads the header of the connection from a trusted source.
+func (l *listener) readHeader(c net.Conn) (net.Conn, error) {
+	if !l.config.trusted(c.RemoteAddr()) {
+		if l.config.Mode == Required {
+			return nil, ErrUntrusted
+		}
+		return c, nil
+	}
+	if l.config.HeaderTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(l.config.HeaderTimeout)); err != nil {
+			return nil, err
+		}
+	}
+	h, read, err := ReadHeader(c)
+	switch {
+	case errors.Is(err, ErrMissingHeader) && l.config.Mode == Optional:
+	case err != nil:
+		return nil, err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, prefix: read, header: h}, nil
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+// conn reports the addresses of the PROXY protocol header. The bytes read
+// while looking for the header are returned by the first reads.
+type conn struct {
+	net.Conn
+	prefix []byte
+	header Header
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the underlying connection.
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// accept connects to the listener, writes the data and returns the
+// accepted connection, or nil if the listener rejected it.
+func accept(t *testing.T, l net.Listener, data []byte) net.Conn {
+	t.Helper()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c
+	}()
+	select {
+	case c := <-accepted:
+		t.Cleanup(func() { c.Close() })
+		return c
+	case <-time.After(200 * time.Millisecond):
+	}
+	// Rejected connections are closed by the listener, or reset
+	// if it did not read all the data.
+	_ = client.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := client.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("rejected connection read = %v, want closed", err)
+	}
+	return nil
+}
+
+func TestListener(t *testing.T) {
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	other := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	data := []byte{0x10, 0x00}
+	v1 := []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 1883\r\n")
+	cases := []struct {
+		desc     string
+		config   Config
+		input    []byte
+		rejected bool
+		remote   string
+	}{
+		{desc: "optional with header", config: Config{Mode: Optional}, input: append(v1, data...), remote: "192.0.2.1:5000"},
+		{desc: "optional without header", config: Config{Mode: Optional}, input: data},
+		{desc: "optional with LOCAL", config: Config{Mode: Optional}, input: append(v2Header(v2Local, v2Unspec), data...)},
+		{desc: "optional with invalid header", config: Config{Mode: Optional}, input: []byte("PROXY TCP4 invalid\r\n"), rejected: true},
+		{desc: "optional from untrusted source", config: Config{Mode: Optional, TrustedCIDRs: other}, input: append(v1, data...)},
+		{desc: "required with header", config: Config{Mode: Required}, input: append(v1, data...), remote: "192.0.2.1:5000"},
+		{desc: "required without header", config: Config{Mode: Required}, input: data, rejected: true},
+		{desc: "required from trusted source", config: Config{Mode: Required, TrustedCIDRs: loopback}, input: append(v1, data...), remote: "192.0.2.1:5000"},
+		{desc: "required from untrusted source", config: Config{Mode: Required, TrustedCIDRs: other}, input: append(v1, data...), rejected: true},
+		{desc: "required with truncated header", config: Config{Mode: Required, HeaderTimeout: 50 * time.Millisecond}, input: v1[:10], rejected: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tcp, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := NewListener(tcp, tc.config, nil, logger)
+			t.Cleanup(func() { l.Close() })
+
+			c := accept(t, l, tc.input)
+			if tc.rejected {
+				if c != nil {
+					t.Fatal("connection accepted, want rejected")
+				}
+				return
+			}
+			if c == nil {
+				t.Fatal("connection rejected")
+			}
+			if tc.remote != "" && c.RemoteAddr().String() != tc.remote {
+				t.Errorf("RemoteAddr() = %s, want %s", c.RemoteAddr(), tc.remote)
+			}
+			want := data
+			if tc.config.TrustedCIDRs != nil && tc.remote == "" {
+				// Untrusted sources are forwarded as they are, header included.
+				want = tc.input
+			}
+			got := make([]byte, len(want))
+			_ = c.SetReadDeadline(time.Now().Add(testTimeout))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Fatalf("read = %v", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("read %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestListenerOff(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if l := NewListener(tcp, Config{Mode: Off}, nil, logger); l != tcp {
+		t.Error("NewListener() wrapped the listener with the PROXY protocol off")
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(tcp, Config{Mode: Optional}, nil, logger)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errs <- err
+	}()
+	l.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept() = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Accept() did not return")
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package proxyproto implements the HAProxy PROXY protocol versions 1 and 2,
+// which carry the address of the client across L4 load balancers and proxies.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	// ErrInvalidMode indicates an unknown PROXY protocol mode value.
+	ErrInvalidMode = errors.New("invalid PROXY protocol mode")
+
+	// ErrInvalidVersion indicates an unknown PROXY protocol version value.
+	ErrInvalidVersion = errors.New("invalid PROXY protocol version")
+
+	// ErrInvalidHeader indicates a malformed PROXY protocol header.
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+	// ErrMissingHeader indicates the connection does not start with a PROXY protocol header.
+	ErrMissingHeader = errors.New("missing PROXY protocol header")
+
+	// ErrUntrusted indicates the connection does not come from a trusted source
+	// while the PROXY protocol header is required.
+	ErrUntrusted = errors.New("connection from untrusted source")
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// v1MaxLength is the maximum length of a version 1 header, including CRLF.
+	v1MaxLength = 107
+
+	v2Local = 0x20
+	v2Proxy = 0x21
+
+	v2Unspec = 0x00
+	v2TCP4   = 0x11
+	v2TCP6   = 0x21
+)
+
+// Mode selects whether the listener accepts the PROXY protocol header.
+type Mode int
+
+const (
+	// Off does not read the header, connections are used as they are.
+	Off Mode = iota
+	// Optional reads the header if the connection starts with one.
+	Optional
+	// Required rejects the connections without the header.
+	Required
+)
+
+// UnmarshalText parses the mode from its name.
+func (m *Mode) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "off":
+		*m = Off
+	case "optional":
+		*m = Optional
+	case "required":
+		*m = Required
+	default:
+		return ErrInvalidMode
+	}
+	return nil
+}
+
+func (m Mode) String() string {
+	switch m {
+	case Optional:
+		return "optional"
+	case Required:
+		return "required"
+	default:
+		return "off"
+	}
+}
+
+// Version is the PROXY protocol version of the headers sent to the target.
+type Version int
+
+const (
+	// None sends no header.
+	None Version = iota
+	// V1 sends the human-readable version 1 header.
+	V1
+	// V2 sends the binary version 2 header.
+	V2
+)
+
+// UnmarshalText parses the version from its name.
+func (v *Version) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "off":
+		*v = None
+	case "v1", "1":
+		*v = V1
+	case "v2", "2":
+		*v = V2
+	default:
+		return ErrInvalidVersion
+	}
+	return nil
+}
+
+// Config holds the PROXY protocol settings of a listener and its target.
+type Config struct {
+	Mode Mode `env:"PROXY_PROTOCOL" envDefault:"off"`
+	// TrustedCIDRs are the networks of the load balancers allowed to send the
+	// header. Headers are accepted from any source if not set. Connections from
+	// other sources are used as they are, or rejected if the header is required.
+	TrustedCIDRs []netip.Prefix `env:"PROXY_PROTOCOL_TRUSTED_CIDRS" envSeparator:","`
+	// HeaderTimeout limits reading the header of a new connection.
+	HeaderTimeout time.Duration `env:"PROXY_PROTOCOL_TIMEOUT" envDefault:"5s"`
+	// Target is the version of the header sent to the target on each connection.
+	Target Version `env:"TARGET_PROXY_PROTOCOL" envDefault:"off"`
+}
+
+// NewConfig parses the PROXY protocol settings from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// trusted reports whether the header is accepted from the given address.
+func (c Config) trusted(addr net.Addr) bool {
+	if len(c.TrustedCIDRs) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, p := range c.TrustedCIDRs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Header is the source and destination of the proxied connection.
+// Addresses are nil for the connections of the proxy itself, such
+// as health checks, or if the proxy does not know them.
+type Header struct {
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ReadHeader reads the header from the start of r. If r does not start with a
+// header, ReadHeader returns ErrMissingHeader and the bytes read, which are
+// the start of the connection data.
+func ReadHeader(r io.Reader) (Header, []byte, error) {
+	read := make([]byte, 1, len(v2Signature))
+	if _, err := io.ReadFull(r, read); err != nil {
+		return Header{}, nil, err
+	}
+	var sig []byte
+	switch read[0] {
+	case v1Signature[0]:
+		sig = v1Signature
+	case v2Signature[0]:
+		sig = v2Signature
+	default:
+		return Header{}, read, ErrMissingHeader
+	}
+	// The signature is read a byte at a time, so that no more than the
+	// first differing byte is read from connections without the header.
+	b := make([]byte, 1)
+	for len(read) < len(sig) {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return Header{}, nil, truncated(err)
+		}
+		read = append(read, b[0])
+		if b[0] != sig[len(read)-1] {
+			return Header{}, read, ErrMissingHeader
+		}
+	}
+	if sig[0] == v1Signature[0] {
+		h, err := readV1(r)
+		return h, nil, err
+	}
+	h, err := readV2(r)
+	return h, nil, err
+}
+
+// truncated returns io.ErrUnexpectedEOF for connections closed in the
+// middle of the header, which io.ReadFull reports as io.EOF if it reads
+// nothing.
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readV1(r io.Reader) (Header, error) {
+	line := make([]byte, 0, v1MaxLength-len(v1Signature))
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return Header{}, truncated(err)
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return Header{}, fmt.Errorf("%w: version 1 header too long", ErrInvalidHeader)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return Header{}, fmt.Errorf("%w: version 1 header not terminated by CRLF", ErrInvalidHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return Header{}, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return Header{}, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	src, err := parseV1Addr(fields[1], fields[3])
+	if err != nil {
+		return Header{}, err
+	}
+	dst, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return Header{}, err
+	}
+	return Header{Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidHeader, err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidHeader, err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readV2(r io.Reader) (Header, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return Header{}, truncated(err)
+	}
+	cmd, family := hdr[0], hdr[1]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Header{}, err
+	}
+	switch cmd {
+	case v2Local:
+		return Header{}, nil
+	case v2Proxy:
+	default:
+		return Header{}, fmt.Errorf("%w: version 2 command 0x%x", ErrInvalidHeader, cmd)
+	}
+	var size int
+	switch family {
+	case v2TCP4:
+		size = net.IPv4len
+	case v2TCP6:
+		size = net.IPv6len
+	default:
+		// Other families, such as UDP and Unix sockets, are not used by the
+		// listeners, so the addresses of the connection are kept.
+		return Header{}, nil
+	}
+	// The addresses may be followed by TLVs, which are ignored.
+	if len(body) < 2*size+4 {
+		return Header{}, fmt.Errorf("%w: version 2 addresses too short", ErrInvalidHeader)
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	return Header{
+		Source:      net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		Destination: net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)),
+	}, nil
+}
+
+// WriteHeader writes the header of the given version to w. Connections whose
+// addresses are not TCP addresses of the same family are sent as UNKNOWN with
+// version 1, and with the LOCAL command with version 2. None writes nothing.
+func WriteHeader(w io.Writer, version Version, h Header) error {
+	var b []byte
+	switch version {
+	case V1:
+		b = appendV1(nil, h)
+	case V2:
+		b = appendV2(nil, h)
+	default:
+		return nil
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// addrs returns the source and destination of the header
+// and whether they are IPv4 addresses, if they are TCP addresses.
+func (h Header) addrs() (src, dst netip.AddrPort, v4, ok bool) {
+	s, ok1 := h.Source.(*net.TCPAddr)
+	d, ok2 := h.Destination.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return src, dst, false, false
+	}
+	src, dst = s.AddrPort(), d.AddrPort()
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	if !src.Addr().IsValid() || !dst.Addr().IsValid() || src.Addr().Is4() != dst.Addr().Is4() {
+		return src, dst, false, false
+	}
+	return src, dst, src.Addr().Is4(), true
+}
+
+func appendV1(b []byte, h Header) []byte {
+	b = append(b, v1Signature...)
+	src, dst, v4, ok := h.addrs()
+	if !ok {
+		return append(b, "UNKNOWN\r\n"...)
+	}
+	proto := "TCP6"
+	if v4 {
+		proto = "TCP4"
+	}
+	return fmt.Appendf(b, "%s %s %s %d %d\r\n", proto, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+}
+
+func appendV2(b []byte, h Header) []byte {
+	b = append(b, v2Signature...)
+	src, dst, v4, ok := h.addrs()
+	if !ok {
+		return append(b, v2Local, v2Unspec, 0, 0)
+	}
+	family, size := byte(v2TCP6), net.IPv6len
+	if v4 {
+		family, size = v2TCP4, net.IPv4len
+	}
+	b = append(b, v2Proxy, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(2*size+4))
+	b = append(b, src.Addr().AsSlice()...)
+	b = append(b, dst.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	return binary.BigEndian.AppendUint16(b, dst.Port())
+}
@@ -0,0 +1,185 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func v2Header(cmd, family byte, body ...byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, cmd, family, byte(len(body)>>8), byte(len(body)))
+	return append(b, body...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := Header{Source: tcpAddr("192.0.2.1:5000"), Destination: tcpAddr("198.51.100.1:1883")}
+	v6 := Header{Source: tcpAddr("[2001:db8::1]:5000"), Destination: tcpAddr("[2001:db8::2]:1883")}
+	v4Body := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x13, 0x88, 0x07, 0x5b}
+	cases := []struct {
+		desc   string
+		input  []byte
+		header Header
+		read   []byte
+		err    error
+	}{
+		{desc: "v1 TCP4", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 1883\r\n"), header: v4},
+		{desc: "v1 TCP6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5000 1883\r\n"), header: v6},
+		{desc: "v1 UNKNOWN", input: []byte("PROXY UNKNOWN\r\n")},
+		{desc: "v1 UNKNOWN with addresses", input: []byte("PROXY UNKNOWN ::1 ::1 5000 1883\r\n")},
+		{desc: "v1 without CRLF", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 1883\n"), err: ErrInvalidHeader},
+		{desc: "v1 too long", input: []byte("PROXY TCP4 " + strings.Repeat("1", v1MaxLength) + "\r\n"), err: ErrInvalidHeader},
+		{desc: "v1 unknown protocol", input: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 5000 1883\r\n"), err: ErrInvalidHeader},
+		{desc: "v1 missing port", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000\r\n"), err: ErrInvalidHeader},
+		{desc: "v1 invalid address", input: []byte("PROXY TCP4 192.0.2 198.51.100.1 5000 1883\r\n"), err: ErrInvalidHeader},
+		{desc: "v1 invalid port", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 65536\r\n"), err: ErrInvalidHeader},
+		{desc: "v1 truncated", input: []byte("PROXY TCP4 192.0.2.1"), err: io.ErrUnexpectedEOF},
+		{desc: "v2 TCP4", input: v2Header(v2Proxy, v2TCP4, v4Body...), header: v4},
+		{desc: "v2 TCP4 with TLVs", input: v2Header(v2Proxy, v2TCP4, append(v4Body, 0x04, 0, 1, 0)...), header: v4},
+		{
+			desc: "v2 TCP6",
+			input: v2Header(v2Proxy, v2TCP6, append(append(
+				netip.MustParseAddr("2001:db8::1").AsSlice(),
+				netip.MustParseAddr("2001:db8::2").AsSlice()...),
+				0x13, 0x88, 0x07, 0x5b)...),
+			header: v6,
+		},
+		{desc: "v2 LOCAL", input: v2Header(v2Local, v2Unspec)},
+		{desc: "v2 LOCAL with addresses", input: v2Header(v2Local, v2TCP4, v4Body...)},
+		{desc: "v2 UNSPEC", input: v2Header(v2Proxy, v2Unspec)},
+		{desc: "v2 unknown command", input: v2Header(0x22, v2TCP4, v4Body...), err: ErrInvalidHeader},
+		{desc: "v2 addresses too short", input: v2Header(v2Proxy, v2TCP4, v4Body[:8]...), err: ErrInvalidHeader},
+		{desc: "v2 truncated header", input: append(append([]byte{}, v2Signature...), v2Proxy, v2TCP4), err: io.ErrUnexpectedEOF},
+		{desc: "v2 truncated body", input: v2Header(v2Proxy, v2TCP4, v4Body...)[:len(v2Signature)+4+6], err: io.ErrUnexpectedEOF},
+		{desc: "v2 truncated signature", input: v2Signature[:5], err: io.ErrUnexpectedEOF},
+		{desc: "no header", input: []byte{0x10, 0x0c}, read: []byte{0x10}, err: ErrMissingHeader},
+		{desc: "v1 signature mismatch", input: []byte("PRO\x10"), read: []byte("PRO\x10"), err: ErrMissingHeader},
+		{desc: "v2 signature mismatch", input: []byte("\r\n\r\nGET"), read: []byte("\r\n\r\nG"), err: ErrMissingHeader},
+		{desc: "empty", err: io.EOF},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h, read, err := ReadHeader(bytes.NewReader(tc.input))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("ReadHeader() error = %v, want %v", err, tc.err)
+			}
+			if !bytes.Equal(read, tc.read) {
+				t.Errorf("ReadHeader() read = %q, want %q", read, tc.read)
+			}
+			if addr(h.Source) != addr(tc.header.Source) || addr(h.Destination) != addr(tc.header.Destination) {
+				t.Errorf("ReadHeader() = %v -> %v, want %v -> %v", h.Source, h.Destination, tc.header.Source, tc.header.Destination)
+			}
+		})
+	}
+}
+
+func addr(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func TestWriteHeader(t *testing.T) {
+	cases := []struct {
+		desc    string
+		version Version
+		header  Header
+		want    []byte
+		// read is the header read back, if it differs from the one written.
+		read *Header
+	}{
+		{
+			desc:    "v1 TCP4",
+			version: V1,
+			header:  Header{Source: tcpAddr("192.0.2.1:5000"), Destination: tcpAddr("198.51.100.1:1883")},
+			want:    []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 1883\r\n"),
+		},
+		{
+			desc:    "v1 IPv4-mapped IPv6",
+			version: V1,
+			header:  Header{Source: tcpAddr("[::ffff:192.0.2.1]:5000"), Destination: tcpAddr("198.51.100.1:1883")},
+			want:    []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 1883\r\n"),
+			read:    &Header{Source: tcpAddr("192.0.2.1:5000"), Destination: tcpAddr("198.51.100.1:1883")},
+		},
+		{
+			desc:    "v1 TCP6",
+			version: V1,
+			header:  Header{Source: tcpAddr("[2001:db8::1]:5000"), Destination: tcpAddr("[2001:db8::2]:1883")},
+			want:    []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5000 1883\r\n"),
+		},
+		{
+			desc:    "v1 mixed families",
+			version: V1,
+			header:  Header{Source: tcpAddr("192.0.2.1:5000"), Destination: tcpAddr("[2001:db8::2]:1883")},
+			want:    []byte("PROXY UNKNOWN\r\n"),
+			read:    &Header{},
+		},
+		{
+			desc:    "v1 unix socket",
+			version: V1,
+			header:  Header{Source: &net.UnixAddr{Name: "@", Net: "unix"}, Destination: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}},
+			want:    []byte("PROXY UNKNOWN\r\n"),
+			read:    &Header{},
+		},
+		{
+			desc:    "v2 TCP4",
+			version: V2,
+			header:  Header{Source: tcpAddr("192.0.2.1:5000"), Destination: tcpAddr("198.51.100.1:1883")},
+			want:    v2Header(v2Proxy, v2TCP4, 192, 0, 2, 1, 198, 51, 100, 1, 0x13, 0x88, 0x07, 0x5b),
+		},
+		{
+			desc:    "v2 TCP6",
+			version: V2,
+			header:  Header{Source: tcpAddr("[2001:db8::1]:5000"), Destination: tcpAddr("[2001:db8::2]:1883")},
+		},
+		{
+			desc:    "v2 no addresses",
+			version: V2,
+			want:    v2Header(v2Local, v2Unspec),
+			read:    &Header{},
+		},
+		{
+			desc:    "none",
+			version: None,
+			header:  Header{Source: tcpAddr("192.0.2.1:5000"), Destination: tcpAddr("198.51.100.1:1883")},
+			want:    []byte{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, tc.version, tc.header); err != nil {
+				t.Fatalf("WriteHeader() = %v", err)
+			}
+			if tc.want != nil && !bytes.Equal(buf.Bytes(), tc.want) {
+				t.Errorf("WriteHeader() = %q, want %q", buf.Bytes(), tc.want)
+			}
+			if tc.version == None {
+				return
+			}
+			want := tc.header
+			if tc.read != nil {
+				want = *tc.read
+			}
+			h, _, err := ReadHeader(&buf)
+			if err != nil {
+				t.Fatalf("ReadHeader() = %v", err)
+			}
+			if addr(h.Source) != addr(want.Source) || addr(h.Destination) != addr(want.Destination) {
+				t.Errorf("ReadHeader() = %v -> %v, want %v -> %v", h.Source, h.Destination, want.Source, want.Destination)
+			}
+		})
+	}
+}
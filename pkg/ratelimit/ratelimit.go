@@ -0,0 +1,340 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ratelimit implements token bucket limits of the publish rate
+// and bandwidth of the proxied clients.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// ErrInvalidKey indicates an unknown rate limit key value.
+	ErrInvalidKey = errors.New("invalid rate limit key")
+
+	// ErrInvalidAction indicates an unknown rate limit action value.
+	ErrInvalidAction = errors.New("invalid rate limit action")
+)
+
+// Key selects the client identity the limits are applied to.
+type Key int
+
+const (
+	// ClientID keys the limits by the MQTT client ID.
+	ClientID Key = iota
+	// Username keys the limits by the username.
+	Username
+	// CertCN keys the limits by the common name of the client certificate.
+	CertCN
+)
+
+// UnmarshalText parses the key from its name.
+func (k *Key) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "client_id":
+		*k = ClientID
+	case "username":
+		*k = Username
+	case "cert_cn":
+		*k = CertCN
+	default:
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+func (k Key) String() string {
+	switch k {
+	case Username:
+		return "username"
+	case CertCN:
+		return "cert_cn"
+	default:
+		return "client_id"
+	}
+}
+
+// Action selects how publishes over the limits are handled.
+type Action int
+
+const (
+	// Delay holds the publish until the limits allow it, which stops
+	// reading from the client and applies backpressure.
+	Delay Action = iota
+	// Drop drops the publish and acknowledges it to the client.
+	Drop
+	// Disconnect closes the client connection.
+	Disconnect
+)
+
+// UnmarshalText parses the action from its name.
+func (a *Action) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "delay":
+		*a = Delay
+	case "drop":
+		*a = Drop
+	case "disconnect":
+		*a = Disconnect
+	default:
+		return ErrInvalidAction
+	}
+	return nil
+}
+
+func (a Action) String() string {
+	switch a {
+	case Drop:
+		return "drop"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "delay"
+	}
+}
+
+// Limit holds the token bucket limits of a single identity.
+// Rate 0 disables the corresponding limit.
+type Limit struct {
+	// PublishRate is the number of publishes per second.
+	PublishRate float64 `env:"PUBLISH_RATE" envDefault:"0" json:"publish_rate"`
+	// PublishBurst is the number of publishes allowed at once,
+	// it defaults to the rate rounded up.
+	PublishBurst int `env:"PUBLISH_BURST" envDefault:"0" json:"publish_burst"`
+	// ByteRate is the number of payload bytes per second.
+	ByteRate float64 `env:"BYTE_RATE" envDefault:"0" json:"byte_rate"`
+	// ByteBurst is the number of payload bytes allowed at once,
+	// it defaults to the rate rounded up.
+	ByteBurst int `env:"BYTE_BURST" envDefault:"0" json:"byte_burst"`
+}
+
+func (l Limit) enabled() bool {
+	return l.PublishRate > 0 || l.ByteRate > 0
+}
+
+// Config holds the rate limits of a listener.
+type Config struct {
+	Limit  `envPrefix:"RATE_LIMIT_"`
+	Key    Key    `env:"RATE_LIMIT_KEY"         envDefault:"client_id"`
+	Action Action `env:"RATE_LIMIT_ACTION"      envDefault:"delay"`
+	// PolicyFile is the path of the JSON file overriding the limits of
+	// individual identities, in the form {"identities": {"<identity>": <limit>}}.
+	PolicyFile string `env:"RATE_LIMIT_POLICY_FILE" envDefault:""`
+}
+
+// NewConfig parses the rate limit configuration from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Policy holds the limits of individual identities.
+type Policy struct {
+	Identities map[string]Limit `json:"identities"`
+}
+
+// LoadPolicy reads the policy from the JSON file.
+func LoadPolicy(path string) (Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Policy{}, err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Policy{}, err
+	}
+	return p, nil
+}
+
+// Limiter keeps the token buckets of the identities with active sessions.
+// Sessions of the same identity share the bucket, so that a client cannot
+// get around its limits by opening more connections.
+type Limiter struct {
+	config Config
+	policy Policy
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// New returns a new Limiter. It returns nil if no limits are configured,
+// either for the listener or in the policy file, so rate limiting is disabled.
+func New(config Config) (*Limiter, error) {
+	var policy Policy
+	if config.PolicyFile != "" {
+		var err error
+		if policy, err = LoadPolicy(config.PolicyFile); err != nil {
+			return nil, err
+		}
+	}
+	if !config.Limit.enabled() && len(policy.Identities) == 0 {
+		return nil, nil
+	}
+	return &Limiter{
+		config:  config,
+		policy:  policy,
+		buckets: make(map[string]*Bucket),
+	}, nil
+}
+
+// Key returns the identity the limits are keyed by.
+func (l *Limiter) Key() Key {
+	if l == nil {
+		return ClientID
+	}
+	return l.config.Key
+}
+
+// Action returns the action applied to publishes over the limits.
+func (l *Limiter) Action() Action {
+	if l == nil {
+		return Delay
+	}
+	return l.config.Action
+}
+
+// Acquire returns the bucket of the given identity. Each call must be
+// followed by Release once the session ends. It returns nil if the
+// identity is not limited.
+func (l *Limiter) Acquire(identity string) *Bucket {
+	if l == nil {
+		return nil
+	}
+	limit, ok := l.policy.Identities[identity]
+	if !ok {
+		limit = l.config.Limit
+	}
+	if !limit.enabled() {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[identity]
+	if !ok {
+		b = newBucket(identity, limit)
+		l.buckets[identity] = b
+	}
+	b.refs++
+	return b
+}
+
+// Release releases the bucket acquired with Acquire.
+func (l *Limiter) Release(b *Bucket) {
+	if l == nil || b == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b.refs--
+	if b.refs <= 0 {
+		delete(l.buckets, b.identity)
+	}
+}
+
+// Bucket holds the tokens of a single identity. Its methods are
+// safe to call on a nil Bucket, which allows all the publishes.
+type Bucket struct {
+	identity  string
+	refs      int
+	publishes *rate.Limiter
+	bytes     *rate.Limiter
+}
+
+func newBucket(identity string, limit Limit) *Bucket {
+	return &Bucket{
+		identity:  identity,
+		publishes: newLimiter(limit.PublishRate, limit.PublishBurst),
+		bytes:     newLimiter(limit.ByteRate, limit.ByteBurst),
+	}
+}
+
+func newLimiter(r float64, burst int) *rate.Limiter {
+	if r <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(r))
+	}
+	return rate.NewLimiter(rate.Limit(r), burst)
+}
+
+// Allow reports whether a publish of the given payload size is within the limits
+// and takes its tokens if it is.
+func (b *Bucket) Allow(size int) bool {
+	if b == nil {
+		return true
+	}
+	now := time.Now()
+	pr := reserve(b.publishes, now, 1)
+	br := reserve(b.bytes, now, size)
+	if pr.delay(now) > 0 || br.delay(now) > 0 {
+		pr.cancel(now)
+		br.cancel(now)
+		return false
+	}
+	return true
+}
+
+// Wait blocks until a publish of the given payload size is within the limits.
+func (b *Bucket) Wait(ctx context.Context, size int) error {
+	if b == nil {
+		return nil
+	}
+	if err := wait(ctx, b.publishes, 1); err != nil {
+		return err
+	}
+	return wait(ctx, b.bytes, size)
+}
+
+// reservation wraps rate.Reservation of an optional limiter.
+type reservation struct {
+	r *rate.Reservation
+}
+
+func reserve(l *rate.Limiter, now time.Time, n int) reservation {
+	if l == nil {
+		return reservation{}
+	}
+	return reservation{r: l.ReserveN(now, clamp(l, n))}
+}
+
+func (r reservation) delay(now time.Time) time.Duration {
+	if r.r == nil {
+		return 0
+	}
+	return r.r.DelayFrom(now)
+}
+
+func (r reservation) cancel(now time.Time) {
+	if r.r != nil {
+		r.r.CancelAt(now)
+	}
+}
+
+func wait(ctx context.Context, l *rate.Limiter, n int) error {
+	if l == nil {
+		return nil
+	}
+	return l.WaitN(ctx, clamp(l, n))
+}
+
+// clamp limits n to the burst, so publishes larger than the burst
+// take the whole bucket instead of failing.
+func clamp(l *rate.Limiter, n int) int {
+	return max(min(n, l.Burst()), 0)
+}
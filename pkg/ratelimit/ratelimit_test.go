@@ -0,0 +1,271 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	cases := []struct {
+		text string
+		want Key
+		err  error
+	}{
+		{text: "", want: ClientID},
+		{text: "client_id", want: ClientID},
+		{text: " Username ", want: Username},
+		{text: "cert_cn", want: CertCN},
+		{text: "ip", err: ErrInvalidKey},
+	}
+	for _, tc := range cases {
+		var k Key
+		err := k.UnmarshalText([]byte(tc.text))
+		if !errors.Is(err, tc.err) || (err == nil && k != tc.want) {
+			t.Errorf("UnmarshalText(%q) = %s, %v, want %s, %v", tc.text, k, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestAction(t *testing.T) {
+	cases := []struct {
+		text string
+		want Action
+		err  error
+	}{
+		{text: "", want: Delay},
+		{text: "delay", want: Delay},
+		{text: "DROP", want: Drop},
+		{text: "disconnect", want: Disconnect},
+		{text: "reject", err: ErrInvalidAction},
+	}
+	for _, tc := range cases {
+		var a Action
+		err := a.UnmarshalText([]byte(tc.text))
+		if !errors.Is(err, tc.err) || (err == nil && a != tc.want) {
+			t.Errorf("UnmarshalText(%q) = %s, %v, want %s, %v", tc.text, a, err, tc.want, tc.err)
+		}
+	}
+}
+
+// writePolicy writes the policy file and returns its path.
+func writePolicy(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		desc    string
+		config  Config
+		policy  string
+		limited bool
+		err     bool
+	}{
+		{desc: "nothing configured"},
+		{desc: "burst without rate", config: Config{Limit: Limit{PublishBurst: 10, ByteBurst: 10}}},
+		{desc: "publish rate", config: Config{Limit: Limit{PublishRate: 1}}, limited: true},
+		{desc: "byte rate", config: Config{Limit: Limit{ByteRate: 1}}, limited: true},
+		{desc: "policy only", policy: `{"identities": {"c1": {"publish_rate": 1}}}`, limited: true},
+		{desc: "empty policy", policy: `{"identities": {}}`},
+		{desc: "invalid policy", policy: `{"identities": [`, err: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.policy != "" {
+				tc.config.PolicyFile = writePolicy(t, tc.policy)
+			}
+			l, err := New(tc.config)
+			if (err != nil) != tc.err {
+				t.Fatalf("New() = %v", err)
+			}
+			if (l != nil) != tc.limited {
+				t.Errorf("New() = %v, want limited %t", l, tc.limited)
+			}
+		})
+	}
+	if _, err := New(Config{PolicyFile: filepath.Join(t.TempDir(), "missing.json")}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("New() with missing policy file = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if l.Key() != ClientID || l.Action() != Delay {
+		t.Errorf("nil Limiter key and action = %s, %s", l.Key(), l.Action())
+	}
+	b := l.Acquire("c1")
+	if b != nil {
+		t.Errorf("Acquire() = %v, want nil", b)
+	}
+	l.Release(b)
+	// A nil Bucket allows everything.
+	for i := 0; i < 10; i++ {
+		if !b.Allow(1 << 20) {
+			t.Fatal("nil Bucket denied a publish")
+		}
+	}
+	if err := b.Wait(context.Background(), 1<<20); err != nil {
+		t.Errorf("Wait() = %v", err)
+	}
+}
+
+func TestPolicyOverride(t *testing.T) {
+	policy := writePolicy(t, `{"identities": {"fast": {"publish_rate": 1, "publish_burst": 5}, "free": {}}}`)
+	l, err := New(Config{Limit: Limit{PublishRate: 1, PublishBurst: 1}, PolicyFile: policy, Key: Username, Action: Drop})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if l.Key() != Username || l.Action() != Drop {
+		t.Errorf("key and action = %s, %s, want %s, %s", l.Key(), l.Action(), Username, Drop)
+	}
+	cases := []struct {
+		identity string
+		allowed  int
+	}{
+		{identity: "fast", allowed: 5},
+		{identity: "other", allowed: 1},
+	}
+	for _, tc := range cases {
+		b := l.Acquire(tc.identity)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if b.Allow(0) {
+				allowed++
+			}
+		}
+		if allowed != tc.allowed {
+			t.Errorf("%s allowed %d publishes at once, want %d", tc.identity, allowed, tc.allowed)
+		}
+		l.Release(b)
+	}
+	// Identities the policy sets no limits for are not limited.
+	if b := l.Acquire("free"); b != nil {
+		t.Errorf("Acquire(free) = %v, want nil", b)
+	}
+}
+
+func TestSharedBucket(t *testing.T) {
+	l, err := New(Config{Limit: Limit{PublishRate: 0.001, PublishBurst: 2}})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	b1 := l.Acquire("c1")
+	b2 := l.Acquire("c1")
+	if b1 != b2 {
+		t.Fatal("sessions of the same identity got different buckets")
+	}
+	if other := l.Acquire("c2"); other == b1 {
+		t.Fatal("sessions of different identities share the bucket")
+	}
+	// The sessions share the tokens.
+	if !b1.Allow(0) || !b2.Allow(0) || b1.Allow(0) {
+		t.Error("bucket shared by two sessions did not allow exactly its burst")
+	}
+
+	// The bucket is kept until its last session releases it.
+	l.Release(b1)
+	if b := l.Acquire("c1"); b != b2 {
+		t.Error("bucket released before its last session")
+	} else {
+		l.Release(b)
+	}
+	l.Release(b2)
+	b3 := l.Acquire("c1")
+	if b3 == b1 {
+		t.Fatal("bucket kept after its last session released it")
+	}
+	if !b3.Allow(0) {
+		t.Error("new bucket has no tokens")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	cases := []struct {
+		desc    string
+		limit   Limit
+		sizes   []int
+		allowed []bool
+	}{
+		{
+			desc:    "publish rate",
+			limit:   Limit{PublishRate: 0.001, PublishBurst: 2},
+			sizes:   []int{100, 100, 100},
+			allowed: []bool{true, true, false},
+		},
+		{
+			desc:    "burst defaults to the rate",
+			limit:   Limit{PublishRate: 2.5},
+			sizes:   []int{0, 0, 0, 0},
+			allowed: []bool{true, true, true, false},
+		},
+		{
+			desc:    "byte rate",
+			limit:   Limit{ByteRate: 0.001, ByteBurst: 10},
+			sizes:   []int{6, 6, 4, 1},
+			allowed: []bool{true, false, true, false},
+		},
+		{
+			desc:    "payload larger than the burst takes the whole bucket",
+			limit:   Limit{ByteRate: 0.001, ByteBurst: 10},
+			sizes:   []int{100, 0, 1},
+			allowed: []bool{true, true, false},
+		},
+		{
+			// Denied publishes give their publish tokens back.
+			desc:    "both limits",
+			limit:   Limit{PublishRate: 0.001, PublishBurst: 2, ByteRate: 0.001, ByteBurst: 10},
+			sizes:   []int{10, 1, 0, 0},
+			allowed: []bool{true, false, true, false},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := newBucket("c1", tc.limit)
+			for i, size := range tc.sizes {
+				if got := b.Allow(size); got != tc.allowed[i] {
+					t.Errorf("publish %d of %d bytes allowed = %t, want %t", i, size, got, tc.allowed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	b := newBucket("c1", Limit{PublishRate: 50, PublishBurst: 1, ByteRate: 0.001, ByteBurst: 100})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := b.Wait(context.Background(), 0); err != nil {
+			t.Fatalf("Wait() = %v", err)
+		}
+	}
+	// The publishes after the burst wait for their tokens.
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("3 publishes at 50 per second took %s, want at least 40ms", d)
+	}
+
+	// Publishes which cannot be allowed before ctx is done fail.
+	if err := b.Wait(context.Background(), 100); err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx, 1); err == nil {
+		t.Error("Wait() over the byte limit succeeded before the deadline")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := b.Wait(ctx, 1); err == nil {
+		t.Error("Wait() succeeded with a cancelled context")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+// passThrough intercepts every packet without changing it, which turns the
+// raw path off and makes every packet decoded and encoded again.
+type passThrough struct{}
+
+func (passThrough) Intercept(_ context.Context, pkt packets.ControlPacket, _ Direction) (packets.ControlPacket, error) {
+	return pkt, nil
+}
+
+// BenchmarkStream measures the packets sent by the client through a session
+// streamed over loopback TCP connections, both on the raw path and with a
+// pass through Interceptor.
+func BenchmarkStream(b *testing.B) {
+	cases := []struct {
+		name string
+		pkt  func() packets.ControlPacket
+	}{
+		{"PINGREQ", func() packets.ControlPacket {
+			return packets.NewControlPacket(packets.Pingreq)
+		}},
+		{"PUBACK", func() packets.ControlPacket {
+			p := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			p.MessageID = 1
+			return p
+		}},
+		{"PUBLISH_QoS0_64B", func() packets.ControlPacket {
+			return benchPublish(0, 64)
+		}},
+		{"PUBLISH_QoS1_1KB", func() packets.ControlPacket {
+			return benchPublish(1, 1024)
+		}},
+	}
+	for _, version := range []byte{packets.V311, packets.V5} {
+		for _, c := range cases {
+			b.Run(fmt.Sprintf("v%d/%s/decode", version, c.name), func(b *testing.B) {
+				benchmarkStream(b, c.pkt(), version, passThrough{})
+			})
+			b.Run(fmt.Sprintf("v%d/%s/raw", version, c.name), func(b *testing.B) {
+				benchmarkStream(b, c.pkt(), version, nil)
+			})
+		}
+	}
+}
+
+func benchPublish(qos byte, size int) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "bench/topic"
+	p.Qos = qos
+	p.MessageID = 1
+	p.Payload = bytes.Repeat([]byte{'x'}, size)
+	return p
+}
+
+func benchmarkStream(b *testing.B, pkt packets.ControlPacket, version byte, ic Interceptor) {
+	client, received := benchSession(b, version, ic)
+
+	var buf bytes.Buffer
+	if err := pkt.Write(&buf, version); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	w := bufio.NewWriter(client)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := received.Load()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	want := start + int64(b.N*len(data))
+	for received.Load() < want {
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+// benchSession connects a client to a broker which discards everything it
+// receives, through a streamed session which ends with the benchmark. It
+// returns the client connection and the number of bytes the broker received.
+func benchSession(b *testing.B, version byte, ic Interceptor) (net.Conn, *atomic.Int64) {
+	b.Helper()
+	bl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { bl.Close() })
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { pl.Close() })
+
+	received := &atomic.Int64{}
+	go func() {
+		c, err := bl.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := c.Read(buf)
+			received.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		in, err := pl.Accept()
+		if err != nil {
+			return
+		}
+		defer in.Close()
+		out, err := net.Dial("tcp", bl.Addr().String())
+		if err != nil {
+			return
+		}
+		defer out.Close()
+		_ = Stream(context.Background(), in, out, allowHandler{}, ic, x509.Certificate{})
+	}()
+
+	client, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { client.Close() })
+	if err := newConnect(version, "bench", 0).Write(client, version); err != nil {
+		b.Fatal(err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	for received.Load() == 0 {
+		if time.Now().After(deadline) {
+			b.Fatal("broker did not receive CONNECT")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return client, received
+}
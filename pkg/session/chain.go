@@ -0,0 +1,151 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+var (
+	_ Handler     = (*HandlerChain)(nil)
+	_ Interceptor = (*InterceptorChain)(nil)
+)
+
+// HandlerChain runs several Handlers in order. Since hook arguments are passed
+// by reference, each Handler sees the modifications made by the previous ones.
+// The chain stops at the first Handler returning an error, except for
+// Disconnect which is always called on all the Handlers.
+type HandlerChain struct {
+	handlers []Handler
+}
+
+// NewHandlerChain returns a new chain of the given handlers.
+func NewHandlerChain(handlers ...Handler) *HandlerChain {
+	return &HandlerChain{handlers: handlers}
+}
+
+// Append adds handlers to the end of the chain.
+func (c *HandlerChain) Append(handlers ...Handler) {
+	c.handlers = append(c.handlers, handlers...)
+}
+
+// Len returns the number of handlers in the chain.
+func (c *HandlerChain) Len() int {
+	return len(c.handlers)
+}
+
+// AuthConnect calls AuthConnect on each handler of the chain.
+func (c *HandlerChain) AuthConnect(ctx context.Context) error {
+	return c.run(func(h Handler) error {
+		return h.AuthConnect(ctx)
+	})
+}
+
+// AuthPublish calls AuthPublish on each handler of the chain.
+func (c *HandlerChain) AuthPublish(ctx context.Context, topic *string, payload *[]byte) error {
+	return c.run(func(h Handler) error {
+		return h.AuthPublish(ctx, topic, payload)
+	})
+}
+
+// AuthSubscribe calls AuthSubscribe on each handler of the chain.
+func (c *HandlerChain) AuthSubscribe(ctx context.Context, topics *[]string) error {
+	return c.run(func(h Handler) error {
+		return h.AuthSubscribe(ctx, topics)
+	})
+}
+
+// DownSubscribe calls DownSubscribe on each handler of the chain.
+func (c *HandlerChain) DownSubscribe(ctx context.Context, topics *[]string) error {
+	return c.run(func(h Handler) error {
+		return h.DownSubscribe(ctx, topics)
+	})
+}
+
+// Connect calls Connect on each handler of the chain.
+func (c *HandlerChain) Connect(ctx context.Context) error {
+	return c.run(func(h Handler) error {
+		return h.Connect(ctx)
+	})
+}
+
+// Publish calls Publish on each handler of the chain.
+func (c *HandlerChain) Publish(ctx context.Context, topic *string, payload *[]byte) error {
+	return c.run(func(h Handler) error {
+		return h.Publish(ctx, topic, payload)
+	})
+}
+
+// Subscribe calls Subscribe on each handler of the chain.
+func (c *HandlerChain) Subscribe(ctx context.Context, topics *[]string) error {
+	return c.run(func(h Handler) error {
+		return h.Subscribe(ctx, topics)
+	})
+}
+
+// Unsubscribe calls Unsubscribe on each handler of the chain.
+func (c *HandlerChain) Unsubscribe(ctx context.Context, topics *[]string) error {
+	return c.run(func(h Handler) error {
+		return h.Unsubscribe(ctx, topics)
+	})
+}
+
+// Disconnect calls Disconnect on all the handlers of the chain
+// and returns their joined errors.
+func (c *HandlerChain) Disconnect(ctx context.Context) error {
+	var errs []error
+	for _, h := range c.handlers {
+		errs = append(errs, h.Disconnect(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *HandlerChain) run(hook func(h Handler) error) error {
+	for _, h := range c.handlers {
+		if err := hook(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InterceptorChain runs several Interceptors in order, passing the packet
+// returned by each Interceptor to the next one. An Interceptor returning
+// a nil packet leaves the packet unchanged. The chain stops at the first
+// Interceptor returning an error.
+type InterceptorChain struct {
+	interceptors []Interceptor
+}
+
+// NewInterceptorChain returns a new chain of the given interceptors.
+func NewInterceptorChain(interceptors ...Interceptor) *InterceptorChain {
+	return &InterceptorChain{interceptors: interceptors}
+}
+
+// Append adds interceptors to the end of the chain.
+func (c *InterceptorChain) Append(interceptors ...Interceptor) {
+	c.interceptors = append(c.interceptors, interceptors...)
+}
+
+// Len returns the number of interceptors in the chain.
+func (c *InterceptorChain) Len() int {
+	return len(c.interceptors)
+}
+
+// Intercept calls Intercept on each interceptor of the chain.
+func (c *InterceptorChain) Intercept(ctx context.Context, pkt packets.ControlPacket, dir Direction) (packets.ControlPacket, error) {
+	for _, ic := range c.interceptors {
+		ret, err := ic.Intercept(ctx, pkt, dir)
+		if err != nil {
+			return nil, err
+		}
+		if ret != nil {
+			pkt = ret
+		}
+	}
+	return pkt, nil
+}
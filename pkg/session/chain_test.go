@@ -0,0 +1,240 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+var errHook = errors.New("hook failed")
+
+// stage is a chained Handler and Interceptor recording its calls, which
+// appends its name to the topics and fails when err is set.
+type stage struct {
+	name  string
+	calls *[]string
+	err   error
+}
+
+func (s stage) hook(hook string) error {
+	*s.calls = append(*s.calls, s.name+"."+hook)
+	return s.err
+}
+
+func (s stage) topic(hook string, topic *string) error {
+	*topic += "/" + s.name
+	return s.hook(hook)
+}
+
+func (s stage) topics(hook string, topics *[]string) error {
+	for i := range *topics {
+		(*topics)[i] += "/" + s.name
+	}
+	return s.hook(hook)
+}
+
+func (s stage) AuthConnect(context.Context) error { return s.hook("AuthConnect") }
+
+func (s stage) AuthPublish(_ context.Context, topic *string, _ *[]byte) error {
+	return s.topic("AuthPublish", topic)
+}
+
+func (s stage) AuthSubscribe(_ context.Context, topics *[]string) error {
+	return s.topics("AuthSubscribe", topics)
+}
+
+func (s stage) DownSubscribe(_ context.Context, topics *[]string) error {
+	return s.topics("DownSubscribe", topics)
+}
+
+func (s stage) Connect(context.Context) error { return s.hook("Connect") }
+
+func (s stage) Publish(_ context.Context, topic *string, _ *[]byte) error {
+	return s.topic("Publish", topic)
+}
+
+func (s stage) Subscribe(_ context.Context, topics *[]string) error {
+	return s.topics("Subscribe", topics)
+}
+
+func (s stage) Unsubscribe(_ context.Context, topics *[]string) error {
+	return s.topics("Unsubscribe", topics)
+}
+
+func (s stage) Disconnect(context.Context) error { return s.hook("Disconnect") }
+
+func (s stage) Intercept(_ context.Context, pkt packets.ControlPacket, _ Direction) (packets.ControlPacket, error) {
+	if err := s.hook("Intercept"); err != nil {
+		return nil, err
+	}
+	pub, ok := pkt.(*packets.PublishPacket)
+	if !ok {
+		// Leave the packet unchanged.
+		return nil, nil
+	}
+	ret := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	ret.TopicName = pub.TopicName + "/" + s.name
+	return ret, nil
+}
+
+func TestHandlerChain(t *testing.T) {
+	ctx := context.Background()
+	hooks := []struct {
+		name string
+		call func(h Handler) (string, error)
+	}{
+		{"AuthConnect", func(h Handler) (string, error) { return "", h.AuthConnect(ctx) }},
+		{"AuthPublish", func(h Handler) (string, error) {
+			topic := "t"
+			err := h.AuthPublish(ctx, &topic, &[]byte{})
+			return topic, err
+		}},
+		{"AuthSubscribe", func(h Handler) (string, error) {
+			topics := []string{"t"}
+			err := h.AuthSubscribe(ctx, &topics)
+			return topics[0], err
+		}},
+		{"DownSubscribe", func(h Handler) (string, error) {
+			topics := []string{"t"}
+			err := h.DownSubscribe(ctx, &topics)
+			return topics[0], err
+		}},
+		{"Connect", func(h Handler) (string, error) { return "", h.Connect(ctx) }},
+		{"Publish", func(h Handler) (string, error) {
+			topic := "t"
+			err := h.Publish(ctx, &topic, &[]byte{})
+			return topic, err
+		}},
+		{"Subscribe", func(h Handler) (string, error) {
+			topics := []string{"t"}
+			err := h.Subscribe(ctx, &topics)
+			return topics[0], err
+		}},
+		{"Unsubscribe", func(h Handler) (string, error) {
+			topics := []string{"t"}
+			err := h.Unsubscribe(ctx, &topics)
+			return topics[0], err
+		}},
+	}
+	cases := []struct {
+		desc  string
+		fail  string
+		calls []string
+		topic string
+	}{
+		{desc: "all stages", calls: []string{"a", "b", "c"}, topic: "t/a/b/c"},
+		{desc: "first stage fails", fail: "a", calls: []string{"a"}, topic: "t/a"},
+		{desc: "middle stage fails", fail: "b", calls: []string{"a", "b"}, topic: "t/a/b"},
+	}
+	for _, hook := range hooks {
+		for _, tc := range cases {
+			t.Run(hook.name+" "+tc.desc, func(t *testing.T) {
+				var calls []string
+				chain := NewHandlerChain()
+				for _, name := range []string{"a", "b", "c"} {
+					s := stage{name: name, calls: &calls}
+					if name == tc.fail {
+						s.err = errHook
+					}
+					chain.Append(s)
+				}
+				topic, err := hook.call(chain)
+				if wantErr := tc.fail != ""; errors.Is(err, errHook) != wantErr {
+					t.Errorf("%s() = %v, want error %t", hook.name, err, wantErr)
+				}
+				var want []string
+				for _, name := range tc.calls {
+					want = append(want, name+"."+hook.name)
+				}
+				if !slices.Equal(calls, want) {
+					t.Errorf("calls = %v, want %v", calls, want)
+				}
+				// Each stage sees the topics as the previous stages changed them.
+				if topic != "" && topic != tc.topic {
+					t.Errorf("topic = %s, want %s", topic, tc.topic)
+				}
+			})
+		}
+	}
+}
+
+func TestHandlerChainDisconnect(t *testing.T) {
+	var calls []string
+	errB := errors.New("b failed")
+	chain := NewHandlerChain(stage{name: "a", calls: &calls, err: errHook}, stage{name: "b", calls: &calls, err: errB}, stage{name: "c", calls: &calls})
+	// Disconnect runs on every stage and returns all their errors.
+	err := chain.Disconnect(context.Background())
+	if !errors.Is(err, errHook) || !errors.Is(err, errB) {
+		t.Errorf("Disconnect() = %v, want both errors", err)
+	}
+	if want := []string{"a.Disconnect", "b.Disconnect", "c.Disconnect"}; !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+
+	calls = nil
+	chain = NewHandlerChain(stage{name: "a", calls: &calls})
+	if err := chain.Disconnect(context.Background()); err != nil {
+		t.Errorf("Disconnect() = %v", err)
+	}
+	if err := NewHandlerChain().AuthConnect(context.Background()); err != nil {
+		t.Errorf("empty chain AuthConnect() = %v", err)
+	}
+}
+
+func TestInterceptorChain(t *testing.T) {
+	cases := []struct {
+		desc  string
+		pkt   packets.ControlPacket
+		fail  string
+		calls []string
+		topic string
+	}{
+		{desc: "all stages", pkt: &packets.PublishPacket{TopicName: "t"}, calls: []string{"a", "b", "c"}, topic: "t/a/b/c"},
+		{desc: "stage fails", pkt: &packets.PublishPacket{TopicName: "t"}, fail: "b", calls: []string{"a", "b"}},
+		{desc: "nil packets pass the packet on", pkt: packets.NewControlPacket(packets.Pingreq), calls: []string{"a", "b", "c"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var calls []string
+			chain := NewInterceptorChain()
+			for _, name := range []string{"a", "b", "c"} {
+				s := stage{name: name, calls: &calls}
+				if name == tc.fail {
+					s.err = errHook
+				}
+				chain.Append(s)
+			}
+			if chain.Len() != 3 {
+				t.Fatalf("Len() = %d, want 3", chain.Len())
+			}
+			pkt, err := chain.Intercept(context.Background(), tc.pkt, Up)
+			var want []string
+			for _, name := range tc.calls {
+				want = append(want, name+".Intercept")
+			}
+			if !slices.Equal(calls, want) {
+				t.Errorf("calls = %v, want %v", calls, want)
+			}
+			switch {
+			case tc.fail != "":
+				if !errors.Is(err, errHook) || pkt != nil {
+					t.Errorf("Intercept() = %v, %v, want %v", pkt, err, errHook)
+				}
+			case err != nil:
+				t.Errorf("Intercept() = %v", err)
+			case tc.topic != "":
+				if pub, ok := pkt.(*packets.PublishPacket); !ok || pub.TopicName != tc.topic {
+					t.Errorf("Intercept() = %v, want PUBLISH to %s", pkt, tc.topic)
+				}
+			case pkt != tc.pkt:
+				t.Errorf("Intercept() = %v, want the packet unchanged", pkt)
+			}
+		})
+	}
+}
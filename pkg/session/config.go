@@ -0,0 +1,191 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/metrics"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/ratelimit"
+)
+
+// ErrInvalidPublishDenyPolicy indicates an unknown publish deny policy value.
+var ErrInvalidPublishDenyPolicy = errors.New("invalid publish deny policy")
+
+// PublishDenyPolicy selects how mProxy handles a PUBLISH denied by Handler.AuthPublish.
+type PublishDenyPolicy int
+
+const (
+	// DisconnectOnDeny closes the client connection, sending a DISCONNECT
+	// with the reason code to MQTT 5.0 clients.
+	DisconnectOnDeny PublishDenyPolicy = iota
+	// DropOnDeny drops the PUBLISH and acknowledges it to the client
+	// so that QoS 1 and 2 messages are not retried.
+	DropOnDeny
+)
+
+// UnmarshalText parses the policy from its name.
+func (p *PublishDenyPolicy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "disconnect":
+		*p = DisconnectOnDeny
+	case "drop":
+		*p = DropOnDeny
+	default:
+		return ErrInvalidPublishDenyPolicy
+	}
+	return nil
+}
+
+func (p PublishDenyPolicy) String() string {
+	switch p {
+	case DropOnDeny:
+		return "drop"
+	default:
+		return "disconnect"
+	}
+}
+
+// ErrInvalidDuplicateClientIDPolicy indicates an unknown duplicate client ID policy value.
+var ErrInvalidDuplicateClientIDPolicy = errors.New("invalid duplicate client ID policy")
+
+// DuplicateClientIDPolicy selects how mProxy handles a client connecting with
+// the client ID of another active session. Sessions are tracked by Registry,
+// so the policy applies across all the listeners sharing the Registry.
+type DuplicateClientIDPolicy int
+
+const (
+	// AllowDuplicateClientID forwards the CONNECT and leaves the take over to the broker.
+	AllowDuplicateClientID DuplicateClientIDPolicy = iota
+	// RejectDuplicateClientID rejects the new client with the identifier rejected code.
+	RejectDuplicateClientID
+	// KickDuplicateClientID disconnects the older session and accepts the new client.
+	KickDuplicateClientID
+	// RewriteDuplicateClientID adds a random suffix to the client ID of the new client.
+	RewriteDuplicateClientID
+)
+
+// UnmarshalText parses the policy from its name.
+func (p *DuplicateClientIDPolicy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "allow":
+		*p = AllowDuplicateClientID
+	case "reject":
+		*p = RejectDuplicateClientID
+	case "kick":
+		*p = KickDuplicateClientID
+	case "rewrite":
+		*p = RewriteDuplicateClientID
+	default:
+		return ErrInvalidDuplicateClientIDPolicy
+	}
+	return nil
+}
+
+func (p DuplicateClientIDPolicy) String() string {
+	switch p {
+	case RejectDuplicateClientID:
+		return "reject"
+	case KickDuplicateClientID:
+		return "kick"
+	case RewriteDuplicateClientID:
+		return "rewrite"
+	default:
+		return "allow"
+	}
+}
+
+// Config holds the options applied to each proxied session.
+type Config struct {
+	PublishDenyPolicy PublishDenyPolicy `env:"PUBLISH_DENY_POLICY" envDefault:"disconnect"`
+
+	DuplicateClientIDPolicy DuplicateClientIDPolicy `env:"DUPLICATE_CLIENT_ID_POLICY" envDefault:"allow"`
+
+	// ConnectTimeout limits the time a new client has to send CONNECT, 0 disables it.
+	ConnectTimeout time.Duration `env:"CONNECT_TIMEOUT" envDefault:"10s"`
+
+	// WriteTimeout limits each write to the client and the broker, 0 disables it.
+	WriteTimeout time.Duration `env:"WRITE_TIMEOUT" envDefault:"10s"`
+
+	// MinKeepAlive and MaxKeepAlive clamp the keep alive of the MQTT 5.0 client
+	// CONNECT before it is forwarded to the broker, 0 leaves the bound unset.
+	MinKeepAlive time.Duration `env:"MIN_KEEP_ALIVE" envDefault:"0"`
+	MaxKeepAlive time.Duration `env:"MAX_KEEP_ALIVE" envDefault:"0"`
+
+	// DrainGracePeriod is the time clients have to disconnect on their own when
+	// the listener shuts down, before mProxy disconnects the remaining sessions.
+	DrainGracePeriod time.Duration `env:"DRAIN_GRACE_PERIOD" envDefault:"5s"`
+
+	// DrainTimeout limits the time the listener waits for the sessions to end on
+	// shutdown, including the grace period. Sessions still active are force-closed.
+	DrainTimeout time.Duration `env:"DRAIN_TIMEOUT" envDefault:"30s"`
+
+	// MaxPacketSize limits the size of the packets sent by the client, 0 disables the limit.
+	MaxPacketSize int `env:"MAX_PACKET_SIZE" envDefault:"1048576"`
+
+	// MaxPacketSizes overrides MaxPacketSize for the given packet types,
+	// keyed by the packet names such as CONNECT and SUBSCRIBE.
+	MaxPacketSizes map[string]int `env:"MAX_PACKET_SIZES" envKeyValSeparator:":" envDefault:"CONNECT:65536"`
+
+	// MaxSubscribeTopics limits the number of topics of a SUBSCRIBE packet, 0 disables the limit.
+	MaxSubscribeTopics int `env:"MAX_SUBSCRIBE_TOPICS" envDefault:"100"`
+
+	// Listener is the name of the listener the sessions are accepted on.
+	Listener string `env:"LISTENER_NAME" envDefault:""`
+
+	// Transport is the transport of the listener, set by the proxy.
+	Transport Transport
+
+	// Registry keeps track of the active sessions, if set.
+	Registry *Registry
+
+	// Metrics records the metrics of the listener, if set.
+	Metrics *metrics.Listener
+
+	// RateLimiter limits the publishes of the clients, if set.
+	RateLimiter *ratelimit.Limiter
+
+	// ConnLimiter limits the concurrent connections of the listener, if set.
+	ConnLimiter *connlimit.Limiter
+
+	// Tracker keeps track of the sessions of the listener, so they can be drained on shutdown.
+	Tracker *Tracker
+
+	// Logger logs the decisions taken on behalf of the broker, slog.Default() if not set.
+	Logger *slog.Logger
+}
+
+func (c Config) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// clampKeepAlive returns the keep alive in seconds bounded by MinKeepAlive and MaxKeepAlive.
+// Keep alive 0 turns the keep alive mechanism off, so it is only lowered to MaxKeepAlive.
+func (c Config) clampKeepAlive(keepAlive uint16) uint16 {
+	ka := time.Duration(keepAlive) * time.Second
+	if c.MinKeepAlive > 0 && ka != 0 && ka < c.MinKeepAlive {
+		ka = c.MinKeepAlive
+	}
+	if c.MaxKeepAlive > 0 && (ka == 0 || ka > c.MaxKeepAlive) {
+		ka = c.MaxKeepAlive
+	}
+	return uint16(min(ka/time.Second, math.MaxUint16))
+}
+
+// maxPacketSize returns the size limit of the packets of the given type.
+func (c Config) maxPacketSize(packetType byte) int {
+	if size, ok := c.MaxPacketSizes[packets.PacketNames[packetType]]; ok {
+		return size
+	}
+	return c.MaxPacketSize
+}
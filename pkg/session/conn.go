@@ -0,0 +1,71 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"bufio"
+	"net"
+	"sync"
+)
+
+// bufferedConn buffers the reads and writes of a connection, so that packets are
+// read without a system call per header byte and the packets forwarded in a row
+// are written at once. Writes are safe for concurrent use and are not flushed
+// until Flush is called.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func newBufferedConn(c net.Conn) *bufferedConn {
+	return &bufferedConn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+		w:    bufio.NewWriter(c),
+	}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ReadByte reads a single byte, so that packet headers are read without allocating.
+func (c *bufferedConn) ReadByte() (byte, error) {
+	return c.r.ReadByte()
+}
+
+// pending reports whether a whole packet is buffered, so that it can be read without blocking.
+func (c *bufferedConn) pending() bool {
+	n := c.r.Buffered()
+	if n < 2 {
+		return false
+	}
+	// The fixed header is the packet type byte followed by the remaining length varint.
+	b, _ := c.r.Peek(min(n, 5))
+	length, mul := 0, 1
+	for i := 1; i < len(b); i++ {
+		length += int(b[i]&0x7f) * mul
+		if b[i]&0x80 == 0 {
+			return n >= i+1+length
+		}
+		mul *= 128
+	}
+	return false
+}
+
+func (c *bufferedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(b)
+}
+
+// Flush writes the buffered data to the connection.
+func (c *bufferedConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Flush()
+}
@@ -0,0 +1,205 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+// Tracker keeps track of the sessions streamed by Stream on a single listener,
+// so they can be drained when the listener shuts down. Its methods are safe
+// to call on a nil Tracker, which does not track sessions.
+type Tracker struct {
+	mu       sync.Mutex
+	sessions idleSet[*state]
+}
+
+// NewTracker returns a new Tracker with no sessions.
+func NewTracker() *Tracker {
+	return &Tracker{sessions: newIdleSet[*state]()}
+}
+
+// Len returns the number of active sessions.
+func (t *Tracker) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sessions.items)
+}
+
+// Drain ends the active sessions. Clients have the grace period to disconnect on
+// their own. After that, each remaining session waits for its QoS 1 and 2 flows in
+// flight to complete and is disconnected with the Server shutting down reason code,
+// sending DISCONNECT to both the client and the broker. Sessions still active when
+// ctx is done are closed right away. Drain returns once all the sessions ended or
+// ctx is done, with the number of sessions remaining after the grace period and the
+// number of the ones which were force-closed.
+func (t *Tracker) Drain(ctx context.Context, grace time.Duration) (total, forced int) {
+	if t == nil {
+		return 0, 0
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-t.idle():
+		return 0, 0
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	sessions := make([]*state, 0, len(t.sessions.items))
+	for st := range t.sessions.items {
+		sessions = append(sessions, st)
+	}
+	t.mu.Unlock()
+
+	var (
+		wg  sync.WaitGroup
+		cnt atomic.Int64
+	)
+	for _, st := range sessions {
+		wg.Add(1)
+		go func(st *state) {
+			defer wg.Done()
+			if !st.drain(ctx) {
+				cnt.Add(1)
+			}
+		}(st)
+	}
+	wg.Wait()
+
+	select {
+	case <-t.idle():
+	case <-ctx.Done():
+	}
+	return len(sessions), int(cnt.Load())
+}
+
+func (t *Tracker) add(st *state) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.sessions.add(st)
+	t.mu.Unlock()
+}
+
+func (t *Tracker) remove(st *state) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.sessions.remove(st)
+	t.mu.Unlock()
+}
+
+func (t *Tracker) idle() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions.idle
+}
+
+// drain waits for the flows in flight of the session and disconnects it.
+// If ctx is done first, the session is closed without DISCONNECT and
+// drain returns false.
+func (st *state) drain(ctx context.Context) bool {
+	select {
+	case <-st.flowsIdle():
+	case <-st.done:
+		return true
+	case <-ctx.Done():
+		st.cancel()
+		return false
+	}
+	if err := st.disconnect(packets.ServerShuttingDown); err != nil {
+		st.logger().Warn("Failed to cleanly disconnect session on shutdown", slog.String("listener", st.cfg.Listener), slog.Any("error", err))
+	}
+	return true
+}
+
+// flow identifies a QoS 1 or 2 PUBLISH in flight by the direction
+// it was forwarded in and its packet ID.
+type flow struct {
+	dir Direction
+	id  uint16
+}
+
+// trackFlow records the QoS 1 and 2 flows started and completed
+// by the packet forwarded in the given direction.
+func (st *state) trackFlow(dir Direction, pkt packets.ControlPacket, version byte) {
+	if p, ok := pkt.(*packets.PublishPacket); ok {
+		if p.Qos > 0 {
+			st.mu.Lock()
+			st.flows.add(flow{dir: dir, id: p.MessageID})
+			st.mu.Unlock()
+		}
+		return
+	}
+	id, code, ok := ack(pkt, version)
+	if !ok {
+		return
+	}
+	// Acknowledgments complete the flows of the opposite direction.
+	other := Up
+	if dir == Up {
+		other = Down
+	}
+	switch pkt.Header().MessageType {
+	case packets.Pubrec:
+		// Failure reason code in PUBREC ends the MQTT 5.0 QoS 2 flow.
+		if code < packets.UnspecifiedError {
+			return
+		}
+	case packets.Pubrel:
+		return
+	}
+	st.mu.Lock()
+	st.flows.remove(flow{dir: other, id: id})
+	st.mu.Unlock()
+}
+
+func (st *state) flowsIdle() <-chan struct{} {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.flows.idle
+}
+
+// idleSet is a set which signals when it is empty. It is not safe for concurrent use.
+type idleSet[K comparable] struct {
+	items map[K]struct{}
+	// idle is closed while the set is empty.
+	idle chan struct{}
+}
+
+func newIdleSet[K comparable]() idleSet[K] {
+	idle := make(chan struct{})
+	close(idle)
+	return idleSet[K]{items: make(map[K]struct{}), idle: idle}
+}
+
+func (s *idleSet[K]) add(k K) {
+	if len(s.items) == 0 {
+		s.idle = make(chan struct{})
+	}
+	s.items[k] = struct{}{}
+}
+
+func (s *idleSet[K]) remove(k K) {
+	if _, ok := s.items[k]; !ok {
+		return
+	}
+	delete(s.items, k)
+	if len(s.items) == 0 {
+		close(s.idle)
+	}
+}
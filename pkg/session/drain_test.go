@@ -0,0 +1,249 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+// drained is the result of Tracker.Drain.
+type drained struct {
+	total, forced int
+}
+
+// drain drains the tracker in the background.
+func drain(ctx context.Context, tr *Tracker, grace time.Duration) <-chan drained {
+	ret := make(chan drained, 1)
+	go func() {
+		total, forced := tr.Drain(ctx, grace)
+		ret <- drained{total: total, forced: forced}
+	}()
+	return ret
+}
+
+func (p *pipe) drained(ret <-chan drained, want drained) {
+	p.t.Helper()
+	select {
+	case got := <-ret:
+		if got != want {
+			p.t.Errorf("Drain() = %+v, want %+v", got, want)
+		}
+	case <-time.After(testTimeout):
+		p.t.Fatal("Drain() did not return")
+	}
+}
+
+// ended waits for the session to end.
+func (p *pipe) ended() {
+	p.t.Helper()
+	select {
+	case err := <-p.done:
+		// Leave the result for the cleanup of the pipe.
+		p.done <- err
+	case <-time.After(testTimeout):
+		p.t.Fatal("session did not end")
+	}
+}
+
+// disconnected checks the broker, and the MQTT 5.0 client, received DISCONNECT.
+func (p *pipe) disconnected(version byte) {
+	p.t.Helper()
+	// The session flushes the connections in any order.
+	client := make(chan packets.ControlPacket, 1)
+	go func() {
+		defer close(client)
+		if version != packets.V5 {
+			return
+		}
+		_ = p.client.SetReadDeadline(time.Now().Add(testTimeout))
+		if pkt, err := packets.ReadPacket(p.client, version); err == nil {
+			client <- pkt
+		}
+	}()
+	if _, ok := p.read(p.broker, version).(*packets.DisconnectPacket); !ok {
+		p.t.Fatal("broker did not receive DISCONNECT")
+	}
+	pkt := <-client
+	if version != packets.V5 {
+		return
+	}
+	d, ok := pkt.(*packets.DisconnectPacket)
+	if !ok {
+		p.t.Fatalf("client received %v, want DISCONNECT", pkt)
+	}
+	if d.ReasonCode != packets.ServerShuttingDown {
+		p.t.Errorf("DISCONNECT reason code = %#x, want %#x", d.ReasonCode, packets.ServerShuttingDown)
+	}
+}
+
+// quiet checks nothing is received on the connection for a while.
+func (p *pipe) quiet(c net.Conn, version byte) {
+	p.t.Helper()
+	if err := c.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		p.t.Fatal(err)
+	}
+	if pkt, err := packets.ReadPacket(c, version); err == nil {
+		p.t.Fatalf("received %s", pkt)
+	}
+}
+
+func newPublish(qos byte, id uint16) *packets.PublishPacket {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "t"
+	pub.Qos = qos
+	pub.MessageID = id
+	return pub
+}
+
+// newAck returns the PUBLISH acknowledgment of the given type.
+func newAck(typ byte, id uint16) packets.ControlPacket {
+	switch pkt := packets.NewControlPacket(typ).(type) {
+	case *packets.PubackPacket:
+		pkt.MessageID = id
+		return pkt
+	case *packets.PubrecPacket:
+		pkt.MessageID = id
+		return pkt
+	case *packets.PubrelPacket:
+		pkt.MessageID = id
+		return pkt
+	case *packets.PubcompPacket:
+		pkt.MessageID = id
+		return pkt
+	default:
+		return pkt
+	}
+}
+
+func TestDrainIdle(t *testing.T) {
+	for _, tr := range []*Tracker{nil, NewTracker()} {
+		total, forced := tr.Drain(context.Background(), time.Hour)
+		if total != 0 || forced != 0 || tr.Len() != 0 {
+			t.Errorf("Drain() without sessions = %d, %d", total, forced)
+		}
+	}
+}
+
+func TestDrainGracePeriod(t *testing.T) {
+	tr := NewTracker()
+	p := newPipe(t, allowHandler{}, Config{Tracker: tr})
+	p.connect(newConnect(packets.V5, "c1", 0), newConnack())
+	if tr.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", tr.Len())
+	}
+
+	ret := drain(context.Background(), tr, time.Hour)
+	// The session is not disconnected during the grace period.
+	p.quiet(p.client, packets.V5)
+	p.quiet(p.broker, packets.V5)
+
+	// The client disconnecting on its own ends the drain.
+	p.send(p.client, packets.NewControlPacket(packets.Disconnect), packets.V5)
+	if _, ok := p.read(p.broker, packets.V5).(*packets.DisconnectPacket); !ok {
+		t.Fatal("broker did not receive DISCONNECT")
+	}
+	p.broker.Close()
+	p.ended()
+	p.drained(ret, drained{})
+}
+
+func TestDrainDisconnect(t *testing.T) {
+	for _, version := range []byte{packets.V311, packets.V5} {
+		tr := NewTracker()
+		p := newPipe(t, allowHandler{}, Config{Tracker: tr})
+		p.connect(newConnect(version, "c1", 0), newConnack())
+
+		start := time.Now()
+		ret := drain(context.Background(), tr, 50*time.Millisecond)
+		p.disconnected(version)
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("MQTT %d session disconnected %s after the drain started, within the grace period", version, d)
+		}
+		p.ended()
+		p.drained(ret, drained{total: 1})
+	}
+}
+
+func TestDrainInflight(t *testing.T) {
+	cases := []struct {
+		desc string
+		// start puts a PUBLISH in flight and complete completes its flow.
+		start    func(p *pipe)
+		complete func(p *pipe)
+	}{
+		{
+			desc: "QoS 1 from the client",
+			start: func(p *pipe) {
+				p.send(p.client, newPublish(1, 1), packets.V5)
+				p.read(p.broker, packets.V5)
+			},
+			complete: func(p *pipe) {
+				p.send(p.broker, newAck(packets.Puback, 1), packets.V5)
+				if _, ok := p.read(p.client, packets.V5).(*packets.PubackPacket); !ok {
+					p.t.Fatal("client did not receive PUBACK")
+				}
+			},
+		},
+		{
+			desc: "QoS 2 from the broker",
+			start: func(p *pipe) {
+				p.send(p.broker, newPublish(2, 7), packets.V5)
+				p.read(p.client, packets.V5)
+			},
+			complete: func(p *pipe) {
+				p.send(p.client, newAck(packets.Pubrec, 7), packets.V5)
+				p.read(p.broker, packets.V5)
+				p.send(p.broker, newAck(packets.Pubrel, 7), packets.V5)
+				p.read(p.client, packets.V5)
+				// The flow is in flight until the PUBCOMP.
+				p.quiet(p.broker, packets.V5)
+				p.send(p.client, newAck(packets.Pubcomp, 7), packets.V5)
+				if _, ok := p.read(p.broker, packets.V5).(*packets.PubcompPacket); !ok {
+					p.t.Fatal("broker did not receive PUBCOMP")
+				}
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tr := NewTracker()
+			p := newPipe(t, allowHandler{}, Config{Tracker: tr})
+			p.connect(newConnect(packets.V5, "c1", 0), newConnack())
+			tc.start(p)
+
+			ret := drain(context.Background(), tr, 0)
+			// The session is not disconnected while the PUBLISH is in flight.
+			p.quiet(p.broker, packets.V5)
+			tc.complete(p)
+			p.disconnected(packets.V5)
+			p.ended()
+			p.drained(ret, drained{total: 1})
+		})
+	}
+}
+
+func TestDrainForced(t *testing.T) {
+	tr := NewTracker()
+	p := newPipe(t, allowHandler{}, Config{Tracker: tr})
+	p.connect(newConnect(packets.V5, "c1", 0), newConnack())
+	p.send(p.client, newPublish(1, 1), packets.V5)
+	p.read(p.broker, packets.V5)
+
+	// The broker never acknowledges the PUBLISH.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ret := drain(ctx, tr, 0)
+	p.ended()
+	p.drained(ret, drained{total: 1, forced: 1})
+	if tr.Len() != 0 {
+		t.Errorf("Len() = %d after the drain, want 0", tr.Len())
+	}
+	// The session was closed without DISCONNECT.
+	p.quiet(p.broker, packets.V5)
+}
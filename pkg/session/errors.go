@@ -0,0 +1,107 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+// Error is returned by Handler hooks to select the MQTT reason code mProxy
+// replies with when it rejects a packet on behalf of the broker.
+// Codes are MQTT 5.0 reason codes, they are mapped to the closest
+// MQTT 3.1.x return code for older clients.
+type Error struct {
+	Code byte
+	Err  error
+}
+
+// NewError returns a new Error with the given MQTT 5.0 reason code.
+func NewError(code byte, err error) *Error {
+	return &Error{Code: code, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("mqtt reason code 0x%02x", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// TopicErrors is returned by AuthSubscribe to deny topics individually.
+// It holds an entry for each of the topics AuthSubscribe was called with,
+// nil for allowed topics. Denied topics receive the SUBACK failure code
+// selected by their error, while allowed topics are forwarded to the broker.
+type TopicErrors []error
+
+func (e TopicErrors) Error() string {
+	return errors.Join(e...).Error()
+}
+
+func (e TopicErrors) Unwrap() []error {
+	var errs []error
+	for _, err := range e {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Errors that can be returned by Handler hooks.
+var (
+	ErrClientIDNotValid      = NewError(packets.ClientIdentifierNotValid, errors.New("client identifier not valid"))
+	ErrBadUsernameOrPassword = NewError(packets.BadUserNameOrPassword, errors.New("bad username or password"))
+	ErrNotAuthorized         = NewError(packets.NotAuthorized, errors.New("not authorized"))
+	ErrServerUnavailable     = NewError(packets.ServerUnavailable, errors.New("server unavailable"))
+	ErrServerBusy            = NewError(packets.ServerBusy, errors.New("server busy"))
+	ErrBanned                = NewError(packets.Banned, errors.New("banned"))
+	ErrTopicNameInvalid      = NewError(packets.TopicNameInvalid, errors.New("topic name invalid"))
+	ErrTopicFilterInvalid    = NewError(packets.TopicFilterInvalid, errors.New("topic filter invalid"))
+	ErrQuotaExceeded         = NewError(packets.QuotaExceeded, errors.New("quota exceeded"))
+)
+
+// reasonCode returns the MQTT 5.0 reason code carried by err,
+// or NotAuthorized for errors without one.
+func reasonCode(err error) byte {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return packets.NotAuthorized
+}
+
+// connackCode returns the CONNACK return code for the given error and protocol version.
+func connackCode(err error, version byte) byte {
+	code := reasonCode(err)
+	if version == packets.V5 {
+		return code
+	}
+	switch code {
+	case packets.UnsupportedProtocolVersion:
+		return packets.ErrRefusedBadProtocolVersion
+	case packets.ClientIdentifierNotValid:
+		return packets.ErrRefusedIDRejected
+	case packets.BadUserNameOrPassword, packets.BadAuthenticationMethod:
+		return packets.ErrRefusedBadUsernameOrPassword
+	case packets.ServerUnavailable, packets.ServerBusy, packets.ServerShuttingDown, packets.UseAnotherServer, packets.ServerMoved, packets.ConnectionRateExceeded, packets.QuotaExceeded:
+		return packets.ErrRefusedServerUnavailable
+	default:
+		return packets.ErrRefusedNotAuthorized
+	}
+}
+
+// subackCode returns the SUBACK failure code for the given error and protocol version.
+func subackCode(err error, version byte) byte {
+	if version == packets.V5 {
+		return reasonCode(err)
+	}
+	return packets.SubackFailure
+}
@@ -6,6 +6,8 @@ package session
 import "context"
 
 // Handler is an interface for mProxy hooks.
+// Authorization hooks may return an *Error to select the reason code
+// mProxy replies with on behalf of the broker.
 type Handler interface {
 	// Authorization on client `CONNECT`
 	// Each of the params are passed by reference, so that it can be changed
@@ -16,7 +18,10 @@ type Handler interface {
 	AuthPublish(ctx context.Context, topic *string, payload *[]byte) error
 
 	// Authorization on client `SUBSCRIBE`
-	// Topics are passed by reference, so that they can be modified
+	// Called once with all the topics of the packet. Topics are passed by reference,
+	// so that they can be modified. Topics removed from the slice are denied individually,
+	// and topics added to it are forwarded as well.
+	// Return TopicErrors to deny topics individually, any other error denies all of them
 	AuthSubscribe(ctx context.Context, topics *[]string) error
 
 	// Reconvert topics on client going down
@@ -38,4 +43,3 @@ type Handler interface {
 	// Disconnect on connection with client lost
 	Disconnect(ctx context.Context) error
 }
-
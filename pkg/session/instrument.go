@@ -0,0 +1,98 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/metrics"
+	"github.com/absmach/mproxy/pkg/tracing"
+)
+
+var _ Handler = (*instrumentedHandler)(nil)
+
+// instrumentedHandler records the duration of Handler hooks and the
+// packets denied by the authorization hooks, and traces each hook call.
+type instrumentedHandler struct {
+	handler Handler
+	metrics *metrics.Listener
+}
+
+// Instrument returns Handler recording hook metrics of h to m, if set, and
+// starting a span for each hook call with the global tracer provider.
+func Instrument(h Handler, m *metrics.Listener) Handler {
+	return &instrumentedHandler{handler: h, metrics: m}
+}
+
+func (ih *instrumentedHandler) AuthConnect(ctx context.Context) error {
+	return ih.auth(ctx, "AuthConnect", func(ctx context.Context) error {
+		return ih.handler.AuthConnect(ctx)
+	})
+}
+
+func (ih *instrumentedHandler) AuthPublish(ctx context.Context, topic *string, payload *[]byte) error {
+	return ih.auth(ctx, "AuthPublish", func(ctx context.Context) error {
+		return ih.handler.AuthPublish(ctx, topic, payload)
+	})
+}
+
+func (ih *instrumentedHandler) AuthSubscribe(ctx context.Context, topics *[]string) error {
+	return ih.auth(ctx, "AuthSubscribe", func(ctx context.Context) error {
+		return ih.handler.AuthSubscribe(ctx, topics)
+	})
+}
+
+func (ih *instrumentedHandler) DownSubscribe(ctx context.Context, topics *[]string) error {
+	return ih.observe(ctx, "DownSubscribe", func(ctx context.Context) error {
+		return ih.handler.DownSubscribe(ctx, topics)
+	})
+}
+
+func (ih *instrumentedHandler) Connect(ctx context.Context) error {
+	return ih.observe(ctx, "Connect", func(ctx context.Context) error {
+		return ih.handler.Connect(ctx)
+	})
+}
+
+func (ih *instrumentedHandler) Publish(ctx context.Context, topic *string, payload *[]byte) error {
+	return ih.observe(ctx, "Publish", func(ctx context.Context) error {
+		return ih.handler.Publish(ctx, topic, payload)
+	})
+}
+
+func (ih *instrumentedHandler) Subscribe(ctx context.Context, topics *[]string) error {
+	return ih.observe(ctx, "Subscribe", func(ctx context.Context) error {
+		return ih.handler.Subscribe(ctx, topics)
+	})
+}
+
+func (ih *instrumentedHandler) Unsubscribe(ctx context.Context, topics *[]string) error {
+	return ih.observe(ctx, "Unsubscribe", func(ctx context.Context) error {
+		return ih.handler.Unsubscribe(ctx, topics)
+	})
+}
+
+func (ih *instrumentedHandler) Disconnect(ctx context.Context) error {
+	return ih.observe(ctx, "Disconnect", func(ctx context.Context) error {
+		return ih.handler.Disconnect(ctx)
+	})
+}
+
+func (ih *instrumentedHandler) auth(ctx context.Context, hook string, call func(context.Context) error) error {
+	err := ih.observe(ctx, hook, call)
+	if err != nil {
+		ih.metrics.AuthDenied(hook)
+	}
+	return err
+}
+
+func (ih *instrumentedHandler) observe(ctx context.Context, hook string, call func(context.Context) error) error {
+	ctx, span := tracing.StartChild(ctx, "Handler."+hook)
+	start := time.Now()
+	err := call(ctx)
+	ih.metrics.HandlerDuration(hook, time.Since(start))
+	tracing.End(span, err)
+	return err
+}
@@ -6,7 +6,7 @@ package session
 import (
 	"context"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
 )
 
 // Interceptor is an interface for mProxy intercept hook.
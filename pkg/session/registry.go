@@ -0,0 +1,349 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrSessionNotFound indicates there is no active session with the given ID.
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrDuplicateClientID indicates the client ID is used by another active session.
+	ErrDuplicateClientID = errors.New("duplicate client ID")
+)
+
+// Info is a snapshot of an active session.
+type Info struct {
+	ID            string    `json:"id"`
+	ClientID      string    `json:"client_id"`
+	Username      string    `json:"username"`
+	CertCN        string    `json:"cert_cn,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Listener      string    `json:"listener"`
+	Transport     Transport `json:"transport,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	Subscriptions []string  `json:"subscriptions"`
+	BytesIn       uint64    `json:"bytes_in"`
+	BytesOut      uint64    `json:"bytes_out"`
+	PacketsIn     uint64    `json:"packets_in"`
+	PacketsOut    uint64    `json:"packets_out"`
+}
+
+// Registry keeps track of the sessions streamed by Stream, and of the sessions
+// recorded by Register.
+// It is safe for concurrent use and can be shared between listeners.
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[string]*entry
+	// clientIDs indexes the sessions by their client ID.
+	clientIDs map[string]*entry
+}
+
+// NewRegistry returns a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions:  make(map[string]*entry),
+		clientIDs: make(map[string]*entry),
+	}
+}
+
+// Sessions returns the snapshots of all the active sessions ordered by connect time.
+func (r *Registry) Sessions() []Info {
+	r.mu.RLock()
+	infos := make([]Info, 0, len(r.sessions))
+	for _, e := range r.sessions {
+		infos = append(infos, e.info())
+	}
+	r.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// Session returns the snapshot of the session with the given ID.
+func (r *Registry) Session(id string) (Info, error) {
+	r.mu.RLock()
+	e, ok := r.sessions[id]
+	r.mu.RUnlock()
+	if !ok {
+		return Info{}, ErrSessionNotFound
+	}
+	return e.info(), nil
+}
+
+// Disconnect sends DISCONNECT to the broker on behalf of the client and
+// closes the client connection of the session with the given ID.
+func (r *Registry) Disconnect(id string) error {
+	r.mu.RLock()
+	e, ok := r.sessions[id]
+	r.mu.RUnlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return e.disconnect(packets.AdministrativeAction)
+}
+
+// Len returns the number of active sessions.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+func (r *Registry) add(e *entry) {
+	r.mu.Lock()
+	r.sessions[e.id] = e
+	r.mu.Unlock()
+}
+
+func (r *Registry) remove(e *entry) {
+	r.mu.Lock()
+	delete(r.sessions, e.id)
+	if r.clientIDs[e.claimedID] == e {
+		delete(r.clientIDs, e.claimedID)
+	}
+	r.mu.Unlock()
+}
+
+// claim records the client ID of the session e, applying the policy if the
+// client ID is used by another session. It returns the client ID the session
+// is recorded with, which differs from the given one when it is rewritten,
+// and the other session using the client ID, if any.
+func (r *Registry) claim(e *entry, clientID string, policy DuplicateClientIDPolicy) (string, *entry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.clientIDs[clientID]
+	if old == e {
+		return clientID, nil, nil
+	}
+	if ok {
+		switch policy {
+		case RejectDuplicateClientID:
+			return clientID, old, ErrDuplicateClientID
+		case RewriteDuplicateClientID:
+			for taken := true; taken; {
+				id := clientID + "-" + uuid.NewString()[:8]
+				_, taken = r.clientIDs[id]
+				clientID = id
+			}
+		}
+	}
+	if r.clientIDs[e.claimedID] == e {
+		delete(r.clientIDs, e.claimedID)
+	}
+	e.claimedID = clientID
+	r.clientIDs[clientID] = e
+	return clientID, old, nil
+}
+
+// ender ends the session of an entry on behalf of the registry.
+type ender interface {
+	// disconnect ends the session with the reason code.
+	disconnect(code byte) error
+	// releaseIdentitySlot releases the connection limit slot of the client identity, if any.
+	releaseIdentitySlot()
+}
+
+// entry is the registry record of a single session. Its methods are safe
+// to call on a nil entry, so Stream does not need to check if registry is used.
+type entry struct {
+	id          string
+	listener    string
+	transport   Transport
+	remoteAddr  string
+	connectedAt time.Time
+	st          ender
+	// claimedID is the client ID the entry is indexed with, guarded by Registry.mu.
+	claimedID string
+
+	mu            sync.Mutex
+	clientID      string
+	username      string
+	certCN        string
+	subscriptions []string
+
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+	packetsIn  atomic.Uint64
+	packetsOut atomic.Uint64
+}
+
+func newEntry(s *Session, st *state) *entry {
+	return &entry{
+		id:          s.ConnID,
+		listener:    s.Listener,
+		transport:   s.Transport,
+		connectedAt: time.Now(),
+		remoteAddr:  addr(st.in.RemoteAddr()),
+		st:          st,
+	}
+}
+
+func (e *entry) info() Info {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return Info{
+		ID:            e.id,
+		ClientID:      e.clientID,
+		Username:      e.username,
+		CertCN:        e.certCN,
+		RemoteAddr:    e.remoteAddr,
+		Listener:      e.listener,
+		Transport:     e.transport,
+		ConnectedAt:   e.connectedAt,
+		Subscriptions: append([]string{}, e.subscriptions...),
+		BytesIn:       e.bytesIn.Load(),
+		BytesOut:      e.bytesOut.Load(),
+		PacketsIn:     e.packetsIn.Load(),
+		PacketsOut:    e.packetsOut.Load(),
+	}
+}
+
+func (e *entry) connected(s Session) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.clientID = s.ID
+	e.username = s.Username
+	e.certCN = s.Cert.Subject.CommonName
+	e.mu.Unlock()
+}
+
+func (e *entry) subscribed(topics []string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, t := range topics {
+		if !contains(e.subscriptions, t) {
+			e.subscriptions = append(e.subscriptions, t)
+		}
+	}
+}
+
+func (e *entry) unsubscribed(topics []string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	subs := e.subscriptions[:0]
+	for _, t := range e.subscriptions {
+		if !contains(topics, t) {
+			subs = append(subs, t)
+		}
+	}
+	e.subscriptions = subs
+}
+
+// count records a packet read in the given direction.
+func (e *entry) count(dir Direction, size int) {
+	if e == nil {
+		return
+	}
+	switch dir {
+	case Up:
+		e.packetsIn.Add(1)
+		e.bytesIn.Add(uint64(size))
+	default:
+		e.packetsOut.Add(1)
+		e.bytesOut.Add(uint64(size))
+	}
+}
+
+// disconnect ends the session, see state.disconnect for the sessions of Stream.
+func (e *entry) disconnect(code byte) error {
+	return e.st.disconnect(code)
+}
+
+func contains(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Registration is the registry record of a session which is not streamed by
+// Stream, such as a connection of the WebSocket proxy. Its methods are safe to
+// call on a nil Registration, which Register returns without a Registry.
+type Registration struct {
+	registry *Registry
+	entry    *entry
+}
+
+// closeFunc ends a session registered by Register.
+type closeFunc func(code byte) error
+
+func (f closeFunc) disconnect(code byte) error {
+	return f(code)
+}
+
+func (closeFunc) releaseIdentitySlot() {}
+
+// Register records the session in the Registry of the configuration, if set,
+// so that the sessions which are not streamed by Stream are listed and
+// disconnected like the others. The client ID of the session, if any, is
+// claimed with the duplicate client ID policy of the configuration, as the
+// client ID of a CONNECT is: the error wraps ErrDuplicateClientID with the
+// reject policy, and s.ID is rewritten with the rewrite policy. The Registry
+// calls end with the MQTT reason code when the session is disconnected
+// through it, or taken over by another session with the kick policy.
+func Register(s *Session, cfg Config, end func(code byte) error) (*Registration, error) {
+	if cfg.Registry == nil {
+		return nil, nil
+	}
+	e := &entry{
+		id:          s.ConnID,
+		listener:    s.Listener,
+		transport:   s.Transport,
+		connectedAt: time.Now(),
+		remoteAddr:  addr(s.RemoteAddr),
+		st:          closeFunc(end),
+	}
+	cfg.Registry.add(e)
+	if err := claimClientID(cfg, e, s); err != nil {
+		cfg.Registry.remove(e)
+		return nil, err
+	}
+	e.connected(*s)
+	return &Registration{registry: cfg.Registry, entry: e}, nil
+}
+
+// Subscribed records the topics the session is subscribed to.
+func (r *Registration) Subscribed(topics []string) {
+	if r == nil {
+		return
+	}
+	r.entry.subscribed(topics)
+}
+
+// Count records a message of the session of the given size, read in the given direction.
+func (r *Registration) Count(dir Direction, size int) {
+	if r == nil {
+		return
+	}
+	r.entry.count(dir, size)
+}
+
+// Unregister removes the session from the Registry once it ends.
+func (r *Registration) Unregister() {
+	if r == nil {
+		return
+	}
+	r.registry.remove(r.entry)
+}
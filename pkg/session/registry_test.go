@@ -0,0 +1,193 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+func newRegistered(id, clientID string) *Session {
+	return &Session{
+		ID:         clientID,
+		ConnID:     id,
+		Username:   "user",
+		Listener:   "ws",
+		Transport:  RawWebSocket,
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000},
+	}
+}
+
+func TestRegister(t *testing.T) {
+	cfg := Config{Registry: NewRegistry()}
+	var ended []byte
+	reg, err := Register(newRegistered("s1", "c1"), cfg, func(code byte) error {
+		ended = append(ended, code)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	reg.Subscribed([]string{"/ws/room"})
+	reg.Count(Up, 10)
+	reg.Count(Down, 20)
+	reg.Count(Down, 30)
+
+	info, err := cfg.Registry.Session("s1")
+	if err != nil {
+		t.Fatalf("Session() = %v", err)
+	}
+	want := Info{
+		ID:            "s1",
+		ClientID:      "c1",
+		Username:      "user",
+		RemoteAddr:    "192.0.2.1:5000",
+		Listener:      "ws",
+		Transport:     RawWebSocket,
+		ConnectedAt:   info.ConnectedAt,
+		Subscriptions: []string{"/ws/room"},
+		BytesIn:       10,
+		BytesOut:      50,
+		PacketsIn:     1,
+		PacketsOut:    2,
+	}
+	if info.ConnectedAt.IsZero() || !reflect.DeepEqual(info, want) {
+		t.Errorf("Session() = %+v, want %+v", info, want)
+	}
+
+	if err := cfg.Registry.Disconnect("s1"); err != nil {
+		t.Fatalf("Disconnect() = %v", err)
+	}
+	if len(ended) != 1 || ended[0] != packets.AdministrativeAction {
+		t.Errorf("ended with %x, want %x", ended, packets.AdministrativeAction)
+	}
+
+	reg.Unregister()
+	if _, err := cfg.Registry.Session("s1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Session() after Unregister() = %v, want %v", err, ErrSessionNotFound)
+	}
+	// The client ID is released along with the session.
+	if _, err := Register(newRegistered("s2", "c1"), Config{Registry: cfg.Registry, DuplicateClientIDPolicy: RejectDuplicateClientID}, nil); err != nil {
+		t.Errorf("Register() with released client ID = %v", err)
+	}
+}
+
+func TestRegisterWithoutRegistry(t *testing.T) {
+	reg, err := Register(newRegistered("s1", "c1"), Config{}, nil)
+	if reg != nil || err != nil {
+		t.Fatalf("Register() = %v, %v, want nil", reg, err)
+	}
+	// The methods of a nil Registration do nothing.
+	reg.Subscribed([]string{"t"})
+	reg.Count(Up, 1)
+	reg.Unregister()
+}
+
+func TestRegisterDuplicateClientID(t *testing.T) {
+	cases := []struct {
+		desc      string
+		policy    DuplicateClientIDPolicy
+		err       error
+		kicked    bool
+		rewritten bool
+	}{
+		{desc: "allow", policy: AllowDuplicateClientID},
+		{desc: "reject", policy: RejectDuplicateClientID, err: ErrDuplicateClientID},
+		{desc: "kick", policy: KickDuplicateClientID, kicked: true},
+		{desc: "rewrite", policy: RewriteDuplicateClientID, rewritten: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := Config{Registry: NewRegistry(), DuplicateClientIDPolicy: tc.policy}
+			kicked := make(chan byte, 1)
+			if _, err := Register(newRegistered("s1", "c1"), cfg, func(code byte) error {
+				kicked <- code
+				return nil
+			}); err != nil {
+				t.Fatalf("Register() = %v", err)
+			}
+
+			s := newRegistered("s2", "c1")
+			_, err := Register(s, cfg, nil)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Register() = %v, want %v", err, tc.err)
+			}
+			select {
+			case code := <-kicked:
+				if !tc.kicked || code != packets.SessionTakenOver {
+					t.Errorf("older session ended with %#x", code)
+				}
+			default:
+				if tc.kicked {
+					t.Error("older session was not ended")
+				}
+			}
+			if rewritten := s.ID != "c1"; rewritten != tc.rewritten || (rewritten && !strings.HasPrefix(s.ID, "c1-")) {
+				t.Errorf("client ID = %q", s.ID)
+			}
+			// Rejected sessions are not recorded.
+			if _, err := cfg.Registry.Session("s2"); (err == nil) == (tc.err != nil) {
+				t.Errorf("Session() of the new session = %v", err)
+			}
+		})
+	}
+}
+
+// A session registered by Register is taken over by an MQTT session, and the
+// other way around.
+func TestRegisterKickStream(t *testing.T) {
+	cfg := Config{Registry: NewRegistry(), DuplicateClientIDPolicy: KickDuplicateClientID}
+	kicked := make(chan byte, 1)
+	reg, err := Register(newRegistered("ws", "device"), cfg, func(code byte) error {
+		kicked <- code
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	defer reg.Unregister()
+
+	p := newPipe(t, allowHandler{}, cfg)
+	if _, ack := p.connect(newConnect(packets.V5, "device", 60), newConnack()); ack.ReturnCode != packets.Success {
+		t.Fatalf("CONNACK = %#x, want success", ack.ReturnCode)
+	}
+	select {
+	case code := <-kicked:
+		if code != packets.SessionTakenOver {
+			t.Errorf("registered session ended with %#x, want %#x", code, packets.SessionTakenOver)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("registered session was not ended")
+	}
+
+	// The MQTT session is disconnected once a registered session takes over.
+	go func() {
+		_, _ = packets.ReadPacket(p.broker, packets.V5)
+	}()
+	disconnected := make(chan byte, 1)
+	go func() {
+		pkt, err := packets.ReadPacket(p.client, packets.V5)
+		if d, ok := pkt.(*packets.DisconnectPacket); err == nil && ok {
+			disconnected <- d.ReasonCode
+		}
+		close(disconnected)
+	}()
+	if _, err := Register(newRegistered("ws2", "device"), cfg, nil); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	select {
+	case code := <-disconnected:
+		if code != packets.SessionTakenOver {
+			t.Errorf("MQTT session DISCONNECT = %#x, want %#x", code, packets.SessionTakenOver)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("MQTT session was not disconnected")
+	}
+}
@@ -5,19 +5,95 @@ package session
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
+	"net"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/unixsock"
 )
 
 // The sessionKey type is unexported to prevent collisions with context keys defined in
 // other packages.
 type sessionKey struct{}
 
+// The propertiesKey type is unexported to prevent collisions with context keys defined in
+// other packages.
+type propertiesKey struct{}
+
+// Transport is the protocol the client connected with.
+type Transport string
+
+const (
+	// TCP is MQTT over TCP.
+	TCP Transport = "tcp"
+	// WebSocket is MQTT over WebSocket.
+	WebSocket Transport = "ws"
+	// HTTP is HTTP requests.
+	HTTP Transport = "http"
+	// QUIC is MQTT over QUIC streams.
+	QUIC Transport = "quic"
+	// MQTTSN is MQTT-SN over UDP, translated to MQTT by the gateway.
+	MQTTSN Transport = "mqttsn"
+	// CoAP is CoAP over UDP or DTLS, translated to MQTT by the proxy.
+	CoAP Transport = "coap"
+	// RawWebSocket is plain WebSocket messages, proxied to a WebSocket target.
+	RawWebSocket Transport = "raw-ws"
+)
+
 // Session stores MQTT session data.
 type Session struct {
-	ID       string
-	Username string
-	Password []byte
-	Cert     x509.Certificate
+	ID              string
+	Username        string
+	Password        []byte
+	Cert            x509.Certificate
+	ProtocolVersion byte
+	// ConnID uniquely identifies the client connection, unlike the client ID,
+	// which is chosen by the client and can be reused by other connections.
+	ConnID string
+	// Listener is the name of the listener the client connected to.
+	Listener  string
+	Transport Transport
+	// RemoteAddr is the address of the client. Behind a load balancer using the
+	// PROXY protocol, it is the address of the client sent by the load balancer.
+	RemoteAddr net.Addr
+	// LocalAddr is the address the client connected to.
+	LocalAddr net.Addr
+	// TLS describes the TLS connection of the client, nil if the client
+	// did not connect over TLS.
+	TLS *TLSInfo
+	// PeerCredentials are the process credentials of the client connected
+	// over a Unix socket, nil for other clients.
+	PeerCredentials *unixsock.Credentials
+}
+
+// TLSInfo describes the TLS connection of the client.
+type TLSInfo struct {
+	// Version is the TLS version, such as tls.VersionTLS13.
+	Version     uint16
+	CipherSuite uint16
+	// ServerName is the server name the client requested with SNI.
+	ServerName string
+	// NegotiatedProtocol is the protocol negotiated with ALPN.
+	NegotiatedProtocol string
+	// VerifiedChains are the chains of the client certificate verified by
+	// mProxy, each starting with the client certificate.
+	VerifiedChains [][]*x509.Certificate
+}
+
+// NewTLSInfo returns the TLSInfo of the connection with the given state.
+// It returns nil if the TLS handshake is not complete.
+func NewTLSInfo(state tls.ConnectionState) *TLSInfo {
+	if !state.HandshakeComplete {
+		return nil
+	}
+	return &TLSInfo{
+		Version:            state.Version,
+		CipherSuite:        state.CipherSuite,
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		VerifiedChains:     state.VerifiedChains,
+	}
 }
 
 // NewContext stores Session in context.Context values.
@@ -35,3 +111,19 @@ func FromContext(ctx context.Context) (*Session, bool) {
 	}
 	return nil, false
 }
+
+// NewPropertiesContext stores MQTT 5.0 properties of the packet being handled in context.Context values.
+// It uses pointer to the properties so they can be modified by handler.
+func NewPropertiesContext(ctx context.Context, p *packets.Properties) context.Context {
+	return context.WithValue(ctx, propertiesKey{}, p)
+}
+
+// PropertiesFromContext retrieves MQTT 5.0 properties of the packet being handled from context.Context.
+// Second value indicates if properties are present in the context, which is
+// only the case for MQTT 5.0 sessions.
+func PropertiesFromContext(ctx context.Context) (*packets.Properties, bool) {
+	if p, ok := ctx.Value(propertiesKey{}).(*packets.Properties); ok && p != nil {
+		return p, true
+	}
+	return nil, false
+}
@@ -5,13 +5,27 @@ package session
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/ratelimit"
+	"github.com/absmach/mproxy/pkg/tracing"
+	"github.com/absmach/mproxy/pkg/unixsock"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -22,38 +36,261 @@ const (
 	Down
 )
 
+func (d Direction) String() string {
+	switch d {
+	case Up:
+		return "up"
+	case Down:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
 const unknownID = "unknown"
 
 var (
 	errBroker = "failed to proxy from MQTT client with id %s to MQTT broker with error: %s"
 	errClient = "failed to proxy from MQTT broker to client with id %s with error: %s"
+
+	errUnknownTopicAlias = errors.New("unknown topic alias")
+	errConnectTimeout    = errors.New("client did not send CONNECT in time")
+	errKeepAliveTimeout  = errors.New("client keep alive timeout")
+	errTooManyTopics     = errors.New("too many topics")
+	errRateLimited       = errors.New("publish rate limit exceeded")
+	errNotConnected      = errors.New("client sent a packet before CONNECT")
+	errSessionEnded      = errors.New("session ended")
 )
 
+// DialFunc connects to the broker of the session. It is called once the client
+// CONNECT is authorized, so that the broker can be selected for the session.
+type DialFunc func(ctx context.Context, s *Session) (net.Conn, error)
+
+// state holds data shared by both directions of a single proxied connection.
+type state struct {
+	cfg Config
+	// in is the buffered client connection.
+	in *bufferedConn
+	// dial connects to the broker once the client CONNECT is authorized,
+	// if the broker connection is not given to Stream.
+	dial DialFunc
+	// forward starts forwarding the packets the broker sends.
+	forward func(out *bufferedConn)
+	// decodeAll is set if all the packets must be decoded, because an
+	// Interceptor may inspect them. Otherwise, packets which are not
+	// inspected by mProxy or Handler are forwarded raw.
+	decodeAll bool
+	cancel    context.CancelFunc
+	// done is closed once the session ends.
+	done  <-chan struct{}
+	entry *entry
+	// version is the protocol version negotiated by the client CONNECT.
+	version atomic.Uint32
+	// connected is set once the client CONNECT is received.
+	connected atomic.Bool
+	// keepAlive is the keep alive the client is expected to use.
+	keepAlive atomic.Int64
+
+	mu sync.Mutex
+	// out is the buffered broker connection, nil until the broker is connected.
+	out *bufferedConn
+	// ended is set once the session ends, so that no broker is connected after that.
+	ended bool
+	// subscriptions holds partially denied SUBSCRIBE packets by packet ID,
+	// waiting for the broker SUBACK.
+	subscriptions map[uint16]subscription
+	// dropped holds IDs of denied QoS 2 PUBLISH packets acknowledged
+	// by mProxy, so it can complete the flow on PUBREL.
+	dropped map[uint16]struct{}
+	// flows holds the QoS 1 and 2 flows in flight, so that
+	// the session is not disconnected in the middle of them.
+	flows idleSet[flow]
+	// serverKeepAlive holds the clamped keep alive announced
+	// to MQTT 5.0 clients in CONNACK, if any.
+	serverKeepAlive *uint16
+	// bucket holds the rate limit tokens of the client identity.
+	// It is only used by the client direction.
+	bucket *ratelimit.Bucket
+	// releaseIdentity releases the connection limit slot of the client identity,
+	// guarded by mu, as the session taking over the client ID releases it.
+	releaseIdentity func()
+}
+
+// subscription records how the topics of a SUBSCRIBE were forwarded.
+type subscription struct {
+	// codes holds the failure codes of denied topics.
+	codes []byte
+	// counts holds the number of topics forwarded for each of the
+	// original topics, 0 for denied topics.
+	counts []int
+}
+
+func newState(ctx context.Context, cfg Config, in net.Conn, dial DialFunc, ic Interceptor, cancel context.CancelFunc) *state {
+	st := &state{
+		cfg:           cfg,
+		in:            newBufferedConn(in),
+		dial:          dial,
+		decodeAll:     ic != nil,
+		cancel:        cancel,
+		done:          ctx.Done(),
+		subscriptions: make(map[uint16]subscription),
+		dropped:       make(map[uint16]struct{}),
+		flows:         newIdleSet[flow](),
+	}
+	st.version.Store(uint32(packets.V311))
+	return st
+}
+
+func (st *state) protocolVersion() byte {
+	return byte(st.version.Load())
+}
+
+// topicAliases maps MQTT 5.0 topic aliases to topic names for one direction.
+type topicAliases map[uint16]string
+
+// resolve fills in the topic name of PUBLISH packets that only carry a topic alias,
+// so that handlers always see the full topic.
+func (ta topicAliases) resolve(p *packets.PublishPacket) error {
+	alias := p.TopicAlias()
+	if alias == 0 {
+		return nil
+	}
+	if p.TopicName != "" {
+		ta[alias] = p.TopicName
+		return nil
+	}
+	topic, ok := ta[alias]
+	if !ok {
+		return errUnknownTopicAlias
+	}
+	p.TopicName = topic
+	return nil
+}
+
+// connTLSInfo returns the TLSInfo of the client connection,
+// nil if it is not a TLS connection.
+func connTLSInfo(c net.Conn) *TLSInfo {
+	tc, ok := c.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	return NewTLSInfo(tc.ConnectionState())
+}
+
 // Stream starts proxy between client and broker.
+// The session is traced with a span per connection and a child span per packet.
 func Stream(ctx context.Context, in, out net.Conn, h Handler, ic Interceptor, cert x509.Certificate) error {
+	return StreamConfig(ctx, in, out, h, ic, cert, Config{})
+}
+
+// StreamConfig starts proxy between client and broker, like Stream,
+// with the session limits and hooks of the configuration.
+func StreamConfig(ctx context.Context, in, out net.Conn, h Handler, ic Interceptor, cert x509.Certificate, cfg Config) error {
+	return proxy(ctx, in, out, nil, h, ic, cert, cfg)
+}
+
+// StreamDial starts proxy between client and the broker connected by dial once
+// the client CONNECT is authorized. If dial fails, the CONNECT is rejected with
+// the Server unavailable reason code. The broker connection is closed when the
+// session ends.
+func StreamDial(ctx context.Context, in net.Conn, dial DialFunc, h Handler, ic Interceptor, cert x509.Certificate, cfg Config) error {
+	return proxy(ctx, in, nil, dial, h, ic, cert, cfg)
+}
+
+func proxy(ctx context.Context, in, out net.Conn, dial DialFunc, h Handler, ic Interceptor, cert x509.Certificate, cfg Config) (err error) {
+	cred, err := unixsock.PeerCredentials(in)
+	if err != nil {
+		return err
+	}
 	s := Session{
-		Cert: cert,
+		Cert:            cert,
+		ConnID:          uuid.NewString(),
+		Listener:        cfg.Listener,
+		Transport:       cfg.Transport,
+		RemoteAddr:      in.RemoteAddr(),
+		LocalAddr:       in.LocalAddr(),
+		TLS:             connTLSInfo(in),
+		PeerCredentials: cred,
 	}
 	ctx = NewContext(ctx, &s)
+	h = Instrument(h, cfg.Metrics)
+
+	ctx, span := tracing.Tracer().Start(ctx, "mqtt.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("mproxy.listener", cfg.Listener),
+			attribute.String("mproxy.conn_id", s.ConnID),
+			attribute.String("net.peer.addr", addr(in.RemoteAddr())),
+		))
+	defer func() {
+		span.SetAttributes(
+			attribute.String("mqtt.client_id", s.ID),
+			attribute.String("mqtt.username", s.Username),
+		)
+		tracing.End(span, err)
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	in = withWriteTimeout(in, cfg.WriteTimeout)
+
+	st := newState(ctx, cfg, in, dial, ic, cancel)
+	if cfg.Registry != nil {
+		st.entry = newEntry(&s, st)
+		cfg.Registry.add(st.entry)
+		defer cfg.Registry.remove(st.entry)
+	}
+	cfg.Tracker.add(st)
+	defer cfg.Tracker.remove(st)
 
 	g, ctx := errgroup.WithContext(ctx)
+	st.forward = func(out *bufferedConn) {
+		g.Go(func() error {
+			return stream(ctx, Down, out, h, ic, st)
+		})
+	}
+	if out != nil {
+		if err := st.attach(withWriteTimeout(out, cfg.WriteTimeout)); err != nil {
+			return err
+		}
+	}
 
 	g.Go(func() error {
-		return stream(ctx, Up, in, out, h, ic)
+		return stream(ctx, Up, st.in, h, ic, st)
 	})
 
+	// Unblock the reads of the other direction once one of them ends,
+	// so that a rejected client does not wait for the broker and vice versa.
 	g.Go(func() error {
-		return stream(ctx, Down, out, in, h, ic)
+		<-ctx.Done()
+		now := time.Now()
+		err := in.SetReadDeadline(now)
+		if out := st.end(); out != nil {
+			err = errors.Join(err, out.SetReadDeadline(now))
+		}
+		return err
 	})
 
-	err := g.Wait()
+	err = g.Wait()
+	// Deliver the replies written right before the session ended, such as
+	// rejections. The connections may be broken, so the error is ignored.
+	_ = st.flush()
+	cfg.RateLimiter.Release(st.bucket)
+	st.releaseIdentitySlot()
 
 	disconnectErr := h.Disconnect(ctx)
 
+	// The broker connections dialed by the session are closed by it.
+	if out := st.broker(); dial != nil && out != nil {
+		err = errors.Join(err, out.Close())
+	}
+
 	return errors.Join(err, disconnectErr)
 }
 
-func stream(ctx context.Context, dir Direction, r, w net.Conn, h Handler, ic Interceptor) error {
+func stream(ctx context.Context, dir Direction, r *bufferedConn, h Handler, ic Interceptor, st *state) error {
+	aliases := topicAliases{}
 	for {
 		select {
 		case <-ctx.Done():
@@ -61,53 +298,484 @@ func stream(ctx context.Context, dir Direction, r, w net.Conn, h Handler, ic Int
 		default:
 		}
 
-		// Read from one connection.
-		pkt, err := packets.ReadPacket(r)
-		if err != nil {
-			return wrap(ctx, err, dir)
+		// Packets forwarded in a row are flushed at once, before the read blocks.
+		if !r.pending() {
+			if err := st.flush(); err != nil {
+				return wrap(ctx, err, dir)
+			}
 		}
 
-		switch dir {
-		case Up:
-			if err = authorize(ctx, pkt, h); err != nil {
+		if dir == Up {
+			if err := r.SetReadDeadline(st.readDeadline()); err != nil {
 				return wrap(ctx, err, dir)
 			}
-		default:
-			if p, ok := pkt.(*packets.PublishPacket); ok {
-				topics := []string{p.TopicName}
-				if err = h.DownSubscribe(ctx, &topics); err != nil {
-					pkt = packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
-					if wErr := pkt.Write(w); wErr != nil {
-						err = errors.Join(err, wErr)
-					}
-					return wrap(ctx, err, dir)
-				}
+			// Deadline set on session end may have been overwritten.
+			if ctx.Err() != nil {
+				return nil
 			}
 		}
 
-		if ic != nil {
-			pkt, err = ic.Intercept(ctx, pkt, dir)
-			if err != nil {
-				return wrap(ctx, err, dir)
+		// Read from one connection.
+		pkt, err := st.read(r, dir)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Read was interrupted because the session is ending.
+				return nil
+			}
+			if dir == Up {
+				var netErr net.Error
+				switch {
+				case errors.Is(err, packets.ErrUnsupportedVersion):
+					err = errors.Join(err, st.rejectConnect(r, packets.V311, NewError(packets.UnsupportedProtocolVersion, err)))
+				case errors.As(err, &netErr) && netErr.Timeout():
+					err = st.timeout(r)
+				case errors.Is(err, packets.ErrPacketTooLarge):
+					err = st.rejectTooLarge(r, err)
+				}
 			}
+			return wrap(ctx, err, dir)
 		}
+		if v := packets.Version(pkt); v != 0 {
+			st.version.Store(uint32(v))
+		}
+		st.entry.count(dir, pkt.Header().Size())
+		st.cfg.Metrics.Packet(packets.PacketNames[pkt.Header().MessageType], dir.String(), pkt.Header().Size())
 
-		// Send to another.
-		if err := pkt.Write(w); err != nil {
+		if err := st.process(ctx, dir, pkt, r, h, ic, aliases); err != nil {
 			return wrap(ctx, err, dir)
 		}
+	}
+}
 
-		// Notify only for packets sent from client to broker (incoming packets).
-		if dir == Up {
-			if err := notify(ctx, pkt, h); err != nil {
-				return wrap(ctx, err, dir)
+// process handles a single packet read in the given direction and
+// forwards it, unless it is answered by mProxy on behalf of the broker.
+func (st *state) process(ctx context.Context, dir Direction, pkt packets.ControlPacket, r net.Conn, h Handler, ic Interceptor, aliases topicAliases) (err error) {
+	if raw, ok := pkt.(*packets.RawPacket); ok {
+		defer raw.Release()
+	}
+	fh := pkt.Header()
+	ctx, span := tracing.StartChild(ctx, spanNames[dir][fh.MessageType])
+	defer func() {
+		tracing.End(span, err)
+	}()
+	// Attributes are only built for sampled spans, to keep the untraced path cheap.
+	recording := span.IsRecording()
+	if recording {
+		span.SetAttributes(
+			attribute.String("mqtt.packet.type", packets.PacketNames[fh.MessageType]),
+			attribute.String("mqtt.direction", dir.String()),
+			attribute.Int("mqtt.packet.size", fh.Size()),
+		)
+	}
+	version := st.protocolVersion()
+
+	if p, ok := pkt.(*packets.PublishPacket); ok {
+		if err := aliases.resolve(p); err != nil {
+			return err
+		}
+		if recording {
+			span.SetAttributes(
+				attribute.String("mqtt.topic", p.TopicName),
+				attribute.Int("mqtt.qos", int(p.Qos)),
+			)
+		}
+	}
+
+	switch dir {
+	case Up:
+		forward, err := st.authorize(ctx, pkt, h, r)
+		if err != nil {
+			return err
+		}
+		if !forward {
+			if recording {
+				span.SetAttributes(attribute.Bool("mproxy.forwarded", false))
 			}
+			return nil
+		}
+	default:
+		switch p := pkt.(type) {
+		case *packets.ConnackPacket:
+			st.announceKeepAlive(p)
+			st.announceMaxPacketSize(p)
+		case *packets.SubackPacket:
+			st.restoreSuback(p)
+		}
+		if p, ok := pkt.(*packets.PublishPacket); ok {
+			topics := []string{p.TopicName}
+			pctx := withProperties(ctx, version, &p.Properties)
+			if err = h.DownSubscribe(pctx, &topics); err != nil {
+				pkt = packets.NewControlPacket(packets.Disconnect)
+				if wErr := pkt.Write(st.in, version); wErr != nil {
+					err = errors.Join(err, wErr)
+				}
+				return err
+			}
+			p.TopicName = topics[0]
+		}
+	}
+
+	if ic != nil {
+		_, icSpan := tracing.StartChild(ctx, "Interceptor.Intercept")
+		pkt, err = ic.Intercept(ctx, pkt, dir)
+		tracing.End(icSpan, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Send to another.
+	w := st.peer(dir)
+	if w == nil {
+		return errNotConnected
+	}
+	_, wSpan := tracing.StartChild(ctx, "mqtt.write", trace.WithSpanKind(trace.SpanKindClient))
+	err = pkt.Write(w, version)
+	tracing.End(wSpan, err)
+	if err != nil {
+		return err
+	}
+	st.trackFlow(dir, pkt, version)
+
+	// Notify only for packets sent from client to broker (incoming packets).
+	if dir == Up {
+		st.track(ctx, pkt)
+		if err := notify(ctx, pkt, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// track records the client packets forwarded to the broker in the registry.
+func (st *state) track(ctx context.Context, pkt packets.ControlPacket) {
+	switch p := pkt.(type) {
+	case *packets.ConnectPacket:
+		if s, ok := FromContext(ctx); ok {
+			st.entry.connected(*s)
+		}
+	case *packets.SubscribePacket:
+		st.entry.subscribed(p.Topics)
+	case *packets.UnsubscribePacket:
+		st.entry.unsubscribed(p.Topics)
+	}
+}
+
+// withProperties exposes the packet properties to the handlers of MQTT 5.0 sessions.
+// Missing properties are allocated so handlers can add new ones.
+func withProperties(ctx context.Context, version byte, props **packets.Properties) context.Context {
+	if version != packets.V5 {
+		return ctx
+	}
+	if *props == nil {
+		*props = &packets.Properties{}
+	}
+	return NewPropertiesContext(ctx, *props)
+}
+
+// read reads a packet from the given direction. The size of the client packets
+// is checked against the configured limits before the packet body is allocated.
+// Packets which are not inspected are read raw into a pooled buffer.
+func (st *state) read(r net.Conn, dir Direction) (packets.ControlPacket, error) {
+	fh, err := packets.ReadFixedHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if dir == Up {
+		if limit := st.cfg.maxPacketSize(fh.MessageType); limit > 0 && fh.Size() > limit {
+			return nil, fmt.Errorf("%w: %s of %d bytes exceeds %d bytes", packets.ErrPacketTooLarge, packets.PacketNames[fh.MessageType], fh.Size(), limit)
+		}
+	}
+	if !st.decodeAll && !inspected(fh.MessageType) {
+		raw, err := packets.ReadRaw(r, fh)
+		if err != nil {
+			return nil, err
+		}
+		return raw, nil
+	}
+	return packets.ReadBody(r, fh, st.protocolVersion())
+}
+
+// inspected reports whether packets of the given type are inspected by mProxy or
+// Handler. Other packets are forwarded raw, without being decoded and encoded again.
+func inspected(packetType byte) bool {
+	switch packetType {
+	case packets.Connect, packets.Connack, packets.Publish, packets.Subscribe, packets.Suback, packets.Unsubscribe:
+		return true
+	default:
+		return false
+	}
+}
+
+// flush writes the packets buffered for the client and the broker.
+func (st *state) flush() error {
+	err := st.in.Flush()
+	if out := st.broker(); out != nil {
+		err = errors.Join(err, out.Flush())
+	}
+	return err
+}
+
+// broker returns the broker connection, nil until the broker is connected.
+func (st *state) broker() *bufferedConn {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.out
+}
+
+// peer returns the connection the packets read in the given direction are
+// forwarded to, or nil if the broker is not connected yet.
+func (st *state) peer(dir Direction) net.Conn {
+	if dir == Down {
+		return st.in
+	}
+	if out := st.broker(); out != nil {
+		return out
+	}
+	return nil
+}
+
+// attach sets the broker connection and starts forwarding the packets the
+// broker sends. It fails if the session already ended.
+func (st *state) attach(out net.Conn) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ended {
+		return errSessionEnded
+	}
+	st.out = newBufferedConn(out)
+	st.forward(st.out)
+	return nil
+}
+
+// end marks the session as ended and returns the broker connection, if any.
+func (st *state) end() *bufferedConn {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.ended = true
+	return st.out
+}
+
+// dialBroker connects to the broker of the session once its CONNECT is
+// authorized, unless the broker connection was given to Stream.
+func (st *state) dialBroker(ctx context.Context, s *Session) error {
+	if st.dial == nil || st.broker() != nil {
+		return nil
+	}
+	ctx, span := tracing.StartChild(ctx, "mqtt.dial", trace.WithSpanKind(trace.SpanKindClient))
+	out, err := st.dial(ctx, s)
+	tracing.End(span, err)
+	if err != nil {
+		st.cfg.Metrics.DialFailed()
+		return NewError(packets.ServerUnavailable, err)
+	}
+	if err := st.attach(withWriteTimeout(out, st.cfg.WriteTimeout)); err != nil {
+		return errors.Join(err, out.Close())
+	}
+	return nil
+}
+
+// rejectTooLarge sends DISCONNECT with the Packet too large reason code to connected
+// MQTT 5.0 clients. Other clients, including the ones which sent too large CONNECT,
+// have their connection closed without a reply.
+func (st *state) rejectTooLarge(client net.Conn, err error) error {
+	version := st.protocolVersion()
+	if !st.connected.Load() || version != packets.V5 {
+		return err
+	}
+	disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	disconnect.ReasonCode = packets.PacketTooLarge
+	return errors.Join(err, disconnect.Write(client, version))
+}
+
+// connect clamps the keep alive of MQTT 5.0 client CONNECT to the configured
+// range and records the keep alive the client is expected to use. MQTT 5.0
+// clients are told to use the clamped one with the Server Keep Alive property
+// of CONNACK. MQTT 3.1.x clients cannot be told, so their keep alive is
+// forwarded unchanged, as the broker would otherwise drop the clients which
+// keep their own.
+func (st *state) connect(p *packets.ConnectPacket) {
+	if p.ProtocolVersion == packets.V5 {
+		if ka := st.cfg.clampKeepAlive(p.Keepalive); ka != p.Keepalive {
+			st.mu.Lock()
+			st.serverKeepAlive = &ka
+			st.mu.Unlock()
+			p.Keepalive = ka
+		}
+	}
+	st.keepAlive.Store(int64(time.Duration(p.Keepalive) * time.Second))
+	st.connected.Store(true)
+}
+
+// claimClientID records the client ID of the session in the registry and applies the
+// duplicate client ID policy if another session uses it. Rewritten client ID is set
+// to the session, so it is forwarded to the broker instead of the original one.
+func (st *state) claimClientID(s *Session) error {
+	if st.entry == nil {
+		return nil
+	}
+	return claimClientID(st.cfg, st.entry, s)
+}
+
+// claimClientID records the client ID of the session of the entry e, see state.claimClientID.
+func claimClientID(cfg Config, e *entry, s *Session) error {
+	if s.ID == "" {
+		return nil
+	}
+	policy := cfg.DuplicateClientIDPolicy
+	id, old, err := cfg.Registry.claim(e, s.ID, policy)
+	if old == nil {
+		return nil
+	}
+	cfg.Metrics.DuplicateClientID(policy.String())
+	cfg.logger().Warn("Duplicate client ID",
+		slog.String("client_id", s.ID),
+		slog.String("policy", policy.String()),
+		slog.String("session", e.id),
+		slog.String("other_session", old.id),
+		slog.String("listener", cfg.Listener))
+	switch policy {
+	case RejectDuplicateClientID:
+		return NewError(packets.ClientIdentifierNotValid, err)
+	case KickDuplicateClientID:
+		// The connection limit slot of the old session is released right away,
+		// as the old session only ends once its goroutines are done, so that
+		// it does not count against the session taking over.
+		old.st.releaseIdentitySlot()
+		if err := old.disconnect(packets.SessionTakenOver); err != nil {
+			cfg.logger().Warn("Failed to cleanly disconnect session", slog.String("session", old.id), slog.Any("error", err))
+		}
+	case RewriteDuplicateClientID:
+		s.ID = id
+	}
+	return nil
+}
+
+func (st *state) logger() *slog.Logger {
+	return st.cfg.logger()
+}
+
+// acquireIdentity counts the session against the connection limits of the client identity.
+func (st *state) acquireIdentity(s *Session) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.releaseIdentity != nil {
+		return nil
+	}
+	release, err := st.cfg.ConnLimiter.Identity(s.Username, s.ID)
+	if err != nil {
+		st.cfg.Metrics.Rejected(connlimit.Reason(err))
+		return NewError(packets.QuotaExceeded, err)
+	}
+	st.releaseIdentity = release
+	return nil
+}
+
+// releaseIdentitySlot releases the connection limit slot of the client identity, if any.
+func (st *state) releaseIdentitySlot() {
+	st.mu.Lock()
+	release := st.releaseIdentity
+	st.releaseIdentity = nil
+	st.mu.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
+// acquireBucket acquires the rate limit bucket of the client identity.
+func (st *state) acquireBucket(s *Session) {
+	limiter := st.cfg.RateLimiter
+	if limiter == nil || st.bucket != nil {
+		return
+	}
+	var identity string
+	switch limiter.Key() {
+	case ratelimit.Username:
+		identity = s.Username
+	case ratelimit.CertCN:
+		identity = s.Cert.Subject.CommonName
+	default:
+		identity = s.ID
+	}
+	st.bucket = limiter.Acquire(identity)
+}
+
+// announceKeepAlive adds the clamped keep alive to the broker CONNACK of MQTT 5.0
+// sessions. If the broker sets its own Server Keep Alive, the client uses that one.
+func (st *state) announceKeepAlive(p *packets.ConnackPacket) {
+	if st.protocolVersion() != packets.V5 {
+		return
+	}
+	if p.Properties != nil && p.Properties.ServerKeepAlive != nil {
+		st.keepAlive.Store(int64(time.Duration(*p.Properties.ServerKeepAlive) * time.Second))
+		return
+	}
+	st.mu.Lock()
+	ka := st.serverKeepAlive
+	st.mu.Unlock()
+	if ka == nil {
+		return
+	}
+	if p.Properties == nil {
+		p.Properties = &packets.Properties{}
+	}
+	p.Properties.ServerKeepAlive = ka
+}
+
+// announceMaxPacketSize tells MQTT 5.0 clients the maximum size of the packets
+// mProxy accepts with the Maximum Packet Size property of CONNACK, unless the
+// broker announces a smaller one.
+func (st *state) announceMaxPacketSize(p *packets.ConnackPacket) {
+	limit := st.cfg.MaxPacketSize
+	if st.protocolVersion() != packets.V5 || limit <= 0 {
+		return
+	}
+	if p.Properties == nil {
+		p.Properties = &packets.Properties{}
+	}
+	if p.Properties.MaximumPacketSize != nil && int64(*p.Properties.MaximumPacketSize) <= int64(limit) {
+		return
+	}
+	size := uint32(min(int64(limit), math.MaxUint32))
+	p.Properties.MaximumPacketSize = &size
+}
+
+// readDeadline returns the deadline of the next client read. The client has
+// ConnectTimeout to send CONNECT, and one and a half keep alive periods to
+// send any packet after that. Keep alive 0 turns the deadline off.
+func (st *state) readDeadline() time.Time {
+	if !st.connected.Load() {
+		if st.cfg.ConnectTimeout <= 0 {
+			return time.Time{}
 		}
-		
+		return time.Now().Add(st.cfg.ConnectTimeout)
+	}
+	ka := time.Duration(st.keepAlive.Load())
+	if ka <= 0 {
+		return time.Time{}
 	}
+	return time.Now().Add(ka * 3 / 2)
 }
 
-func authorize(ctx context.Context, pkt packets.ControlPacket, h Handler) error {
+// timeout returns the error of the expired client read deadline. MQTT 5.0 clients
+// which miss their keep alive receive DISCONNECT with the Keep Alive timeout reason code.
+func (st *state) timeout(client net.Conn) error {
+	if !st.connected.Load() {
+		return errConnectTimeout
+	}
+	version := st.protocolVersion()
+	if version != packets.V5 {
+		return errKeepAliveTimeout
+	}
+	disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	disconnect.ReasonCode = packets.KeepAliveTimeout
+	return errors.Join(errKeepAliveTimeout, disconnect.Write(client, version))
+}
+
+// authorize calls the authorization hooks for packets sent by the client.
+// Denied packets are answered on behalf of the broker by writing to client.
+// It returns false if the packet must not be forwarded to the broker.
+func (st *state) authorize(ctx context.Context, pkt packets.ControlPacket, h Handler, client net.Conn) (bool, error) {
 	switch p := pkt.(type) {
 	case *packets.ConnectPacket:
 		s, ok := FromContext(ctx)
@@ -115,42 +783,416 @@ func authorize(ctx context.Context, pkt packets.ControlPacket, h Handler) error
 			s.ID = p.ClientIdentifier
 			s.Username = p.Username
 			s.Password = p.Password
+			s.ProtocolVersion = p.ProtocolVersion
 		}
 
-		ctx = NewContext(ctx, s)
+		ctx = withProperties(NewContext(ctx, s), p.ProtocolVersion, &p.Properties)
 		if err := h.AuthConnect(ctx); err != nil {
-			return err
+			return false, errors.Join(err, st.rejectConnect(client, p.ProtocolVersion, err))
+		}
+		if err := st.claimClientID(s); err != nil {
+			return false, errors.Join(err, st.rejectConnect(client, p.ProtocolVersion, err))
+		}
+		if err := st.acquireIdentity(s); err != nil {
+			return false, errors.Join(err, st.rejectConnect(client, p.ProtocolVersion, err))
 		}
 		// Copy back to the packet in case values are changed by Event handler.
 		// This is specific to CONN, as only that package type has credentials.
 		p.ClientIdentifier = s.ID
 		p.Username = s.Username
+		p.UsernameFlag = s.Username != ""
 		p.Password = s.Password
-		return nil
+		p.PasswordFlag = len(s.Password) > 0
+		if err := st.dialBroker(ctx, s); err != nil {
+			return false, errors.Join(err, st.rejectConnect(client, p.ProtocolVersion, err))
+		}
+		st.connect(p)
+		st.acquireBucket(s)
+		return true, nil
 	case *packets.PublishPacket:
-		return h.AuthPublish(ctx, &p.TopicName, &p.Payload)
+		if forward, err := st.limitPublish(ctx, client, p); !forward || err != nil {
+			return false, err
+		}
+		ctx = withProperties(ctx, sessionVersion(ctx), &p.Properties)
+		if err := h.AuthPublish(ctx, &p.TopicName, &p.Payload); err != nil {
+			return false, st.rejectPublish(client, p, err)
+		}
+		return true, nil
 	case *packets.SubscribePacket:
-		return h.AuthSubscribe(ctx, &p.Topics)
+		if limit := st.cfg.MaxSubscribeTopics; limit > 0 && len(p.Topics) > limit {
+			return false, st.rejectSubscribe(client, p, NewError(packets.QuotaExceeded, errTooManyTopics))
+		}
+		ctx = withProperties(ctx, sessionVersion(ctx), &p.Properties)
+		return st.authorizeSubscribe(ctx, p, h, client)
+	default:
+		if pkt.Header().MessageType == packets.Pubrel {
+			id, _, _ := ack(pkt, st.protocolVersion())
+			return st.releaseDropped(client, id)
+		}
+		return true, nil
+	}
+}
+
+// authorizeSubscribe calls AuthSubscribe once with all the topics of the SUBSCRIBE packet.
+// If the handler denies topics individually with TopicErrors, only allowed topics are
+// forwarded. If all topics are denied, mProxy replies with SUBACK.
+func (st *state) authorizeSubscribe(ctx context.Context, p *packets.SubscribePacket, h Handler, client net.Conn) (bool, error) {
+	topics := slices.Clone(p.Topics)
+	err := h.AuthSubscribe(ctx, &topics)
+	var topicErrs TopicErrors
+	switch {
+	case errors.As(err, &topicErrs) && len(topicErrs) == len(p.Topics) && len(topics) == len(p.Topics):
+		return st.authorizeTopics(p, topics, topicErrs, client)
+	case err != nil:
+		return false, st.rejectSubscribe(client, p, err)
+	case len(topics) != len(p.Topics):
+		return st.filterTopics(p, topics, client)
+	}
+	p.Topics = topics
+	return true, nil
+}
+
+// filterTopics forwards the topics of a SUBSCRIBE whose topics AuthSubscribe removed
+// or added. As they can no longer be matched by position, the topics kept are matched
+// with the original ones by value, and the removed ones are denied with Not authorized.
+// Added topics are forwarded with the options of the kept topic they follow, or of the
+// first kept topic, and are dropped if AuthSubscribe kept none of the original topics.
+func (st *state) filterTopics(p *packets.SubscribePacket, topics []string, client net.Conn) (bool, error) {
+	kept := make([]bool, len(p.Topics))
+	// added holds the topics added after each kept topic, by its index.
+	added := make(map[int][]string)
+	last := -1
+	for _, topic := range topics {
+		i := -1
+		for j, t := range p.Topics {
+			if t == topic && !kept[j] {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			added[last] = append(added[last], topic)
+			continue
+		}
+		kept[i] = true
+		last = i
+	}
+
+	version := st.protocolVersion()
+	sub := subscription{
+		codes:  make([]byte, len(p.Topics)),
+		counts: make([]int, len(p.Topics)),
+	}
+	var (
+		allowed []string
+		options []byte
+	)
+	for i, topic := range p.Topics {
+		if !kept[i] {
+			sub.codes[i] = subackCode(ErrNotAuthorized, version)
+			continue
+		}
+		forward := append([]string{topic}, added[i]...)
+		if len(allowed) == 0 {
+			forward = append(forward, added[-1]...)
+		}
+		// The broker SUBACK code of the topic is the one of its first forwarded topic.
+		sub.counts[i] = len(forward)
+		for _, t := range forward {
+			allowed = append(allowed, t)
+			options = append(options, p.Options[i])
+		}
+	}
+	if len(allowed) == 0 {
+		return false, st.writeSuback(client, p.MessageID, sub.codes)
+	}
+	p.Topics = allowed
+	p.Options = options
+	st.mu.Lock()
+	st.subscriptions[p.MessageID] = sub
+	st.mu.Unlock()
+	return true, nil
+}
+
+// authorizeTopics forwards the topics allowed by AuthSubscribe and
+// keeps the failure codes of denied ones for the broker SUBACK.
+func (st *state) authorizeTopics(p *packets.SubscribePacket, topics []string, errs TopicErrors, client net.Conn) (bool, error) {
+	version := st.protocolVersion()
+	sub := subscription{
+		codes:  make([]byte, len(p.Topics)),
+		counts: make([]int, len(p.Topics)),
+	}
+	var (
+		allowed []string
+		options []byte
+	)
+	for i, err := range errs {
+		if err != nil {
+			sub.codes[i] = subackCode(err, version)
+			continue
+		}
+		sub.counts[i] = 1
+		allowed = append(allowed, topics[i])
+		options = append(options, p.Options[i])
+	}
+	if len(allowed) == 0 {
+		return false, st.writeSuback(client, p.MessageID, sub.codes)
+	}
+	p.Topics = allowed
+	p.Options = options
+	if len(allowed) < len(errs) {
+		st.mu.Lock()
+		st.subscriptions[p.MessageID] = sub
+		st.mu.Unlock()
+	}
+	return true, nil
+}
+
+// rejectSubscribe replies to the client with a SUBACK denying all the topics with
+// the failure code selected by err. The SUBSCRIBE is not forwarded to the broker.
+func (st *state) rejectSubscribe(client net.Conn, p *packets.SubscribePacket, err error) error {
+	codes := make([]byte, len(p.Topics))
+	for i := range codes {
+		codes[i] = subackCode(err, st.protocolVersion())
+	}
+	return st.writeSuback(client, p.MessageID, codes)
+}
+
+func (st *state) writeSuback(client net.Conn, id uint16, codes []byte) error {
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = id
+	suback.ReturnCodes = codes
+	return suback.Write(client, st.protocolVersion())
+}
+
+// restoreSuback adds the failure codes of denied topics to the broker SUBACK,
+// so the client receives a return code for each topic it subscribed to.
+func (st *state) restoreSuback(p *packets.SubackPacket) {
+	st.mu.Lock()
+	sub, ok := st.subscriptions[p.MessageID]
+	delete(st.subscriptions, p.MessageID)
+	st.mu.Unlock()
+	if !ok {
+		return
+	}
+	codes := make([]byte, len(sub.counts))
+	next := 0
+	for i, n := range sub.counts {
+		if n == 0 || next >= len(p.ReturnCodes) {
+			codes[i] = sub.codes[i]
+			continue
+		}
+		codes[i] = p.ReturnCodes[next]
+		next += n
+	}
+	p.ReturnCodes = codes
+}
+
+// rejectConnect replies to the client with a CONNACK carrying the return code selected by err.
+func (st *state) rejectConnect(client net.Conn, version byte, err error) error {
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connackCode(err, version)
+	return connack.Write(client, version)
+}
+
+// rejectPublish applies the publish deny policy. With the drop policy the PUBLISH is
+// acknowledged to the client and nil is returned, so the session continues.
+func (st *state) rejectPublish(client net.Conn, p *packets.PublishPacket, err error) error {
+	if st.cfg.PublishDenyPolicy == DisconnectOnDeny {
+		return st.disconnectClient(client, err)
+	}
+	return st.dropPublish(client, p, err)
+}
+
+// disconnectClient sends DISCONNECT with the reason code selected by err to MQTT 5.0
+// clients and returns err, so that the session ends.
+func (st *state) disconnectClient(client net.Conn, err error) error {
+	version := st.protocolVersion()
+	if version == packets.V5 {
+		disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+		disconnect.ReasonCode = reasonCode(err)
+		err = errors.Join(err, disconnect.Write(client, version))
+	}
+	return err
+}
+
+// disconnect ends the session cleanly: the broker receives a DISCONNECT
+// as if sent by the client, so the will message is not published, and
+// MQTT 5.0 clients receive a DISCONNECT with the given reason code.
+func (st *state) disconnect(code byte) error {
+	version := st.protocolVersion()
+	var err error
+	if out := st.broker(); out != nil {
+		err = packets.NewControlPacket(packets.Disconnect).Write(out, version)
+	}
+	if version == packets.V5 {
+		d := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+		d.ReasonCode = code
+		err = errors.Join(err, d.Write(st.in, version))
+	}
+	err = errors.Join(err, st.flush())
+	st.cancel()
+	return err
+}
+
+// dropPublish acknowledges the dropped PUBLISH to the client, so that QoS 1 and 2
+// messages are not retried. MQTT 5.0 acknowledgments carry the reason code selected by err.
+func (st *state) dropPublish(client net.Conn, p *packets.PublishPacket, err error) error {
+	version := st.protocolVersion()
+	switch p.Qos {
+	case 1:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		if version == packets.V5 {
+			puback.ReasonCode = reasonCode(err)
+		}
+		return puback.Write(client, version)
+	case 2:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.MessageID
+		if version == packets.V5 {
+			// Failure reason code in PUBREC ends the MQTT 5.0 QoS 2 flow.
+			pubrec.ReasonCode = reasonCode(err)
+			return pubrec.Write(client, version)
+		}
+		st.mu.Lock()
+		st.dropped[p.MessageID] = struct{}{}
+		st.mu.Unlock()
+		return pubrec.Write(client, version)
 	default:
 		return nil
 	}
 }
 
+// limitPublish applies the rate limits of the client to the PUBLISH.
+// It returns false if the PUBLISH must not be forwarded.
+func (st *state) limitPublish(ctx context.Context, client net.Conn, p *packets.PublishPacket) (bool, error) {
+	if st.bucket == nil {
+		return true, nil
+	}
+	size := len(p.Payload)
+	action := st.cfg.RateLimiter.Action()
+	if action == ratelimit.Delay {
+		// A session ending while the PUBLISH waits must not forward it over the limits.
+		if err := st.bucket.Wait(ctx, size); err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	if st.bucket.Allow(size) {
+		return true, nil
+	}
+	err := NewError(packets.MessageRateTooHigh, errRateLimited)
+	if action == ratelimit.Drop {
+		return false, st.dropPublish(client, p, err)
+	}
+	return false, st.disconnectClient(client, err)
+}
+
+// releaseDropped completes the QoS 2 flow of dropped PUBLISH packets by replying
+// with PUBCOMP to their PUBREL. It returns false if the PUBREL must not be forwarded.
+func (st *state) releaseDropped(client net.Conn, id uint16) (bool, error) {
+	st.mu.Lock()
+	_, ok := st.dropped[id]
+	delete(st.dropped, id)
+	st.mu.Unlock()
+	if !ok {
+		return true, nil
+	}
+	pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = id
+	return false, pubcomp.Write(client, st.protocolVersion())
+}
+
 func notify(ctx context.Context, pkt packets.ControlPacket, h Handler) error {
 	switch p := pkt.(type) {
 	case *packets.ConnectPacket:
 		return h.Connect(ctx)
 	case *packets.PublishPacket:
+		ctx = withProperties(ctx, sessionVersion(ctx), &p.Properties)
 		return h.Publish(ctx, &p.TopicName, &p.Payload)
 	case *packets.SubscribePacket:
+		ctx = withProperties(ctx, sessionVersion(ctx), &p.Properties)
 		return h.Subscribe(ctx, &p.Topics)
 	case *packets.UnsubscribePacket:
+		ctx = withProperties(ctx, sessionVersion(ctx), &p.Properties)
 		return h.Unsubscribe(ctx, &p.Topics)
 	default:
 		return nil
 	}
 }
 
+// writeTimeoutConn sets the write deadline before each write, so
+// that a peer which stopped reading does not block the session.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func withWriteTimeout(c net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return c
+	}
+	return writeTimeoutConn{Conn: c, timeout: timeout}
+}
+
+func (c writeTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func addr(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+// ack returns the packet ID and the reason code of PUBACK, PUBREC, PUBREL and
+// PUBCOMP packets, decoded or raw. It returns false for other packets.
+func ack(pkt packets.ControlPacket, version byte) (uint16, byte, bool) {
+	switch p := pkt.(type) {
+	case *packets.PubackPacket:
+		return p.MessageID, p.ReasonCode, true
+	case *packets.PubrecPacket:
+		return p.MessageID, p.ReasonCode, true
+	case *packets.PubrelPacket:
+		return p.MessageID, p.ReasonCode, true
+	case *packets.PubcompPacket:
+		return p.MessageID, p.ReasonCode, true
+	case *packets.RawPacket:
+		switch p.MessageType {
+		case packets.Puback, packets.Pubrec, packets.Pubrel, packets.Pubcomp:
+			return p.MessageID(), p.ReasonCode(version), true
+		}
+	}
+	return 0, 0, false
+}
+
+// spanNames holds the names of the packet spans by direction and packet type,
+// so that they are not built for each packet.
+var spanNames = func() [2][16]string {
+	var names [2][16]string
+	for _, dir := range []Direction{Up, Down} {
+		for t, name := range packets.PacketNames {
+			names[dir][t] = "mqtt." + name + " " + dir.String()
+		}
+	}
+	return names
+}()
+
+func sessionVersion(ctx context.Context) byte {
+	if s, ok := FromContext(ctx); ok {
+		return s.ProtocolVersion
+	}
+	return 0
+}
+
 func wrap(ctx context.Context, err error, dir Direction) error {
 	if err == io.EOF {
 		return err
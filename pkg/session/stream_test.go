@@ -0,0 +1,460 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/ratelimit"
+)
+
+// testTimeout limits each step of the tests, so that a stuck session fails the test.
+const testTimeout = 5 * time.Second
+
+// allowHandler authorizes everything and lets the tests hook into the calls.
+type allowHandler struct {
+	authConnect   func(ctx context.Context) error
+	authSubscribe func(ctx context.Context, topics *[]string) error
+}
+
+func (h allowHandler) AuthConnect(ctx context.Context) error {
+	if h.authConnect != nil {
+		return h.authConnect(ctx)
+	}
+	return nil
+}
+
+func (h allowHandler) AuthPublish(context.Context, *string, *[]byte) error { return nil }
+
+func (h allowHandler) AuthSubscribe(ctx context.Context, topics *[]string) error {
+	if h.authSubscribe != nil {
+		return h.authSubscribe(ctx, topics)
+	}
+	return nil
+}
+
+func (allowHandler) DownSubscribe(context.Context, *[]string) error  { return nil }
+func (allowHandler) Connect(context.Context) error                   { return nil }
+func (allowHandler) Publish(context.Context, *string, *[]byte) error { return nil }
+func (allowHandler) Subscribe(context.Context, *[]string) error      { return nil }
+func (allowHandler) Unsubscribe(context.Context, *[]string) error    { return nil }
+func (allowHandler) Disconnect(context.Context) error                { return nil }
+
+// pipe is a session streamed between in-memory client and broker connections.
+type pipe struct {
+	t      *testing.T
+	client net.Conn
+	broker net.Conn
+	done   chan error
+	// cancel ends the session.
+	cancel context.CancelFunc
+}
+
+// newPipe streams a session with the handler and configuration, which ends with the test.
+func newPipe(t *testing.T, h Handler, cfg Config) *pipe {
+	t.Helper()
+	client, in := net.Pipe()
+	out, broker := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pipe{t: t, client: client, broker: broker, done: make(chan error, 1), cancel: cancel}
+	go func() {
+		p.done <- StreamConfig(ctx, in, out, h, nil, x509.Certificate{}, cfg)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		broker.Close()
+		select {
+		case <-p.done:
+		case <-time.After(testTimeout):
+			t.Error("session did not end")
+		}
+	})
+	return p
+}
+
+// send writes the packet to the connection in the background, as the pipes
+// block until the other side reads.
+func (p *pipe) send(c net.Conn, pkt packets.ControlPacket, version byte) {
+	go func() {
+		_ = c.SetWriteDeadline(time.Now().Add(testTimeout))
+		if err := pkt.Write(c, version); err != nil {
+			p.t.Logf("write %s: %v", pkt, err)
+		}
+	}()
+}
+
+// read reads the next packet from the connection.
+func (p *pipe) read(c net.Conn, version byte) packets.ControlPacket {
+	p.t.Helper()
+	if err := c.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		p.t.Fatal(err)
+	}
+	pkt, err := packets.ReadPacket(c, version)
+	if err != nil {
+		p.t.Fatalf("read: %v", err)
+	}
+	return pkt
+}
+
+// connect sends the client CONNECT and returns it as the broker received it,
+// answering it with the CONNACK, which is returned as the client received it.
+func (p *pipe) connect(connect *packets.ConnectPacket, connack *packets.ConnackPacket) (*packets.ConnectPacket, *packets.ConnackPacket) {
+	p.t.Helper()
+	version := connect.ProtocolVersion
+	p.send(p.client, connect, version)
+	got, ok := p.read(p.broker, version).(*packets.ConnectPacket)
+	if !ok {
+		p.t.Fatal("broker did not receive CONNECT")
+	}
+	p.send(p.broker, connack, version)
+	ack, ok := p.read(p.client, version).(*packets.ConnackPacket)
+	if !ok {
+		p.t.Fatal("client did not receive CONNACK")
+	}
+	return got, ack
+}
+
+func newConnect(version byte, clientID string, keepAlive uint16) *packets.ConnectPacket {
+	c := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	c.ProtocolName = "MQTT"
+	c.ProtocolVersion = version
+	c.CleanSession = true
+	c.ClientIdentifier = clientID
+	c.Keepalive = keepAlive
+	return c
+}
+
+func newConnack() *packets.ConnackPacket {
+	return packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+}
+
+func TestKeepAlive(t *testing.T) {
+	cfg := Config{MinKeepAlive: 30 * time.Second, MaxKeepAlive: 5 * time.Minute}
+	cases := []struct {
+		desc    string
+		version byte
+		client  uint16
+		broker  uint16
+		server  *uint16
+	}{
+		{desc: "3.1.1 above maximum", version: packets.V311, client: 600, broker: 600},
+		{desc: "3.1.1 off", version: packets.V311, client: 0, broker: 0},
+		{desc: "3.1.1 below minimum", version: packets.V311, client: 10, broker: 10},
+		{desc: "3.1.1 in range", version: packets.V311, client: 60, broker: 60},
+		{desc: "5.0 above maximum", version: packets.V5, client: 600, broker: 300, server: ptr[uint16](300)},
+		{desc: "5.0 off", version: packets.V5, client: 0, broker: 300, server: ptr[uint16](300)},
+		{desc: "5.0 below minimum", version: packets.V5, client: 10, broker: 30, server: ptr[uint16](30)},
+		{desc: "5.0 in range", version: packets.V5, client: 60, broker: 60},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := newPipe(t, allowHandler{}, cfg)
+			got, ack := p.connect(newConnect(tc.version, "client", tc.client), newConnack())
+			if got.Keepalive != tc.broker {
+				t.Errorf("broker keep alive = %d, want %d", got.Keepalive, tc.broker)
+			}
+			var server *uint16
+			if ack.Properties != nil {
+				server = ack.Properties.ServerKeepAlive
+			}
+			switch {
+			case tc.server == nil && server != nil:
+				t.Errorf("server keep alive = %d, want none", *server)
+			case tc.server != nil && server == nil:
+				t.Errorf("server keep alive not set, want %d", *tc.server)
+			case tc.server != nil && *server != *tc.server:
+				t.Errorf("server keep alive = %d, want %d", *server, *tc.server)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestKickDuplicateClientIDWithIdentityLimit(t *testing.T) {
+	cfg := Config{
+		Registry:                NewRegistry(),
+		DuplicateClientIDPolicy: KickDuplicateClientID,
+		ConnLimiter:             connlimit.New(connlimit.Config{MaxConnectionsPerClientID: 1}),
+	}
+	old := newPipe(t, allowHandler{}, cfg)
+	if _, ack := old.connect(newConnect(packets.V5, "device", 60), newConnack()); ack.ReturnCode != packets.Success {
+		t.Fatalf("first session CONNACK = %#x, want success", ack.ReturnCode)
+	}
+
+	// The old session is disconnected while the new one connects.
+	kicked := make(chan byte, 1)
+	go func() {
+		for {
+			pkt, err := packets.ReadPacket(old.client, packets.V5)
+			if err != nil {
+				close(kicked)
+				return
+			}
+			if d, ok := pkt.(*packets.DisconnectPacket); ok {
+				kicked <- d.ReasonCode
+				return
+			}
+		}
+	}()
+	go func() {
+		// The broker of the old session receives its DISCONNECT.
+		_, _ = packets.ReadPacket(old.broker, packets.V5)
+	}()
+
+	taking := newPipe(t, allowHandler{}, cfg)
+	if _, ack := taking.connect(newConnect(packets.V5, "device", 60), newConnack()); ack.ReturnCode != packets.Success {
+		t.Fatalf("session taking over CONNACK = %#x, want success", ack.ReturnCode)
+	}
+	select {
+	case code, ok := <-kicked:
+		if !ok || code != packets.SessionTakenOver {
+			t.Errorf("old session DISCONNECT = %#x, want %#x", code, packets.SessionTakenOver)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("old session was not disconnected")
+	}
+
+	// The slot of the old session is not released twice once it ends,
+	// so a third session is still limited.
+	select {
+	case <-old.done:
+	case <-time.After(testTimeout):
+		t.Fatal("old session did not end")
+	}
+	old.done <- nil
+	if _, err := cfg.ConnLimiter.Identity("", "device"); err == nil {
+		t.Error("identity limit released twice")
+	}
+}
+
+func TestAuthSubscribe(t *testing.T) {
+	cases := []struct {
+		desc     string
+		version  byte
+		auth     func(topics *[]string) error
+		forward  []string
+		options  []byte
+		granted  []byte
+		suback   []byte
+		rejected bool
+	}{
+		{
+			desc:    "rewrite topics",
+			version: packets.V5,
+			auth: func(topics *[]string) error {
+				for i, t := range *topics {
+					(*topics)[i] = "x/" + t
+				}
+				return nil
+			},
+			forward: []string{"x/a", "x/b", "x/c"},
+			options: []byte{0, 1, 2},
+			granted: []byte{0, 1, 2},
+			suback:  []byte{0, 1, 2},
+		},
+		{
+			desc:    "deny topics individually",
+			version: packets.V5,
+			auth: func(*[]string) error {
+				return TopicErrors{nil, ErrTopicFilterInvalid, nil}
+			},
+			forward: []string{"a", "c"},
+			options: []byte{0, 2},
+			granted: []byte{0, 2},
+			suback:  []byte{0, packets.TopicFilterInvalid, 2},
+		},
+		{
+			desc:    "deny topics individually 3.1.1",
+			version: packets.V311,
+			auth: func(*[]string) error {
+				return TopicErrors{ErrNotAuthorized, nil, nil}
+			},
+			forward: []string{"b", "c"},
+			options: []byte{1, 2},
+			granted: []byte{1, 2},
+			suback:  []byte{packets.SubackFailure, 1, 2},
+		},
+		{
+			desc:     "deny all topics individually",
+			version:  packets.V5,
+			auth:     func(*[]string) error { return TopicErrors{ErrNotAuthorized, ErrNotAuthorized, ErrQuotaExceeded} },
+			suback:   []byte{packets.NotAuthorized, packets.NotAuthorized, packets.QuotaExceeded},
+			rejected: true,
+		},
+		{
+			desc:     "deny",
+			version:  packets.V5,
+			auth:     func(*[]string) error { return ErrTopicFilterInvalid },
+			suback:   []byte{packets.TopicFilterInvalid, packets.TopicFilterInvalid, packets.TopicFilterInvalid},
+			rejected: true,
+		},
+		{
+			desc:    "remove all topics",
+			version: packets.V5,
+			auth: func(topics *[]string) error {
+				*topics = nil
+				return nil
+			},
+			suback:   []byte{packets.NotAuthorized, packets.NotAuthorized, packets.NotAuthorized},
+			rejected: true,
+		},
+		{
+			desc:    "remove all topics 3.1.1",
+			version: packets.V311,
+			auth: func(topics *[]string) error {
+				*topics = (*topics)[:0]
+				return nil
+			},
+			suback:   []byte{packets.SubackFailure, packets.SubackFailure, packets.SubackFailure},
+			rejected: true,
+		},
+		{
+			desc:    "remove a topic",
+			version: packets.V5,
+			auth: func(topics *[]string) error {
+				*topics = (*topics)[1:]
+				return nil
+			},
+			forward: []string{"b", "c"},
+			options: []byte{1, 2},
+			granted: []byte{1, 2},
+			suback:  []byte{packets.NotAuthorized, 1, 2},
+		},
+		{
+			desc:    "remove a topic 3.1.1",
+			version: packets.V311,
+			auth: func(topics *[]string) error {
+				*topics = []string{"c", "a"}
+				return nil
+			},
+			forward: []string{"a", "c"},
+			options: []byte{0, 2},
+			granted: []byte{0, packets.SubackFailure},
+			suback:  []byte{0, packets.SubackFailure, packets.SubackFailure},
+		},
+		{
+			desc:    "add a topic",
+			version: packets.V5,
+			auth: func(topics *[]string) error {
+				*topics = []string{"a", "b", "b/d", "c"}
+				return nil
+			},
+			forward: []string{"a", "b", "b/d", "c"},
+			options: []byte{0, 1, 1, 2},
+			granted: []byte{0, 1, packets.NotAuthorized, 2},
+			suback:  []byte{0, 1, 2},
+		},
+		{
+			desc:    "add a topic first and remove others",
+			version: packets.V5,
+			auth: func(topics *[]string) error {
+				*topics = []string{"z", "b"}
+				return nil
+			},
+			forward: []string{"b", "z"},
+			options: []byte{1, 1},
+			granted: []byte{1, 1},
+			suback:  []byte{packets.NotAuthorized, 1, packets.NotAuthorized},
+		},
+		{
+			desc:    "rewrite and remove topics",
+			version: packets.V5,
+			auth: func(topics *[]string) error {
+				*topics = []string{"x/a"}
+				return nil
+			},
+			suback:   []byte{packets.NotAuthorized, packets.NotAuthorized, packets.NotAuthorized},
+			rejected: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			calls := 0
+			h := allowHandler{authSubscribe: func(_ context.Context, topics *[]string) error {
+				calls++
+				return tc.auth(topics)
+			}}
+			p := newPipe(t, h, Config{})
+			p.connect(newConnect(tc.version, "client", 60), newConnack())
+
+			sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			sub.MessageID = 7
+			sub.Topics = []string{"a", "b", "c"}
+			sub.Options = []byte{0, 1, 2}
+			p.send(p.client, sub, tc.version)
+			if !tc.rejected {
+				got, ok := p.read(p.broker, tc.version).(*packets.SubscribePacket)
+				if !ok {
+					t.Fatal("broker did not receive SUBSCRIBE")
+				}
+				if !slices.Equal(got.Topics, tc.forward) || !slices.Equal(got.Options, tc.options) {
+					t.Errorf("forwarded %v %v, want %v %v", got.Topics, got.Options, tc.forward, tc.options)
+				}
+				ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+				ack.MessageID = got.MessageID
+				ack.ReturnCodes = tc.granted
+				p.send(p.broker, ack, tc.version)
+			}
+			ack, ok := p.read(p.client, tc.version).(*packets.SubackPacket)
+			if !ok {
+				t.Fatal("client did not receive SUBACK")
+			}
+			if ack.MessageID != sub.MessageID || !slices.Equal(ack.ReturnCodes, tc.suback) {
+				t.Errorf("SUBACK %d %v, want %d %v", ack.MessageID, ack.ReturnCodes, sub.MessageID, tc.suback)
+			}
+			if calls != 1 {
+				t.Errorf("AuthSubscribe called %d times, want once", calls)
+			}
+		})
+	}
+}
+
+func TestRateLimitDelayCancelled(t *testing.T) {
+	limiter, err := ratelimit.New(ratelimit.Config{Limit: ratelimit.Limit{PublishRate: 0.001, PublishBurst: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPipe(t, allowHandler{}, Config{RateLimiter: limiter})
+	p.connect(newConnect(packets.V311, "c1", 0), newConnack())
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "t"
+	p.send(p.client, pub, packets.V311)
+	if _, ok := p.read(p.broker, packets.V311).(*packets.PublishPacket); !ok {
+		t.Fatal("broker did not receive the first PUBLISH")
+	}
+	// The second PUBLISH waits for the tokens the first one took.
+	if err := p.client.SetWriteDeadline(time.Now().Add(testTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Write(p.client, packets.V311); err != nil {
+		t.Fatal(err)
+	}
+
+	// The PUBLISH waiting when the session ends is not forwarded.
+	p.cancel()
+	select {
+	case err := <-p.done:
+		p.done <- err
+	case <-time.After(testTimeout):
+		t.Fatal("session did not end")
+	}
+	if err := p.broker.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if pkt, err := packets.ReadPacket(p.broker, packets.V311); err == nil {
+		t.Errorf("broker received %s after the session ended", pkt)
+	}
+}
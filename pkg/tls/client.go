@@ -0,0 +1,110 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	errLoadTargetCerts = errors.New("failed to load target client certificates")
+	errLoadTargetCA    = errors.New("failed to load target CA")
+
+	// ErrInvalidVersion indicates an unknown TLS version value.
+	ErrInvalidVersion = errors.New("invalid TLS version")
+)
+
+// Version is a TLS protocol version, parsed from its number such as 1.2.
+type Version uint16
+
+// UnmarshalText parses the version from its number.
+func (v *Version) UnmarshalText(text []byte) error {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(string(text))), "tls") {
+	case "":
+		*v = 0
+	case "1.0":
+		*v = tls.VersionTLS10
+	case "1.1":
+		*v = tls.VersionTLS11
+	case "1.2":
+		*v = tls.VersionTLS12
+	case "1.3":
+		*v = tls.VersionTLS13
+	default:
+		return ErrInvalidVersion
+	}
+	return nil
+}
+
+// ClientConfig holds the TLS settings of the connections to the target broker.
+type ClientConfig struct {
+	// Enabled turns TLS on for MQTT targets with the system root CAs, even if
+	// no other setting is set. MQTT over WebSocket targets use TLS for wss URLs.
+	Enabled bool `env:"TARGET_TLS" envDefault:"false"`
+	// CAFile is the bundle of the CAs the target certificate is verified with,
+	// the system root CAs if not set.
+	CAFile string `env:"TARGET_TLS_CA_FILE" envDefault:""`
+	// CertFile and KeyFile are the client certificate for mTLS with the target.
+	CertFile string `env:"TARGET_TLS_CERT_FILE" envDefault:""`
+	KeyFile  string `env:"TARGET_TLS_KEY_FILE"  envDefault:""`
+	// ServerName overrides the name the target certificate is verified against,
+	// which defaults to the host of the target address.
+	ServerName string  `env:"TARGET_TLS_SERVER_NAME" envDefault:""`
+	MinVersion Version `env:"TARGET_TLS_MIN_VERSION" envDefault:"1.2"`
+	// InsecureSkipVerify turns off the verification of the target certificate.
+	// It is only meant for lab setups with self-signed certificates.
+	InsecureSkipVerify bool `env:"TARGET_TLS_INSECURE_SKIP_VERIFY" envDefault:"false"`
+}
+
+// NewClientConfig parses the target TLS settings from environment.
+func NewClientConfig(opts env.Options) (ClientConfig, error) {
+	c := ClientConfig{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return ClientConfig{}, err
+	}
+	return c, nil
+}
+
+func (c ClientConfig) configured() bool {
+	return c.Enabled || c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.InsecureSkipVerify
+}
+
+// LoadClient returns a TLS configuration that can be used to dial the target.
+// It returns nil if none of the settings is set, so the target is dialed without TLS.
+func LoadClient(c *ClientConfig) (*tls.Config, error) {
+	if !c.configured() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		MinVersion:         uint16(c.MinVersion),
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Join(errLoadTargetCerts, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	rootCA, err := loadCertFile(c.CAFile)
+	if err != nil {
+		return nil, errors.Join(errLoadTargetCA, err)
+	}
+	if len(rootCA) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(rootCA) {
+			return nil, errAppendCA
+		}
+	}
+	return tlsConfig, nil
+}
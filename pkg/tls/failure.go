@@ -0,0 +1,94 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// TLS handshake failure reasons.
+const (
+	FailureTimeout             = "timeout"
+	FailureEOF                 = "eof"
+	FailureNotTLS              = "not_tls"
+	FailureNoCertificate       = "no_certificate"
+	FailureUnknownAuthority    = "unknown_authority"
+	FailureInvalidCertificate  = "invalid_certificate"
+	FailureRevokedCertificate  = "revoked_certificate"
+	FailureUnsupportedProtocol = "unsupported_protocol"
+	FailureAlert               = "alert"
+	FailureOther               = "other"
+)
+
+// HandshakeFailure classifies TLS handshake error into a short reason
+// suitable for metric labels. Errors which lost their type, such as
+// the ones logged by http.Server, are classified by their message.
+func HandshakeFailure(err error) string {
+	var (
+		netErr       net.Error
+		unknownCA    x509.UnknownAuthorityError
+		invalidCert  x509.CertificateInvalidError
+		recordHeader tls.RecordHeaderError
+		alert        tls.AlertError
+	)
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return FailureEOF
+	case errors.As(err, &recordHeader):
+		return FailureNotTLS
+	case errors.As(err, &unknownCA):
+		return FailureUnknownAuthority
+	case errors.As(err, &invalidCert):
+		return FailureInvalidCertificate
+	case errors.As(err, &alert):
+		return FailureAlert
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "timeout"):
+		return FailureTimeout
+	case strings.HasSuffix(msg, "EOF"):
+		return FailureEOF
+	case strings.Contains(msg, "does not look like a TLS handshake"):
+		return FailureNotTLS
+	case strings.Contains(msg, "didn't provide a certificate"):
+		return FailureNoCertificate
+	case strings.Contains(msg, "unknown authority"), strings.Contains(msg, "unknown certificate authority"):
+		return FailureUnknownAuthority
+	case strings.Contains(msg, "revoked"):
+		return FailureRevokedCertificate
+	case strings.Contains(msg, "certificate"):
+		return FailureInvalidCertificate
+	case strings.Contains(msg, "protocol version"), strings.Contains(msg, "no cipher suite"), strings.Contains(msg, "no application protocol"):
+		return FailureUnsupportedProtocol
+	case strings.Contains(msg, "alert"):
+		return FailureAlert
+	default:
+		return FailureOther
+	}
+}
+
+// IsHandshakeError reports whether the http.Server error log message is about
+// a failed TLS handshake, and returns the error part of the message.
+func IsHandshakeError(msg string) (string, bool) {
+	const prefix = "TLS handshake error from "
+	i := strings.Index(msg, prefix)
+	if i < 0 {
+		return "", false
+	}
+	msg = msg[i+len(prefix):]
+	// Message is in the form "http: TLS handshake error from <addr>: <err>".
+	if j := strings.Index(msg, ": "); j >= 0 {
+		msg = msg[j+2:]
+	}
+	return strings.TrimSpace(msg), true
+}
@@ -0,0 +1,147 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tracing sets up OpenTelemetry tracing of mProxy.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/caarlos0/env/v11"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Name is the instrumentation name of the mProxy tracers.
+const Name = "github.com/absmach/mproxy"
+
+// Supported exporters.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// ErrUnknownExporter indicates an unsupported exporter value.
+var ErrUnknownExporter = errors.New("unknown trace exporter")
+
+// Config holds the tracing configuration.
+type Config struct {
+	// Exporter is one of none, stdout and otlp.
+	Exporter     string  `env:"EXPORTER"      envDefault:"none"`
+	OTLPEndpoint string  `env:"OTLP_ENDPOINT" envDefault:"localhost:4318"`
+	OTLPInsecure bool    `env:"OTLP_INSECURE" envDefault:"true"`
+	ServiceName  string  `env:"SERVICE_NAME"  envDefault:"mproxy"`
+	SampleRatio  float64 `env:"SAMPLE_RATIO"  envDefault:"1"`
+}
+
+// NewConfig parses the tracing configuration from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// NewProvider returns the tracer provider exporting spans with the configured
+// exporter, and the function which flushes and stops it. With the none exporter
+// the returned provider does not record spans.
+func NewProvider(ctx context.Context, cfg Config) (trace.TracerProvider, func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch strings.ToLower(strings.TrimSpace(cfg.Exporter)) {
+	case "", ExporterNone:
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, nil, ErrUnknownExporter
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	return tp, tp.Shutdown, nil
+}
+
+// Setup registers the tracer provider and the W3C trace context and baggage
+// propagators globally, so they are used by all the proxies.
+func Setup(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+// tracer delegates to the global tracer provider, including the one set after
+// it is created, so it is obtained once instead of for each span.
+var tracer = otel.Tracer(Name)
+
+// Tracer returns the mProxy tracer of the global tracer provider.
+func Tracer() trace.Tracer {
+	return tracer
+}
+
+// StartChild starts a span only if the span of ctx is recording, so that untraced
+// sessions do not allocate spans for each packet. Otherwise, it returns ctx and its
+// span, which ignores the calls, and the spans which would be its children are not
+// sampled either.
+func StartChild(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, parent
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// Extract returns the context carrying the trace context of the HTTP headers.
+func Extract(ctx context.Context, h map[string][]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// Inject adds the trace context of ctx to the HTTP headers.
+func Inject(ctx context.Context, h map[string][]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// End records err, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, io.EOF) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,13 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package unixsock
+
+import "net"
+
+// peerCredentials returns nil, SO_PEERCRED is only supported on Linux.
+func peerCredentials(*net.UnixConn) (*Credentials, error) {
+	return nil, nil
+}
@@ -0,0 +1,179 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package unixsock adds Unix domain sockets to the addresses of the listeners
+// and targets. Unix socket addresses are written as unix:///path/to/socket.
+package unixsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// Scheme is the prefix of Unix socket addresses.
+const Scheme = "unix://"
+
+var (
+	// ErrInvalidMode indicates a socket file mode which is not an octal permission.
+	ErrInvalidMode = errors.New("invalid socket mode")
+
+	// ErrSocketInUse indicates another process is listening on the socket.
+	ErrSocketInUse = errors.New("socket in use")
+
+	// ErrNotSocket indicates the socket path is taken by a file which is not a socket.
+	ErrNotSocket = errors.New("path exists and is not a socket")
+)
+
+// Mode is the permission bits of the socket file, parsed from octal.
+type Mode fs.FileMode
+
+// UnmarshalText parses the mode from its octal notation, such as 0660.
+func (m *Mode) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(strings.TrimSpace(string(text)), 8, 32)
+	if err != nil || v&^uint64(fs.ModePerm) != 0 {
+		return ErrInvalidMode
+	}
+	*m = Mode(v)
+	return nil
+}
+
+// Config holds the settings of the socket file of Unix socket listeners.
+type Config struct {
+	// Mode is the permission bits of the socket file. Clients need write
+	// permission on the socket to connect.
+	Mode Mode `env:"SOCKET_MODE" envDefault:"0660"`
+	// Group is the name or ID of the group owning the socket file,
+	// the group of the process if not set.
+	Group string `env:"SOCKET_GROUP" envDefault:""`
+}
+
+// NewConfig parses the socket settings from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Path returns the socket path of the address and whether it is a Unix socket address.
+func Path(addr string) (string, bool) {
+	return strings.CutPrefix(addr, Scheme)
+}
+
+// SplitURI splits the Unix socket address of an HTTP or WebSocket target into
+// the socket path and the request URI, separated by a colon as in
+// unix:///run/broker.sock:/mqtt. The URI is "/" if not set.
+func SplitURI(addr string) (path, uri string, ok bool) {
+	path, ok = Path(addr)
+	if !ok {
+		return "", "", false
+	}
+	if i := strings.Index(path, ":/"); i >= 0 {
+		return path[:i], path[i+1:], true
+	}
+	return path, "/", true
+}
+
+// Listen listens on the Unix socket of a Unix socket address, and on TCP
+// otherwise. A socket file left over by a process which is no longer running
+// is removed first. The socket file is given the mode and group of the
+// configuration, and is removed once the listener is closed.
+func Listen(addr string, config Config) (net.Listener, error) {
+	path, ok := Path(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := chown(path, config.Group); err != nil {
+		return nil, errors.Join(err, l.Close())
+	}
+	if err := os.Chmod(path, fs.FileMode(config.Mode)); err != nil {
+		return nil, errors.Join(err, l.Close())
+	}
+	return l, nil
+}
+
+// removeStale removes the socket file at path if no process accepts its connections.
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	case fi.Mode()&fs.ModeSocket == 0:
+		return fmt.Errorf("%w: %s", ErrNotSocket, path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%w: %s", ErrSocketInUse, path)
+	}
+	return os.Remove(path)
+}
+
+func chown(path, group string) error {
+	if group == "" {
+		return nil
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chown(path, -1, gid)
+}
+
+// Dial connects to the Unix socket of a Unix socket address, and over TCP otherwise.
+func Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if path, ok := Path(addr); ok {
+		return d.DialContext(ctx, "unix", path)
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Credentials are the credentials of the process connected to a Unix socket,
+// as reported by the kernel when it connected.
+type Credentials struct {
+	PID int32  `json:"pid"`
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+// PeerCredentials returns the credentials of the peer of the Unix socket
+// connection c is running over. Wrappers of the connection are unwrapped
+// with their NetConn method, as for tls.Conn. It returns nil if c is not
+// a Unix socket connection, or on platforms without SO_PEERCRED.
+func PeerCredentials(c net.Conn) (*Credentials, error) {
+	for {
+		switch conn := c.(type) {
+		case *net.UnixConn:
+			return peerCredentials(conn)
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil, nil
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+var (
+	errUnexpectedPacket  = errors.New("unexpected packet")
+	errServerUnavailable = errors.New("server unavailable")
+)
+
+// Run probes the health of the upstreams every health check interval until
+// ctx is done. Upstreams which fail the unhealthy threshold of probes in a row
+// are removed from the rotation, and are reinstated once they pass the healthy
+// threshold of probes in a row. Run returns right away if health checks are off.
+func (p *Pool) Run(ctx context.Context) {
+	if p.config.HealthCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check probes all the upstreams at once.
+func (p *Pool) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			err := p.probe(ctx, u.addr)
+			if ctx.Err() != nil {
+				return
+			}
+			p.report(u, err)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// probe connects to the upstream as an MQTT 3.1.1 client with a clean session.
+// Any CONNACK other than Server unavailable proves the broker is alive, even if
+// the probe is refused. Accepted probes also exchange PINGREQ and PINGRESP.
+func (p *Pool) probe(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.config.HealthCheckTimeout)
+	defer cancel()
+	conn, err := p.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = packets.V311
+	connect.CleanSession = true
+	connect.ClientIdentifier = clientID()
+	connect.Username = p.config.Username
+	connect.UsernameFlag = p.config.Username != ""
+	connect.Password = []byte(p.config.Password)
+	connect.PasswordFlag = p.config.Password != ""
+	if err := connect.Write(conn, packets.V311); err != nil {
+		return err
+	}
+	pkt, err := packets.ReadPacket(conn, packets.V311)
+	if err != nil {
+		return err
+	}
+	connack, ok := pkt.(*packets.ConnackPacket)
+	if !ok {
+		return fmt.Errorf("%w: %s instead of CONNACK", errUnexpectedPacket, packets.PacketNames[pkt.Header().MessageType])
+	}
+	switch connack.ReturnCode {
+	case packets.Accepted:
+	case packets.ErrRefusedServerUnavailable:
+		return errServerUnavailable
+	default:
+		return nil
+	}
+
+	if err := packets.NewControlPacket(packets.Pingreq).Write(conn, packets.V311); err != nil {
+		return err
+	}
+	pkt, err = packets.ReadPacket(conn, packets.V311)
+	if err != nil {
+		return err
+	}
+	if pkt.Header().MessageType != packets.Pingresp {
+		return fmt.Errorf("%w: %s instead of PINGRESP", errUnexpectedPacket, packets.PacketNames[pkt.Header().MessageType])
+	}
+	// The probe already succeeded, so failing to disconnect cleanly is ignored.
+	_ = packets.NewControlPacket(packets.Disconnect).Write(conn, packets.V311)
+	return nil
+}
+
+// report records the result of a probe and updates the health of the upstream
+// once the threshold of its outcome is reached.
+func (p *Pool) report(u *upstream, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		u.successes = 0
+		u.failures++
+		if u.healthy && u.failures >= p.config.UnhealthyThreshold {
+			u.healthy = false
+			p.logger.Warn("Upstream is unhealthy, removed from rotation", slog.String("upstream", u.addr), slog.Int("failures", u.failures), slog.Any("error", err))
+		}
+		return
+	}
+	u.failures = 0
+	u.successes++
+	if !u.healthy && u.successes >= p.config.HealthyThreshold {
+		u.healthy = true
+		p.logger.Info("Upstream is healthy, reinstated in rotation", slog.String("upstream", u.addr))
+	}
+}
+
+// clientID returns a random client ID, so that probes never take over the
+// session of a client or of each other.
+func clientID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "mproxy-health-" + hex.EncodeToString(b)
+}
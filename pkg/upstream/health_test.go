@@ -0,0 +1,194 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+)
+
+// probeResult is the answer of a fake broker to a health check probe.
+type probeResult int
+
+const (
+	accepted probeResult = iota
+	// refused answers CONNECT with a refusal which still proves the broker alive.
+	refused
+	unavailable
+	unreachable
+	noPingresp
+)
+
+// prober dials fake brokers answering the probes with the result of their upstream.
+type prober struct {
+	mu       sync.Mutex
+	results  map[string]probeResult
+	username string
+}
+
+func (p *prober) set(addr string, r probeResult) {
+	p.mu.Lock()
+	p.results[addr] = r
+	p.mu.Unlock()
+}
+
+func (p *prober) dial(_ context.Context, addr string) (net.Conn, error) {
+	p.mu.Lock()
+	r := p.results[addr]
+	p.mu.Unlock()
+	if r == unreachable {
+		return nil, errDial
+	}
+	c, broker := net.Pipe()
+	go func() {
+		defer broker.Close()
+		pkt, err := packets.ReadPacket(broker, packets.V311)
+		if err != nil {
+			return
+		}
+		connect, ok := pkt.(*packets.ConnectPacket)
+		if !ok {
+			return
+		}
+		p.mu.Lock()
+		p.username = connect.Username
+		p.mu.Unlock()
+		connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		switch r {
+		case refused:
+			connack.ReturnCode = packets.ErrRefusedBadUsernameOrPassword
+		case unavailable:
+			connack.ReturnCode = packets.ErrRefusedServerUnavailable
+		}
+		if err := connack.Write(broker, packets.V311); err != nil || r != accepted && r != noPingresp {
+			return
+		}
+		if _, err := packets.ReadPacket(broker, packets.V311); err != nil {
+			return
+		}
+		reply := packets.NewControlPacket(packets.Pingresp)
+		if r == noPingresp {
+			reply = packets.NewControlPacket(packets.Pingreq)
+		}
+		if err := reply.Write(broker, packets.V311); err != nil {
+			return
+		}
+		_, _ = packets.ReadPacket(broker, packets.V311)
+	}()
+	return c, nil
+}
+
+func TestProbe(t *testing.T) {
+	cases := []struct {
+		desc   string
+		result probeResult
+		err    error
+	}{
+		{desc: "accepted", result: accepted},
+		{desc: "refused", result: refused},
+		{desc: "server unavailable", result: unavailable, err: errServerUnavailable},
+		{desc: "unreachable", result: unreachable, err: errDial},
+		{desc: "no PINGRESP", result: noPingresp, err: errUnexpectedPacket},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			pr := &prober{results: map[string]probeResult{"a": tc.result}}
+			p := New([]string{"a"}, Config{HealthCheckTimeout: time.Second, Username: "probe"}, pr.dial, logger)
+			if err := p.probe(context.Background(), "a"); !errors.Is(err, tc.err) {
+				t.Errorf("probe() = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestHealthThresholds(t *testing.T) {
+	cases := []struct {
+		desc    string
+		results []probeResult
+		healthy []bool
+	}{
+		{
+			desc:    "failures below the threshold",
+			results: []probeResult{unreachable, accepted, unreachable, accepted},
+			healthy: []bool{true, true, true, true},
+		},
+		{
+			desc:    "removed after failures in a row",
+			results: []probeResult{unreachable, unavailable, unreachable},
+			healthy: []bool{true, false, false},
+		},
+		{
+			desc:    "reinstated after successes in a row",
+			results: []probeResult{unreachable, unreachable, accepted, unreachable, refused, accepted},
+			healthy: []bool{true, false, false, false, false, true},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			pr := &prober{results: map[string]probeResult{}}
+			cfg := Config{HealthCheckTimeout: time.Second, UnhealthyThreshold: 2, HealthyThreshold: 2}
+			p := New([]string{"a", "b"}, cfg, pr.dial, logger)
+			for i, r := range tc.results {
+				pr.set("a", r)
+				p.check(context.Background())
+				if got := p.upstreams[0].isHealthy(); got != tc.healthy[i] {
+					t.Errorf("probe %d: healthy = %t, want %t", i, got, tc.healthy[i])
+				}
+				// The other upstream is probed as well.
+				if !p.upstreams[1].isHealthy() {
+					t.Errorf("probe %d: healthy upstream removed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	pr := &prober{results: map[string]probeResult{"a": unreachable}}
+	cfg := Config{HealthCheckInterval: time.Millisecond, HealthCheckTimeout: time.Second, UnhealthyThreshold: 1, HealthyThreshold: 1, Username: "probe"}
+	p := New([]string{"a"}, cfg, pr.dial, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitHealthy := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for p.upstreams[0].isHealthy() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("upstream healthy = %t, want %t", !want, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitHealthy(false)
+	if _, err := p.Dial(ctx, ""); !errors.Is(err, ErrNoUpstream) {
+		t.Errorf("Dial() = %v, want %v", err, ErrNoUpstream)
+	}
+	// The upstream is reinstated once it answers the probes again.
+	pr.set("a", accepted)
+	waitHealthy(true)
+	pr.mu.Lock()
+	username := pr.username
+	pr.mu.Unlock()
+	if username != "probe" {
+		t.Errorf("probe username = %q, want probe", username)
+	}
+
+	// Run returns right away without health checks.
+	New([]string{"a"}, Config{}, pr.dial, logger).Run(context.Background())
+}
@@ -0,0 +1,273 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+var (
+	errNoBackends       = errors.New("route has no backends")
+	errNoTargets        = errors.New("backend has no targets")
+	errNegativeWeight   = errors.New("backend weight is negative")
+	errInvalidRouteFile = errors.New("invalid routes file")
+)
+
+// Pattern is a regular expression matched against the whole value.
+// The zero Pattern matches any value.
+type Pattern struct {
+	re *regexp.Regexp
+}
+
+// UnmarshalText compiles the pattern.
+func (p *Pattern) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		p.re = nil
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + string(text) + ")$")
+	if err != nil {
+		return err
+	}
+	p.re = re
+	return nil
+}
+
+func (p Pattern) set() bool {
+	return p.re != nil
+}
+
+// matchAny reports whether any of the values matches the pattern.
+func (p Pattern) matchAny(values ...string) bool {
+	for _, v := range values {
+		if p.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match selects the sessions of a route. All the patterns which are set must
+// match. Certificate fields with multiple values match if any of them does.
+type Match struct {
+	Username Pattern `json:"username"`
+	ClientID Pattern `json:"client_id"`
+	CertCN   Pattern `json:"cert_cn"`
+	CertOU   Pattern `json:"cert_ou"`
+	// CertSAN is matched against the DNS names, email addresses,
+	// URIs and IP addresses of the certificate.
+	CertSAN Pattern `json:"cert_san"`
+}
+
+func (m Match) matches(s *session.Session) bool {
+	switch {
+	case m.Username.set() && !m.Username.matchAny(s.Username):
+		return false
+	case m.ClientID.set() && !m.ClientID.matchAny(s.ID):
+		return false
+	case m.CertCN.set() && !m.CertCN.matchAny(s.Cert.Subject.CommonName):
+		return false
+	case m.CertOU.set() && !m.CertOU.matchAny(s.Cert.Subject.OrganizationalUnit...):
+		return false
+	case m.CertSAN.set() && !m.CertSAN.matchAny(sans(s.Cert)...):
+		return false
+	default:
+		return true
+	}
+}
+
+func sans(cert x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// Backend is a group of targets the sessions of a route are balanced between.
+type Backend struct {
+	Name    string   `json:"name"`
+	Targets []string `json:"targets"`
+	// Weight is the share of the sessions of the route the backend receives,
+	// so that a canary backend can be given a small part of them. If all the
+	// backends of the route have weight 0, the sessions are split evenly.
+	Weight int `json:"weight"`
+}
+
+// Route sends the sessions matching it to its backends.
+type Route struct {
+	Name     string    `json:"name"`
+	Match    Match     `json:"match"`
+	Backends []Backend `json:"backends"`
+}
+
+// Routes holds the routes of a listener, in the order they are matched.
+type Routes struct {
+	Routes []Route `json:"routes"`
+}
+
+// LoadRoutes reads the routes from the JSON file.
+func LoadRoutes(path string) ([]Route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Routes
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, errors.Join(errInvalidRouteFile, err)
+	}
+	for i, route := range r.Routes {
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("%w: route %d: %w", errInvalidRouteFile, i, err)
+		}
+	}
+	return r.Routes, nil
+}
+
+func (r Route) validate() error {
+	if len(r.Backends) == 0 {
+		return errNoBackends
+	}
+	for _, b := range r.Backends {
+		if len(b.Targets) == 0 {
+			return errNoTargets
+		}
+		if b.Weight < 0 {
+			return errNegativeWeight
+		}
+	}
+	return nil
+}
+
+// Router selects the upstream of each session once its CONNECT is authorized.
+// Sessions are sent to the first route they match, and to the fallback Pool of
+// the listener targets if they match none.
+type Router struct {
+	routes   []route
+	fallback *Pool
+	logger   *slog.Logger
+}
+
+type route struct {
+	name     string
+	match    Match
+	backends []backend
+	total    int
+}
+
+type backend struct {
+	name   string
+	weight int
+	pool   *Pool
+}
+
+// NewRouter returns a new Router with the routes of the configuration, which
+// balances the sessions matching no route between the given addresses. Each
+// backend of the routes is balanced and health checked with the configuration.
+func NewRouter(addrs []string, config Config, dial DialFunc, logger *slog.Logger) *Router {
+	rt := &Router{
+		fallback: New(addrs, config, dial, logger),
+		logger:   logger,
+	}
+	for _, r := range config.Routes {
+		even := true
+		for _, b := range r.Backends {
+			if b.Weight > 0 {
+				even = false
+			}
+		}
+		rr := route{name: r.Name, match: r.Match}
+		for _, b := range r.Backends {
+			weight := b.Weight
+			if even {
+				weight = 1
+			}
+			rr.total += weight
+			rr.backends = append(rr.backends, backend{
+				name:   b.Name,
+				weight: weight,
+				pool:   New(b.Targets, config, dial, logger),
+			})
+		}
+		rt.routes = append(rt.routes, rr)
+	}
+	return rt
+}
+
+// Dial connects to the upstream of the session. It can be used as session.DialFunc.
+func (rt *Router) Dial(ctx context.Context, s *session.Session) (net.Conn, error) {
+	for _, r := range rt.routes {
+		if r.match.matches(s) {
+			return rt.dial(ctx, r, s)
+		}
+	}
+	return rt.fallback.Dial(ctx, s.ID)
+}
+
+// dial connects to the backend of the route selected by the weights. Clients
+// with a client ID always select the same backend. If the backend has no
+// upstream which can be dialed, the other backends are dialed in turn.
+func (rt *Router) dial(ctx context.Context, r route, s *session.Session) (net.Conn, error) {
+	n := rand.Intn(r.total)
+	if s.ID != "" {
+		n = int(score(s.ID, r.name) % uint64(r.total))
+	}
+	first := 0
+	for i, b := range r.backends {
+		if n < b.weight {
+			first = i
+			break
+		}
+		n -= b.weight
+	}
+	var errs []error
+	for i := range r.backends {
+		b := r.backends[(first+i)%len(r.backends)]
+		conn, err := b.pool.Dial(ctx, s.ID)
+		if err == nil {
+			rt.logger.Debug("Routed session", slog.String("client_id", s.ID), slog.String("route", r.name), slog.String("backend", b.name))
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Run probes the health of the upstreams of all the backends until ctx is done.
+func (rt *Router) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	run := func(p *Pool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Run(ctx)
+		}()
+	}
+	run(rt.fallback)
+	for _, r := range rt.routes {
+		for _, b := range r.backends {
+			run(b.pool)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,233 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/absmach/mproxy/pkg/session"
+)
+
+func pattern(t *testing.T, expr string) Pattern {
+	t.Helper()
+	var p Pattern
+	if err := p.UnmarshalText([]byte(expr)); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// routed dials the session with the router and returns the upstream dialed.
+func routed(t *testing.T, rt *Router, d *dialer, s *session.Session) string {
+	t.Helper()
+	n := len(d.dialed)
+	c, err := rt.Dial(context.Background(), s)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	c.Close()
+	return d.dialed[n]
+}
+
+func TestRouteMatch(t *testing.T) {
+	u, err := url.Parse("spiffe://example.org/device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := x509.Certificate{
+		Subject:     pkix.Name{CommonName: "device-1", OrganizationalUnit: []string{"fleet", "tenant-b"}},
+		DNSNames:    []string{"device-1.example.org"},
+		URIs:        []*url.URL{u},
+		IPAddresses: []net.IP{net.IPv4(192, 0, 2, 7)},
+	}
+	routes := []Route{
+		{Name: "user", Match: Match{Username: pattern(t, "tenant-a-.*")}, Backends: []Backend{{Targets: []string{"user"}}}},
+		{Name: "client", Match: Match{ClientID: pattern(t, "sensor-[0-9]+")}, Backends: []Backend{{Targets: []string{"client"}}}},
+		{Name: "both", Match: Match{Username: pattern(t, "ops"), ClientID: pattern(t, "console")}, Backends: []Backend{{Targets: []string{"both"}}}},
+		{Name: "cn", Match: Match{CertCN: pattern(t, "device-1")}, Backends: []Backend{{Targets: []string{"cn"}}}},
+		{Name: "ou", Match: Match{CertOU: pattern(t, "tenant-b")}, Backends: []Backend{{Targets: []string{"ou"}}}},
+		{Name: "san", Match: Match{CertSAN: pattern(t, "192.0.2.7")}, Backends: []Backend{{Targets: []string{"san"}}}},
+		{Name: "uri", Match: Match{CertSAN: pattern(t, "spiffe://example.org/.*")}, Backends: []Backend{{Targets: []string{"uri"}}}},
+	}
+	cases := []struct {
+		desc string
+		s    session.Session
+		want string
+	}{
+		{desc: "username", s: session.Session{Username: "tenant-a-1", ID: "sensor-1"}, want: "user"},
+		{desc: "username matched whole", s: session.Session{Username: "x-tenant-a-1"}, want: "fallback"},
+		{desc: "client ID", s: session.Session{Username: "tenant-c", ID: "sensor-42"}, want: "client"},
+		{desc: "client ID matched whole", s: session.Session{ID: "sensor-42x"}, want: "fallback"},
+		{desc: "all patterns", s: session.Session{Username: "ops", ID: "console"}, want: "both"},
+		{desc: "not all patterns", s: session.Session{Username: "ops", ID: "shell"}, want: "fallback"},
+		{desc: "certificate CN", s: session.Session{Cert: cert}, want: "cn"},
+		{desc: "certificate OU", s: session.Session{Cert: x509.Certificate{Subject: pkix.Name{OrganizationalUnit: cert.Subject.OrganizationalUnit}}}, want: "ou"},
+		{desc: "certificate IP SAN", s: session.Session{Cert: x509.Certificate{IPAddresses: cert.IPAddresses}}, want: "san"},
+		{desc: "certificate URI SAN", s: session.Session{Cert: x509.Certificate{URIs: cert.URIs}}, want: "uri"},
+		{desc: "no route", s: session.Session{Username: "tenant-c", ID: "c1"}, want: "fallback"},
+		{desc: "anonymous", s: session.Session{}, want: "fallback"},
+	}
+	d := &dialer{}
+	rt := NewRouter([]string{"fallback"}, Config{Routes: routes}, d.dial, logger)
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := routed(t, rt, d, &tc.s); got != tc.want {
+				t.Errorf("routed to %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouteOrder(t *testing.T) {
+	routes := []Route{
+		{Name: "first", Match: Match{Username: pattern(t, "a.*")}, Backends: []Backend{{Targets: []string{"first"}}}},
+		{Name: "second", Match: Match{Username: pattern(t, "ab")}, Backends: []Backend{{Targets: []string{"second"}}}},
+		// A route without patterns matches any session.
+		{Name: "any", Backends: []Backend{{Targets: []string{"any"}}}},
+	}
+	d := &dialer{}
+	rt := NewRouter([]string{"fallback"}, Config{Routes: routes}, d.dial, logger)
+	for username, want := range map[string]string{"ab": "first", "b": "any"} {
+		if got := routed(t, rt, d, &session.Session{Username: username}); got != want {
+			t.Errorf("%s routed to %s, want %s", username, got, want)
+		}
+	}
+}
+
+func TestRouteWeights(t *testing.T) {
+	cases := []struct {
+		desc     string
+		backends []Backend
+		// share is the expected share of the sessions of each target, in percent.
+		share map[string]int
+	}{
+		{
+			desc:     "canary",
+			backends: []Backend{{Name: "stable", Targets: []string{"stable"}, Weight: 90}, {Name: "canary", Targets: []string{"canary"}, Weight: 10}},
+			share:    map[string]int{"stable": 90, "canary": 10},
+		},
+		{
+			desc:     "even without weights",
+			backends: []Backend{{Targets: []string{"a"}}, {Targets: []string{"b"}}},
+			share:    map[string]int{"a": 50, "b": 50},
+		},
+		{
+			desc:     "weight 0 with other weights",
+			backends: []Backend{{Targets: []string{"a"}, Weight: 1}, {Targets: []string{"b"}}},
+			share:    map[string]int{"a": 100},
+		},
+	}
+	const sessions = 2000
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			d := &dialer{}
+			rt := NewRouter([]string{"fallback"}, Config{Routes: []Route{{Name: "r", Backends: tc.backends}}}, d.dial, logger)
+			counts := map[string]int{}
+			for i := 0; i < sessions; i++ {
+				s := &session.Session{ID: fmt.Sprintf("client-%d", i)}
+				target := routed(t, rt, d, s)
+				counts[target]++
+				// A client ID always lands on the same backend.
+				if again := routed(t, rt, d, s); again != target {
+					t.Fatalf("client %s routed to %s, then %s", s.ID, target, again)
+				}
+			}
+			for target, n := range counts {
+				want := tc.share[target] * sessions / 100
+				if diff := n - want; diff < -sessions/20 || diff > sessions/20 {
+					t.Errorf("%s got %d of %d sessions, want about %d", target, n, sessions, want)
+				}
+			}
+			// Sessions without client ID are split by weight as well.
+			for i := 0; i < 100; i++ {
+				if target := routed(t, rt, d, &session.Session{}); tc.share[target] == 0 {
+					t.Errorf("anonymous session routed to %s", target)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteBackendFailover(t *testing.T) {
+	backends := []Backend{{Name: "canary", Targets: []string{"canary"}, Weight: 100}, {Name: "stable", Targets: []string{"stable"}, Weight: 0}}
+	cases := []struct {
+		desc   string
+		fail   []string
+		dialed []string
+		err    error
+	}{
+		{desc: "selected backend", dialed: []string{"canary"}},
+		{desc: "other backend", fail: []string{"canary"}, dialed: []string{"canary", "stable"}},
+		{desc: "all backends fail", fail: []string{"canary", "stable"}, dialed: []string{"canary", "stable"}, err: errDial},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			d := &dialer{fail: map[string]bool{}}
+			for _, addr := range tc.fail {
+				d.fail[addr] = true
+			}
+			rt := NewRouter([]string{"fallback"}, Config{Routes: []Route{{Name: "r", Backends: backends}}}, d.dial, logger)
+			c, err := rt.Dial(context.Background(), &session.Session{ID: "c1"})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Dial() = %v, want %v", err, tc.err)
+			}
+			if c != nil {
+				c.Close()
+			}
+			// Sessions of a route never fall back to the listener targets.
+			if !slices.Equal(d.dialed, tc.dialed) {
+				t.Errorf("dialed %v, want %v", d.dialed, tc.dialed)
+			}
+		})
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	cases := []struct {
+		desc string
+		data string
+		err  error
+	}{
+		{
+			desc: "valid",
+			data: `{"routes": [{"name": "a", "match": {"username": "tenant-a-.*"}, "backends": [{"name": "b", "targets": ["broker:1883"], "weight": 1}]}]}`,
+		},
+		{desc: "invalid JSON", data: `{"routes": [`, err: errInvalidRouteFile},
+		{desc: "invalid pattern", data: `{"routes": [{"match": {"client_id": "("}, "backends": [{"targets": ["t"]}]}]}`, err: errInvalidRouteFile},
+		{desc: "no backends", data: `{"routes": [{"name": "a"}]}`, err: errNoBackends},
+		{desc: "no targets", data: `{"routes": [{"backends": [{"name": "b"}]}]}`, err: errNoTargets},
+		{desc: "negative weight", data: `{"routes": [{"backends": [{"targets": ["t"], "weight": -1}]}]}`, err: errNegativeWeight},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.json")
+			if err := os.WriteFile(path, []byte(tc.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			routes, err := LoadRoutes(path)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("LoadRoutes() = %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if len(routes) != 1 || !routes[0].Match.Username.set() || routes[0].Match.ClientID.set() {
+				t.Errorf("LoadRoutes() = %+v", routes)
+			}
+		})
+	}
+	if _, err := LoadRoutes(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadRoutes() of missing file = %v, want %v", err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstream balances the sessions of a listener between multiple
+// target brokers and removes the unhealthy ones from the rotation.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+var (
+	// ErrInvalidStrategy indicates an unknown load balancing strategy value.
+	ErrInvalidStrategy = errors.New("invalid load balancing strategy")
+
+	// ErrNoUpstream indicates there is no healthy upstream to dial.
+	ErrNoUpstream = errors.New("no healthy upstream")
+)
+
+// Strategy selects the upstream each session is dialed to.
+type Strategy int
+
+const (
+	// RoundRobin dials the healthy upstreams in turn.
+	RoundRobin Strategy = iota
+	// LeastConnections dials the healthy upstream with the fewest open connections.
+	LeastConnections
+	// Hash dials the upstream selected by consistent hashing of the client ID,
+	// so that reconnecting clients land on the same upstream while it is healthy.
+	Hash
+)
+
+// UnmarshalText parses the strategy from its name.
+func (s *Strategy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(strings.TrimSpace(string(text))) {
+	case "", "round_robin":
+		*s = RoundRobin
+	case "least_connections":
+		*s = LeastConnections
+	case "hash":
+		*s = Hash
+	default:
+		return ErrInvalidStrategy
+	}
+	return nil
+}
+
+func (s Strategy) String() string {
+	switch s {
+	case LeastConnections:
+		return "least_connections"
+	case Hash:
+		return "hash"
+	default:
+		return "round_robin"
+	}
+}
+
+// Config holds the load balancing and health check options of a listener.
+type Config struct {
+	Strategy Strategy `env:"LB_STRATEGY" envDefault:"round_robin"`
+
+	// HealthCheckInterval is the period of the health check probes, 0 disables
+	// health checks and all the upstreams are considered healthy.
+	HealthCheckInterval time.Duration `env:"HEALTH_CHECK_INTERVAL" envDefault:"10s"`
+
+	// HealthCheckTimeout limits each probe.
+	HealthCheckTimeout time.Duration `env:"HEALTH_CHECK_TIMEOUT" envDefault:"5s"`
+
+	// UnhealthyThreshold is the number of failed probes in a row which
+	// removes the upstream from the rotation.
+	UnhealthyThreshold int `env:"HEALTH_CHECK_UNHEALTHY_THRESHOLD" envDefault:"3"`
+
+	// HealthyThreshold is the number of successful probes in a row which
+	// reinstates an unhealthy upstream.
+	HealthyThreshold int `env:"HEALTH_CHECK_HEALTHY_THRESHOLD" envDefault:"2"`
+
+	// Username and Password are sent in the CONNECT of the probes.
+	Username string `env:"HEALTH_CHECK_USERNAME" envDefault:""`
+	Password string `env:"HEALTH_CHECK_PASSWORD" envDefault:""`
+
+	// RoutesFile is the path of the JSON file with the routes selecting the
+	// targets of the sessions by their identity, in the form {"routes": [<route>]}.
+	RoutesFile string `env:"ROUTES_FILE" envDefault:""`
+	// Routes are loaded from RoutesFile.
+	Routes []Route
+}
+
+// NewConfig parses the load balancing options from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// DialFunc connects to the upstream with the given address.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// Pool keeps the health and the open connections of the upstreams.
+type Pool struct {
+	config    Config
+	dial      DialFunc
+	logger    *slog.Logger
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+type upstream struct {
+	addr   string
+	active atomic.Int64
+
+	mu        sync.Mutex
+	healthy   bool
+	failures  int
+	successes int
+}
+
+// New returns a new Pool of the upstreams with the given addresses,
+// all of them considered healthy until checked.
+func New(addrs []string, config Config, dial DialFunc, logger *slog.Logger) *Pool {
+	p := &Pool{
+		config: config,
+		dial:   dial,
+		logger: logger,
+	}
+	for _, addr := range addrs {
+		p.upstreams = append(p.upstreams, &upstream{addr: addr, healthy: true})
+	}
+	return p
+}
+
+// Dial connects to an upstream selected by the strategy. The key is the client
+// ID used by the Hash strategy. If the dial fails, the next healthy upstream in
+// the order of the strategy is dialed.
+func (p *Pool) Dial(ctx context.Context, key string) (net.Conn, error) {
+	candidates := p.candidates(key)
+	if len(candidates) == 0 {
+		return nil, ErrNoUpstream
+	}
+	var errs []error
+	for _, u := range candidates {
+		c, err := p.dial(ctx, u.addr)
+		if err == nil {
+			u.active.Add(1)
+			return &conn{Conn: c, release: u.release()}, nil
+		}
+		p.logger.Warn("Failed to dial upstream", slog.String("upstream", u.addr), slog.Any("error", err))
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// candidates returns the healthy upstreams in the order they are dialed.
+func (p *Pool) candidates(key string) []*upstream {
+	healthy := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.isHealthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	switch p.config.Strategy {
+	case LeastConnections:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].active.Load() < healthy[j].active.Load()
+		})
+	case Hash:
+		// Rendezvous hashing: only the clients of an upstream which is
+		// removed or added move to another one.
+		scores := make(map[*upstream]uint64, len(healthy))
+		for _, u := range healthy {
+			scores[u] = score(key, u.addr)
+		}
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return scores[healthy[i]] > scores[healthy[j]]
+		})
+	default:
+		start := int(p.next.Add(1)-1) % len(healthy)
+		ordered := make([]*upstream, 0, len(healthy))
+		ordered = append(ordered, healthy[start:]...)
+		healthy = append(ordered, healthy[:start]...)
+	}
+	return healthy
+}
+
+func score(key, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	return h.Sum64()
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+// release returns the function decrementing the open connections once.
+func (u *upstream) release() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			u.active.Add(-1)
+		})
+	}
+}
+
+// conn decrements the open connections of its upstream on close.
+type conn struct {
+	net.Conn
+	release func()
+}
+
+func (c *conn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
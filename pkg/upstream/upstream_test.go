@@ -0,0 +1,262 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+var (
+	errDial = errors.New("dial failed")
+	logger  = slog.New(slog.NewTextHandler(io.Discard, nil))
+)
+
+// dialer dials in-memory connections to the upstreams, failing the ones in fail.
+type dialer struct {
+	mu     sync.Mutex
+	fail   map[string]bool
+	dialed []string
+}
+
+func (d *dialer) dial(_ context.Context, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dialed = append(d.dialed, addr)
+	if d.fail[addr] {
+		return nil, errDial
+	}
+	c, peer := net.Pipe()
+	peer.Close()
+	return c, nil
+}
+
+func TestStrategy(t *testing.T) {
+	cases := []struct {
+		text string
+		want Strategy
+		err  error
+	}{
+		{text: "", want: RoundRobin},
+		{text: "round_robin", want: RoundRobin},
+		{text: " Least_Connections ", want: LeastConnections},
+		{text: "hash", want: Hash},
+		{text: "random", err: ErrInvalidStrategy},
+	}
+	for _, tc := range cases {
+		var s Strategy
+		err := s.UnmarshalText([]byte(tc.text))
+		if !errors.Is(err, tc.err) || (err == nil && s != tc.want) {
+			t.Errorf("UnmarshalText(%q) = %s, %v, want %s, %v", tc.text, s, err, tc.want, tc.err)
+		}
+		if err == nil && tc.text != "" && s.String() != tc.want.String() {
+			t.Errorf("String() = %s, want %s", s, tc.want)
+		}
+	}
+}
+
+// dialAll dials the pool n times with the key and returns the upstreams dialed.
+func dialAll(t *testing.T, p *Pool, d *dialer, key string, n int) []string {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		d.mu.Lock()
+		d.dialed = nil
+		d.mu.Unlock()
+		c, err := p.Dial(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Dial() = %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		d.mu.Lock()
+		got = append(got, d.dialed[len(d.dialed)-1])
+		d.mu.Unlock()
+	}
+	return got
+}
+
+func TestRoundRobin(t *testing.T) {
+	cases := []struct {
+		desc      string
+		unhealthy []string
+		want      []string
+	}{
+		{desc: "all healthy", want: []string{"a", "b", "c", "a", "b", "c", "a"}},
+		{desc: "unhealthy skipped", unhealthy: []string{"b"}, want: []string{"a", "c", "a", "c"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			d := &dialer{}
+			p := New([]string{"a", "b", "c"}, Config{Strategy: RoundRobin}, d.dial, logger)
+			for _, u := range p.upstreams {
+				u.healthy = !slices.Contains(tc.unhealthy, u.addr)
+			}
+			if got := dialAll(t, p, d, "", len(tc.want)); !slices.Equal(got, tc.want) {
+				t.Errorf("dialed %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	d := &dialer{}
+	p := New([]string{"a", "b", "c"}, Config{Strategy: LeastConnections}, d.dial, logger)
+
+	var conns []net.Conn
+	for _, want := range []string{"a", "b", "c", "a"} {
+		c, err := p.Dial(context.Background(), "")
+		if err != nil {
+			t.Fatalf("Dial() = %v", err)
+		}
+		conns = append(conns, c)
+		if got := d.dialed[len(d.dialed)-1]; got != want {
+			t.Errorf("dialed %s, want %s", got, want)
+		}
+	}
+	// Closing a connection of b makes it the least loaded, once only.
+	conns[1].Close()
+	conns[1].Close()
+	if got := active(p); !slices.Equal(got, []int64{2, 0, 1}) {
+		t.Errorf("active connections = %v, want [2 0 1]", got)
+	}
+	c, err := p.Dial(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer c.Close()
+	if got := d.dialed[len(d.dialed)-1]; got != "b" {
+		t.Errorf("dialed %s after release, want b", got)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if got := active(p); !slices.Equal(got, []int64{0, 1, 0}) {
+		t.Errorf("active connections = %v, want [0 1 0]", got)
+	}
+}
+
+// active returns the open connections of the upstreams in order.
+func active(p *Pool) []int64 {
+	var n []int64
+	for _, u := range p.upstreams {
+		n = append(n, u.active.Load())
+	}
+	return n
+}
+
+func TestHash(t *testing.T) {
+	addrs := []string{"a", "b", "c", "d"}
+	d := &dialer{}
+	p := New(addrs, Config{Strategy: Hash}, d.dial, logger)
+
+	selected := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		// The same key always selects the same upstream.
+		got := dialAll(t, p, d, key, 3)
+		if got[0] != got[1] || got[1] != got[2] {
+			t.Fatalf("key %s dialed %v, want the same upstream", key, got)
+		}
+		selected[key] = got[0]
+	}
+	used := map[string]bool{}
+	for _, addr := range selected {
+		used[addr] = true
+	}
+	if len(used) != len(addrs) {
+		t.Errorf("keys spread over %d upstreams, want %d", len(used), len(addrs))
+	}
+
+	// Only the keys of the removed upstream move.
+	p.upstreams[1].healthy = false
+	for key, addr := range selected {
+		got := dialAll(t, p, d, key, 1)[0]
+		switch {
+		case addr != "b" && got != addr:
+			t.Errorf("key %s moved from %s to %s", key, addr, got)
+		case addr == "b" && got == "b":
+			t.Errorf("key %s dialed the removed upstream", key)
+		}
+	}
+	// The keys come back once the upstream is reinstated.
+	p.upstreams[1].healthy = true
+	for key, addr := range selected {
+		if got := dialAll(t, p, d, key, 1)[0]; got != addr {
+			t.Errorf("key %s dialed %s once reinstated, want %s", key, got, addr)
+		}
+	}
+}
+
+func TestDialFallthrough(t *testing.T) {
+	cases := []struct {
+		desc     string
+		strategy Strategy
+		fail     []string
+		dialed   []string
+		err      error
+	}{
+		{desc: "first fails", strategy: RoundRobin, fail: []string{"a"}, dialed: []string{"a", "b"}},
+		{desc: "two fail", strategy: RoundRobin, fail: []string{"a", "b"}, dialed: []string{"a", "b", "c"}},
+		{desc: "least connections", strategy: LeastConnections, fail: []string{"a"}, dialed: []string{"a", "b"}},
+		{desc: "all fail", strategy: RoundRobin, fail: []string{"a", "b", "c"}, dialed: []string{"a", "b", "c"}, err: errDial},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			d := &dialer{fail: map[string]bool{}}
+			for _, addr := range tc.fail {
+				d.fail[addr] = true
+			}
+			p := New([]string{"a", "b", "c"}, Config{Strategy: tc.strategy}, d.dial, logger)
+			c, err := p.Dial(context.Background(), "")
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Dial() = %v, want %v", err, tc.err)
+			}
+			if c != nil {
+				c.Close()
+			}
+			if !slices.Equal(d.dialed, tc.dialed) {
+				t.Errorf("dialed %v, want %v", d.dialed, tc.dialed)
+			}
+			// Failed dials do not count as open connections.
+			for _, u := range p.upstreams {
+				if n := u.active.Load(); n != 0 {
+					t.Errorf("upstream %s has %d active connections, want 0", u.addr, n)
+				}
+			}
+		})
+	}
+}
+
+func TestNoUpstream(t *testing.T) {
+	cases := []struct {
+		desc      string
+		addrs     []string
+		unhealthy bool
+	}{
+		{desc: "no upstreams"},
+		{desc: "all unhealthy", addrs: []string{"a", "b"}, unhealthy: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			d := &dialer{}
+			p := New(tc.addrs, Config{}, d.dial, logger)
+			for _, u := range p.upstreams {
+				u.healthy = !tc.unhealthy
+			}
+			if _, err := p.Dial(context.Background(), "key"); !errors.Is(err, ErrNoUpstream) {
+				t.Errorf("Dial() = %v, want %v", err, ErrNoUpstream)
+			}
+			if len(d.dialed) != 0 {
+				t.Errorf("dialed %v, want none", d.dialed)
+			}
+		})
+	}
+}
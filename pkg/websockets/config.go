@@ -0,0 +1,31 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package websockets
+
+import (
+	"github.com/caarlos0/env/v11"
+)
+
+// Config holds the settings of the WebSocket proxy.
+type Config struct {
+	// AllowedOrigins lists the origins, such as https://example.com, the
+	// browsers may open connections from. "*" allows any origin. Without
+	// origins, only the origin of the host of the proxy is allowed. Upgrade
+	// requests without the Origin header, which are not sent by browsers,
+	// are always allowed.
+	AllowedOrigins []string `env:"ALLOWED_ORIGINS" envDefault:""`
+	// ForwardBasicAuth passes the Authorization header of clients using basic
+	// authentication on to the target, which receives their password. Other
+	// Authorization headers, such as bearer tokens, are always passed on.
+	ForwardBasicAuth bool `env:"FORWARD_BASIC_AUTH" envDefault:"false"`
+}
+
+// NewConfig parses the WebSocket proxy settings from environment.
+func NewConfig(opts env.Options) (Config, error) {
+	c := Config{}
+	if err := env.ParseWithOptions(&c, opts); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
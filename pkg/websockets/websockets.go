@@ -8,125 +8,550 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/connlimit"
+	"github.com/absmach/mproxy/pkg/mqtt/packets"
+	"github.com/absmach/mproxy/pkg/proxyproto"
 	"github.com/absmach/mproxy/pkg/session"
+	mptls "github.com/absmach/mproxy/pkg/tls"
+	"github.com/absmach/mproxy/pkg/tracing"
+	"github.com/absmach/mproxy/pkg/unixsock"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
+// closeTimeout limits the time spent sending the close message to a client
+// whose session is drained.
+const closeTimeout = time.Second
+
 var (
-	upgrader               = websocket.Upgrader{}
 	ErrAuthorizationNotSet = errors.New("authorization not set")
+	// ErrOriginNotAllowed indicates an upgrade request from an origin which is not allowed.
+	ErrOriginNotAllowed = errors.New("origin not allowed")
 )
 
+// connKey is the context key of the peer credentials of the client connection.
+type connKey struct{}
+
+// Proxy represents the WebSocket Proxy, which forwards the messages of the
+// clients to the target WebSocket server, the topic of the messages being
+// the path of the upgrade request.
 type Proxy struct {
-	target  string
-	address string
-	event   session.Handler
-	logger  *slog.Logger
+	config      mproxy.Config
+	ws          Config
+	upgrader    websocket.Upgrader
+	handler     session.Handler
+	interceptor session.Interceptor
+	logger      *slog.Logger
+
+	// sessions holds the client connections of the active sessions,
+	// so that they can be drained on shutdown.
+	mu       sync.Mutex
+	sessions map[*websocket.Conn]struct{}
+	draining bool
+	wg       sync.WaitGroup
 }
 
-func (p *Proxy) Handler(w http.ResponseWriter, r *http.Request) {
-	var token string
+// New - creates new WebSocket proxy.
+func New(config mproxy.Config, ws Config, handler session.Handler, interceptor session.Interceptor, logger *slog.Logger) *Proxy {
+	config.Session.Transport = session.RawWebSocket
+	return &Proxy{
+		config: config,
+		ws:     ws,
+		upgrader: websocket.Upgrader{
+			// Timeout for WS upgrade request handshake
+			HandshakeTimeout: 10 * time.Second,
+			// The origin is checked before the session starts, see allowOrigin.
+			CheckOrigin: func(*http.Request) bool {
+				return true
+			},
+		},
+		handler:     session.Instrument(handler, config.Session.Metrics),
+		interceptor: interceptor,
+		logger:      logger,
+		sessions:    make(map[*websocket.Conn]struct{}),
+	}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, p.config.PathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	if !p.allowOrigin(r) {
+		http.Error(w, ErrOriginNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+
+	var username, token string
 	headers := http.Header{}
-	switch {
+	switch u, pass, ok := r.BasicAuth(); {
+	case ok:
+		username, token = u, pass
+		if p.ws.ForwardBasicAuth {
+			headers.Set("Authorization", r.Header.Get("Authorization"))
+		}
 	case len(r.URL.Query()["authorization"]) != 0:
 		token = r.URL.Query()["authorization"][0]
 	case r.Header.Get("Authorization") != "":
 		token = r.Header.Get("Authorization")
-		headers.Add("Authorization", token)
+		headers.Set("Authorization", token)
 	default:
 		http.Error(w, ErrAuthorizationNotSet.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	target := fmt.Sprintf("%s%s", p.target, r.RequestURI)
+	s := &session.Session{
+		ID:         r.URL.Query().Get("client_id"),
+		Username:   username,
+		Password:   []byte(token),
+		ConnID:     uuid.NewString(),
+		Listener:   p.config.Session.Listener,
+		Transport:  p.config.Session.Transport,
+		RemoteAddr: remoteAddr(r),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		s.LocalAddr = addr
+	}
+	if cred, ok := r.Context().Value(connKey{}).(*unixsock.Credentials); ok {
+		s.PeerCredentials = cred
+	}
+	if r.TLS != nil {
+		s.TLS = session.NewTLSInfo(*r.TLS)
+		if len(r.TLS.PeerCertificates) > 0 {
+			s.Cert = *r.TLS.PeerCertificates[0]
+		}
+	}
+	topic := r.URL.Path
+
+	ctx, span := tracing.Tracer().Start(tracing.Extract(r.Context(), r.Header), "websocket.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("mproxy.listener", s.Listener),
+			attribute.String("mproxy.conn_id", s.ConnID),
+			attribute.String("net.peer.addr", r.RemoteAddr),
+			attribute.String("mqtt.topic", topic),
+		))
+	defer span.End()
+	ctx = session.NewContext(ctx, s)
+
+	if err := p.handler.AuthConnect(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := p.handler.AuthSubscribe(ctx, &[]string{topic}); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The session is ended by the registry once it is taken over by another
+	// session with the same client ID, or disconnected through the admin API.
+	// Only the connections are ended, the hooks still run with ctx.
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cl := &closer{cancel: cancel}
+	reg, err := session.Register(s, p.config.Session, cl.close)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer reg.Unregister()
 
-	targetConn, _, err := websocket.DefaultDialer.Dial(target, headers)
+	tracing.Inject(ctx, headers)
+	targetConn, err := p.dial(sctx, r.RequestURI, headers)
 	if err != nil {
+		p.config.Session.Metrics.DialFailed()
+		p.logger.Error("Failed to dial target", slog.Any("error", err))
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer targetConn.Close()
 
-	topic := r.URL.Path
-	s := session.Session{Password: []byte(token)}
-	ctx := session.NewContext(context.Background(), &s)
-	if err := p.event.AuthConnect(ctx); err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-	if err := p.event.AuthSubscribe(ctx, &[]string{topic}); err != nil {
+	if err := p.handler.Connect(ctx); err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	if err := p.event.Subscribe(ctx, &[]string{topic}); err != nil {
+	defer func() {
+		if err := p.handler.Disconnect(ctx); err != nil {
+			p.logger.Warn("Failed to disconnect", slog.Any("error", err))
+		}
+	}()
+	if err := p.handler.Subscribe(ctx, &[]string{topic}); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	inConn, err := upgrader.Upgrade(w, r, nil)
+	reg.Subscribed([]string{topic})
+	defer func() {
+		if err := p.handler.Unsubscribe(ctx, &[]string{topic}); err != nil {
+			p.logger.Warn("Failed to unsubscribe", slog.Any("error", err))
+		}
+	}()
+
+	inConn, err := p.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		p.logger.Warn("WS Proxy failed to upgrade connection", slog.Any("error", err))
 		return
 	}
+	defer p.config.Session.Metrics.Closed()
 	defer inConn.Close()
+	if limit := p.config.Session.MaxPacketSize; limit > 0 {
+		inConn.SetReadLimit(int64(limit))
+	}
+	if !p.add(inConn) {
+		return
+	}
+	defer p.remove(inConn)
+	if !cl.set(inConn) {
+		return
+	}
 
-	g, ctx := errgroup.WithContext(ctx)
-
+	g, gctx := errgroup.WithContext(sctx)
+	g.Go(func() error {
+		return p.stream(gctx, topic, inConn, targetConn, session.Up, reg)
+	})
 	g.Go(func() error {
-		return p.stream(ctx, topic, inConn, targetConn, true)
+		return p.stream(gctx, topic, targetConn, inConn, session.Down, reg)
 	})
+	// Unblock the reads of the other direction once one of them ends.
 	g.Go(func() error {
-		return p.stream(ctx, topic, targetConn, inConn, false)
+		<-gctx.Done()
+		now := time.Now()
+		return errors.Join(inConn.SetReadDeadline(now), targetConn.SetReadDeadline(now))
 	})
 
-	if err := g.Wait(); err != nil {
-		if err := p.event.Unsubscribe(ctx, &[]string{topic}); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		p.logger.Error("WS Proxy terminated", slog.Any("error", err))
+	err = g.Wait()
+	if err == nil || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) || p.isDraining() || cl.closed() {
 		return
 	}
+	p.logger.Warn("WS Proxy terminated", slog.Any("error", err))
 }
 
-func (p *Proxy) stream(ctx context.Context, topic string, src, dest *websocket.Conn, upstream bool) error {
+func (p *Proxy) stream(ctx context.Context, topic string, src, dest *websocket.Conn, dir session.Direction, reg *session.Registration) error {
 	for {
 		messageType, payload, err := src.ReadMessage()
 		if err != nil {
 			return err
 		}
-		if upstream {
-			if err := p.event.AuthPublish(ctx, &topic, &payload); err != nil {
-				return err
+		reg.Count(dir, len(payload))
+		if err := p.forward(ctx, topic, dest, messageType, payload, dir); err != nil {
+			return err
+		}
+	}
+}
+
+// forward handles a single message read from the client, for the Up direction,
+// or the target. The message is passed to the interceptor as a PUBLISH packet
+// to the topic, and the payload of the packet it returns is forwarded.
+func (p *Proxy) forward(ctx context.Context, topic string, dest *websocket.Conn, messageType int, payload []byte, dir session.Direction) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "websocket.message "+dir.String(),
+		trace.WithAttributes(
+			attribute.String("mqtt.direction", dir.String()),
+			attribute.Int("websocket.message.size", len(payload)),
+		))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	if dir == session.Up {
+		if err := p.handler.AuthPublish(ctx, &topic, &payload); err != nil {
+			return err
+		}
+	} else {
+		topics := []string{topic}
+		if err := p.handler.DownSubscribe(ctx, &topics); err != nil {
+			return err
+		}
+		topic = topics[0]
+	}
+
+	if p.interceptor != nil {
+		pkt := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pkt.TopicName = topic
+		pkt.Payload = payload
+		_, icSpan := tracing.StartChild(ctx, "Interceptor.Intercept")
+		ipkt, err := p.interceptor.Intercept(ctx, pkt, dir)
+		tracing.End(icSpan, err)
+		if err != nil {
+			return err
+		}
+		if pub, ok := ipkt.(*packets.PublishPacket); ok {
+			payload = pub.Payload
+		}
+	}
+
+	if err := dest.WriteMessage(messageType, payload); err != nil {
+		return err
+	}
+	if dir == session.Up {
+		return p.handler.Publish(ctx, &topic, &payload)
+	}
+	return nil
+}
+
+// dial connects to the target with the URI of the upgrade request. The PROXY
+// protocol header, if configured, carries the addresses of the client of the
+// session. Targets on Unix sockets are written as unix:///run/app.sock:/ws,
+// with the path the requests are sent to after the socket path.
+func (p *Proxy) dial(ctx context.Context, uri string, header http.Header) (*websocket.Conn, error) {
+	var h proxyproto.Header
+	if s, ok := session.FromContext(ctx); ok {
+		h = proxyproto.Header{Source: s.RemoteAddr, Destination: s.LocalAddr}
+	}
+	url := p.config.Target + uri
+	// socket is the Unix socket dialed instead of the host of the URL.
+	var socket string
+	if path, prefix, ok := unixsock.SplitURI(p.config.Target); ok {
+		url = "ws://localhost" + prefix + uri
+		if p.config.TargetTLSConfig != nil {
+			url = "wss://localhost" + prefix + uri
+		}
+		socket = unixsock.Scheme + path
+	}
+	dialer := &websocket.Dialer{
+		TLSClientConfig: p.config.TargetTLSConfig,
+		NetDialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			if socket != "" {
+				addr = socket
 			}
-			if err := p.event.Publish(ctx, &topic, &payload); err != nil {
-				return err
+			conn, err := unixsock.Dial(ctx, addr)
+			if err != nil {
+				return nil, err
 			}
-		} else {
-			topics := []string{topic}
-			fmt.Println(topics)
-			if err := p.event.DownSubscribe(ctx, &topics); err != nil {
-				return err
+			if err := proxyproto.WriteHeader(conn, p.config.ProxyProtocol.Target, h); err != nil {
+				return nil, errors.Join(err, conn.Close())
 			}
-		}
-		if err := dest.WriteMessage(messageType, payload); err != nil {
-			return err
+			return conn, nil
+		},
+	}
+	conn, _, err := dialer.DialContext(ctx, url, header)
+	return conn, err
+}
+
+func (p *Proxy) Listen(ctx context.Context) error {
+	l, err := unixsock.Listen(p.config.Address, p.config.Socket)
+	if err != nil {
+		return err
+	}
+
+	l = proxyproto.NewListener(l, p.config.ProxyProtocol, p.config.Session.Metrics, p.logger)
+	l = connlimit.NewListener(l, p.config.Session.ConnLimiter, p.config.Session.Metrics, p.logger)
+	if p.config.TLSConfig != nil {
+		l = connlimit.NewTLSListener(l, p.config.TLSConfig, p.config.Session.ConnLimiter, p.config.Session.Metrics, p.logger)
+	}
+
+	server := http.Server{
+		ErrorLog:    p.config.Session.Metrics.ServerErrorLog(p.logger),
+		ConnState:   p.connState,
+		ConnContext: p.connContext,
+	}
+	g, ctx := errgroup.WithContext(ctx)
+
+	mux := http.NewServeMux()
+	// The topics are the paths below the path prefix.
+	mux.Handle(strings.TrimSuffix(p.config.PathPrefix, "/")+"/", p)
+	server.Handler = mux
+
+	g.Go(func() error {
+		return server.Serve(l)
+	})
+	status := mptls.SecurityStatus(p.config.TLSConfig)
+
+	p.logger.Info(fmt.Sprintf("WebSocket proxy server started at %s%s with %s", p.config.Address, p.config.PathPrefix, status))
+
+	g.Go(func() error {
+		<-ctx.Done()
+		return server.Close()
+	})
+	if err := g.Wait(); err != nil {
+		p.logger.Info(fmt.Sprintf("WebSocket proxy server at %s%s with %s exiting with errors", p.config.Address, p.config.PathPrefix, status), slog.String("error", err.Error()))
+	} else {
+		p.logger.Info(fmt.Sprintf("WebSocket proxy server at %s%s with %s exiting...", p.config.Address, p.config.PathPrefix, status))
+	}
+	p.drain()
+	return nil
+}
+
+// drain ends the sessions still active once the listener is closed. Clients
+// have the grace period to disconnect on their own. After that, the remaining
+// sessions are sent the going away close message and closed.
+func (p *Proxy) drain() {
+	cfg := p.config.Session
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+
+	p.mu.Lock()
+	p.draining = true
+	p.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(cfg.DrainGracePeriod)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	conns := make([]*websocket.Conn, 0, len(p.sessions))
+	for conn := range p.sessions {
+		conns = append(conns, conn)
+	}
+	p.mu.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, conn := range conns {
+		// The close message is best effort, the connection is closed anyway.
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+		conn.Close()
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	if len(conns) == 0 {
+		return
+	}
+	p.logger.Info("Drained sessions", slog.String("address", p.config.Address), slog.Int("sessions", len(conns)))
+}
+
+// add tracks the client connection of a session, unless the proxy is draining.
+func (p *Proxy) add(conn *websocket.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining {
+		return false
+	}
+	p.sessions[conn] = struct{}{}
+	p.wg.Add(1)
+	return true
+}
+
+// isDraining reports whether the listener is closed and the sessions are
+// drained, which closes their connections.
+func (p *Proxy) isDraining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining
+}
+
+func (p *Proxy) remove(conn *websocket.Conn) {
+	p.mu.Lock()
+	delete(p.sessions, conn)
+	p.mu.Unlock()
+	p.wg.Done()
+}
+
+// connContext stores the peer credentials of clients connected over a Unix socket.
+func (p *Proxy) connContext(ctx context.Context, c net.Conn) context.Context {
+	cred, err := unixsock.PeerCredentials(c)
+	if err != nil {
+		p.logger.Warn("Failed to get peer credentials", slog.Any("error", err))
+	}
+	return context.WithValue(ctx, connKey{}, cred)
+}
+
+// connState records accepted and closed client connections. The connections
+// upgraded to WebSocket are recorded closed when their session ends.
+func (p *Proxy) connState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		p.config.Session.Metrics.Accepted()
+	case http.StateClosed:
+		p.config.Session.Metrics.Closed()
+	}
+}
+
+// allowOrigin reports whether the upgrade request comes from an allowed
+// origin, see Config.AllowedOrigins.
+func (p *Proxy) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(p.ws.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range p.ws.AllowedOrigins {
+		if o = strings.TrimSpace(o); o == "*" || strings.EqualFold(o, origin) {
+			return true
 		}
 	}
+	return false
 }
 
-func NewProxy(address, target string, logger *slog.Logger, handler session.Handler) (*Proxy, error) {
-	return &Proxy{target: target, address: address, logger: logger, event: handler}, nil
+// closer ends a session on behalf of the registry, before or after the
+// client connection is upgraded.
+type closer struct {
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	conn  *websocket.Conn
+	ended bool
+}
+
+// set sets the upgraded client connection, unless the session is already ended.
+func (c *closer) set(conn *websocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	return !c.ended
 }
 
-// Listen - listen withrout tls.
-func (p *Proxy) Listen() error {
-	return http.ListenAndServe(p.address, http.HandlerFunc(p.Handler))
+// close sends the close message with the reason code to the client, if
+// connected, and ends the session.
+func (c *closer) close(code byte) error {
+	c.mu.Lock()
+	c.ended = true
+	conn := c.conn
+	c.mu.Unlock()
+	defer c.cancel()
+	if conn == nil {
+		return nil
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, closeReason(code))
+	return conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
 }
 
-// ListenTLS - version of Listen with TLS encryption.
-func (p Proxy) ListenTLS(crt, key string) error {
-	return http.ListenAndServeTLS(p.address, crt, key, http.HandlerFunc(p.Handler))
+func (c *closer) closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ended
+}
+
+// closeReason returns the reason of the close message of a session ended
+// with the MQTT reason code.
+func closeReason(code byte) string {
+	switch code {
+	case packets.SessionTakenOver:
+		return "session taken over"
+	case packets.AdministrativeAction:
+		return "administrative action"
+	default:
+		return "disconnected"
+	}
+}
+
+// remoteAddr returns the address of the client of the request.
+func remoteAddr(r *http.Request) net.Addr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(ap)
 }
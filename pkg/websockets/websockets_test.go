@@ -0,0 +1,232 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package websockets
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/mproxy"
+	"github.com/absmach/mproxy/pkg/session"
+	"github.com/gorilla/websocket"
+)
+
+// testTimeout limits each step of the tests, so that a stuck session fails the test.
+const testTimeout = 5 * time.Second
+
+func TestAllowOrigin(t *testing.T) {
+	cases := []struct {
+		desc    string
+		allowed []string
+		origin  string
+		allow   bool
+	}{
+		{desc: "no origin", origin: "", allow: true},
+		{desc: "same host", origin: "http://proxy.example.com", allow: true},
+		{desc: "other host", origin: "http://evil.example.com", allow: false},
+		{desc: "listed origin", allowed: []string{"https://app.example.com"}, origin: "https://APP.example.com", allow: true},
+		{desc: "unlisted origin", allowed: []string{"https://app.example.com"}, origin: "http://proxy.example.com", allow: false},
+		{desc: "any origin", allowed: []string{" * "}, origin: "http://evil.example.com", allow: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := &Proxy{ws: Config{AllowedOrigins: tc.allowed}}
+			r := httptest.NewRequest("GET", "http://proxy.example.com/ws", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if got := p.allowOrigin(r); got != tc.allow {
+				t.Errorf("allowOrigin(%q) = %t, want %t", tc.origin, got, tc.allow)
+			}
+		})
+	}
+}
+
+// handler authorizes everything and records the hooks called.
+type handler struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (h *handler) call(name string) error {
+	h.mu.Lock()
+	h.calls = append(h.calls, name)
+	h.mu.Unlock()
+	return nil
+}
+
+// wait waits for the hooks with the given names to be called, and returns the hooks called.
+func (h *handler) wait(t *testing.T, names ...string) []string {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		h.mu.Lock()
+		calls := slices.Clone(h.calls)
+		h.mu.Unlock()
+		if slices.ContainsFunc(names, func(name string) bool { return !slices.Contains(calls, name) }) {
+			if time.Now().After(deadline) {
+				t.Fatalf("hooks %v called, want %v", calls, names)
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		return calls
+	}
+}
+
+func (h *handler) AuthConnect(context.Context) error { return h.call("AuthConnect") }
+
+func (h *handler) AuthPublish(context.Context, *string, *[]byte) error {
+	return h.call("AuthPublish")
+}
+
+func (h *handler) AuthSubscribe(context.Context, *[]string) error {
+	return h.call("AuthSubscribe")
+}
+
+func (h *handler) DownSubscribe(context.Context, *[]string) error {
+	return h.call("DownSubscribe")
+}
+
+func (h *handler) Connect(context.Context) error { return h.call("Connect") }
+
+func (h *handler) Publish(context.Context, *string, *[]byte) error { return h.call("Publish") }
+
+func (h *handler) Subscribe(context.Context, *[]string) error { return h.call("Subscribe") }
+
+func (h *handler) Unsubscribe(context.Context, *[]string) error { return h.call("Unsubscribe") }
+
+func (h *handler) Disconnect(context.Context) error { return h.call("Disconnect") }
+
+// target echoes the messages of the sessions and sends the Authorization
+// header of their upgrade requests.
+func target(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	auth := make(chan string, 10)
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			typ, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), auth
+}
+
+// newProxy serves the proxy to the target with the handler.
+func newProxy(t *testing.T, target string, ws Config, h session.Handler) string {
+	t.Helper()
+	cfg := mproxy.Config{PathPrefix: "/ws", Target: target}
+	p := New(cfg, ws, h, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestSessionHooks(t *testing.T) {
+	target, _ := target(t)
+	h := &handler{}
+	url := newProxy(t, target, Config{}, h)
+
+	header := http.Header{}
+	header.Set("Authorization", "token")
+	c, _, err := websocket.DefaultDialer.Dial(url+"/ws/topic", header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := c.WriteMessage(websocket.TextMessage, []byte("m")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, msg, err := c.ReadMessage(); err != nil || string(msg) != "m" {
+		t.Fatalf("read = %q, %v, want the echoed message", msg, err)
+	}
+	h.wait(t, "Subscribe", "Publish", "DownSubscribe")
+
+	// The client going away ends the session with its hooks.
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(testTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	calls := h.wait(t, "Unsubscribe", "Disconnect")
+	if want := []string{"Unsubscribe", "Disconnect"}; !slices.Equal(calls[len(calls)-2:], want) {
+		t.Errorf("hooks %v, want to end with %v", calls, want)
+	}
+	if want := []string{"AuthConnect", "AuthSubscribe", "Connect", "Subscribe"}; !slices.Equal(calls[:4], want) {
+		t.Errorf("hooks %v, want to start with %v", calls, want)
+	}
+}
+
+func TestForwardAuthorization(t *testing.T) {
+	cases := []struct {
+		desc  string
+		ws    Config
+		basic bool
+		auth  string
+		want  string
+	}{
+		{desc: "basic authentication", basic: true},
+		{desc: "forwarded basic authentication", ws: Config{ForwardBasicAuth: true}, basic: true, want: "Basic dXNlcjpwYXNz"},
+		{desc: "token", auth: "token", want: "token"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			target, auth := target(t)
+			url := newProxy(t, target, tc.ws, &handler{})
+			header := http.Header{}
+			if tc.auth != "" {
+				header.Set("Authorization", tc.auth)
+			}
+			if tc.basic {
+				header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+			}
+			c, _, err := websocket.DefaultDialer.Dial(url+"/ws/topic", header)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer c.Close()
+			if got := <-auth; got != tc.want {
+				t.Errorf("target Authorization = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOriginNotAllowed(t *testing.T) {
+	target, auth := target(t)
+	h := &handler{}
+	url := newProxy(t, target, Config{AllowedOrigins: []string{"https://app.example.com"}}, h)
+	header := http.Header{}
+	header.Set("Authorization", "token")
+	header.Set("Origin", "https://evil.example.com")
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/ws/topic", header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("dial = %v, want %d", err, http.StatusForbidden)
+	}
+	if len(h.calls) != 0 || len(auth) != 0 {
+		t.Errorf("denied upgrade called hooks %v and dialed the target", h.calls)
+	}
+}